@@ -4,23 +4,24 @@ import (
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/freegle/iznik-server-go/utils"
+	"github.com/freegle/iznik-server-go/validate"
 	"github.com/gofiber/fiber/v2"
 	"strconv"
 )
 
 type CreateRequest struct {
-	PafID        uint64  `json:"pafid"`
+	PafID        uint64  `json:"pafid" validate:"required"`
 	Instructions string  `json:"instructions"`
-	Lat          float64 `json:"lat"`
-	Lng          float64 `json:"lng"`
+	Lat          float64 `json:"lat" validate:"min=-90,max=90"`
+	Lng          float64 `json:"lng" validate:"min=-180,max=180"`
 }
 
 type UpdateRequest struct {
-	ID           uint64   `json:"id"`
+	ID           uint64   `json:"id" validate:"required"`
 	PafID        *uint64  `json:"pafid,omitempty"`
 	Instructions *string  `json:"instructions,omitempty"`
-	Lat          *float64 `json:"lat,omitempty"`
-	Lng          *float64 `json:"lng,omitempty"`
+	Lat          *float64 `json:"lat,omitempty" validate:"min=-90,max=90"`
+	Lng          *float64 `json:"lng,omitempty" validate:"min=-180,max=180"`
 }
 
 func Create(c *fiber.Ctx) error {
@@ -29,13 +30,9 @@ func Create(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusUnauthorized, "Not logged in")
 	}
 
-	var req CreateRequest
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
-	}
-
-	if req.PafID == 0 {
-		return fiber.NewError(fiber.StatusBadRequest, "pafid is required")
+	req, err := validate.Parsed[CreateRequest](c)
+	if err != nil {
+		return err
 	}
 
 	db := database.DBConn
@@ -61,13 +58,9 @@ func Update(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusUnauthorized, "Not logged in")
 	}
 
-	var req UpdateRequest
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
-	}
-
-	if req.ID == 0 {
-		return fiber.NewError(fiber.StatusBadRequest, "id is required")
+	req, err := validate.Parsed[UpdateRequest](c)
+	if err != nil {
+		return err
 	}
 
 	db := database.DBConn
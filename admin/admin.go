@@ -170,7 +170,7 @@ func PostAdmin(c *fiber.Ctx) error {
 		var adminGroupID uint64
 		db.Raw("SELECT COALESCE(groupid, 0) FROM admins WHERE id = ?", req.ID).Scan(&adminGroupID)
 
-		if !user.IsModOfGroup(myid, adminGroupID) {
+		if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, adminGroupID) {
 			return fiber.NewError(fiber.StatusForbidden, "Must be a moderator of the admin's group")
 		}
 
@@ -185,7 +185,7 @@ func PostAdmin(c *fiber.Ctx) error {
 		var adminGroupID uint64
 		db.Raw("SELECT COALESCE(groupid, 0) FROM admins WHERE id = ?", req.ID).Scan(&adminGroupID)
 
-		if !user.IsModOfGroup(myid, adminGroupID) {
+		if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, adminGroupID) {
 			return fiber.NewError(fiber.StatusForbidden, "Must be a moderator of the admin's group")
 		}
 
@@ -198,7 +198,7 @@ func PostAdmin(c *fiber.Ctx) error {
 			return fiber.NewError(fiber.StatusBadRequest, "groupid is required")
 		}
 
-		if req.GroupID > 0 && !user.IsModOfGroup(myid, req.GroupID) {
+		if req.GroupID > 0 && !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, req.GroupID) {
 			return fiber.NewError(fiber.StatusForbidden, "Must be a moderator of the group")
 		}
 
@@ -281,7 +281,7 @@ func PatchAdmin(c *fiber.Ctx) error {
 	var adminGroupID uint64
 	db.Raw("SELECT COALESCE(groupid, 0) FROM admins WHERE id = ?", req.ID).Scan(&adminGroupID)
 
-	if !user.IsModOfGroup(myid, adminGroupID) {
+	if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, adminGroupID) {
 		return fiber.NewError(fiber.StatusForbidden, "Must be a moderator of the admin's group")
 	}
 
@@ -358,7 +358,7 @@ func DeleteAdmin(c *fiber.Ctx) error {
 	var adminGroupID uint64
 	db.Raw("SELECT COALESCE(groupid, 0) FROM admins WHERE id = ?", id).Scan(&adminGroupID)
 
-	if !user.IsModOfGroup(myid, adminGroupID) {
+	if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, adminGroupID) {
 		return fiber.NewError(fiber.StatusForbidden, "Must be a moderator of the admin's group")
 	}
 
@@ -119,15 +119,6 @@ func GetAlert(c *fiber.Ctx) error {
 // @Failure 403 {object} fiber.Error "Not authorized"
 // @Router /api/alert [get]
 func ListAlerts(c *fiber.Ctx) error {
-	myid := user.WhoAmI(c)
-	if myid == 0 {
-		return fiber.NewError(fiber.StatusUnauthorized, "Not logged in")
-	}
-
-	if !user.IsAdminOrSupport(myid) {
-		return fiber.NewError(fiber.StatusForbidden, "Not authorized")
-	}
-
 	db := database.DBConn
 
 	var alerts []Alert
@@ -158,13 +149,6 @@ func ListAlerts(c *fiber.Ctx) error {
 // @Router /api/alert [put]
 func CreateAlert(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
-	if myid == 0 {
-		return fiber.NewError(fiber.StatusUnauthorized, "Not logged in")
-	}
-
-	if !user.IsAdminOrSupport(myid) {
-		return fiber.NewError(fiber.StatusForbidden, "Not authorized")
-	}
 
 	type CreateRequest struct {
 		From     string  `json:"from"`
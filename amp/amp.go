@@ -23,6 +23,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/chat"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/utils"
@@ -47,12 +48,15 @@ type AMPChatResponse struct {
 	CanReply bool             `json:"canReply"`
 }
 
-// ReplyResponse is the response for AMP chat reply submissions.
+// ReplyResponse is the response for AMP chat reply submissions.  Errors are the usual v1 error body, which has
+// "message" too, so the email's submit-error template can show it.
 type ReplyResponse struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
 }
 
+var errSendFailed = apierror.ErrInternal.WithMessage("Failed to send message. Please try on Freegle.")
+
 // getAMPSecret returns the AMP secret from environment.
 func getAMPSecret() string {
 	secret := os.Getenv("AMP_SECRET")
@@ -393,15 +397,12 @@ func GetChatMessages(c *fiber.Ctx) error {
 // @Param tid query int false "Email tracking ID for analytics"
 // @Param body body object true "Message body with 'message' field"
 // @Success 200 {object} ReplyResponse
-// @Failure 400 {object} ReplyResponse
+// @Failure 400 {object} map[string]interface{}
 // @Router /amp/chat/{id}/reply [post]
 func PostChatReply(c *fiber.Ctx) error {
 	userID, chatID, err := ValidateToken(c)
 	if err != nil || userID == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(ReplyResponse{
-			Success: false,
-			Message: "Invalid token",
-		})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeTokenInvalid, "Invalid token")
 	}
 
 	// Get optional tracking ID from query param
@@ -416,19 +417,13 @@ func PostChatReply(c *fiber.Ctx) error {
 		Message string `json:"message"`
 	}
 	if err := c.BodyParser(&body); err != nil || strings.TrimSpace(body.Message) == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(ReplyResponse{
-			Success: false,
-			Message: "Please enter a message.",
-		})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "Please enter a message.")
 	}
 
 	// Trim and validate message length
 	message := strings.TrimSpace(body.Message)
 	if len(message) > 10000 {
-		return c.Status(fiber.StatusBadRequest).JSON(ReplyResponse{
-			Success: false,
-			Message: "Message is too long. Please keep it under 10,000 characters.",
-		})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "Message is too long. Please keep it under 10,000 characters.")
 	}
 
 	db := database.DBConn
@@ -441,10 +436,7 @@ func PostChatReply(c *fiber.Ctx) error {
 	`, chatID, userID).Scan(&memberUserID)
 
 	if memberUserID == 0 {
-		return c.Status(fiber.StatusForbidden).JSON(ReplyResponse{
-			Success: false,
-			Message: "You are not a member of this conversation.",
-		})
+		return apierror.ErrForbidden.WithMessage("You are not a member of this conversation.")
 	}
 
 	// Insert the message.
@@ -453,10 +445,7 @@ func PostChatReply(c *fiber.Ctx) error {
 	// parallel load (GORM's connection pool may assign a different connection).
 	sqlDB, err := db.DB()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(ReplyResponse{
-			Success: false,
-			Message: "Failed to send message. Please try on Freegle.",
-		})
+		return errSendFailed.WithCause(err)
 	}
 	sqlResult, err := sqlDB.Exec(`
 		INSERT INTO chat_messages (chatid, userid, message, type, date, processingsuccessful)
@@ -464,10 +453,7 @@ func PostChatReply(c *fiber.Ctx) error {
 	`, chatID, userID, message, utils.CHAT_MESSAGE_DEFAULT)
 
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(ReplyResponse{
-			Success: false,
-			Message: "Failed to send message. Please try on Freegle.",
-		})
+		return errSendFailed.WithCause(err)
 	}
 
 	var messageID uint64
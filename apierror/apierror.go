@@ -0,0 +1,259 @@
+// Package apierror is the error type returned by handlers, and the global error handler which renders it.
+//
+// Every error has a stable machine-readable code which clients can switch on, rather than matching the message,
+// which is for people and may change.  Handlers can return either an *Error or a plain fiber.NewError; the latter
+// gets a code from its HTTP status.
+//
+// Errors are rendered differently for the two API versions.  /api keeps the v1 shape which older clients check:
+//
+//	{"ret": 2, "status": "Not found", "code": "not_found", "error": 404, "message": "Not found"}
+//
+// and /apiv2 has a cleaner one:
+//
+//	{"error": {"code": "not_found", "message": "Not found"}}
+//
+// Both include "fields" when there are validation errors for individual fields.
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Error codes.  These are part of the API, so don't change existing ones.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeInvalidID        = "invalid_id"
+	CodeInvalidBody      = "invalid_body"
+	CodeValidationFailed = "validation_failed"
+	CodeNotLoggedIn      = "not_logged_in"
+	CodeLoginFailed      = "login_failed"
+	CodeAccountLocked    = "account_locked"
+	CodeMFARequired      = "mfa_required"
+	CodeMFAFailed        = "mfa_failed"
+	CodeTokenInvalid     = "token_invalid"
+	CodeTokenReused      = "token_reused"
+	CodeUnknownEmail     = "unknown_email"
+	CodeEmailInUse       = "email_in_use"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeGone             = "gone"
+	CodeTooLarge         = "too_large"
+	CodeRateLimited      = "rate_limited"
+	CodeKeyReused        = "idempotency_key_reused"
+	CodeInternal         = "internal_error"
+	CodeUnavailable      = "unavailable"
+)
+
+// FieldError describes a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is an error which can be shown to the client.  Message must be safe to show to users; put anything
+// internal in Err, which is logged but not returned.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+
+	// Ret is the v1 "ret" value.  If zero, we use one based on the status.
+	Ret int
+
+	Fields []FieldError
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches errors with the same status and code, so that errors.Is works against the sentinel errors below even
+// after WithMessage etc.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Status == e.Status && t.Code == e.Code
+}
+
+// New creates an error.
+func New(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// Newf creates an error with a formatted message.
+func Newf(status int, code string, format string, args ...interface{}) *Error {
+	return New(status, code, fmt.Sprintf(format, args...))
+}
+
+// Common errors.  Use WithMessage if the default message isn't specific enough.
+var (
+	ErrNotLoggedIn = &Error{Status: fiber.StatusUnauthorized, Code: CodeNotLoggedIn, Message: "Not logged in", Ret: 1}
+	ErrForbidden   = &Error{Status: fiber.StatusForbidden, Code: CodeForbidden, Message: "Permission denied", Ret: 2}
+	ErrNotFound    = &Error{Status: fiber.StatusNotFound, Code: CodeNotFound, Message: "Not found", Ret: 2}
+	ErrInvalidID   = &Error{Status: fiber.StatusBadRequest, Code: CodeInvalidID, Message: "Invalid id", Ret: 2}
+	ErrInvalidBody = &Error{Status: fiber.StatusBadRequest, Code: CodeInvalidBody, Message: "Invalid request body", Ret: 2}
+	ErrInternal    = &Error{Status: fiber.StatusInternalServerError, Code: CodeInternal, Message: "Internal error", Ret: 1}
+)
+
+// The helpers below return copies, so the sentinel errors are never modified.
+
+// WithMessage returns a copy of the error with a different message.
+func (e *Error) WithMessage(message string) *Error {
+	c := *e
+	c.Message = message
+	return &c
+}
+
+// WithRet returns a copy of the error with a specific v1 ret value, for handlers whose clients check it.
+func (e *Error) WithRet(ret int) *Error {
+	c := *e
+	c.Ret = ret
+	return &c
+}
+
+// WithFields returns a copy of the error with details of which fields were wrong.
+func (e *Error) WithFields(fields ...FieldError) *Error {
+	c := *e
+	c.Fields = append(append([]FieldError{}, e.Fields...), fields...)
+	return &c
+}
+
+// WithCause returns a copy of the error wrapping an underlying error, which is logged but not shown.
+func (e *Error) WithCause(err error) *Error {
+	c := *e
+	c.Err = err
+	return &c
+}
+
+// codeForStatus is the code we use for errors which don't have one.
+func codeForStatus(status int) string {
+	switch status {
+	case fiber.StatusBadRequest:
+		return CodeBadRequest
+	case fiber.StatusUnauthorized:
+		return CodeNotLoggedIn
+	case fiber.StatusForbidden:
+		return CodeForbidden
+	case fiber.StatusNotFound:
+		return CodeNotFound
+	case fiber.StatusConflict:
+		return CodeConflict
+	case fiber.StatusGone:
+		return CodeGone
+	case fiber.StatusRequestEntityTooLarge:
+		return CodeTooLarge
+	case fiber.StatusUnprocessableEntity:
+		return CodeValidationFailed
+	case fiber.StatusTooManyRequests:
+		return CodeRateLimited
+	case fiber.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+
+	if status >= 500 {
+		return CodeInternal
+	}
+
+	return CodeBadRequest
+}
+
+// retForStatus is the v1 ret value for errors which don't have one.  The old API used 1 for not logged in and
+// server failures, and 2 for most other problems.
+func retForStatus(status int) int {
+	switch {
+	case status == fiber.StatusUnauthorized, status >= 500:
+		return 1
+	case status == fiber.StatusConflict:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// From converts any error into an *Error.  Errors we don't know about become an internal error, so that we don't
+// leak details of them to the client.
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		c := *e
+
+		if c.Status == 0 {
+			c.Status = fiber.StatusInternalServerError
+		}
+
+		if c.Code == "" {
+			c.Code = codeForStatus(c.Status)
+		}
+
+		if c.Ret == 0 {
+			c.Ret = retForStatus(c.Status)
+		}
+
+		return &c
+	}
+
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		return &Error{Status: fe.Code, Code: codeForStatus(fe.Code), Message: fe.Message, Ret: retForStatus(fe.Code)}
+	}
+
+	return ErrInternal.WithCause(err)
+}
+
+// Handler is the global fiber error handler.
+func Handler(ctx *fiber.Ctx, err error) error {
+	e := From(err)
+
+	// Log server errors and 400s so we can diagnose them.
+	if e.Status >= 500 {
+		fmt.Printf("SERVER ERROR %d %s %s: %v\n", e.Status, ctx.Method(), ctx.OriginalURL(), err)
+	} else if e.Status == fiber.StatusBadRequest {
+		fmt.Printf("BAD REQUEST %d %s %s: %v\n", e.Status, ctx.Method(), ctx.OriginalURL(), err)
+	}
+
+	return ctx.Status(e.Status).JSON(Body(ctx.Path(), e))
+}
+
+// Body returns the response body for an error on a path.
+func Body(path string, e *Error) fiber.Map {
+	if strings.HasPrefix(path, "/apiv2/") || path == "/apiv2" {
+		body := fiber.Map{
+			"code":    e.Code,
+			"message": e.Message,
+		}
+
+		if len(e.Fields) > 0 {
+			body["fields"] = e.Fields
+		}
+
+		return fiber.Map{"error": body}
+	}
+
+	body := fiber.Map{
+		"ret":     e.Ret,
+		"status":  e.Message,
+		"code":    e.Code,
+		"error":   e.Status,
+		"message": e.Message,
+	}
+
+	if len(e.Fields) > 0 {
+		body["fields"] = e.Fields
+	}
+
+	return body
+}
@@ -0,0 +1,113 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func testApp(err error) *fiber.App {
+	app := fiber.New(fiber.Config{ErrorHandler: Handler})
+
+	for _, prefix := range []string{"/api", "/apiv2"} {
+		app.Get(prefix+"/thing", func(c *fiber.Ctx) error {
+			return err
+		})
+	}
+
+	return app
+}
+
+func get(t *testing.T, app *fiber.App, path string) (int, map[string]interface{}) {
+	resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+	assert.NoError(t, err)
+
+	body, _ := io.ReadAll(resp.Body)
+
+	var result map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &result), string(body))
+
+	return resp.StatusCode, result
+}
+
+func TestV1Shape(t *testing.T) {
+	status, result := get(t, testApp(ErrNotFound), "/api/thing")
+	assert.Equal(t, 404, status)
+	assert.Equal(t, float64(2), result["ret"])
+	assert.Equal(t, "Not found", result["status"])
+	assert.Equal(t, CodeNotFound, result["code"])
+	assert.Equal(t, float64(404), result["error"])
+	assert.Equal(t, "Not found", result["message"])
+	assert.NotContains(t, result, "fields")
+}
+
+func TestV2Shape(t *testing.T) {
+	status, result := get(t, testApp(ErrNotFound), "/apiv2/thing")
+	assert.Equal(t, 404, status)
+	assert.NotContains(t, result, "ret")
+
+	e := result["error"].(map[string]interface{})
+	assert.Equal(t, CodeNotFound, e["code"])
+	assert.Equal(t, "Not found", e["message"])
+}
+
+func TestFiberErrorGetsCode(t *testing.T) {
+	status, result := get(t, testApp(fiber.NewError(fiber.StatusUnauthorized, "Not logged in")), "/api/thing")
+	assert.Equal(t, 401, status)
+	assert.Equal(t, CodeNotLoggedIn, result["code"])
+	assert.Equal(t, float64(1), result["ret"])
+
+	_, result = get(t, testApp(fiber.NewError(fiber.StatusConflict, "Already exists")), "/apiv2/thing")
+	assert.Equal(t, CodeConflict, result["error"].(map[string]interface{})["code"])
+}
+
+func TestUnknownErrorIsHidden(t *testing.T) {
+	status, result := get(t, testApp(errors.New("dial tcp 10.0.0.1:3306: connection refused")), "/apiv2/thing")
+	assert.Equal(t, 500, status)
+
+	e := result["error"].(map[string]interface{})
+	assert.Equal(t, CodeInternal, e["code"])
+	assert.Equal(t, "Internal error", e["message"])
+}
+
+func TestFields(t *testing.T) {
+	err := New(fiber.StatusBadRequest, CodeValidationFailed, "Invalid request").WithFields(
+		FieldError{Field: "email", Code: "required", Message: "email is required"},
+		FieldError{Field: "radius", Code: "max", Message: "radius must be at most 50"},
+	)
+
+	_, result := get(t, testApp(err), "/api/thing")
+	assert.Len(t, result["fields"], 2)
+
+	_, result = get(t, testApp(err), "/apiv2/thing")
+	fields := result["error"].(map[string]interface{})["fields"].([]interface{})
+	assert.Len(t, fields, 2)
+	assert.Equal(t, "email", fields[0].(map[string]interface{})["field"])
+	assert.Equal(t, "required", fields[0].(map[string]interface{})["code"])
+}
+
+func TestCopiesAndIs(t *testing.T) {
+	err := ErrForbidden.WithMessage("Not your post").WithRet(4)
+
+	assert.Equal(t, "Permission denied", ErrForbidden.Message)
+	assert.Equal(t, 2, ErrForbidden.Ret)
+	assert.True(t, errors.Is(err, ErrForbidden))
+	assert.False(t, errors.Is(err, ErrNotFound))
+
+	cause := errors.New("deadlock")
+	wrapped := ErrInternal.WithCause(cause)
+	assert.True(t, errors.Is(wrapped, cause))
+	assert.Equal(t, "Internal error", From(wrapped).Message)
+}
+
+func TestRetDefaults(t *testing.T) {
+	assert.Equal(t, 1, From(New(fiber.StatusInternalServerError, CodeInternal, "Database error")).Ret)
+	assert.Equal(t, 2, From(New(fiber.StatusBadRequest, CodeBadRequest, "Missing id")).Ret)
+	assert.Equal(t, 3, From(New(fiber.StatusConflict, CodeConflict, "Name already in use")).Ret)
+	assert.Equal(t, 5, From(New(fiber.StatusConflict, CodeConflict, "Config still in use").WithRet(5)).Ret)
+}
@@ -5,16 +5,14 @@
 package auth
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
 	json2 "encoding/json"
-	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/utils"
@@ -69,14 +67,209 @@ func WhoAmI(c *fiber.Ctx) uint64 {
 	return id
 }
 
+// SessionFromRequest returns the ID of the session which made the request, from the JWT or else the old-style
+// persistent token, or 0 if there isn't one.
+func SessionFromRequest(c *fiber.Ctx) uint64 {
+	if _, sessionID, _ := GetJWTFromRequest(c); sessionID > 0 {
+		return sessionID
+	}
+
+	var persistentToken PersistentToken
+	_ = json2.Unmarshal([]byte(c.Get("Authorization2")), &persistentToken)
+
+	if persistentToken.ID == 0 || persistentToken.Series == 0 || persistentToken.Token == "" {
+		return 0
+	}
+
+	var sessionID uint64
+	database.DBConn.Raw("SELECT id FROM sessions WHERE id = ? AND series = ? AND token = ? LIMIT 1;",
+		persistentToken.ID, persistentToken.Series, persistentToken.Token).Scan(&sessionID)
+
+	return sessionID
+}
+
+// trustedProxies are the proxies, e.g. HAProxy, whose X-Forwarded-For we believe.  They come from TRUSTED_PROXIES,
+// a comma-separated list of IPs or CIDR ranges, unless SetTrustedProxies has been called.  TRUSTED_PROXIES=none
+// says that nothing sits in front of us, e.g. when we're behind API Gateway.
+var trustedProxies struct {
+	sync.RWMutex
+	once       sync.Once
+	configured bool
+	nets       []*net.IPNet
+}
+
+// CheckTrustedProxies returns an error if TRUSTED_PROXIES hasn't been set.  Behind a proxy, every request would then
+// seem to come from the proxy, and so limits by IP address, e.g. on logins and the rate limits, would apply to all
+// our users at once.
+func CheckTrustedProxies() error {
+	loadTrustedProxies()
+
+	trustedProxies.RLock()
+	defer trustedProxies.RUnlock()
+
+	if !trustedProxies.configured {
+		return fmt.Errorf("TRUSTED_PROXIES isn't set, so if we're behind a proxy every request will seem to come from it " +
+			"and limits by IP address will apply to everyone at once.  Set it to the proxies' addresses, or to none if there " +
+			"isn't a proxy")
+	}
+
+	return nil
+}
+
+// SetTrustedProxies replaces the list of trusted proxies.  Each entry is an IP or a CIDR range.
+func SetTrustedProxies(proxies []string) error {
+	nets, err := parseProxies(proxies)
+	if err != nil {
+		return err
+	}
+
+	trustedProxies.once.Do(func() {})
+	trustedProxies.Lock()
+	trustedProxies.configured = true
+	trustedProxies.nets = nets
+	trustedProxies.Unlock()
+
+	return nil
+}
+
+// TrustedProxies returns the trusted proxies, in the form Fiber's TrustedProxies config expects.
+func TrustedProxies() []string {
+	loadTrustedProxies()
+
+	trustedProxies.RLock()
+	defer trustedProxies.RUnlock()
+
+	ret := make([]string, len(trustedProxies.nets))
+	for i, n := range trustedProxies.nets {
+		ret[i] = n.String()
+	}
+
+	return ret
+}
+
+func loadTrustedProxies() {
+	trustedProxies.once.Do(func() {
+		env := strings.TrimSpace(os.Getenv("TRUSTED_PROXIES"))
+		if env == "" {
+			return
+		}
+
+		if strings.EqualFold(env, "none") {
+			env = ""
+		}
+
+		var proxies []string
+		for _, p := range strings.Split(env, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				proxies = append(proxies, p)
+			}
+		}
+
+		nets, err := parseProxies(proxies)
+		if err != nil {
+			log.Printf("Ignoring TRUSTED_PROXIES: %v", err)
+			return
+		}
+
+		trustedProxies.Lock()
+		trustedProxies.configured = true
+		trustedProxies.nets = nets
+		trustedProxies.Unlock()
+	})
+}
+
+func parseProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", p)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	loadTrustedProxies()
+
+	trustedProxies.RLock()
+	defer trustedProxies.RUnlock()
+
+	for _, n := range trustedProxies.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns the IP address of the client which made the request.
+//
+// The client controls whatever it sends in X-Forwarded-For, so we only look at that header when the request reached
+// us through a trusted proxy, and then only at the hops which trusted proxies appended.  We walk the header from the
+// right, and the first hop which isn't a trusted proxy is the client.  With no trusted proxies configured, e.g. when
+// running directly behind API Gateway, the client is whoever connected to us.
+func ClientIP(c *fiber.Ctx) string {
+	peer := c.Context().RemoteIP()
+
+	if !isTrustedProxy(peer) {
+		return c.IP()
+	}
+
+	if xff := c.Get(fiber.HeaderXForwardedFor); xff != "" {
+		hops := strings.Split(xff, ",")
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				// Not something a proxy of ours wrote, so we can't believe anything to the left of it.
+				break
+			}
+
+			peer = ip
+			if !isTrustedProxy(ip) {
+				break
+			}
+		}
+
+		return peer.String()
+	}
+
+	// X-Real-IP is set by some proxies instead.
+	if ip := net.ParseIP(strings.TrimSpace(c.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+
+	return peer.String()
+}
+
+// jwtInURLAllowed returns whether we accept a JWT as ?jwt= on a path.  JWTs in URLs end up in logs, so /apiv2 only
+// accepts them where there's no other way: EventSource can't set headers, so the chat stream needs one.  Existing
+// clients of /api send ?jwt= everywhere, so it still works there, but it's deprecated; see API-GUIDE.md.  Either way
+// the JWT is short-lived, which limits the damage.
+func jwtInURLAllowed(path string) bool {
+	return strings.HasSuffix(path, "/chat/stream") || strings.HasPrefix(path, "/api/")
+}
+
 // GetJWTFromRequest extracts user ID, session ID, and expiry from the JWT in the request.
 func GetJWTFromRequest(c *fiber.Ctx) (uint64, uint64, float64) {
-	// Passing JWT via URL parameters is not a great idea, but it's useful to support that for testing.
-	tokenString := c.Query("jwt")
+	tokenString := c.Get("Authorization")
 
-	if tokenString == "" {
-		// No URL parameter found.  Try Authorization header.
-		tokenString = c.Get("Authorization")
+	if tokenString == "" && jwtInURLAllowed(c.Path()) {
+		tokenString = c.Query("jwt")
 	}
 
 	if tokenString != "" && len(tokenString) > 2 {
@@ -88,13 +281,7 @@ func GetJWTFromRequest(c *fiber.Ctx) (uint64, uint64, float64) {
 			tokenString = tokenString[:len(tokenString)-1]
 		}
 
-		token, err := jwt.Parse(string(tokenString), func(token *jwt.Token) (interface{}, error) {
-			key := os.Getenv("JWT_SECRET")
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("unexpected signing method")
-			}
-			return []byte(key), nil
-		})
+		token, err := jwt.Parse(string(tokenString), jwtKey)
 
 		if err != nil {
 			// JWT parse failures are expected for expired/malformed tokens; no action needed.
@@ -127,22 +314,12 @@ func GetJWTFromRequest(c *fiber.Ctx) (uint64, uint64, float64) {
 
 // IsAdminOrSupport checks if the user has Admin or Support system role.
 func IsAdminOrSupport(myid uint64) bool {
-	db := database.DBConn
-	var systemrole string
-	result := db.Raw("SELECT systemrole FROM users WHERE id = ?", myid).Scan(&systemrole)
-	if result.Error != nil {
-		log.Printf("Failed to check admin/support role for user %d: %v", myid, result.Error)
-		return false
-	}
-	return systemrole == utils.SYSTEMROLE_SUPPORT || systemrole == utils.SYSTEMROLE_ADMIN
+	return PolicyForUser(myid).Can(PERM_SYSTEM_SUPPORT)
 }
 
 // IsAdmin checks if the user has the Admin systemrole.
 func IsAdmin(myid uint64) bool {
-	db := database.DBConn
-	var systemrole string
-	db.Raw("SELECT systemrole FROM users WHERE id = ?", myid).Scan(&systemrole)
-	return systemrole == utils.SYSTEMROLE_ADMIN
+	return PolicyForUser(myid).Can(PERM_SYSTEM_ADMIN)
 }
 
 // Permission constants matching the comma-separated permissions field in the users table.
@@ -158,110 +335,27 @@ const (
 // HasPermission checks if a user has a specific permission.
 // Permissions are stored as a comma-separated string in the users.permissions column.
 func HasPermission(userid uint64, perm string) bool {
-	db := database.DBConn
-	var permissions *string
-	db.Raw("SELECT permissions FROM users WHERE id = ?", userid).Scan(&permissions)
-	if permissions == nil || *permissions == "" {
-		return false
-	}
-	for _, p := range strings.Split(*permissions, ",") {
-		if strings.EqualFold(strings.TrimSpace(p), perm) {
-			return true
-		}
-	}
-	return false
+	return PolicyForUser(userid).Can(canonicalPermission(perm))
 }
 
 // IsSystemMod checks if the user has system-level Moderator, Support, or Admin role.
 func IsSystemMod(myid uint64) bool {
-	db := database.DBConn
-	var systemrole string
-	result := db.Raw("SELECT systemrole FROM users WHERE id = ?", myid).Scan(&systemrole)
-	if result.Error != nil {
-		log.Printf("Failed to check system mod role for user %d: %v", myid, result.Error)
-		return false
-	}
-	return systemrole == utils.SYSTEMROLE_MODERATOR || systemrole == utils.SYSTEMROLE_SUPPORT || systemrole == utils.SYSTEMROLE_ADMIN
+	return PolicyForUser(myid).Can(PERM_SYSTEM_MODERATE)
 }
 
 // IsModOfGroup checks if the user is a Moderator or Owner of the given group, or is Admin/Support.
 func IsModOfGroup(myid uint64, groupid uint64) bool {
-	if IsAdminOrSupport(myid) {
-		return true
-	}
-
-	if groupid == 0 {
-		return false
-	}
-
-	db := database.DBConn
-	var role string
-	result := db.Raw("SELECT role FROM memberships WHERE userid = ? AND groupid = ?", myid, groupid).Scan(&role)
-	if result.Error != nil {
-		log.Printf("Failed to check mod role for user %d group %d: %v", myid, groupid, result.Error)
-		return false
-	}
-	return role == utils.ROLE_MODERATOR || role == utils.ROLE_OWNER
+	return PolicyForUser(myid).CanInGroup(PERM_GROUP_MODERATE, groupid)
 }
 
 // IsModOfAnyGroup checks if the user is a Moderator or Owner of any group, or is Admin/Support.
 func IsModOfAnyGroup(myid uint64) bool {
-	if IsAdminOrSupport(myid) {
-		return true
-	}
-
-	db := database.DBConn
-	var count int64
-	db.Raw("SELECT COUNT(*) FROM memberships WHERE userid = ? AND role IN (?, ?)", myid, utils.ROLE_MODERATOR, utils.ROLE_OWNER).Scan(&count)
-	return count > 0
-}
-
-
-// HashPassword computes sha1(password + salt).
-func HashPassword(password, salt string) string {
-	h := sha1.New()
-	h.Write([]byte(password + salt))
-	return hex.EncodeToString(h.Sum(nil))
-}
-
-// GetPasswordSalt returns the global password salt from env, with fallback default.
-func GetPasswordSalt() string {
-	salt := os.Getenv("PASSWORD_SALT")
-	if salt == "" {
-		salt = "zzzz"
-	}
-	return salt
+	return PolicyForUser(myid).CanInAnyGroup(PERM_GROUP_MODERATE)
 }
 
-// VerifyPassword checks a plaintext password against a user's stored Native login.
-// We filter by userid only (not uid) because some legacy Native logins have NULL uid.
-func VerifyPassword(userID uint64, password string) bool {
-	db := database.DBConn
-
-	var logins []struct {
-		Credentials string
-		Salt        string
-	}
-	db.Raw("SELECT credentials, salt FROM users_logins WHERE userid = ? AND type = ? ORDER BY lastaccess DESC", userID, utils.LOGIN_TYPE_NATIVE).Scan(&logins)
-
-	for _, login := range logins {
-		if login.Credentials == "" {
-			continue
-		}
-		salt := login.Salt
-		if salt == "" {
-			salt = GetPasswordSalt()
-		}
-		hashed := HashPassword(password, salt)
-		if strings.EqualFold(hashed, login.Credentials) {
-			return true
-		}
-	}
-	return false
-}
-
-// CreateSessionAndJWT creates a sessions row and returns the persistent token data and a JWT.
-func CreateSessionAndJWT(userID uint64) (map[string]interface{}, string, error) {
+// CreateSessionAndJWT creates a sessions row and returns the persistent token data, a JWT and a
+// refresh token.
+func CreateSessionAndJWT(userID uint64) (map[string]interface{}, Tokens, error) {
 	db := database.DBConn
 
 	series := utils.RandomHex(16)
@@ -274,7 +368,7 @@ func CreateSessionAndJWT(userID uint64) (map[string]interface{}, string, error)
 	db.Raw("SELECT id FROM sessions WHERE userid = ? ORDER BY id DESC LIMIT 1", userID).Scan(&sessionID)
 
 	if sessionID == 0 {
-		return nil, "", fmt.Errorf("failed to create session")
+		return nil, Tokens{}, fmt.Errorf("failed to create session")
 	}
 
 	persistent := map[string]interface{}{
@@ -284,17 +378,10 @@ func CreateSessionAndJWT(userID uint64) (map[string]interface{}, string, error)
 		"userid": userID,
 	}
 
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":        strconv.FormatUint(userID, 10),
-		"sessionid": strconv.FormatUint(sessionID, 10),
-		"exp":       time.Now().Unix() + 30*24*60*60, // 30 days
-	})
-
-	secret := os.Getenv("JWT_SECRET")
-	jwtString, err := jwtToken.SignedString([]byte(secret))
+	tokens, err := IssueTokens(userID, sessionID)
 	if err != nil {
-		return nil, "", err
+		return nil, Tokens{}, err
 	}
 
-	return persistent, jwtString, nil
+	return persistent, tokens, nil
 }
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"io"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func clientIPFor(t *testing.T, headers map[string]string) string {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString(ClientIP(c))
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+
+	return string(body)
+}
+
+func TestClientIP(t *testing.T) {
+	defer SetTrustedProxies(nil)
+
+	// Test requests come from 0.0.0.0.  Unless that's a trusted proxy, we ignore whatever the client says.
+	assert.NoError(t, SetTrustedProxies(nil))
+	assert.Equal(t, "0.0.0.0", clientIPFor(t, map[string]string{"X-Forwarded-For": "81.2.69.160"}))
+	assert.Equal(t, "0.0.0.0", clientIPFor(t, map[string]string{"X-Real-IP": "81.2.69.160"}))
+
+	assert.NoError(t, SetTrustedProxies([]string{"0.0.0.0", "10.0.0.0/8"}))
+
+	// The proxy appends the address which connected to it, so a value the client sent is further left and ignored.
+	assert.Equal(t, "81.2.69.160", clientIPFor(t, map[string]string{"X-Forwarded-For": "1.2.3.4, 81.2.69.160"}))
+
+	// Hops added by other trusted proxies are skipped.
+	assert.Equal(t, "81.2.69.160", clientIPFor(t, map[string]string{"X-Forwarded-For": "1.2.3.4, 81.2.69.160, 10.1.2.3"}))
+
+	// We don't believe anything to the left of a hop which isn't an address.
+	assert.Equal(t, "10.1.2.3", clientIPFor(t, map[string]string{"X-Forwarded-For": "81.2.69.160, nonsense, 10.1.2.3"}))
+
+	assert.Equal(t, "81.2.69.160", clientIPFor(t, map[string]string{"X-Real-IP": "81.2.69.160"}))
+	assert.Equal(t, "0.0.0.0", clientIPFor(t, nil))
+
+	assert.Error(t, SetTrustedProxies([]string{"nonsense"}))
+}
+
+func TestCheckTrustedProxies(t *testing.T) {
+	defer SetTrustedProxies(nil)
+
+	load := func(env string) error {
+		t.Setenv("TRUSTED_PROXIES", env)
+
+		trustedProxies.Lock()
+		trustedProxies.once = sync.Once{}
+		trustedProxies.configured = false
+		trustedProxies.nets = nil
+		trustedProxies.Unlock()
+
+		return CheckTrustedProxies()
+	}
+
+	// Unset is an error, as behind a proxy every request would seem to come from it.
+	assert.Error(t, load(""))
+	assert.Empty(t, TrustedProxies())
+
+	assert.NoError(t, load("10.0.0.0/8, 192.168.1.1"))
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1/32"}, TrustedProxies())
+
+	// none says there isn't a proxy.
+	assert.NoError(t, load("none"))
+	assert.Empty(t, TrustedProxies())
+
+	// A mistake isn't treated as set.
+	assert.Error(t, load("nonsense"))
+}
@@ -0,0 +1,299 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/utils"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords in one format.
+//
+// Hashes are encoded in the PHC string format, e.g. $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>, which records the
+// algorithm, its version, its parameters and the salt alongside the hash.  That means we can verify a hash without
+// knowing how it was made, and can change algorithm or parameters without breaking existing passwords.  It's also
+// the format PHP's password_verify understands.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of a password, with a new random salt.
+	Hash(password string) (string, error)
+
+	// Recognises returns true if the encoded hash is in this hasher's format.
+	Recognises(encoded string) bool
+
+	// Verify checks a password against an encoded hash in this hasher's format.
+	Verify(password, encoded string) (bool, error)
+
+	// NeedsRehash returns true if the encoded hash was made with weaker parameters than the hasher now uses.
+	NeedsRehash(encoded string) bool
+}
+
+// Argon2idHasher hashes passwords with argon2id, which is the current OWASP recommendation.
+type Argon2idHasher struct {
+	// Memory is in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// BcryptHasher hashes passwords with bcrypt.  Only the first 72 bytes of a password are used, so Hash rejects
+// longer ones.
+type BcryptHasher struct {
+	Cost int
+}
+
+var (
+	// Argon2id is the default hasher.  These are OWASP's recommended parameters.  Each hash needs Memory, so we keep
+	// it modest; a burst of logins, or a Lambda with a small memory limit, would otherwise run out.
+	Argon2id = Argon2idHasher{Memory: 19 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+	Bcrypt = BcryptHasher{Cost: 12}
+)
+
+var errBadHash = errors.New("malformed password hash")
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Recognises(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+// decode splits an encoded argon2id hash into its parameters, salt and key.
+func (h Argon2idHasher) decode(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	var p Argon2idHasher
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, errBadHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errBadHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, errBadHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, errBadHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, errBadHash
+	}
+
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+
+	return p, salt, key, nil
+}
+
+func (h Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, _, _, err := h.decode(encoded)
+
+	return err != nil || p.Memory < h.Memory || p.Iterations < h.Iterations || p.Parallelism < h.Parallelism ||
+		p.SaltLength < h.SaltLength || p.KeyLength < h.KeyLength
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+func (h BcryptHasher) Recognises(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.Cost
+}
+
+var (
+	hashersMu sync.RWMutex
+
+	// builtinHashers are the formats we can always verify.
+	builtinHashers = []PasswordHasher{Argon2id, Bcrypt}
+
+	// passwordHashers are all the formats we can verify, the current hasher first.  Anything else is a legacy SHA-1
+	// hash.
+	passwordHashers = builtinHashers
+
+	// passwordHasher is used for new hashes.  PASSWORD_HASHER=bcrypt chooses bcrypt instead of argon2id.
+	passwordHasher = defaultPasswordHasher()
+)
+
+func defaultPasswordHasher() PasswordHasher {
+	if os.Getenv("PASSWORD_HASHER") == "bcrypt" {
+		return Bcrypt
+	}
+
+	return Argon2id
+}
+
+// SetPasswordHasher changes the hasher used for new hashes.  Existing hashes in other formats are upgraded to it as
+// users log in.
+func SetPasswordHasher(h PasswordHasher) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+
+	passwordHasher = h
+	passwordHashers = []PasswordHasher{h}
+
+	for _, b := range builtinHashers {
+		if b != h {
+			passwordHashers = append(passwordHashers, b)
+		}
+	}
+}
+
+// hashers returns the hasher for new hashes, and all the ones we can verify.
+func hashers() (PasswordHasher, []PasswordHasher) {
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+
+	return passwordHasher, passwordHashers
+}
+
+// HashPassword returns the encoded hash of a password, for storing in users_logins.credentials.  The salt is part
+// of the hash, so users_logins.salt should be NULL.
+func HashPassword(password string) (string, error) {
+	current, _ := hashers()
+	return current.Hash(password)
+}
+
+// legacyHashPassword computes sha1(password + salt), which is how passwords used to be stored.
+func legacyHashPassword(password, salt string) string {
+	h := sha1.New()
+	h.Write([]byte(password + salt))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// GetPasswordSalt returns the global password salt from env, with fallback default.  This is only used for legacy
+// hashes which don't have their own salt.
+func GetPasswordSalt() string {
+	salt := os.Getenv("PASSWORD_SALT")
+	if salt == "" {
+		salt = "zzzz"
+	}
+	return salt
+}
+
+// rehashOnLogin returns whether to replace old password hashes with current ones as users log in.  The PHP server
+// still checks SHA-1 hashes in users_logins itself, and replacing one would stop the user logging in there, so this
+// is off unless PASSWORD_REHASH=true.
+func rehashOnLogin() bool {
+	return os.Getenv("PASSWORD_REHASH") == "true"
+}
+
+// checkPassword checks a password against a stored hash in any format.  It also returns whether the hash should be
+// replaced by one from the current hasher.
+func checkPassword(password, credentials, salt string) (ok bool, rehash bool) {
+	current, all := hashers()
+
+	for _, h := range all {
+		if h.Recognises(credentials) {
+			ok, err := h.Verify(password, credentials)
+			if err != nil {
+				log.Printf("Failed to verify password hash: %v", err)
+				return false, false
+			}
+
+			return ok, ok && (h != current || h.NeedsRehash(credentials))
+		}
+	}
+
+	if salt == "" {
+		salt = GetPasswordSalt()
+	}
+
+	// Legacy hashes are hex, and some were stored in upper case.
+	legacy := legacyHashPassword(password, salt)
+	ok = subtle.ConstantTimeCompare([]byte(legacy), []byte(strings.ToLower(credentials))) == 1
+
+	return ok, ok
+}
+
+// VerifyPassword checks a plaintext password against a user's stored Native login.
+// We filter by userid only (not uid) because some legacy Native logins have NULL uid.
+// If the password is right but the hash is in an old format, we replace it with a current one if rehashOnLogin.
+func VerifyPassword(userID uint64, password string) bool {
+	db := database.DBConn
+
+	var logins []struct {
+		ID          uint64
+		Credentials string
+		Salt        string
+	}
+	db.Raw("SELECT id, credentials, COALESCE(salt, '') AS salt FROM users_logins WHERE userid = ? AND type = ? ORDER BY lastaccess DESC", userID, utils.LOGIN_TYPE_NATIVE).Scan(&logins)
+
+	for _, login := range logins {
+		if login.Credentials == "" {
+			continue
+		}
+
+		ok, rehash := checkPassword(password, login.Credentials, login.Salt)
+		if !ok {
+			continue
+		}
+
+		if rehash && rehashOnLogin() {
+			// If this fails the old hash still works, so we'll try again next time.
+			if hashed, err := HashPassword(password); err != nil {
+				log.Printf("Failed to rehash password for user %d: %v", userID, err)
+			} else {
+				db.Exec("UPDATE users_logins SET credentials = ?, salt = NULL WHERE id = ?", hashed, login.ID)
+			}
+		}
+
+		return true
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Cheap parameters so that the tests are quick.
+var (
+	testArgon2id = Argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	testBcrypt   = BcryptHasher{Cost: 4}
+)
+
+func TestHashers(t *testing.T) {
+	for _, h := range []PasswordHasher{testArgon2id, testBcrypt} {
+		hash, err := h.Hash("correct horse")
+		assert.NoError(t, err)
+		assert.True(t, h.Recognises(hash))
+
+		ok, err := h.Verify("correct horse", hash)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = h.Verify("battery staple", hash)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		// Each hash has its own salt.
+		other, _ := h.Hash("correct horse")
+		assert.NotEqual(t, hash, other)
+	}
+
+	hash, _ := testArgon2id.Hash("pw")
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	assert.False(t, testBcrypt.Recognises(hash))
+
+	_, err := testArgon2id.Verify("pw", "$argon2id$v=19$m=1024$nope")
+	assert.Error(t, err)
+
+	// bcrypt ignores everything after 72 bytes, so two long passwords with the same start would match.
+	_, err = testBcrypt.Hash(strings.Repeat("x", 73))
+	assert.Error(t, err)
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hash, _ := testArgon2id.Hash("pw")
+	assert.False(t, testArgon2id.NeedsRehash(hash))
+	assert.True(t, Argon2id.NeedsRehash(hash))
+
+	hash, _ = testBcrypt.Hash("pw")
+	assert.False(t, testBcrypt.NeedsRehash(hash))
+	assert.True(t, Bcrypt.NeedsRehash(hash))
+}
+
+func TestStrongerHashesKept(t *testing.T) {
+	// Hashes made with the stronger parameters we used to have don't need redoing.
+	old := Argon2idHasher{Memory: 64 * 1024, Iterations: 3, Parallelism: 2, SaltLength: 16, KeyLength: 32}
+	hash, _ := old.Hash("pw")
+	assert.False(t, Argon2id.NeedsRehash(hash))
+
+	ok, _ := Argon2id.Verify("pw", hash)
+	assert.True(t, ok)
+}
+
+func TestCheckPassword(t *testing.T) {
+	legacy := legacyHashPassword("pw", "salt")
+
+	// Legacy hashes work, in either case, but should be replaced.
+	ok, rehash := checkPassword("pw", legacy, "salt")
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	ok, _ = checkPassword("pw", strings.ToUpper(legacy), "salt")
+	assert.True(t, ok)
+
+	ok, rehash = checkPassword("wrong", legacy, "salt")
+	assert.False(t, ok)
+	assert.False(t, rehash)
+
+	ok, _ = checkPassword("pw", legacyHashPassword("pw", GetPasswordSalt()), "")
+	assert.True(t, ok)
+
+	// Hashes from the current hasher are kept unless its parameters have gone up.
+	hash, _ := Argon2id.Hash("pw")
+	ok, rehash = checkPassword("pw", hash, "")
+	assert.True(t, ok)
+	assert.False(t, rehash)
+
+	hash, _ = testArgon2id.Hash("pw")
+	ok, rehash = checkPassword("pw", hash, "")
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	// Other formats we know are accepted, and moved to the current one.
+	hash, _ = testBcrypt.Hash("pw")
+	ok, rehash = checkPassword("pw", hash, "")
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	ok, _ = checkPassword("wrong", hash, "")
+	assert.False(t, ok)
+}
+
+func TestSetPasswordHasher(t *testing.T) {
+	defer SetPasswordHasher(Argon2id)
+
+	// Setting the hasher replaces the last one rather than adding to the list each time.
+	SetPasswordHasher(testBcrypt)
+	SetPasswordHasher(testArgon2id)
+	SetPasswordHasher(testArgon2id)
+
+	current, all := hashers()
+	assert.Equal(t, PasswordHasher(testArgon2id), current)
+	assert.Equal(t, []PasswordHasher{testArgon2id, Argon2id, Bcrypt}, all)
+
+	SetPasswordHasher(Bcrypt)
+
+	current, all = hashers()
+	assert.Equal(t, PasswordHasher(Bcrypt), current)
+	assert.Equal(t, []PasswordHasher{Bcrypt, Argon2id}, all)
+}
@@ -0,0 +1,315 @@
+package auth
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Who can do what.
+//
+// A user's permissions come from their system role, from the users.permissions column, and from their role in
+// each group they're an approved member of.  The tables below are the only place which says which role gets which
+// permission, so to add a role (e.g. a read-only mod, with just PERM_GROUP_VIEW) add it to GroupRolePermissions
+// rather than checking for it in handlers.
+//
+// A group permission granted by a system role applies in every group, which is how support and admins can act as
+// mods anywhere.
+//
+// Handlers get the policy for the request with PolicyFor, which only loads the user's roles once however many
+// checks are made.  Routes which need a permission whatever the request is for can say so with Require.
+
+// Permissions which come from roles.  The PERM_ constants in auth.go come from the users.permissions column.
+const (
+	PERM_SYSTEM_MODERATE = "SystemModerate"
+	PERM_SYSTEM_SUPPORT  = "SystemSupport"
+	PERM_SYSTEM_ADMIN    = "SystemAdmin"
+
+	// PERM_GROUP_VIEW is for seeing what mods see, e.g. pending messages and member lists.
+	PERM_GROUP_VIEW = "GroupView"
+
+	// PERM_GROUP_MODERATE is for acting as a mod, e.g. approving messages and changing memberships.
+	PERM_GROUP_MODERATE = "GroupModerate"
+
+	// PERM_GROUP_OWN is for things only owners can do.
+	PERM_GROUP_OWN = "GroupOwn"
+)
+
+var groupPermissions = []string{PERM_GROUP_VIEW, PERM_GROUP_MODERATE, PERM_GROUP_OWN}
+
+// SystemRolePermissions are the permissions each system role has.
+var SystemRolePermissions = map[string][]string{
+	utils.SYSTEMROLE_USER:      {},
+	utils.SYSTEMROLE_MODERATOR: {PERM_SYSTEM_MODERATE},
+	utils.SYSTEMROLE_SUPPORT:   append([]string{PERM_SYSTEM_MODERATE, PERM_SYSTEM_SUPPORT}, groupPermissions...),
+	utils.SYSTEMROLE_ADMIN:     append([]string{PERM_SYSTEM_MODERATE, PERM_SYSTEM_SUPPORT, PERM_SYSTEM_ADMIN}, groupPermissions...),
+}
+
+// systemRoleRanks orders the system roles, for checks that someone isn't acting against a more senior user.
+var systemRoleRanks = map[string]int{
+	utils.SYSTEMROLE_USER:      0,
+	utils.SYSTEMROLE_MODERATOR: 1,
+	utils.SYSTEMROLE_SUPPORT:   2,
+	utils.SYSTEMROLE_ADMIN:     3,
+}
+
+// GroupRolePermissions are the permissions each membership role has in its group.
+var GroupRolePermissions = map[string][]string{
+	utils.ROLE_MEMBER:    {},
+	utils.ROLE_MODERATOR: {PERM_GROUP_VIEW, PERM_GROUP_MODERATE},
+	utils.ROLE_OWNER:     {PERM_GROUP_VIEW, PERM_GROUP_MODERATE, PERM_GROUP_OWN},
+}
+
+// Policy is what one user can do.  It loads their roles when first asked, and is safe to use from several
+// goroutines.
+type Policy struct {
+	UserID uint64
+
+	userOnce   sync.Once
+	systemrole string
+	granted    map[string]bool
+
+	groupOnce sync.Once
+	groups    map[uint64]string
+}
+
+const policyLocal = "policy"
+
+// PolicyFor returns the policy for the user making a request.  It's cached for the rest of the request.
+func PolicyFor(c *fiber.Ctx) *Policy {
+	myid := WhoAmI(c)
+
+	if p, ok := c.Locals(policyLocal).(*Policy); ok && p.UserID == myid {
+		return p
+	}
+
+	p := PolicyForUser(myid)
+	c.Locals(policyLocal, p)
+
+	return p
+}
+
+// PolicyForUser returns the policy for a user, e.g. when we're not handling a request from them.
+func PolicyForUser(userid uint64) *Policy {
+	return &Policy{UserID: userid}
+}
+
+func (p *Policy) loadUser() {
+	p.userOnce.Do(func() {
+		p.granted = map[string]bool{}
+
+		if p.UserID == 0 || database.DBConn == nil {
+			return
+		}
+
+		var row struct {
+			Systemrole  string
+			Permissions *string
+		}
+
+		if err := database.DBConn.Raw("SELECT systemrole, permissions FROM users WHERE id = ?", p.UserID).Scan(&row).Error; err != nil {
+			log.Printf("Failed to load roles for user %d: %v", p.UserID, err)
+			return
+		}
+
+		p.systemrole = row.Systemrole
+
+		for _, perm := range SystemRolePermissions[row.Systemrole] {
+			p.granted[perm] = true
+		}
+
+		if row.Permissions != nil {
+			for _, perm := range strings.Split(*row.Permissions, ",") {
+				if perm = canonicalPermission(strings.TrimSpace(perm)); perm != "" {
+					p.granted[perm] = true
+				}
+			}
+		}
+	})
+}
+
+// canonicalPermission matches a users.permissions entry to our name for it.  They have been stored with varying
+// case over the years.
+func canonicalPermission(perm string) string {
+	for _, known := range []string{PERM_GIFTAID, PERM_NEWSLETTER, PERM_NATIONAL_VOLUNTEERS, PERM_SPAM_ADMIN, PERM_TEAMS, PERM_BUSINESS_CARDS} {
+		if strings.EqualFold(perm, known) {
+			return known
+		}
+	}
+
+	return perm
+}
+
+// loadGroups loads the groups where the user has a role which gives them permissions.  There aren't many of those,
+// even for people who are members of lots of groups.
+func (p *Policy) loadGroups() {
+	p.groupOnce.Do(func() {
+		p.groups = map[uint64]string{}
+
+		if p.UserID == 0 || database.DBConn == nil {
+			return
+		}
+
+		var roles []string
+		for role, perms := range GroupRolePermissions {
+			if len(perms) > 0 {
+				roles = append(roles, role)
+			}
+		}
+
+		var rows []struct {
+			Groupid uint64
+			Role    string
+		}
+
+		if err := database.DBConn.Raw("SELECT groupid, role FROM memberships WHERE userid = ? AND collection = ? AND role IN ?",
+			p.UserID, utils.COLLECTION_APPROVED, roles).Scan(&rows).Error; err != nil {
+			log.Printf("Failed to load group roles for user %d: %v", p.UserID, err)
+			return
+		}
+
+		for _, r := range rows {
+			p.groups[r.Groupid] = r.Role
+		}
+	})
+}
+
+// SystemRole returns the user's system role.
+func (p *Policy) SystemRole() string {
+	p.loadUser()
+	return p.systemrole
+}
+
+// Outranks returns whether the user's system role is more senior than another user's.
+func (p *Policy) Outranks(other *Policy) bool {
+	return systemRoleRanks[p.SystemRole()] > systemRoleRanks[other.SystemRole()]
+}
+
+// Can returns whether the user has a permission everywhere, from their system role or users.permissions.
+func (p *Policy) Can(perm string) bool {
+	p.loadUser()
+	return p.granted[perm]
+}
+
+// CanInGroup returns whether the user has a permission in a group.
+func (p *Policy) CanInGroup(perm string, groupid uint64) bool {
+	if p.Can(perm) {
+		return true
+	}
+
+	if groupid == 0 {
+		return false
+	}
+
+	p.loadGroups()
+
+	return roleGrants(p.groups[groupid], perm)
+}
+
+// CanInSomeGroup returns whether the user has a permission in at least one of some groups, e.g. those an item is
+// on.
+func (p *Policy) CanInSomeGroup(perm string, groupids []uint64) bool {
+	if p.Can(perm) {
+		return true
+	}
+
+	for _, groupid := range groupids {
+		if p.CanInGroup(perm, groupid) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanInAnyGroup returns whether the user has a permission in at least one group.
+func (p *Policy) CanInAnyGroup(perm string) bool {
+	return p.Can(perm) || len(p.GroupsWith(perm)) > 0
+}
+
+// GroupsWith returns the groups where the user's role gives them a permission.  It doesn't include groups where
+// they only have it because of their system role, which would be all of them.
+func (p *Policy) GroupsWith(perm string) []uint64 {
+	p.loadGroups()
+
+	ret := []uint64{}
+	for groupid, role := range p.groups {
+		if roleGrants(role, perm) {
+			ret = append(ret, groupid)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+
+	return ret
+}
+
+// Permissions returns the permissions the user has everywhere.
+func (p *Policy) Permissions() []string {
+	p.loadUser()
+
+	ret := []string{}
+	for perm := range p.granted {
+		ret = append(ret, perm)
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+// GroupRoles returns the groups where the user has a role which gives them permissions, and the role.
+func (p *Policy) GroupRoles() map[uint64]string {
+	p.loadGroups()
+	return p.groups
+}
+
+func roleGrants(role string, perm string) bool {
+	for _, p := range GroupRolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Require is a middleware for routes which need permissions, whichever group or item the request is for.
+func Require(perms ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		p := PolicyFor(c)
+		if p.UserID == 0 {
+			return apierror.ErrNotLoggedIn
+		}
+
+		for _, perm := range perms {
+			if !p.Can(perm) {
+				return apierror.ErrForbidden
+			}
+		}
+
+		return c.Next()
+	}
+}
+
+// RequireInGroup is a middleware for routes which need a permission in the group the request is for.
+func RequireInGroup(perm string, groupid func(c *fiber.Ctx) uint64) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		p := PolicyFor(c)
+		if p.UserID == 0 {
+			return apierror.ErrNotLoggedIn
+		}
+
+		if !p.CanInGroup(perm, groupid(c)) {
+			return apierror.ErrForbidden
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleGrants(t *testing.T) {
+	assert.False(t, roleGrants(utils.ROLE_MEMBER, PERM_GROUP_VIEW))
+	assert.True(t, roleGrants(utils.ROLE_MODERATOR, PERM_GROUP_VIEW))
+	assert.True(t, roleGrants(utils.ROLE_MODERATOR, PERM_GROUP_MODERATE))
+	assert.False(t, roleGrants(utils.ROLE_MODERATOR, PERM_GROUP_OWN))
+	assert.True(t, roleGrants(utils.ROLE_OWNER, PERM_GROUP_OWN))
+	assert.False(t, roleGrants("", PERM_GROUP_VIEW))
+}
+
+func TestSystemRolePermissions(t *testing.T) {
+	// Support and admin can act as mods everywhere; only admins are admins.
+	for _, role := range []string{utils.SYSTEMROLE_SUPPORT, utils.SYSTEMROLE_ADMIN} {
+		assert.Subset(t, SystemRolePermissions[role], []string{PERM_SYSTEM_SUPPORT, PERM_GROUP_VIEW, PERM_GROUP_MODERATE, PERM_GROUP_OWN})
+	}
+
+	assert.Contains(t, SystemRolePermissions[utils.SYSTEMROLE_ADMIN], PERM_SYSTEM_ADMIN)
+	assert.NotContains(t, SystemRolePermissions[utils.SYSTEMROLE_SUPPORT], PERM_SYSTEM_ADMIN)
+	assert.NotContains(t, SystemRolePermissions[utils.SYSTEMROLE_MODERATOR], PERM_GROUP_MODERATE)
+	assert.Empty(t, SystemRolePermissions[utils.SYSTEMROLE_USER])
+}
+
+func TestCanonicalPermission(t *testing.T) {
+	assert.Equal(t, PERM_GIFTAID, canonicalPermission("giftaid"))
+	assert.Equal(t, PERM_SPAM_ADMIN, canonicalPermission(PERM_SPAM_ADMIN))
+	assert.Equal(t, "Unknown", canonicalPermission("Unknown"))
+}
+
+func TestPolicyNotLoggedIn(t *testing.T) {
+	p := PolicyForUser(0)
+
+	assert.False(t, p.Can(PERM_SYSTEM_SUPPORT))
+	assert.False(t, p.CanInGroup(PERM_GROUP_VIEW, 1))
+	assert.False(t, p.CanInAnyGroup(PERM_GROUP_VIEW))
+	assert.Empty(t, p.GroupsWith(PERM_GROUP_VIEW))
+	assert.Empty(t, p.Permissions())
+}
+
+func TestPolicyRoles(t *testing.T) {
+	// Set up what loading would have found.
+	p := PolicyForUser(1)
+	p.userOnce.Do(func() {
+		p.granted = map[string]bool{PERM_NEWSLETTER: true}
+	})
+	p.groupOnce.Do(func() {
+		p.groups = map[uint64]string{10: utils.ROLE_MODERATOR, 20: utils.ROLE_OWNER}
+	})
+
+	assert.True(t, p.Can(PERM_NEWSLETTER))
+	assert.False(t, p.Can(PERM_GROUP_MODERATE))
+
+	assert.True(t, p.CanInGroup(PERM_GROUP_MODERATE, 10))
+	assert.False(t, p.CanInGroup(PERM_GROUP_OWN, 10))
+	assert.True(t, p.CanInGroup(PERM_GROUP_OWN, 20))
+	assert.False(t, p.CanInGroup(PERM_GROUP_VIEW, 30))
+	assert.False(t, p.CanInGroup(PERM_GROUP_VIEW, 0))
+
+	assert.True(t, p.CanInSomeGroup(PERM_GROUP_MODERATE, []uint64{30, 10}))
+	assert.False(t, p.CanInSomeGroup(PERM_GROUP_MODERATE, []uint64{30}))
+	assert.False(t, p.CanInSomeGroup(PERM_GROUP_MODERATE, nil))
+
+	assert.Equal(t, []uint64{10, 20}, p.GroupsWith(PERM_GROUP_MODERATE))
+	assert.Equal(t, []uint64{20}, p.GroupsWith(PERM_GROUP_OWN))
+	assert.True(t, p.CanInAnyGroup(PERM_GROUP_OWN))
+}
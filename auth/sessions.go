@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"net"
+	"time"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/handler"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Each session records where it was last used from, so that users can see where they're logged in and end
+// sessions they don't recognise.  The columns are created by iznik-batch migrations:
+//
+//	sessions.ip (VARCHAR(45) NULL), sessions.useragent (VARCHAR(255) NULL), sessions.location (VARCHAR(80) NULL)
+//	  location is an approximate place for the IP, e.g. "Scotland, United Kingdom", looked up when the IP changes.
+
+// maxUserAgentLength is the size of the useragent column.
+const maxUserAgentLength = 255
+
+// SessionInfo describes one of a user's sessions.
+type SessionInfo struct {
+	ID         uint64     `json:"id"`
+	Created    *time.Time `json:"created"`
+	Lastactive *time.Time `json:"lastactive"`
+	IP         *string    `json:"ip,omitempty"`
+	Location   *string    `json:"location"`
+	Useragent  *string    `json:"useragent"`
+	Mfa        bool       `json:"mfa"`
+	Current    bool       `json:"current"`
+}
+
+// RecordSessionClient notes that a session has just been used by a request, and where from.
+func RecordSessionClient(c *fiber.Ctx, sessionID uint64) {
+	if sessionID == 0 {
+		return
+	}
+
+	db := database.DBConn
+	ip := ClientIP(c)
+
+	useragent := c.Get("User-Agent")
+	if len(useragent) > maxUserAgentLength {
+		useragent = useragent[:maxUserAgentLength]
+	}
+
+	moved := db.Exec("UPDATE sessions SET ip = ?, location = NULL WHERE id = ? AND (ip IS NULL OR ip != ?)",
+		ip, sessionID, ip).RowsAffected > 0
+
+	db.Exec("UPDATE sessions SET lastactive = NOW(), useragent = ? WHERE id = ?", useragent, sessionID)
+
+	if moved && lookupWorthwhile(ip) {
+		go func() {
+			loc, err := handler.LookupIP(ip)
+			if err != nil || loc.Status != "success" {
+				return
+			}
+
+			place := loc.Country
+			if loc.Region != "" {
+				place = loc.Region + ", " + loc.Country
+			}
+
+			// Only if it's still there; it may have moved again while we were looking.
+			db.Exec("UPDATE sessions SET location = ? WHERE id = ? AND ip = ?", place, sessionID, ip)
+		}()
+	}
+}
+
+// lookupWorthwhile returns false for addresses which the geolocation API can't place, such as our own network or
+// the documentation ranges used in tests.
+func lookupWorthwhile(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || !parsed.IsGlobalUnicast() || parsed.IsPrivate() {
+		return false
+	}
+
+	for _, cidr := range []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "2001:db8::/32"} {
+		if _, block, _ := net.ParseCIDR(cidr); block.Contains(parsed) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ListSessions returns a user's sessions, most recently used first.  The IP is only included if withIP is set, as
+// a location and device are enough for people to recognise their own sessions.
+func ListSessions(userID uint64, currentSessionID uint64, withIP bool) []SessionInfo {
+	var sessions []SessionInfo
+
+	database.DBConn.Raw("SELECT id, date AS created, lastactive, ip, location, useragent, mfa FROM sessions "+
+		"WHERE userid = ? ORDER BY lastactive DESC, id DESC", userID).Scan(&sessions)
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+
+		if !withIP {
+			sessions[i].IP = nil
+		}
+	}
+
+	if sessions == nil {
+		sessions = []SessionInfo{}
+	}
+
+	return sessions
+}
+
+// RevokeUserSession ends one of a user's sessions, returning false if they don't have one with that ID.
+func RevokeUserSession(userID uint64, sessionID uint64) bool {
+	var owner uint64
+	database.DBConn.Raw("SELECT userid FROM sessions WHERE id = ?", sessionID).Scan(&owner)
+
+	if owner == 0 || owner != userID {
+		return false
+	}
+
+	RevokeSession(sessionID)
+	return true
+}
+
+// RevokeOtherSessions ends all of a user's sessions except one, which may be 0 to end them all.  It returns how
+// many were ended.
+func RevokeOtherSessions(userID uint64, keepSessionID uint64) int64 {
+	db := database.DBConn
+
+	db.Exec("DELETE sessions_refresh FROM sessions_refresh INNER JOIN sessions ON sessions.id = sessions_refresh.sessionid "+
+		"WHERE sessions.userid = ? AND sessions.id != ?", userID, keepSessionID)
+
+	return db.Exec("DELETE FROM sessions WHERE userid = ? AND id != ?", userID, keepSessionID).RowsAffected
+}
@@ -0,0 +1,24 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupWorthwhile(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"81.2.69.160":  true,
+		"2a00:1450::1": true,
+		"127.0.0.1":    false,
+		"10.1.2.3":     false,
+		"192.168.0.1":  false,
+		"203.0.113.5":  false,
+		"2001:db8::1":  false,
+		"::1":          false,
+		"":             false,
+		"nonsense":     false,
+	} {
+		assert.Equal(t, want, lookupWorthwhile(ip), ip)
+	}
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Access tokens and refresh tokens.
+//
+// A JWT is an access token.  It only lasts a short time, so that one which leaks (e.g. from a URL in a log) isn't
+// much use.  When it expires the client swaps its refresh token for a new JWT and a new refresh token.  Each refresh
+// token can only be used once, so if one is used twice then either the client or an attacker has a copy it
+// shouldn't, and we can't tell which; we log the session out, which stops both.  The exception is a second use
+// within RefreshGrace of the first, which is most likely two tabs refreshing at the same moment.  That gets the
+// same new refresh token as the first, so we don't need to keep new tokens in the clear to hand them out again.
+//
+// Refresh tokens belong to a sessions row, so deleting the session (e.g. logging out) stops them working too.  They
+// are in a table created by iznik-batch migrations:
+//
+//	sessions_refresh (id, sessionid, token, created, expires, used NULL), unique on token, indexed on sessionid.
+//	  token is the SHA-256 of the refresh token.  Used ones are kept until they expire, so that we spot reuse.
+//
+// JWTs are signed with one of several keys, named by the kid header, so that we can change key without logging
+// everyone out:
+//
+//	JWT_KEYS         kid:secret pairs, comma-separated, e.g. "2024a:xxx,2025a:yyy"
+//	JWT_SIGNING_KID  which of those to sign new JWTs with; by default the first
+//	JWT_SECRET       the original key, for JWTs without a kid, which include those from the PHP server
+//
+// To change key, add the new one to JWT_KEYS and make it the signing key.  Once AccessTokenLifetime has passed,
+// nothing signed with the old key is still valid, so it can be removed.
+const (
+	AccessTokenLifetime  = 15 * time.Minute
+	RefreshTokenLifetime = 30 * 24 * time.Hour
+
+	// RefreshGrace is how long after a refresh token is used that it can be used again without ending the session.
+	RefreshGrace = 10 * time.Second
+)
+
+// Tokens are what a client needs to make requests as a session.
+type Tokens struct {
+	JWT          string
+	RefreshToken string
+}
+
+var (
+	// ErrRefreshTokenInvalid is for refresh tokens which we don't know, have expired, or whose session has ended.
+	ErrRefreshTokenInvalid = apierror.New(fiber.StatusUnauthorized, apierror.CodeTokenInvalid, "Please log in again.")
+
+	// ErrRefreshTokenReused is for refresh tokens which have been used before.  The session has been ended.
+	ErrRefreshTokenReused = apierror.New(fiber.StatusUnauthorized, apierror.CodeTokenReused, "Please log in again.")
+)
+
+// jwtKeys returns the keys we accept, by kid, and the kid to sign with.  "" is JWT_SECRET, which has no kid.
+func jwtKeys() (map[string][]byte, string) {
+	keys := map[string][]byte{"": []byte(os.Getenv("JWT_SECRET"))}
+	signWith := ""
+
+	for _, entry := range strings.Split(os.Getenv("JWT_KEYS"), ",") {
+		kid, secret, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || kid == "" || secret == "" {
+			continue
+		}
+
+		keys[kid] = []byte(secret)
+
+		if signWith == "" {
+			signWith = kid
+		}
+	}
+
+	if kid := os.Getenv("JWT_SIGNING_KID"); kid != "" {
+		if _, ok := keys[kid]; ok {
+			signWith = kid
+		}
+	}
+
+	return keys, signWith
+}
+
+// jwtKey finds the key to verify a JWT with.
+func jwtKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, errors.New("unexpected signing method")
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	keys, _ := jwtKeys()
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", kid)
+	}
+
+	return key, nil
+}
+
+// SignAccessToken returns a JWT for a session, which expires at a Unix time.
+func SignAccessToken(userID uint64, sessionID uint64, expires int64) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id":        strconv.FormatUint(userID, 10),
+		"sessionid": strconv.FormatUint(sessionID, 10),
+		"iat":       time.Now().Unix(),
+		"exp":       expires,
+	})
+
+	keys, kid := jwtKeys()
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	return token.SignedString(keys[kid])
+}
+
+// NewAccessToken returns a new JWT for a session.
+func NewAccessToken(userID uint64, sessionID uint64) (string, error) {
+	return SignAccessToken(userID, sessionID, time.Now().Add(AccessTokenLifetime).Unix())
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// successorRefreshToken returns the refresh token which replaces another.  It's derived from the old one with our
+// signing key, so that anyone who has a used token can't work out what replaced it.
+func successorRefreshToken(token string) string {
+	keys, kid := jwtKeys()
+
+	mac := hmac.New(sha256.New, keys[kid])
+	mac.Write([]byte("refresh:" + token))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// storeRefreshToken adds a refresh token for a session, unless it's already there.
+func storeRefreshToken(sessionID uint64, token string) error {
+	return database.DBConn.Exec("INSERT IGNORE INTO sessions_refresh (sessionid, token, created, expires) VALUES (?, ?, NOW(), DATE_ADD(NOW(), INTERVAL ? SECOND))",
+		sessionID, hashRefreshToken(token), int(RefreshTokenLifetime.Seconds())).Error
+}
+
+// NewRefreshToken returns a new refresh token for a session.
+func NewRefreshToken(sessionID uint64) (string, error) {
+	token := utils.RandomHex(32)
+
+	return token, storeRefreshToken(sessionID, token)
+}
+
+// IssueTokens returns a new JWT and refresh token for a session.
+func IssueTokens(userID uint64, sessionID uint64) (Tokens, error) {
+	jwtString, err := NewAccessToken(userID, sessionID)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	refresh, err := NewRefreshToken(sessionID)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return Tokens{JWT: jwtString, RefreshToken: refresh}, nil
+}
+
+// RefreshSession swaps a refresh token for new tokens.  If the refresh token was used before, longer ago than
+// RefreshGrace, the session is ended and ErrRefreshTokenReused returned, along with the user and session so that
+// the caller can log it.
+func RefreshSession(refreshToken string) (uint64, uint64, Tokens, error) {
+	db := database.DBConn
+
+	var row struct {
+		ID        uint64
+		Sessionid uint64
+		Userid    uint64
+		Used      bool
+		Recent    bool
+		Expired   bool
+	}
+
+	db.Raw("SELECT sessions_refresh.id, sessions_refresh.sessionid, COALESCE(sessions.userid, 0) AS userid, "+
+		"sessions_refresh.used IS NOT NULL AS used, COALESCE(sessions_refresh.used > DATE_SUB(NOW(), INTERVAL ? SECOND), 0) AS recent, "+
+		"sessions_refresh.expires < NOW() AS expired "+
+		"FROM sessions_refresh LEFT JOIN sessions ON sessions.id = sessions_refresh.sessionid "+
+		"WHERE sessions_refresh.token = ?", int(RefreshGrace.Seconds()), hashRefreshToken(refreshToken)).Scan(&row)
+
+	if row.ID == 0 || row.Userid == 0 || row.Expired {
+		return 0, 0, Tokens{}, ErrRefreshTokenInvalid
+	}
+
+	// If it wasn't used when we looked but marking it used fails, another request has only just used it, which is
+	// the same as a recent use.
+	if !row.Used && db.Exec("UPDATE sessions_refresh SET used = NOW() WHERE id = ? AND used IS NULL", row.ID).RowsAffected != 1 {
+		row.Used = true
+		row.Recent = true
+	}
+
+	if row.Used && !row.Recent {
+		RevokeSession(row.Sessionid)
+		return row.Userid, row.Sessionid, Tokens{}, ErrRefreshTokenReused
+	}
+
+	db.Exec("UPDATE sessions SET lastactive = NOW() WHERE id = ?", row.Sessionid)
+
+	// Whether this is the first use or a repeat within the grace period, the replacement is the same.
+	jwtString, err := NewAccessToken(row.Userid, row.Sessionid)
+	if err != nil {
+		return row.Userid, row.Sessionid, Tokens{}, err
+	}
+
+	successor := successorRefreshToken(refreshToken)
+	if err := storeRefreshToken(row.Sessionid, successor); err != nil {
+		return row.Userid, row.Sessionid, Tokens{}, err
+	}
+
+	return row.Userid, row.Sessionid, Tokens{JWT: jwtString, RefreshToken: successor}, nil
+}
+
+// RevokeSession ends a session, so that its JWTs, refresh tokens and persistent token stop working.
+func RevokeSession(sessionID uint64) {
+	db := database.DBConn
+	db.Exec("DELETE FROM sessions_refresh WHERE sessionid = ?", sessionID)
+	db.Exec("DELETE FROM sessions WHERE id = ?", sessionID)
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func setJWTKeys(t *testing.T, secret, keys, signWith string) {
+	for k, v := range map[string]string{"JWT_SECRET": secret, "JWT_KEYS": keys, "JWT_SIGNING_KID": signWith} {
+		old, had := os.LookupEnv(k)
+		os.Setenv(k, v)
+		t.Cleanup(func() {
+			if had {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+}
+
+// parseWithApp runs a JWT through GetJWTFromRequest, as a request would.
+func parseWithApp(token string) (uint64, uint64, float64) {
+	var id, sessionID uint64
+	var exp float64
+
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		id, sessionID, exp = GetJWTFromRequest(c)
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", token)
+	app.Test(req)
+
+	return id, sessionID, exp
+}
+
+func TestJWTKeys(t *testing.T) {
+	setJWTKeys(t, "legacy", " 2025a:first , 2025b:second,bad,:nokid", "")
+
+	keys, signWith := jwtKeys()
+	assert.Equal(t, "2025a", signWith)
+	assert.Equal(t, []byte("legacy"), keys[""])
+	assert.Equal(t, []byte("first"), keys["2025a"])
+	assert.Equal(t, []byte("second"), keys["2025b"])
+	assert.Len(t, keys, 3)
+
+	os.Setenv("JWT_SIGNING_KID", "2025b")
+	_, signWith = jwtKeys()
+	assert.Equal(t, "2025b", signWith)
+
+	// A signing key which isn't configured is ignored, rather than signing with an empty secret.
+	os.Setenv("JWT_SIGNING_KID", "missing")
+	_, signWith = jwtKeys()
+	assert.Equal(t, "2025a", signWith)
+}
+
+func TestAccessTokenKid(t *testing.T) {
+	setJWTKeys(t, "legacy", "2025a:first,2025b:second", "")
+
+	token, err := NewAccessToken(7, 8)
+	assert.NoError(t, err)
+
+	parsed, _, _ := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	assert.Equal(t, "2025a", parsed.Header["kid"])
+
+	id, sessionID, exp := parseWithApp(token)
+	assert.Equal(t, uint64(7), id)
+	assert.Equal(t, uint64(8), sessionID)
+	assert.InDelta(t, float64(time.Now().Add(AccessTokenLifetime).Unix()), exp, 5)
+
+	// Moving to a new key leaves tokens signed with the old one working, until it's removed.
+	os.Setenv("JWT_SIGNING_KID", "2025b")
+	id, _, _ = parseWithApp(token)
+	assert.Equal(t, uint64(7), id)
+
+	os.Setenv("JWT_KEYS", "2025b:second")
+	id, _, _ = parseWithApp(token)
+	assert.Equal(t, uint64(0), id)
+}
+
+func TestAccessTokenWithoutKid(t *testing.T) {
+	setJWTKeys(t, "legacy", "", "")
+
+	// With no JWT_KEYS we sign with JWT_SECRET and no kid, as before.
+	token, err := NewAccessToken(7, 8)
+	assert.NoError(t, err)
+
+	parsed, _, _ := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	_, hasKid := parsed.Header["kid"]
+	assert.False(t, hasKid)
+
+	// JWTs from elsewhere, such as the PHP server, have no kid and are still accepted once keys are configured.
+	os.Setenv("JWT_KEYS", "2025a:first")
+	id, _, _ := parseWithApp(token)
+	assert.Equal(t, uint64(7), id)
+
+	// An unknown kid isn't accepted, even with the right secret for another key.
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id":        strconv.Itoa(7),
+		"sessionid": strconv.Itoa(8),
+		"exp":       time.Now().Add(time.Minute).Unix(),
+	})
+	forged.Header["kid"] = "unknown"
+	s, _ := forged.SignedString([]byte("first"))
+	id, _, _ = parseWithApp(s)
+	assert.Equal(t, uint64(0), id)
+
+	// Nor is an expired one.
+	expired, _ := SignAccessToken(7, 8, time.Now().Add(-time.Minute).Unix())
+	id, _, _ = parseWithApp(expired)
+	assert.Equal(t, uint64(0), id)
+}
+
+func TestJWTInURL(t *testing.T) {
+	setJWTKeys(t, "legacy", "", "")
+
+	token, err := NewAccessToken(1, 2)
+	assert.NoError(t, err)
+
+	var id uint64
+
+	app := fiber.New()
+	app.Get("/*", func(c *fiber.Ctx) error {
+		id, _, _ = GetJWTFromRequest(c)
+		return nil
+	})
+
+	app.Test(httptest.NewRequest("GET", "/api/chat/stream?jwt="+token, nil))
+	assert.Equal(t, uint64(1), id)
+
+	app.Test(httptest.NewRequest("GET", "/apiv2/chat/stream?jwt="+token, nil))
+	assert.Equal(t, uint64(1), id)
+
+	// Older clients of /api still send it in the URL everywhere.
+	app.Test(httptest.NewRequest("GET", "/api/session?jwt="+token, nil))
+	assert.Equal(t, uint64(1), id)
+
+	// Anywhere else on /apiv2 it has to be in the header.
+	app.Test(httptest.NewRequest("GET", "/apiv2/session?jwt="+token, nil))
+	assert.Equal(t, uint64(0), id)
+
+	req := httptest.NewRequest("GET", "/apiv2/session", nil)
+	req.Header.Set("Authorization", token)
+	app.Test(req)
+	assert.Equal(t, uint64(1), id)
+}
+
+func TestSuccessorRefreshToken(t *testing.T) {
+	setJWTKeys(t, "legacy", "", "")
+
+	// The same token always has the same successor, which depends on our key.
+	s := successorRefreshToken("abc")
+	assert.Equal(t, s, successorRefreshToken("abc"))
+	assert.NotEqual(t, s, successorRefreshToken("abd"))
+	assert.Len(t, s, 64)
+
+	setJWTKeys(t, "other", "", "")
+	assert.NotEqual(t, s, successorRefreshToken("abc"))
+}
@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Two-factor authentication using time-based one-time passwords (RFC 6238), as generated by authenticator apps.
+//
+// Users enrol by scanning a secret into their app and then confirming a code from it, at which point they get some
+// single-use recovery codes in case they lose their phone.  After that, logging in needs a code as well as the
+// password or link.  Sessions which were logged in with a code are marked, so that routes which need it can check.
+//
+// The tables are created by iznik-batch migrations:
+//
+//	users_totp (userid PRIMARY KEY, secret, enabled, lastused, created)
+//	  lastused is the time step of the last code accepted, so that a code can't be used twice.
+//	users_totp_recovery (id, userid, code, used NULL), indexed on userid
+//	  code is the SHA-256 of the recovery code; they're random enough that a slow hash isn't needed.
+//	sessions.mfa (TINYINT, default 0)
+const (
+	totpDigits  = 6
+	totpModulus = 1000000
+	totpPeriod  = 30
+
+	// totpSkew is how many periods either side of now we accept, to allow for clocks being out.
+	totpSkew = 1
+
+	// RecoveryCodeCount is how many recovery codes a user gets at a time.
+	RecoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a new random secret, base32-encoded as authenticator apps expect.
+func NewTOTPSecret() string {
+	secret := make([]byte, 20)
+	_, _ = rand.Read(secret)
+	return totpEncoding.EncodeToString(secret)
+}
+
+// TOTPURI returns the otpauth:// URI for a secret, which clients show as a QR code.
+func TOTPURI(secret, account string) string {
+	issuer := "Freegle"
+	return fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s&digits=%d&period=%d",
+		url.PathEscape(issuer), url.PathEscape(account), secret, url.QueryEscape(issuer), totpDigits, totpPeriod)
+}
+
+func totpKey(secret string) ([]byte, error) {
+	return totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "=")))
+}
+
+func totpAt(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, code%totpModulus)
+}
+
+// TOTPCode returns the code for a secret at a time.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpKey(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return totpAt(key, t.Unix()/totpPeriod), nil
+}
+
+// CheckTOTP checks a code against a secret.  Codes from time steps up to lastStep have already been used, so
+// aren't accepted again.  It returns the time step of the code, to be stored as the new lastStep.
+func CheckTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpKey(secret)
+	code = strings.ReplaceAll(code, " ", "")
+
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpAt(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// NewRecoveryCodes returns new recovery codes, to show to the user, and their hashes, to store.
+func NewRecoveryCodes() ([]string, []string) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		_, _ = rand.Read(b)
+		h := hex.EncodeToString(b)
+		codes[i] = h[:5] + "-" + h[5:]
+		hashes[i] = HashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes
+}
+
+// HashRecoveryCode returns the hash we store for a recovery code.  People may type them without the dash or in
+// upper case, so we ignore those.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// TOTPRequiredForRole returns true if users with a system role must use two-factor authentication.  The roles are
+// listed in TOTP_REQUIRED_ROLES, e.g. "Moderator,Support,Admin".
+func TOTPRequiredForRole(systemrole string) bool {
+	for _, r := range strings.Split(os.Getenv("TOTP_REQUIRED_ROLES"), ",") {
+		if strings.TrimSpace(r) == systemrole && systemrole != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasTOTP returns true if the user has enrolled for two-factor authentication.
+func HasTOTP(userID uint64) bool {
+	var enabled bool
+	database.DBConn.Raw("SELECT enabled FROM users_totp WHERE userid = ?", userID).Scan(&enabled)
+	return enabled
+}
+
+// VerifySecondFactor checks a code from the user's authenticator app, or else one of their recovery codes, and
+// uses it up.
+func VerifySecondFactor(userID uint64, code string, recoveryCode string) bool {
+	db := database.DBConn
+
+	if code != "" {
+		var totp struct {
+			Secret   string
+			Lastused int64
+		}
+
+		db.Raw("SELECT secret, lastused FROM users_totp WHERE userid = ? AND enabled = 1", userID).Scan(&totp)
+
+		if totp.Secret == "" {
+			return false
+		}
+
+		step, ok := CheckTOTP(totp.Secret, code, totp.Lastused, time.Now())
+		if !ok {
+			return false
+		}
+
+		// Only one request can use each code, even if two arrive at once.
+		return db.Exec("UPDATE users_totp SET lastused = ? WHERE userid = ? AND lastused < ?", step, userID, step).RowsAffected == 1
+	}
+
+	if recoveryCode != "" {
+		return db.Exec("UPDATE users_totp_recovery SET used = NOW() WHERE userid = ? AND code = ? AND used IS NULL",
+			userID, HashRecoveryCode(recoveryCode)).RowsAffected == 1
+	}
+
+	return false
+}
+
+// SetSessionSecondFactor records that a session was logged in with a second factor.
+func SetSessionSecondFactor(sessionID uint64) {
+	database.DBConn.Exec("UPDATE sessions SET mfa = 1 WHERE id = ?", sessionID)
+}
+
+// ErrSecondFactorRequired is returned for routes which need a session logged in with a second factor.
+var ErrSecondFactorRequired = apierror.New(fiber.StatusForbidden, apierror.CodeMFARequired,
+	"Please log in again with a code from your authenticator app.")
+
+// RequireSecondFactor checks that a session was logged in with a second factor, if the user has enrolled or their
+// role needs it.  Sessions from before they enrolled don't count.
+func RequireSecondFactor(userID uint64, sessionID uint64, systemrole string) error {
+	var s struct {
+		Mfa     bool
+		Enabled bool
+	}
+
+	database.DBConn.Raw("SELECT sessions.mfa, COALESCE(users_totp.enabled, 0) AS enabled FROM sessions "+
+		"LEFT JOIN users_totp ON users_totp.userid = sessions.userid "+
+		"WHERE sessions.id = ? AND sessions.userid = ?", sessionID, userID).Scan(&s)
+
+	if s.Mfa {
+		return nil
+	}
+
+	if s.Enabled {
+		return ErrSecondFactorRequired
+	}
+
+	if TOTPRequiredForRole(systemrole) {
+		return ErrSecondFactorRequired.WithMessage("Please set up two-factor authentication, and then log in again with a code from your authenticator app.")
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"encoding/base32"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The SHA-1 test vectors from RFC 6238 appendix B, truncated to our 6 digits.
+func TestTOTPCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		code, err := TOTPCode(secret, time.Unix(unix, 0))
+		assert.NoError(t, err)
+		assert.Equal(t, want, code, unix)
+	}
+
+	_, err := TOTPCode("not base32!", time.Now())
+	assert.Error(t, err)
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret := NewTOTPSecret()
+	now := time.Unix(1700000000, 0)
+	step := now.Unix() / totpPeriod
+
+	code, _ := TOTPCode(secret, now)
+	got, ok := CheckTOTP(secret, code, 0, now)
+	assert.True(t, ok)
+	assert.Equal(t, step, got)
+
+	// Apps often show codes with a space in the middle.
+	_, ok = CheckTOTP(secret, code[:3]+" "+code[3:], 0, now)
+	assert.True(t, ok)
+
+	// A code can't be used twice.
+	_, ok = CheckTOTP(secret, code, step, now)
+	assert.False(t, ok)
+
+	// Codes from just before or after now are allowed, for clock drift, but not further out.
+	prev, _ := TOTPCode(secret, now.Add(-totpPeriod*time.Second))
+	_, ok = CheckTOTP(secret, prev, 0, now)
+	assert.True(t, ok)
+
+	old, _ := TOTPCode(secret, now.Add(-3*totpPeriod*time.Second))
+	_, ok = CheckTOTP(secret, old, 0, now)
+	assert.False(t, ok)
+
+	_, ok = CheckTOTP(secret, "12345", 0, now)
+	assert.False(t, ok)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := NewRecoveryCodes()
+	assert.Len(t, codes, RecoveryCodeCount)
+	assert.Len(t, hashes, RecoveryCodeCount)
+
+	seen := map[string]bool{}
+	for i, c := range codes {
+		assert.Len(t, c, 11)
+		assert.False(t, seen[c])
+		seen[c] = true
+
+		assert.Equal(t, hashes[i], HashRecoveryCode(c))
+		assert.Equal(t, hashes[i], HashRecoveryCode(strings.ToUpper(strings.ReplaceAll(c, "-", ""))))
+	}
+}
+
+func TestTOTPRequiredForRole(t *testing.T) {
+	defer os.Unsetenv("TOTP_REQUIRED_ROLES")
+
+	os.Setenv("TOTP_REQUIRED_ROLES", "")
+	assert.False(t, TOTPRequiredForRole("Admin"))
+	assert.False(t, TOTPRequiredForRole(""))
+
+	os.Setenv("TOTP_REQUIRED_ROLES", "Support, Admin")
+	assert.True(t, TOTPRequiredForRole("Admin"))
+	assert.True(t, TOTPRequiredForRole("Support"))
+	assert.False(t, TOTPRequiredForRole("Moderator"))
+	assert.False(t, TOTPRequiredForRole("User"))
+}
+
+func TestTOTPURI(t *testing.T) {
+	assert.Equal(t, "otpauth://totp/Freegle:test@example.com?secret=ABC&issuer=Freegle&digits=6&period=30",
+		TOTPURI("ABC", "test@example.com"))
+}
@@ -1,11 +1,9 @@
 package changes
 
 import (
-	"sync"
 	"time"
 
 	"github.com/freegle/iznik-server-go/database"
-	"github.com/freegle/iznik-server-go/utils"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -21,6 +19,7 @@ type UserChange struct {
 }
 
 type Rating struct {
+	ID        uint64 `json:"id"`
 	Rater     uint64 `json:"rater"`
 	Ratee     uint64 `json:"ratee"`
 	Rating    string `json:"rating"`
@@ -35,124 +34,135 @@ type ChangesData struct {
 	Ratings  []Rating        `json:"ratings"`
 }
 
-// ChangesResponse is the top-level response for the changes endpoint.
+// ChangesResponse is the top-level response for the changes endpoint.  Next is the cursor to pass to get the
+// changes after these ones.
 type ChangesResponse struct {
 	Ret     int         `json:"ret" example:"0"`
 	Status  string      `json:"status" example:"Success"`
 	Changes ChangesData `json:"changes"`
+	Next    string      `json:"next"`
 }
 
-// GetChanges returns message changes, user changes, and optionally ratings since a given time.
-// Requires partner key authentication via the partner query parameter.
-// @Summary Get changes since a timestamp
-// @Description Returns message changes (deleted, edited, promised, reneged, outcomes, approved/reposted), user changes, and ratings since a given time. Requires partner key authentication.
+const (
+	// changesDefaultLimit is the page size when paging with a cursor and no limit is given.
+	changesDefaultLimit = 500
+
+	// changesMaxLimit is the largest page we'll return.
+	changesMaxLimit = 1000
+)
+
+// GetChanges returns message changes, user changes, and ratings since a given time.
+// Requires a partner key with the changes:read scope, via the partner query parameter.
+//
+// Changes are returned in a stable order.  To page through them, pass a limit, and then pass the next cursor from
+// each response to get the following page; this returns every change exactly once, even when many share a
+// timestamp.  A page with no changes means the partner has caught up, and can call again later with the same
+// cursor.  Without a cursor or limit, all changes since the time are returned, as before cursors existed.
+// @Summary Get changes since a timestamp or cursor
+// @Description Returns message changes (deleted, edited, promised, reneged, outcomes, approved/reposted), user changes, and ratings since a given time or cursor. Requires partner key authentication.
 // @Tags changes
 // @Produce json
 // @Param since query string false "ISO8601 or MySQL datetime timestamp (defaults to 1 hour ago)" example("2026-03-04T12:00:00Z")
+// @Param cursor query string false "The next cursor from a previous response; takes precedence over since"
+// @Param limit query integer false "Maximum number of changes to return (1-1000)"
 // @Param partner query string true "Partner API key"
 // @Success 200 {object} ChangesResponse
-// @Failure 400 {object} fiber.Error "Invalid since parameter"
+// @Failure 400 {object} fiber.Error "Invalid since, cursor or limit parameter"
 // @Failure 403 {object} fiber.Error "Invalid or missing partner key"
 // @Router /api/changes [get]
 func GetChanges(c *fiber.Ctx) error {
 	// Partner authentication is required.
-	partner := c.Query("partner", "")
-	if partner == "" {
-		return fiber.NewError(fiber.StatusForbidden, "Partner key required")
+	if _, err := partnerID(c); err != nil {
+		return err
 	}
 
 	db := database.DBConn
 
-	var partnerID uint64
-	db.Raw("SELECT id FROM partners_keys WHERE `key` = ?", partner).Scan(&partnerID)
-
-	if partnerID == 0 {
-		return fiber.NewError(fiber.StatusForbidden, "Invalid partner key")
-	}
-
-	// Parse since parameter - default to 1 hour ago.
-	sinceStr := c.Query("since", "")
-	var since time.Time
+	var after Position
+	cursor := c.Query("cursor", "")
 
-	if sinceStr != "" {
-		parsed, err := time.Parse(time.RFC3339, sinceStr)
+	if cursor != "" {
+		pos, err := DecodeCursor(cursor)
 		if err != nil {
-			// Try MySQL-style datetime format.
-			parsed, err = time.Parse("2006-01-02 15:04:05", sinceStr)
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid cursor parameter")
+		}
+		after = pos
+	} else {
+		// Parse since parameter - default to 1 hour ago.
+		sinceStr := c.Query("since", "")
+
+		if sinceStr != "" {
+			parsed, err := time.Parse(time.RFC3339, sinceStr)
 			if err != nil {
-				return fiber.NewError(fiber.StatusBadRequest, "Invalid since parameter")
+				// Try MySQL-style datetime format.
+				parsed, err = time.ParseInLocation("2006-01-02 15:04:05", sinceStr, time.Local)
+				if err != nil {
+					return fiber.NewError(fiber.StatusBadRequest, "Invalid since parameter")
+				}
 			}
+			after.Timestamp = parsed
+		} else {
+			after.Timestamp = time.Now().Add(-1 * time.Hour)
 		}
-		since = parsed
-	} else {
-		since = time.Now().Add(-1 * time.Hour)
 	}
 
-	mysqlTime := since.Format("2006-01-02 15:04:05")
-
-	// Fetch message changes, user changes, and ratings in parallel.
-	var messages []MessageChange
-	var users []UserChange
-	var ratings []Rating
-	var wg sync.WaitGroup
-
-	wg.Add(3)
-
-	go func() {
-		defer wg.Done()
-		db.Raw("SELECT id, deleted AS timestamp, 'Deleted' AS `type` FROM messages WHERE deleted > ? "+
-			"UNION SELECT msgid AS id, timestamp, outcome AS `type` FROM messages_outcomes WHERE timestamp > ? "+
-			"UNION SELECT messages_edits.msgid AS id, timestamp, 'Edited' AS `type` FROM messages_edits "+
-			"INNER JOIN messages_groups ON messages_groups.msgid = messages_edits.msgid AND collection = ? WHERE timestamp > ? "+
-			"UNION SELECT msgid AS id, promisedat AS timestamp, 'Promised' AS `type` FROM messages_promises WHERE promisedat > ? "+
-			"UNION SELECT msgid AS id, timestamp, 'Reneged' AS `type` FROM messages_reneged WHERE timestamp > ? "+
-			"UNION SELECT msgid AS id, arrival AS timestamp, 'ApprovedOrReposted' AS `type` FROM messages_groups "+
-			"WHERE messages_groups.arrival > ? AND messages_groups.collection = ?",
-			mysqlTime, mysqlTime, utils.COLLECTION_APPROVED, mysqlTime, mysqlTime, mysqlTime, mysqlTime, utils.COLLECTION_APPROVED).Scan(&messages)
-	}()
-
-	go func() {
-		defer wg.Done()
-		db.Raw("SELECT id, lastupdated FROM users WHERE lastupdated >= ?", mysqlTime).Scan(&users)
-	}()
-
-	go func() {
-		defer wg.Done()
-		db.Raw("SELECT rater, ratee, rating, timestamp, visible FROM ratings WHERE timestamp >= ? AND visible = 1", mysqlTime).Scan(&ratings)
-	}()
-
-	wg.Wait()
-
-	// Format timestamps to ISO8601.
-	for i := range messages {
-		messages[i].Timestamp = formatISO(messages[i].Timestamp)
-	}
-	for i := range users {
-		users[i].LastUpdated = formatISO(users[i].LastUpdated)
+	limit := 0
+	until := time.Now()
+
+	if c.Query("limit", "") != "" {
+		limit = c.QueryInt("limit", 0)
+		if limit < 1 || limit > changesMaxLimit {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid limit parameter")
+		}
+	} else if cursor != "" {
+		limit = changesDefaultLimit
 	}
-	for i := range ratings {
-		ratings[i].Timestamp = formatISO(ratings[i].Timestamp)
+
+	if limit > 0 {
+		// When paging, stay a little behind now so that the next cursor can't skip changes still being written.
+		until = until.Add(-feedSettle)
 	}
 
-	// Ensure empty arrays rather than null in JSON.
-	if messages == nil {
-		messages = make([]MessageChange, 0)
+	items := FetchFeed(db, after, until, limit)
+
+	messages := make([]MessageChange, 0)
+	users := make([]UserChange, 0)
+	ratings := make([]Rating, 0)
+	var ratingIDs []uint64
+
+	for _, item := range items {
+		switch item.Source {
+		case SourceUser:
+			users = append(users, UserChange{ID: item.ID, LastUpdated: formatISO(mysqlTime(item.Timestamp))})
+		case SourceRating:
+			ratingIDs = append(ratingIDs, item.ID)
+		default:
+			messages = append(messages, MessageChange{ID: item.ID, Timestamp: formatISO(mysqlTime(item.Timestamp)), Type: item.Type})
+		}
 	}
-	if users == nil {
-		users = make([]UserChange, 0)
+
+	if len(ratingIDs) > 0 {
+		db.Raw("SELECT id, rater, ratee, rating, timestamp, visible FROM ratings WHERE id IN ? ORDER BY timestamp, id", ratingIDs).Scan(&ratings)
+
+		for i := range ratings {
+			ratings[i].Timestamp = formatISO(ratings[i].Timestamp)
+		}
 	}
-	if ratings == nil {
-		ratings = make([]Rating, 0)
+
+	next := after
+	if len(items) > 0 {
+		next = items[len(items)-1].Position()
 	}
 
-	return c.JSON(fiber.Map{
-		"ret":    0,
-		"status": "Success",
-		"changes": fiber.Map{
-			"messages": messages,
-			"users":    users,
-			"ratings":  ratings,
+	return c.JSON(ChangesResponse{
+		Ret:    0,
+		Status: "Success",
+		Changes: ChangesData{
+			Messages: messages,
+			Users:    users,
+			Ratings:  ratings,
 		},
+		Next: EncodeCursor(next),
 	})
 }
 
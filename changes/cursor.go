@@ -0,0 +1,62 @@
+package changes
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// Cursors are opaque to partners.  They encode a feed position and are signed, so that we are free to change
+// what's inside them and partners can't construct their own.
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+type cursorPayload struct {
+	T int64  `json:"t"`
+	S string `json:"s"`
+	I uint64 `json:"i"`
+}
+
+func cursorMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, []byte("changes-cursor:"+os.Getenv("JWT_SECRET")))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)[:16]
+}
+
+// EncodeCursor returns the cursor for a position.
+func EncodeCursor(p Position) string {
+	data, _ := json.Marshal(cursorPayload{T: p.Timestamp.Unix(), S: p.Source, I: p.ID})
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(cursorMAC(payload))
+}
+
+// DecodeCursor returns the position for a cursor, checking that we issued it.
+func DecodeCursor(cursor string) (Position, error) {
+	payload, sig, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return Position{}, errInvalidCursor
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, cursorMAC(payload)) {
+		return Position{}, errInvalidCursor
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Position{}, errInvalidCursor
+	}
+
+	var p cursorPayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Position{}, errInvalidCursor
+	}
+
+	return Position{Timestamp: time.Unix(p.T, 0), Source: p.S, ID: p.I}, nil
+}
@@ -0,0 +1,38 @@
+package changes
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	p := Position{Timestamp: time.Unix(1700000000, 0), Source: SourceOutcome, ID: 42}
+
+	got, err := DecodeCursor(EncodeCursor(p))
+	assert.NoError(t, err)
+	assert.True(t, p.Timestamp.Equal(got.Timestamp))
+	assert.Equal(t, p.Source, got.Source)
+	assert.Equal(t, p.ID, got.ID)
+}
+
+func TestCursorRejectsTampering(t *testing.T) {
+	cursor := EncodeCursor(Position{Timestamp: time.Unix(1700000000, 0), Source: SourceEdit, ID: 1})
+	payload, sig, _ := strings.Cut(cursor, ".")
+
+	// A payload from a different position with this signature.
+	other, _, _ := strings.Cut(EncodeCursor(Position{Timestamp: time.Unix(1600000000, 0), Source: SourceEdit, ID: 1}), ".")
+	_, err := DecodeCursor(other + "." + sig)
+	assert.Error(t, err)
+
+	_, err = DecodeCursor(payload)
+	assert.Error(t, err)
+
+	_, err = DecodeCursor(payload + ".!!!")
+	assert.Error(t, err)
+
+	_, err = DecodeCursor("")
+	assert.Error(t, err)
+}
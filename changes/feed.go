@@ -0,0 +1,208 @@
+package changes
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/freegle/iznik-server-go/utils"
+	"gorm.io/gorm"
+)
+
+// Sources of changes.  Each is a table we read changes from, and together with the timestamp and row id
+// they give a total order over the feed, so that a reader can resume exactly where it left off.
+const (
+	SourceArrival = "arrival"
+	SourceDeleted = "deleted"
+	SourceEdit    = "edit"
+	SourceOutcome = "outcome"
+	SourcePromise = "promise"
+	SourceReneged = "reneged"
+	SourceRating  = "rating"
+	SourceUser    = "user"
+)
+
+// feedSettle is how far behind now we read the feed, so that changes still being written in the current second
+// are not skipped by a reader which has already moved past that second.
+const feedSettle = 5 * time.Second
+
+// Position is a point in the change feed.  Items are ordered by (timestamp, source, id).
+type Position struct {
+	Timestamp time.Time
+	Source    string
+	ID        uint64
+}
+
+// FeedItem is a single change in the feed.
+type FeedItem struct {
+	ID        uint64    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"type"`
+	Source    string    `json:"source"`
+}
+
+// Position returns the feed position of this item.
+func (f FeedItem) Position() Position {
+	return Position{Timestamp: f.Timestamp, Source: f.Source, ID: f.ID}
+}
+
+type feedSource struct {
+	name string
+
+	// sql selects id, timestamp, type and source, and ends with a WHERE clause to which we append conditions on
+	// the ts and id columns.
+	sql  string
+	args []interface{}
+	ts   string
+	id   string
+}
+
+func messageSources() []feedSource {
+	return []feedSource{
+		{
+			name: SourceArrival,
+			sql: "SELECT msgid AS id, arrival AS timestamp, 'ApprovedOrReposted' AS `type`, '" + SourceArrival + "' AS source " +
+				"FROM messages_groups WHERE collection = ?",
+			args: []interface{}{utils.COLLECTION_APPROVED},
+			ts:   "arrival",
+			id:   "msgid",
+		},
+		{
+			name: SourceDeleted,
+			sql:  "SELECT id, deleted AS timestamp, 'Deleted' AS `type`, '" + SourceDeleted + "' AS source FROM messages WHERE deleted IS NOT NULL",
+			ts:   "deleted",
+			id:   "id",
+		},
+		{
+			name: SourceEdit,
+			sql: "SELECT messages_edits.msgid AS id, timestamp, 'Edited' AS `type`, '" + SourceEdit + "' AS source FROM messages_edits " +
+				"INNER JOIN messages_groups ON messages_groups.msgid = messages_edits.msgid AND collection = ? WHERE 1=1",
+			args: []interface{}{utils.COLLECTION_APPROVED},
+			ts:   "messages_edits.timestamp",
+			id:   "messages_edits.msgid",
+		},
+		{
+			name: SourceOutcome,
+			sql:  "SELECT msgid AS id, timestamp, outcome AS `type`, '" + SourceOutcome + "' AS source FROM messages_outcomes WHERE 1=1",
+			ts:   "timestamp",
+			id:   "msgid",
+		},
+		{
+			name: SourcePromise,
+			sql:  "SELECT msgid AS id, promisedat AS timestamp, 'Promised' AS `type`, '" + SourcePromise + "' AS source FROM messages_promises WHERE 1=1",
+			ts:   "promisedat",
+			id:   "msgid",
+		},
+		{
+			name: SourceReneged,
+			sql:  "SELECT msgid AS id, timestamp, 'Reneged' AS `type`, '" + SourceReneged + "' AS source FROM messages_reneged WHERE 1=1",
+			ts:   "timestamp",
+			id:   "msgid",
+		},
+	}
+}
+
+// otherSources are the changes to users and ratings which GetChanges returns alongside message changes.
+func otherSources() []feedSource {
+	return []feedSource{
+		{
+			name: SourceRating,
+			sql:  "SELECT id, timestamp, rating AS `type`, '" + SourceRating + "' AS source FROM ratings WHERE visible = 1",
+			ts:   "timestamp",
+			id:   "id",
+		},
+		{
+			name: SourceUser,
+			sql:  "SELECT id, lastupdated AS timestamp, 'Updated' AS `type`, '" + SourceUser + "' AS source FROM users WHERE lastupdated IS NOT NULL",
+			ts:   "lastupdated",
+			id:   "id",
+		},
+	}
+}
+
+// mysqlTime formats a time for comparison with DATETIME columns, which we read and write in local time.
+func mysqlTime(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// afterCondition returns the SQL condition for rows from a source which come after a position.  Because the
+// source is constant within one table, this reduces to a simple condition on timestamp and id which can use the
+// timestamp index.
+func afterCondition(source string, tsCol string, idCol string, after Position) (string, []interface{}) {
+	ts := mysqlTime(after.Timestamp)
+
+	switch {
+	case source > after.Source:
+		return fmt.Sprintf("%s >= ?", tsCol), []interface{}{ts}
+	case source == after.Source:
+		return fmt.Sprintf("(%s > ? OR (%s = ? AND %s > ?))", tsCol, tsCol, idCol), []interface{}{ts, ts, after.ID}
+	default:
+		return fmt.Sprintf("%s > ?", tsCol), []interface{}{ts}
+	}
+}
+
+// FetchMessageFeed returns up to limit message changes after a position, in feed order, and no later than until.
+func FetchMessageFeed(db *gorm.DB, after Position, until time.Time, limit int) []FeedItem {
+	return fetchFeed(db, messageSources(), after, until, limit)
+}
+
+// FetchFeed is FetchMessageFeed plus changes to users and ratings.  A limit of 0 means no limit.
+func FetchFeed(db *gorm.DB, after Position, until time.Time, limit int) []FeedItem {
+	return fetchFeed(db, append(messageSources(), otherSources()...), after, until, limit)
+}
+
+// fetchFeed merges the sources in feed order.  Because the order is total, a reader which passes the position of
+// the last item it received gets everything after it, with nothing skipped or repeated even when many changes
+// share a timestamp.
+func fetchFeed(db *gorm.DB, sources []feedSource, after Position, until time.Time, limit int) []FeedItem {
+	var unions []string
+	var args []interface{}
+
+	limitSQL := ""
+	if limit > 0 {
+		limitSQL = fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	for _, s := range sources {
+		cond, condArgs := afterCondition(s.name, s.ts, s.id, after)
+		unions = append(unions, fmt.Sprintf("(%s AND %s AND %s <= ? ORDER BY %s, %s%s)", s.sql, cond, s.ts, s.ts, s.id, limitSQL))
+		args = append(args, s.args...)
+		args = append(args, condArgs...)
+		args = append(args, mysqlTime(until))
+	}
+
+	sql := "SELECT DISTINCT id, timestamp, `type`, source FROM (" + strings.Join(unions, " UNION ALL ") + ") t " +
+		"ORDER BY timestamp, source, id" + limitSQL
+
+	items := []FeedItem{}
+	db.Raw(sql, args...).Scan(&items)
+
+	if limit <= 0 {
+		return items
+	}
+
+	return trimTies(items, limit)
+}
+
+// trimTies drops items at the end of a full page which share the last item's position.  Several changes can share
+// a position (e.g. two outcomes for a message in the same second), and if a page ended part way through them the
+// rest would be skipped by the next page.  Dropping them means the next page returns them all together.
+func trimTies(items []FeedItem, limit int) []FeedItem {
+	if len(items) < limit || len(items) == 0 {
+		return items
+	}
+
+	last := items[len(items)-1].Position()
+	end := len(items)
+
+	for end > 0 && items[end-1].Position() == last {
+		end--
+	}
+
+	if end == 0 {
+		// The whole page is one position, so we can't do better than returning it.
+		return items
+	}
+
+	return items[:end]
+}
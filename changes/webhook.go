@@ -0,0 +1,422 @@
+package changes
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/partner"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Partners can subscribe a webhook URL to receive message changes as they happen, rather than polling GetChanges.
+//
+// Each subscription (a row in partners_webhooks, created by the iznik-batch migrations) has its own position in
+// the change feed.  The dispatcher posts batches of changes after that position, and only moves the position on
+// when the partner acknowledges a batch with a 2xx response.  So a partner which is down receives everything it
+// missed once it is back, with no gaps and no duplicates.  Failed deliveries are retried with exponential backoff,
+// and after too many failures the subscription is dead-lettered until the partner resumes it.
+
+// Webhook statuses.
+const (
+	WebhookActive     = "Active"
+	WebhookDeadLetter = "DeadLetter"
+)
+
+const (
+	// webhookBatchSize is the maximum number of changes in one delivery.
+	webhookBatchSize = 100
+
+	// webhookMaxBatches is how many batches we send to one subscription before moving on to others.
+	webhookMaxBatches = 10
+
+	// webhookMaxAttempts is how many consecutive failures we allow before dead-lettering.
+	webhookMaxAttempts = 10
+
+	// webhookBaseBackoff and webhookMaxBackoff bound the delay between retries.
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+
+	// webhookPollInterval is how often the dispatcher looks for subscriptions with work to do.
+	webhookPollInterval = 10 * time.Second
+
+	// webhookLock is how long a dispatcher owns a subscription while delivering to it.  It's renewed after each
+	// batch, so it only has to be longer than one batch can take, i.e. the client timeout.
+	webhookLock = 2 * time.Minute
+)
+
+// SignatureHeader carries the HMAC signature of a delivery, in the form t=<unix time>,v1=<hex HMAC-SHA256>.  The
+// signed payload is the timestamp, a full stop, and the raw request body.
+const SignatureHeader = "X-Freegle-Signature"
+
+// DeliveryHeader carries an ID for the batch which is the same for every retry of it.
+const DeliveryHeader = "X-Freegle-Delivery"
+
+// Webhook is a partner's subscription.  The secret is only returned when the subscription is created.
+type Webhook struct {
+	ID            uint64     `json:"id"`
+	Partnerid     uint64     `json:"-"`
+	URL           string     `json:"url" gorm:"column:url"`
+	Secret        string     `json:"-"`
+	Status        string     `json:"status"`
+	CursorTs      time.Time  `json:"position" gorm:"column:cursor_ts"`
+	CursorSource  string     `json:"-" gorm:"column:cursor_source"`
+	CursorID      uint64     `json:"-" gorm:"column:cursor_id"`
+	Attempts      int        `json:"attempts"`
+	Nextattempt   *time.Time `json:"nextattempt"`
+	Lasterror     *string    `json:"lasterror"`
+	Lastdelivered *time.Time `json:"lastdelivered"`
+	Added         time.Time  `json:"added"`
+}
+
+func (Webhook) TableName() string {
+	return "partners_webhooks"
+}
+
+// WebhookPayload is the JSON body posted to a partner.
+type WebhookPayload struct {
+	Webhook  uint64     `json:"webhook"`
+	Delivery string     `json:"delivery"`
+	Changes  []FeedItem `json:"changes"`
+}
+
+type WebhookRequest struct {
+	ID     uint64 `json:"id"`
+	URL    string `json:"url"`
+	Action string `json:"action"`
+}
+
+// partnerID authenticates the partner key in the request, which must allow reading changes, and returns the
+// partner's ID.
+func partnerID(c *fiber.Ctx) (uint64, error) {
+	k, err := partner.Authenticate(c, c.Query("partner"), partner.ScopeChangesRead)
+	if err != nil {
+		return 0, err
+	}
+
+	return k.Partnerid, nil
+}
+
+// loopbackWebhooks is whether we'll deliver to this machine, which is only useful in development and tests.  It's
+// set by WEBHOOK_ALLOW_LOOPBACK=true.
+func loopbackWebhooks() bool {
+	return os.Getenv("WEBHOOK_ALLOW_LOOPBACK") == "true"
+}
+
+// carrierNAT is the shared address space (RFC 6598), which isn't reachable from the internet either.
+var carrierNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// blockedWebhookIP returns whether we refuse to deliver to an address.  Webhook URLs come from partners, so without
+// this they could have us post to our own API or to anything else on our internal network.
+func blockedWebhookIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return !loopbackWebhooks()
+	}
+
+	return ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() || carrierNAT.Contains(ip)
+}
+
+// validWebhookURL checks that a URL is one we're willing to post to.  We require https, other than for loopback
+// addresses when those are allowed.  Hosts which are addresses are checked here; names are checked when we connect,
+// as that's the only time we know what they resolve to.
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+
+	if ip != nil && blockedWebhookIP(ip) {
+		return false
+	}
+
+	if strings.EqualFold(host, "localhost") {
+		return loopbackWebhooks() && (u.Scheme == "https" || u.Scheme == "http")
+	}
+
+	if u.Scheme == "https" {
+		return true
+	}
+
+	return u.Scheme == "http" && ip != nil && ip.IsLoopback()
+}
+
+// ListWebhooks returns the partner's webhook subscriptions.
+func ListWebhooks(c *fiber.Ctx) error {
+	db := database.DBConn
+	pid, err := partnerID(c)
+	if err != nil {
+		return err
+	}
+
+	webhooks := []Webhook{}
+	db.Raw("SELECT * FROM partners_webhooks WHERE partnerid = ? ORDER BY id", pid).Scan(&webhooks)
+
+	return c.JSON(webhooks)
+}
+
+// CreateWebhook subscribes a URL to the change feed, starting from now.  The response contains the signing
+// secret, which is not shown again.
+func CreateWebhook(c *fiber.Ctx) error {
+	db := database.DBConn
+	pid, err := partnerID(c)
+	if err != nil {
+		return err
+	}
+
+	var req WebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	if !validWebhookURL(req.URL) {
+		return fiber.NewError(fiber.StatusBadRequest, "url must be an https URL")
+	}
+
+	secret := utils.RandomHex(32)
+
+	result := db.Exec("INSERT INTO partners_webhooks (partnerid, url, secret, status, cursor_ts, cursor_source, cursor_id, attempts, added) "+
+		"VALUES (?, ?, ?, ?, NOW(), '', 0, 0, NOW())", pid, req.URL, secret, WebhookActive)
+
+	if result.Error != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create webhook")
+	}
+
+	var id uint64
+	db.Raw("SELECT id FROM partners_webhooks WHERE partnerid = ? ORDER BY id DESC LIMIT 1", pid).Scan(&id)
+
+	return c.JSON(fiber.Map{"id": id, "secret": secret})
+}
+
+// PostWebhook performs actions on a subscription.  Resume takes a dead-lettered subscription back to active, and
+// delivery continues from where it stopped.
+func PostWebhook(c *fiber.Ctx) error {
+	db := database.DBConn
+	pid, err := partnerID(c)
+	if err != nil {
+		return err
+	}
+
+	var req WebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	switch req.Action {
+	case "Resume":
+		result := db.Exec("UPDATE partners_webhooks SET status = ?, attempts = 0, nextattempt = NULL, lasterror = NULL WHERE id = ? AND partnerid = ?",
+			WebhookActive, req.ID, pid)
+
+		if result.RowsAffected == 0 {
+			return fiber.NewError(fiber.StatusNotFound, "Webhook not found")
+		}
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "Unknown action")
+	}
+
+	return c.JSON(fiber.Map{"ret": 0, "status": "Success"})
+}
+
+// DeleteWebhook removes a subscription.
+func DeleteWebhook(c *fiber.Ctx) error {
+	db := database.DBConn
+	pid, err := partnerID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid ID")
+	}
+
+	result := db.Exec("DELETE FROM partners_webhooks WHERE id = ? AND partnerid = ?", id, pid)
+
+	if result.RowsAffected == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "Webhook not found")
+	}
+
+	return c.JSON(fiber.Map{"ret": 0, "status": "Success"})
+}
+
+// Sign returns the signature header value for a body.  Partners verify deliveries by computing the same HMAC
+// with their secret and checking the timestamp is recent.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// backoff returns the delay before the next attempt after a number of consecutive failures.
+func backoff(attempts int) time.Duration {
+	d := webhookBaseBackoff
+
+	for i := 1; i < attempts; i++ {
+		d *= 2
+
+		if d >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+
+	return d
+}
+
+// deliveryID identifies a batch by its subscription and range, so that retries of a batch share an ID which
+// partners can use to spot a redelivery after a lost acknowledgement.
+func deliveryID(webhookID uint64, first Position, last Position) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d|%d|%s|%d|%d|%s|%d", webhookID, first.Timestamp.Unix(), first.Source, first.ID, last.Timestamp.Unix(), last.Source, last.ID)
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// checkWebhookDial refuses connections to addresses we don't deliver to.  It runs for every connection, including
+// those for redirects, after the name has been resolved, so DNS can't be used to get round blockedWebhookIP.
+func checkWebhookDial(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || blockedWebhookIP(ip) {
+		return fmt.Errorf("webhook address %s isn't allowed", host)
+	}
+
+	return nil
+}
+
+// webhookClient doesn't use a proxy from the environment, as then we'd only check the proxy's address.
+var webhookClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: checkWebhookDial}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// post sends one batch.  Any non-2xx response counts as a failure.
+func post(w Webhook, items []FeedItem) error {
+	payload := WebhookPayload{
+		Webhook:  w.ID,
+		Delivery: deliveryID(w.ID, items[0].Position(), items[len(items)-1].Position()),
+		Changes:  items,
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(w.Secret, time.Now().Unix(), body))
+	req.Header.Set(DeliveryHeader, payload.Delivery)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// deliverWebhook sends pending batches to one subscription, advancing its position after each acknowledged one.
+func deliverWebhook(db *gorm.DB, w Webhook) {
+	pos := Position{Timestamp: w.CursorTs, Source: w.CursorSource, ID: w.CursorID}
+	until := time.Now().Add(-feedSettle)
+
+	for batch := 0; batch < webhookMaxBatches; batch++ {
+		items := FetchMessageFeed(db, pos, until, webhookBatchSize)
+
+		if len(items) == 0 {
+			return
+		}
+
+		if err := post(w, items); err != nil {
+			attempts := w.Attempts + 1
+			status := WebhookActive
+
+			if attempts >= webhookMaxAttempts {
+				status = WebhookDeadLetter
+				log.Printf("Webhook %d for partner %d dead-lettered after %d attempts: %v", w.ID, w.Partnerid, attempts, err)
+			}
+
+			db.Exec("UPDATE partners_webhooks SET attempts = ?, status = ?, lasterror = ?, nextattempt = ? WHERE id = ?",
+				attempts, status, err.Error(), time.Now().Add(backoff(attempts)), w.ID)
+			return
+		}
+
+		pos = items[len(items)-1].Position()
+		w.Attempts = 0
+
+		// Renew the lock as we go, as all the batches together can take longer than it lasts.
+		db.Exec("UPDATE partners_webhooks SET cursor_ts = ?, cursor_source = ?, cursor_id = ?, attempts = 0, nextattempt = NULL, lasterror = NULL, lastdelivered = NOW(), lockeduntil = ? WHERE id = ?",
+			mysqlTime(pos.Timestamp), pos.Source, pos.ID, time.Now().Add(webhookLock), w.ID)
+
+		if len(items) < webhookBatchSize {
+			return
+		}
+	}
+}
+
+// DeliverWebhooks makes one pass over the subscriptions which are due.  Each subscription is locked while we
+// deliver to it, so several API instances can run the dispatcher without sending anything twice.
+func DeliverWebhooks(db *gorm.DB) {
+	var due []Webhook
+	db.Raw("SELECT * FROM partners_webhooks WHERE status = ? AND (nextattempt IS NULL OR nextattempt <= NOW()) "+
+		"AND (lockeduntil IS NULL OR lockeduntil < NOW())", WebhookActive).Scan(&due)
+
+	for _, w := range due {
+		claim := db.Exec("UPDATE partners_webhooks SET lockeduntil = ? WHERE id = ? AND (lockeduntil IS NULL OR lockeduntil < NOW())",
+			time.Now().Add(webhookLock), w.ID)
+
+		if claim.RowsAffected != 1 {
+			continue
+		}
+
+		deliverWebhook(db, w)
+		db.Exec("UPDATE partners_webhooks SET lockeduntil = NULL WHERE id = ?", w.ID)
+	}
+}
+
+// StartWebhookDispatcher runs DeliverWebhooks periodically in the background.
+func StartWebhookDispatcher() {
+	go func() {
+		for {
+			time.Sleep(webhookPollInterval)
+			DeliverWebhooks(database.DBConn)
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package changes
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"changes":[]}`)
+	sig := Sign("secret", 1700000000, body)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	assert.Equal(t, "t=1700000000,v1="+hex.EncodeToString(mac.Sum(nil)), sig)
+
+	assert.NotEqual(t, sig, Sign("other", 1700000000, body))
+	assert.NotEqual(t, sig, Sign("secret", 1700000001, body))
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, webhookBaseBackoff, backoff(1))
+	assert.Equal(t, 2*webhookBaseBackoff, backoff(2))
+	assert.Equal(t, 4*webhookBaseBackoff, backoff(3))
+	assert.Equal(t, webhookMaxBackoff, backoff(50))
+}
+
+func TestValidWebhookURL(t *testing.T) {
+	assert.True(t, validWebhookURL("https://partner.example.com/hook"))
+	assert.True(t, validWebhookURL("https://81.2.69.160/hook"))
+	assert.False(t, validWebhookURL("http://partner.example.com/hook"))
+	assert.False(t, validWebhookURL("ftp://partner.example.com/hook"))
+	assert.False(t, validWebhookURL("not a url"))
+	assert.False(t, validWebhookURL(""))
+
+	// Nothing on our own network.
+	assert.False(t, validWebhookURL("https://10.1.2.3/hook"))
+	assert.False(t, validWebhookURL("https://192.168.1.1/hook"))
+	assert.False(t, validWebhookURL("https://169.254.169.254/latest/meta-data"))
+	assert.False(t, validWebhookURL("https://[fd00::1]/hook"))
+	assert.False(t, validWebhookURL("https://0.0.0.0/hook"))
+
+	// Nor this machine, unless that's allowed for development.
+	t.Setenv("WEBHOOK_ALLOW_LOOPBACK", "")
+	assert.False(t, validWebhookURL("http://127.0.0.1:8080/hook"))
+	assert.False(t, validWebhookURL("https://127.0.0.1/hook"))
+	assert.False(t, validWebhookURL("http://localhost/hook"))
+	assert.False(t, validWebhookURL("http://[::1]/hook"))
+
+	t.Setenv("WEBHOOK_ALLOW_LOOPBACK", "true")
+	assert.True(t, validWebhookURL("http://127.0.0.1:8080/hook"))
+	assert.True(t, validWebhookURL("http://localhost/hook"))
+	assert.True(t, validWebhookURL("http://[::1]/hook"))
+}
+
+func TestCheckWebhookDial(t *testing.T) {
+	t.Setenv("WEBHOOK_ALLOW_LOOPBACK", "")
+
+	// Names have been resolved by the time we check, so this catches names which point inside.
+	assert.NoError(t, checkWebhookDial("tcp", "81.2.69.160:443", nil))
+	assert.Error(t, checkWebhookDial("tcp", "10.0.0.5:443", nil))
+	assert.Error(t, checkWebhookDial("tcp", "127.0.0.1:443", nil))
+	assert.Error(t, checkWebhookDial("tcp", "[fe80::1]:443", nil))
+	assert.Error(t, checkWebhookDial("tcp", "100.64.1.1:443", nil))
+
+	t.Setenv("WEBHOOK_ALLOW_LOOPBACK", "true")
+	assert.NoError(t, checkWebhookDial("tcp", "127.0.0.1:443", nil))
+	assert.Error(t, checkWebhookDial("tcp", "10.0.0.5:443", nil))
+}
+
+func TestWebhookLockOutlastsBatch(t *testing.T) {
+	// The lock is renewed after each batch, so it must outlast the slowest one.
+	assert.Greater(t, webhookLock, webhookClient.Timeout)
+}
+
+func TestDeliveryIDStable(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a := Position{Timestamp: now, Source: SourceEdit, ID: 1}
+	b := Position{Timestamp: now, Source: SourceOutcome, ID: 2}
+
+	assert.Equal(t, deliveryID(1, a, b), deliveryID(1, a, b))
+	assert.NotEqual(t, deliveryID(1, a, b), deliveryID(2, a, b))
+	assert.NotEqual(t, deliveryID(1, a, b), deliveryID(1, a, a))
+}
+
+func TestAfterCondition(t *testing.T) {
+	after := Position{Timestamp: time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local), Source: SourceEdit, ID: 7}
+
+	// Later sources include the same second, earlier ones don't.
+	cond, args := afterCondition(SourceOutcome, "ts", "id", after)
+	assert.Equal(t, "ts >= ?", cond)
+	assert.Equal(t, []interface{}{"2026-01-02 03:04:05"}, args)
+
+	cond, _ = afterCondition(SourceDeleted, "ts", "id", after)
+	assert.Equal(t, "ts > ?", cond)
+
+	cond, args = afterCondition(SourceEdit, "ts", "id", after)
+	assert.True(t, strings.Contains(cond, "id > ?"))
+	assert.Equal(t, uint64(7), args[2])
+}
+
+func TestTrimTies(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	items := []FeedItem{
+		{ID: 1, Timestamp: now, Source: SourceOutcome, Type: "Taken"},
+		{ID: 2, Timestamp: now, Source: SourceOutcome, Type: "Taken"},
+		{ID: 2, Timestamp: now, Source: SourceOutcome, Type: "Withdrawn"},
+	}
+
+	// A full page ending in a tie is trimmed so the next page gets the whole tie.
+	assert.Len(t, trimTies(items, 3), 1)
+
+	// A partial page is the end of the feed, so nothing can be split.
+	assert.Len(t, trimTies(items, 4), 3)
+
+	// A page which is all one position is returned as is.
+	assert.Len(t, trimTies(items[1:], 2), 2)
+}
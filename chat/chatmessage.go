@@ -9,10 +9,13 @@ import (
 	"strings"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/contentscan"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/log"
 	"github.com/freegle/iznik-server-go/misc"
+	"github.com/freegle/iznik-server-go/partner"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/gofiber/fiber/v2"
@@ -183,33 +186,37 @@ func FetchChatMessages(chatID, userID uint64, limit int, excludeID uint64, desce
 	messages := []ChatMessageQuery{}
 	db.Raw(query, args...).Scan(&messages)
 
-	// Process images and deleted messages
-	for ix, a := range messages {
-		if a.Imageid != nil {
-			path, paththumb := misc.BuildChatImageUrl(*a.Imageid, a.Imageuid, string(a.Imagemods), a.Archived)
-			messages[ix].Image = &ChatAttachment{
-				ID:           *a.Imageid,
-				Ouruid:       a.Imageuid,
-				Externalmods: a.Imagemods,
-				Path:         path,
-				Paththumb:    paththumb,
-			}
-		}
+	for ix := range messages {
+		prepareChatMessage(&messages[ix], modAccess)
+	}
 
-		if a.Deleted {
-			messages[ix].Message = "(Message deleted)"
-		}
+	return messages
+}
 
-		// strip review/processing fields from non-mod responses.
-		if !modAccess {
-			messages[ix].Reviewrequired = false
-			messages[ix].Reviewrejected = false
-			messages[ix].Processingrequired = false
-			messages[ix].Processingsuccessful = false
+// prepareChatMessage fills in image info, masks deleted messages and strips review fields for non-mods.
+func prepareChatMessage(m *ChatMessageQuery, modAccess bool) {
+	if m.Imageid != nil {
+		path, paththumb := misc.BuildChatImageUrl(*m.Imageid, m.Imageuid, string(m.Imagemods), m.Archived)
+		m.Image = &ChatAttachment{
+			ID:           *m.Imageid,
+			Ouruid:       m.Imageuid,
+			Externalmods: m.Imagemods,
+			Path:         path,
+			Paththumb:    paththumb,
 		}
 	}
 
-	return messages
+	if m.Deleted {
+		m.Message = "(Message deleted)"
+	}
+
+	// strip review/processing fields from non-mod responses.
+	if !modAccess {
+		m.Reviewrequired = false
+		m.Reviewrejected = false
+		m.Processingrequired = false
+		m.Processingsuccessful = false
+	}
 }
 
 func GetChatMessages(c *fiber.Ctx) error {
@@ -269,7 +276,7 @@ func GetChatMessages(c *fiber.Ctx) error {
 func GetReviewChatMessages(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ret": 1, "status": "Not logged in"})
+		return apierror.ErrNotLoggedIn
 	}
 
 	roomid, _ := strconv.ParseUint(c.Query("roomid", "0"), 10, 64)
@@ -372,6 +379,9 @@ func CreateChatMessage(c *fiber.Ctx) error {
 		db.Exec("UPDATE chat_images SET chatmsgid = ? WHERE id = ?;", newid, *payload.Imageid)
 	}
 
+	// Tell the sender's other devices.  Everyone else hears about it once processing has finished.
+	publishOwnChatMessage(db, myid, newid)
+
 	ret := struct {
 		Id int64 `json:"id"`
 	}{}
@@ -388,7 +398,17 @@ func CreateChatMessageLoveJunk(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "Invalid parameters")
 	}
 
-	err2, myid := user.GetLoveJunkUser(*payload.Ljuserid, payload.Partnerkey, payload.Firstname, payload.Lastname, payload.PostcodePrefix, payload.Profileurl)
+	k, err := partner.Authenticate(c, payload.Partnerkey, partner.ScopeChatWrite)
+	if err != nil {
+		// LoveJunk has always had a 401 for a key we don't know.
+		if err == partner.ErrInvalidKey {
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid partner key")
+		}
+
+		return err
+	}
+
+	err2, myid := user.GetLoveJunkUser(*payload.Ljuserid, k.Partner, payload.Firstname, payload.Lastname, payload.PostcodePrefix, payload.Profileurl)
 
 	if err2.Code != fiber.StatusOK {
 		return err2
@@ -713,11 +733,11 @@ func getChatMessagesForRoom(c *fiber.Ctx, myid uint64, roomid uint64) error {
 	db.Raw("SELECT id, user1, user2, COALESCE(groupid, 0) AS groupid, chattype FROM chat_rooms WHERE id = ?", roomid).Scan(&room)
 
 	if room.ID == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"ret": 2, "status": "Chat not found"})
+		return apierror.New(fiber.StatusNotFound, apierror.CodeNotFound, "Chat not found")
 	}
 
 	if !canSeeChatRoom(myid, room.User1, room.User2, room.Groupid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": "Permission denied"})
+		return apierror.ErrForbidden
 	}
 
 	limit, _ := strconv.Atoi(c.Query("limit", "100"))
@@ -959,6 +979,8 @@ func getReviewQueue(c *fiber.Ctx, myid uint64) error {
 		}
 	}
 
+	spam := contentscan.SpamKeywords(db)
+
 	// Build response with inline chatroom info.
 	result := make([]fiber.Map, 0, len(msgs))
 	for _, m := range msgs {
@@ -983,7 +1005,7 @@ func getReviewQueue(c *fiber.Ctx, myid uint64) error {
 			"message":         m.Message,
 			"date":            m.Date,
 			"refmsgid":        m.Refmsgid,
-			"reviewreason":    enrichReviewReason(db, m.Message, m.Reportreason),
+			"reviewreason":    enrichReviewReason(db, spam, m.Message, m.Reportreason),
 			"widerchatreview": m.Widerchatreview > 0,
 			"groupid":         m.Groupid,
 			"groupidfrom":     m.Groupidfrom,
@@ -1157,6 +1179,9 @@ func approveChatMessage(c *fiber.Ctx, db *gorm.DB, myid uint64, msgID uint64, ap
 	// Remove hold if it exists
 	db.Exec("DELETE FROM chat_messages_held WHERE msgid = ?", msgID)
 
+	// The message is now visible to the other members of the chat.
+	publishVisibleChatMessage(db, msg.Chatid, msg.Userid, msgID, false)
+
 	// Whitelist the message text so similar messages aren't flagged again
 	//.
 	if msg.Message != "" {
@@ -1251,7 +1276,7 @@ var freegleDomains = []string{"ilovefreegle.org", "trashnothing", "yahoogroups"}
 
 // enrichReviewReason re-checks message content when reportreason is 'Spam' to provide
 // a more specific reason (Money, Email, Link, etc.), matching V1 PHP behaviour.
-func enrichReviewReason(db *gorm.DB, message string, reportreason *string) string {
+func enrichReviewReason(db *gorm.DB, spam *contentscan.SpamMatcher, message string, reportreason *string) string {
 	if reportreason == nil {
 		return ""
 	}
@@ -1268,34 +1293,8 @@ func enrichReviewReason(db *gorm.DB, message string, reportreason *string) strin
 	}
 
 	// Step 1: Check spam_keywords (matches both Spam and Review actions).
-	type spamWord struct {
-		Word    string  `gorm:"column:word"`
-		Type    string  `gorm:"column:type"`
-		Action  string  `gorm:"column:action"`
-		Exclude *string `gorm:"column:exclude"`
-	}
-	var keywords []spamWord
-	db.Raw("SELECT word, type, action, exclude FROM spam_keywords WHERE action IN ('Spam', 'Review') AND LENGTH(TRIM(word)) > 0").Scan(&keywords)
-
-	for _, kw := range keywords {
-		word := strings.TrimSpace(kw.Word)
-		if len(word) == 0 {
-			continue
-		}
-		pattern := `(?i)\b` + regexp.QuoteMeta(word) + `\b`
-		re, err := regexp.Compile(pattern)
-		if err != nil {
-			continue
-		}
-		if re.MatchString(msg) {
-			if kw.Exclude != nil && *kw.Exclude != "" {
-				exRe, exErr := regexp.Compile(`(?i)` + *kw.Exclude)
-				if exErr == nil && exRe.MatchString(msg) {
-					continue
-				}
-			}
-			return "Known spam keyword"
-		}
+	if _, ok := spam.Match(msg); ok {
+		return "Known spam keyword"
 	}
 
 	// Step 2: checkReview-style pattern checks (matching PHP Spam::checkReview order).
@@ -10,8 +10,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/realtime"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/gofiber/fiber/v2"
@@ -186,7 +188,7 @@ func ListForUserMT(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ret": 1, "status": "Not logged in"})
+		return apierror.ErrNotLoggedIn
 	}
 
 	chattypes := parseChattypes(c)
@@ -302,7 +304,7 @@ func GetChatRoom(id uint64, myid uint64) (ChatRoomListEntry, bool) {
 func GetChatRoomsMT(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ret": 1, "status": "Not logged in"})
+		return apierror.ErrNotLoggedIn
 	}
 
 	countMode := c.QueryBool("count", false)
@@ -324,7 +326,7 @@ func GetChatRoomsMT(c *fiber.Ctx) error {
 
 	// Listing is handled by ListForUserMT via /chat/rooms.
 	// Single-chat fetch uses GET /chat/:id.
-	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 3, "status": "Use GET /chat/:id for single chat, or /chat/rooms for listing"})
+	return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Use GET /chat/:id for single chat, or /chat/rooms for listing").WithRet(3)
 }
 
 // =============================================================================
@@ -387,7 +389,7 @@ func PutChatRoom(c *fiber.Ctx) error {
 		// If a moderator provides userid, they want to open the MEMBER's existing
 		// chat (e.g. from ModTools Feedback page). Non-mods always get their own chat.
 		chatUserID := myid
-		if req.Userid > 0 && req.Userid != myid && auth.IsModOfGroup(myid, req.Groupid) {
+		if req.Userid > 0 && req.Userid != myid && auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, req.Groupid) {
 			chatUserID = req.Userid
 		}
 
@@ -1271,6 +1273,10 @@ func handleNudge(c *fiber.Ctx, db *gorm.DB, myid uint64, chatid uint64) error {
 	db.Exec("INSERT INTO users_nudges (fromuser, touser) VALUES (?, ?)",
 		myid, getOtherUser(room, myid))
 
+	// Nudges don't need processing, so everyone can see them straight away.
+	publishOwnChatMessage(db, myid, newId)
+	publishVisibleChatMessage(db, chatid, myid, newId, false)
+
 	return c.JSON(fiber.Map{"ret": 0, "status": "Success", "id": newId})
 }
 
@@ -1296,6 +1302,8 @@ func handleTyping(c *fiber.Ctx, db *gorm.DB, myid uint64, chatid uint64) error {
 	// Record the last typing time in roster.
 	db.Exec("UPDATE chat_roster SET lasttype = NOW() WHERE chatid = ? AND userid = ?", chatid, myid)
 
+	publishChatEvent(db, realtime.EventTyping, chatid, myid, nil)
+
 	return c.JSON(fiber.Map{"ret": 0, "status": "Success", "count": count})
 }
 
@@ -1304,7 +1312,7 @@ func handleRosterUpdate(c *fiber.Ctx, db *gorm.DB, myid uint64, req ChatRoomPost
 	var room ChatRoom
 	db.Raw("SELECT id, chattype, user1, user2 FROM chat_rooms WHERE id = ?", req.ID).Scan(&room)
 	if room.ID == 0 {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": strconv.FormatUint(req.ID, 10) + " Not visible to you"})
+		return apierror.ErrForbidden.WithMessage(strconv.FormatUint(req.ID, 10) + " Not visible to you")
 	}
 
 	// Permission check - prevent client bugs from inserting mods into User2User chats
@@ -1317,7 +1325,7 @@ func handleRosterUpdate(c *fiber.Ctx, db *gorm.DB, myid uint64, req ChatRoomPost
 	}
 
 	if !canUpdate {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": strconv.FormatUint(req.ID, 10) + " Not visible to you"})
+		return apierror.ErrForbidden.WithMessage(strconv.FormatUint(req.ID, 10) + " Not visible to you")
 	}
 
 	// Determine status - default to Online if not specified
@@ -1370,6 +1378,9 @@ func handleRosterUpdate(c *fiber.Ctx, db *gorm.DB, myid uint64, req ChatRoomPost
 				WHERE chatid = ? AND (lastmsgseen IS NULL OR lastmsgseen < chat_messages.id)
 				AND userid != chat_messages.userid
 			)`, req.ID, req.Lastmsgseen, req.ID)
+
+		// Read receipt for the other members.
+		publishChatEvent(db, realtime.EventRead, req.ID, myid, fiber.Map{"lastmsgseen": req.Lastmsgseen})
 	}
 
 	// Get updated roster
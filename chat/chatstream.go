@@ -0,0 +1,315 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/realtime"
+	"github.com/freegle/iznik-server-go/user"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+)
+
+// streamKeepalive is how often we send an SSE comment so that proxies don't time out an idle stream.
+const streamKeepalive = 25 * time.Second
+
+// streamMaxLifetime bounds how long one stream stays open.  Clients reconnect automatically (EventSource does this
+// natively), which means we re-check their JWT and session periodically.
+const streamMaxLifetime = 10 * time.Minute
+
+// processedPollInterval is how often we look for chat messages which have finished background processing.
+const processedPollInterval = 2 * time.Second
+
+// processedGiveUp is how long we wait for a message to be processed before we stop watching for it.
+const processedGiveUp = 10 * time.Minute
+
+// StreamChats handles GET /chat/stream.
+//
+// This is a Server-Sent Events stream of chatmessage, typing, nudge and read events for chats the user is in, so
+// that clients don't need to poll GetChatMessages and ListForUser.  EventSource can't set headers, so clients
+// normally pass the JWT as ?jwt=.
+func StreamChats(c *fiber.Ctx) error {
+	myid := user.WhoAmI(c)
+
+	if myid == 0 {
+		return fiber.NewError(fiber.StatusUnauthorized, "Not logged in")
+	}
+
+	startProcessedWatcher()
+
+	sub := realtime.Default().Subscribe(myid)
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer sub.Close()
+
+		keepalive := time.NewTicker(streamKeepalive)
+		defer keepalive.Stop()
+
+		lifetime := time.NewTimer(streamMaxLifetime)
+		defer lifetime.Stop()
+
+		// Tell the client we're connected, and how long to wait before reconnecting.
+		fmt.Fprintf(w, "retry: 3000\n: connected\n\n")
+
+		if w.Flush() != nil {
+			return
+		}
+
+		for {
+			select {
+			case ev := <-sub.C:
+				data, err := json.Marshal(ev)
+				if err != nil {
+					continue
+				}
+
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			case <-keepalive.C:
+				fmt.Fprintf(w, ": keepalive\n\n")
+			case <-lifetime.C:
+				return
+			}
+
+			// A flush error means the client has gone away.
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}))
+
+	return nil
+}
+
+// chatMemberIDs returns the users who should receive events for a chat: both participants, plus the group's
+// moderators for chats with volunteers.
+func chatMemberIDs(db *gorm.DB, chatid uint64) []uint64 {
+	var room struct {
+		Chattype string
+		User1    uint64
+		User2    uint64
+		Groupid  uint64
+	}
+	db.Raw("SELECT chattype, COALESCE(user1, 0) AS user1, COALESCE(user2, 0) AS user2, COALESCE(groupid, 0) AS groupid FROM chat_rooms WHERE id = ?", chatid).Scan(&room)
+
+	ids := []uint64{}
+
+	if room.User1 > 0 {
+		ids = append(ids, room.User1)
+	}
+
+	if room.User2 > 0 {
+		ids = append(ids, room.User2)
+	}
+
+	if room.Groupid > 0 && room.Chattype != utils.CHAT_TYPE_USER2USER {
+		var mods []uint64
+		db.Raw("SELECT userid FROM memberships WHERE groupid = ? AND role IN (?, ?)",
+			room.Groupid, utils.ROLE_MODERATOR, utils.ROLE_OWNER).Pluck("userid", &mods)
+		ids = append(ids, mods...)
+	}
+
+	return ids
+}
+
+// without returns ids with one user removed, e.g. so that people aren't told that they're typing.
+func without(ids []uint64, userid uint64) []uint64 {
+	ret := make([]uint64, 0, len(ids))
+
+	for _, id := range ids {
+		if id != userid {
+			ret = append(ret, id)
+		}
+	}
+
+	return ret
+}
+
+// fetchChatMessage returns a single chat message in the form clients see it.
+func fetchChatMessage(db *gorm.DB, msgid uint64) *ChatMessageQuery {
+	var msgs []ChatMessageQuery
+	db.Raw("SELECT chat_messages.*, chat_images.archived, chat_images.externaluid AS imageuid, chat_images.externalmods AS imagemods FROM chat_messages "+
+		"LEFT JOIN chat_images ON chat_images.chatmsgid = chat_messages.id "+
+		"WHERE chat_messages.id = ?", msgid).Scan(&msgs)
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	prepareChatMessage(&msgs[0], false)
+	return &msgs[0]
+}
+
+// publishChatMessage pushes a chat message to the given users.  If local is set it only goes to clients connected
+// to this instance.
+func publishChatMessage(db *gorm.DB, to []uint64, msgid uint64, local bool) {
+	if len(to) == 0 {
+		return
+	}
+
+	msg := fetchChatMessage(db, msgid)
+
+	if msg == nil {
+		return
+	}
+
+	ev := realtime.Event{
+		Type:   realtime.EventChatMessage,
+		Chatid: msg.Chatid,
+		Userid: msg.Userid,
+		Data:   msg,
+	}
+
+	if msg.Type == utils.CHAT_MESSAGE_NUDGE {
+		ev.Type = realtime.EventNudge
+	}
+
+	if local {
+		realtime.Default().PublishLocal(to, ev)
+	} else {
+		realtime.Default().Publish(to, ev)
+	}
+}
+
+// publishOwnChatMessage pushes a message to the sender's devices.  New messages are created with processingrequired
+// set, so only the sender can see them until the batch system has checked them for spam.
+func publishOwnChatMessage(db *gorm.DB, myid uint64, msgid uint64) {
+	if !realtime.Default().Listening() {
+		return
+	}
+
+	publishChatMessage(db, []uint64{myid}, msgid, false)
+}
+
+// publishVisibleChatMessage pushes a message that everyone in the chat can now see to everyone except the sender,
+// who was told when they created it.  On any one instance each message is only published once, whether that's by
+// the handler which made it visible or by the processed message watcher.  Clients should still merge chatmessage
+// events by id, as with several instances they may occasionally see one twice.
+func publishVisibleChatMessage(db *gorm.DB, chatid uint64, senderid uint64, msgid uint64, local bool) {
+	if !realtime.Default().Listening() || !claimAnnouncement(msgid) {
+		return
+	}
+
+	publishChatMessage(db, without(chatMemberIDs(db, chatid), senderid), msgid, local)
+}
+
+var announcedMu sync.Mutex
+var announced = map[uint64]bool{}
+
+// claimAnnouncement returns true the first time it is called for a message.
+func claimAnnouncement(msgid uint64) bool {
+	announcedMu.Lock()
+	defer announcedMu.Unlock()
+
+	if announced[msgid] {
+		return false
+	}
+
+	announced[msgid] = true
+	return true
+}
+
+// forgetAnnouncements drops messages at or below the watcher's cursor, which it will never look at again.
+func forgetAnnouncements(cursor uint64) {
+	announcedMu.Lock()
+	defer announcedMu.Unlock()
+
+	for id := range announced {
+		if id <= cursor {
+			delete(announced, id)
+		}
+	}
+}
+
+// publishChatEvent pushes a non-message event (typing, read) to everyone in the chat except the user who caused it.
+func publishChatEvent(db *gorm.DB, evType string, chatid uint64, myid uint64, data interface{}) {
+	if !realtime.Default().Listening() {
+		return
+	}
+
+	realtime.Default().Publish(without(chatMemberIDs(db, chatid), myid), realtime.Event{
+		Type:   evType,
+		Chatid: chatid,
+		Userid: myid,
+		Data:   data,
+	})
+}
+
+var processedWatcherOnce sync.Once
+
+// startProcessedWatcher starts a single background loop which publishes chat messages once background processing
+// has made them visible.  One query per instance replaces a poll from every client.  Every instance with clients
+// runs its own watcher, so it only publishes to local clients.
+func startProcessedWatcher() {
+	processedWatcherOnce.Do(func() {
+		go watchProcessed(database.DBConn)
+	})
+}
+
+type processedRow struct {
+	ID                   uint64
+	Chatid               uint64
+	Userid               uint64
+	Date                 time.Time
+	Processingrequired   bool
+	Processingsuccessful bool
+	Reviewrequired       bool
+	Reviewrejected       bool
+}
+
+func watchProcessed(db *gorm.DB) {
+	var cursor uint64
+	db.Raw("SELECT COALESCE(MAX(id), 0) FROM chat_messages").Scan(&cursor)
+
+	for {
+		time.Sleep(processedPollInterval)
+
+		if realtime.Default().Subscribers() == 0 {
+			// Nobody to tell.  Keep up anyway, so that the first client to connect isn't sent a backlog of old
+			// messages; it fetches those itself when it opens the chat.
+			db.Raw("SELECT COALESCE(MAX(id), ?) FROM chat_messages", cursor).Scan(&cursor)
+			forgetAnnouncements(cursor)
+			continue
+		}
+
+		var rows []processedRow
+		db.Raw("SELECT id, chatid, userid, date, processingrequired, processingsuccessful, reviewrequired, reviewrejected "+
+			"FROM chat_messages WHERE id > ? ORDER BY id ASC LIMIT 500", cursor).Scan(&rows)
+
+		cursor = processRows(rows, cursor, time.Now(), func(r processedRow) {
+			publishVisibleChatMessage(db, r.Chatid, r.Userid, r.ID, true)
+		})
+
+		forgetAnnouncements(cursor)
+	}
+}
+
+// processRows publishes visible messages and returns the advanced cursor.  The cursor only moves past a message
+// once it no longer needs processing (or we've given up on it), so that a slow message can't be skipped.
+func processRows(rows []processedRow, cursor uint64, now time.Time, publish func(processedRow)) uint64 {
+	advancing := true
+
+	for _, r := range rows {
+		if !r.Processingrequired && r.Processingsuccessful && !r.Reviewrequired && !r.Reviewrejected {
+			publish(r)
+		}
+
+		if advancing && (!r.Processingrequired || now.Sub(r.Date) > processedGiveUp) {
+			cursor = r.ID
+		} else {
+			advancing = false
+		}
+	}
+
+	return cursor
+}
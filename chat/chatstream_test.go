@@ -0,0 +1,54 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessRowsWaitsForUnprocessed(t *testing.T) {
+	now := time.Now()
+
+	rows := []processedRow{
+		{ID: 11, Processingsuccessful: true, Date: now},
+		{ID: 12, Processingrequired: true, Date: now},
+		{ID: 13, Processingsuccessful: true, Date: now},
+		{ID: 14, Processingsuccessful: true, Reviewrequired: true, Date: now},
+	}
+
+	var published []uint64
+	cursor := processRows(rows, 10, now, func(r processedRow) {
+		published = append(published, r.ID)
+	})
+
+	// 12 is still being processed so we mustn't move past it, but 13 can be published already.
+	assert.Equal(t, uint64(11), cursor)
+	assert.Equal(t, []uint64{11, 13}, published)
+}
+
+func TestProcessRowsGivesUp(t *testing.T) {
+	now := time.Now()
+
+	rows := []processedRow{
+		{ID: 21, Processingrequired: true, Date: now.Add(-processedGiveUp - time.Minute)},
+		{ID: 22, Processingsuccessful: true, Date: now},
+	}
+
+	cursor := processRows(rows, 20, now, func(r processedRow) {})
+	assert.Equal(t, uint64(22), cursor)
+}
+
+func TestClaimAnnouncement(t *testing.T) {
+	assert.True(t, claimAnnouncement(1001))
+	assert.False(t, claimAnnouncement(1001))
+
+	forgetAnnouncements(1001)
+	assert.True(t, claimAnnouncement(1001))
+	forgetAnnouncements(1001)
+}
+
+func TestWithout(t *testing.T) {
+	assert.Equal(t, []uint64{1, 3}, without([]uint64{1, 2, 3, 2}, 2))
+	assert.Equal(t, []uint64{}, without([]uint64{}, 2))
+}
@@ -7,8 +7,8 @@ import (
 
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
-	"github.com/freegle/iznik-server-go/utils"
 	"github.com/freegle/iznik-server-go/user"
+	"github.com/freegle/iznik-server-go/validate"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -165,7 +165,7 @@ func getSingle(c *fiber.Ctx, myid uint64, id uint64) error {
 }
 
 type CreateRequest struct {
-	Userid  uint64  `json:"userid"`
+	Userid  uint64  `json:"userid" validate:"required"`
 	Groupid *uint64 `json:"groupid"`
 	User1   *string `json:"user1"`
 	User2   *string `json:"user2"`
@@ -182,7 +182,7 @@ type CreateRequest struct {
 }
 
 type PatchRequest struct {
-	ID     uint64  `json:"id"`
+	ID     uint64  `json:"id" validate:"required"`
 	User1  *string `json:"user1"`
 	User2  *string `json:"user2"`
 	User3  *string `json:"user3"`
@@ -198,30 +198,22 @@ type PatchRequest struct {
 }
 
 // canModerate checks if the user is a moderator/owner of the group, or admin/support.
-func canModerate(myid uint64, groupid *uint64) bool {
-	if auth.IsAdminOrSupport(myid) {
-		return true
+func canModerate(p *auth.Policy, groupid *uint64) bool {
+	if groupid == nil {
+		return p.Can(auth.PERM_GROUP_MODERATE)
 	}
 
-	if groupid == nil || *groupid == 0 {
-		return false
-	}
-
-	db := database.DBConn
-	var role string
-	db.Raw("SELECT role FROM memberships WHERE userid = ? AND groupid = ? AND collection = ?", myid, *groupid, utils.COLLECTION_APPROVED).Scan(&role)
-
-	return role == utils.ROLE_MODERATOR || role == utils.ROLE_OWNER
+	return p.CanInGroup(auth.PERM_GROUP_MODERATE, *groupid)
 }
 
 // canModerateComment checks if the user can modify a specific existing comment.
-func canModerateComment(myid uint64, commentID uint64) bool {
+func canModerateComment(p *auth.Policy, commentID uint64) bool {
 	db := database.DBConn
 
 	var groupid *uint64
 	db.Raw("SELECT groupid FROM users_comments WHERE id = ?", commentID).Scan(&groupid)
 
-	return canModerate(myid, groupid)
+	return canModerate(p, groupid)
 }
 
 // flagOthers flags a user for review in all their groups except the given group.
@@ -248,16 +240,12 @@ func Create(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusUnauthorized, "Not logged in")
 	}
 
-	var req CreateRequest
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
-	}
-
-	if req.Userid == 0 {
-		return fiber.NewError(fiber.StatusBadRequest, "userid is required")
+	req, err := validate.Parsed[CreateRequest](c)
+	if err != nil {
+		return err
 	}
 
-	if !canModerate(myid, req.Groupid) {
+	if !canModerate(auth.PolicyFor(c), req.Groupid) {
 		return fiber.NewError(fiber.StatusForbidden, "Not a moderator of this group")
 	}
 
@@ -310,16 +298,12 @@ func Edit(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusUnauthorized, "Not logged in")
 	}
 
-	var req PatchRequest
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
-	}
-
-	if req.ID == 0 {
-		return fiber.NewError(fiber.StatusBadRequest, "id is required")
+	req, err := validate.Parsed[PatchRequest](c)
+	if err != nil {
+		return err
 	}
 
-	if !canModerateComment(myid, req.ID) {
+	if !canModerateComment(auth.PolicyFor(c), req.ID) {
 		return fiber.NewError(fiber.StatusForbidden, "Not a moderator of this group")
 	}
 
@@ -359,7 +343,7 @@ func Delete(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "Invalid comment ID")
 	}
 
-	if !canModerateComment(myid, id) {
+	if !canModerateComment(auth.PolicyFor(c), id) {
 		return fiber.NewError(fiber.StatusForbidden, "Not a moderator of this group")
 	}
 
@@ -2,6 +2,7 @@ package communityevent
 
 import (
 	"errors"
+	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/misc"
 	"github.com/freegle/iznik-server-go/newsfeed"
@@ -208,7 +209,7 @@ func Single(c *fiber.Ctx) error {
 
 			myid := user.WhoAmI(c)
 			if myid > 0 {
-				communityevent.Canmodify = canModify(myid, communityevent.ID)
+				communityevent.Canmodify = canModify(auth.PolicyFor(c), communityevent.ID)
 			}
 
 			return c.JSON(communityevent)
@@ -218,33 +219,25 @@ func Single(c *fiber.Ctx) error {
 	return fiber.NewError(fiber.StatusNotFound, "Not found")
 }
 
-func canModify(myid uint64, eventID uint64) bool {
+func canModify(p *auth.Policy, eventID uint64) bool {
 	db := database.DBConn
 
 	var ownerID uint64
 	db.Raw("SELECT userid FROM communityevents WHERE id = ?", eventID).Scan(&ownerID)
 
-	if ownerID == myid {
+	if ownerID == p.UserID {
 		return true
 	}
 
-	return isModerator(myid, eventID)
+	return isModerator(p, eventID)
 }
 
-func isModerator(myid uint64, eventID uint64) bool {
-	if user.IsAdminOrSupport(myid) {
-		return true
-	}
-
-	// Single query to check if user is moderator/owner of any linked group.
-	db := database.DBConn
-	var count int64
-	db.Raw("SELECT COUNT(*) FROM memberships m "+
-		"INNER JOIN communityevents_groups ceg ON ceg.groupid = m.groupid "+
-		"WHERE ceg.eventid = ? AND m.userid = ? AND m.collection = ? AND m.role IN (?, ?)",
-		eventID, myid, utils.COLLECTION_APPROVED, utils.ROLE_MODERATOR, utils.ROLE_OWNER).Scan(&count)
+// isModerator checks if a user can moderate any group the item is linked to, e.g. to hold/release it.
+func isModerator(p *auth.Policy, eventID uint64) bool {
+	var groupIDs []uint64
+	database.DBConn.Raw("SELECT groupid FROM communityevents_groups WHERE eventid = ?", eventID).Scan(&groupIDs)
 
-	return count > 0
+	return p.CanInSomeGroup(auth.PERM_GROUP_MODERATE, groupIDs)
 }
 
 // isMemberOfGroup checks if a user has an approved membership in the given group.
@@ -373,7 +366,7 @@ func Update(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusNotFound, "Community event not found")
 	}
 
-	if !canModify(myid, req.ID) {
+	if !canModify(auth.PolicyFor(c), req.ID) {
 		return fiber.NewError(fiber.StatusForbidden, "Not authorized to modify this community event")
 	}
 
@@ -424,9 +417,7 @@ func Update(c *fiber.Ctx) error {
 			}
 
 			// 2. Notify group moderators via background task queue.
-			if err := queue.QueueTask(queue.TaskPushNotifyGroupMods, map[string]interface{}{
-				"group_id": req.GroupID,
-			}); err != nil {
+			if err := queue.QueuePushNotifyGroupMods(req.GroupID); err != nil {
 				log.Printf("Failed to queue push notification for group %d: %v", req.GroupID, err)
 			}
 		}
@@ -446,11 +437,11 @@ func Update(c *fiber.Ctx) error {
 			db.Exec("UPDATE communityevents_images SET eventid = ? WHERE id = ?", req.ID, req.PhotoID)
 		}
 	case "Hold":
-		if isModerator(myid, req.ID) {
+		if isModerator(auth.PolicyFor(c), req.ID) {
 			db.Exec("UPDATE communityevents SET heldby = ? WHERE id = ?", myid, req.ID)
 		}
 	case "Release":
-		if isModerator(myid, req.ID) {
+		if isModerator(auth.PolicyFor(c), req.ID) {
 			db.Exec("UPDATE communityevents SET heldby = NULL WHERE id = ?", req.ID)
 		}
 	}
@@ -484,7 +475,7 @@ func Delete(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusNotFound, "Community event not found")
 	}
 
-	if !canModify(myid, id) {
+	if !canModify(auth.PolicyFor(c), id) {
 		return fiber.NewError(fiber.StatusForbidden, "Not authorized to delete this community event")
 	}
 
@@ -3,6 +3,8 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/contentscan"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/freegle/iznik-server-go/utils"
@@ -80,6 +82,10 @@ func RequireSupportOrAdminMiddleware() fiber.Handler {
 			return fiber.NewError(fiber.StatusForbidden, "Support or Admin role required")
 		}
 
+		if err := auth.RequireSecondFactor(userID, sessionID, userInfo.Systemrole); err != nil {
+			return err
+		}
+
 		return c.Next()
 	}
 }
@@ -191,6 +197,8 @@ func CreateSpamKeyword(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create spam keyword")
 	}
 
+	contentscan.Invalidate()
+
 	return c.Status(fiber.StatusOK).JSON(keyword)
 }
 
@@ -211,6 +219,8 @@ func DeleteSpamKeyword(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusNotFound, "Spam keyword not found")
 	}
 
+	contentscan.Invalidate()
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"success": true})
 }
 
@@ -253,6 +263,8 @@ func CreateWorryWord(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create worry word")
 	}
 
+	contentscan.Invalidate()
+
 	return c.Status(fiber.StatusOK).JSON(word)
 }
 
@@ -273,5 +285,7 @@ func DeleteWorryWord(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusNotFound, "Worry word not found")
 	}
 
+	contentscan.Invalidate()
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"success": true})
 }
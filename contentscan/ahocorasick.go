@@ -0,0 +1,126 @@
+package contentscan
+
+// matcher finds every occurrence of a set of patterns in a text in one pass, however many patterns there are
+// (Aho-Corasick).  It works on bytes, so lowercase the patterns and the text the same way first.
+type matcher struct {
+	next []map[byte]int32
+	fail []int32
+
+	// out is the patterns which end at each state, including those reached by following fail links.
+	out [][]int32
+
+	lengths []int
+}
+
+func newMatcher(patterns []string) *matcher {
+	m := &matcher{
+		next:    []map[byte]int32{{}},
+		fail:    []int32{0},
+		out:     [][]int32{nil},
+		lengths: make([]int, len(patterns)),
+	}
+
+	for i, p := range patterns {
+		m.lengths[i] = len(p)
+
+		if p == "" {
+			continue
+		}
+
+		state := int32(0)
+		for j := 0; j < len(p); j++ {
+			s, ok := m.next[state][p[j]]
+			if !ok {
+				s = int32(len(m.next))
+				m.next = append(m.next, map[byte]int32{})
+				m.fail = append(m.fail, 0)
+				m.out = append(m.out, nil)
+				m.next[state][p[j]] = s
+			}
+
+			state = s
+		}
+
+		m.out[state] = append(m.out[state], int32(i))
+	}
+
+	// Breadth first, so that the fail state of each state is done before those below it.
+	queue := make([]int32, 0, len(m.next))
+	for _, s := range m.next[0] {
+		queue = append(queue, s)
+	}
+
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+
+		for b, s := range m.next[state] {
+			queue = append(queue, s)
+
+			f := m.fail[state]
+			for {
+				if t, ok := m.next[f][b]; ok {
+					m.fail[s] = t
+					break
+				}
+
+				if f == 0 {
+					break
+				}
+
+				f = m.fail[f]
+			}
+
+			m.out[s] = append(m.out[s], m.out[m.fail[s]]...)
+		}
+	}
+
+	return m
+}
+
+// each calls fn with each occurrence of a pattern, in the order they end, until fn returns false.
+func (m *matcher) each(text string, fn func(pattern int, start int, end int) bool) {
+	if m == nil || len(m.next) == 1 {
+		return
+	}
+
+	state := int32(0)
+
+	for i := 0; i < len(text); i++ {
+		for {
+			if s, ok := m.next[state][text[i]]; ok {
+				state = s
+				break
+			}
+
+			if state == 0 {
+				break
+			}
+
+			state = m.fail[state]
+		}
+
+		for _, p := range m.out[state] {
+			if !fn(int(p), i+1-m.lengths[p], i+1) {
+				return
+			}
+		}
+	}
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// atBoundary returns whether there's a word boundary before position i, as \b in a regexp.
+func atBoundary(text string, i int) bool {
+	before := i > 0 && isWordByte(text[i-1])
+	after := i < len(text) && isWordByte(text[i])
+
+	return before != after
+}
+
+// wholeWord returns whether text[start:end] is a whole word, as \bword\b in a regexp.
+func wholeWord(text string, start int, end int) bool {
+	return atBoundary(text, start) && atBoundary(text, end)
+}
@@ -0,0 +1,135 @@
+package contentscan
+
+import (
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// The compiled matchers are cached until the words change.  Each time they're asked for we check a fingerprint
+// of the table - one aggregate query over a small table, which is much cheaper than loading and compiling the
+// words.  That picks up changes made through another server, or directly in the database, straight away.  The
+// admin config endpoints also call Invalidate when they change them.
+//
+// Callers should get a matcher once and use it for all the messages they're checking.
+
+// maxWorrySets is how many different sets of extra worry words we keep compiled before starting again.
+const maxWorrySets = 256
+
+type fingerprint struct {
+	Count int64
+	Crc   int64
+}
+
+var spamCache struct {
+	sync.Mutex
+	fingerprint *fingerprint
+	matcher     *SpamMatcher
+}
+
+var worryCache struct {
+	sync.Mutex
+	fingerprint *fingerprint
+	set         *WorryWordSet
+}
+
+// Invalidate makes the next request for each matcher reload its words.
+func Invalidate() {
+	spamCache.Lock()
+	spamCache.fingerprint = nil
+	spamCache.matcher = nil
+	spamCache.Unlock()
+
+	worryCache.Lock()
+	worryCache.fingerprint = nil
+	worryCache.set = nil
+	worryCache.Unlock()
+}
+
+// SpamKeywords returns the matcher for the spam keywords whose action is Spam or Review.
+func SpamKeywords(db *gorm.DB) *SpamMatcher {
+	var fp fingerprint
+	db.Raw("SELECT COUNT(*) AS count, COALESCE(BIT_XOR(CRC32(CONCAT_WS('|', id, word, type, action, COALESCE(exclude, '')))), 0) AS crc " +
+		"FROM spam_keywords").Scan(&fp)
+
+	spamCache.Lock()
+	defer spamCache.Unlock()
+
+	if spamCache.matcher != nil && *spamCache.fingerprint == fp {
+		return spamCache.matcher
+	}
+
+	var keywords []SpamKeyword
+	db.Raw("SELECT word, type, action, exclude FROM spam_keywords WHERE action IN ('Spam', 'Review') AND LENGTH(TRIM(word)) > 0 ORDER BY id").Scan(&keywords)
+
+	spamCache.fingerprint = &fp
+	spamCache.matcher = NewSpamMatcher(keywords)
+
+	return spamCache.matcher
+}
+
+// WorryWordSet is the worry words from the worrywords table, which can be combined with others, e.g. a group's.
+type WorryWordSet struct {
+	words []WorryWord
+
+	mu       sync.Mutex
+	matchers map[string]*WorryMatcher
+}
+
+// WorryWords returns the worry words from the worrywords table.
+func WorryWords(db *gorm.DB) *WorryWordSet {
+	var fp fingerprint
+	db.Raw("SELECT COUNT(*) AS count, COALESCE(BIT_XOR(CRC32(CONCAT_WS('|', id, keyword, type))), 0) AS crc " +
+		"FROM worrywords").Scan(&fp)
+
+	worryCache.Lock()
+	defer worryCache.Unlock()
+
+	if worryCache.set != nil && *worryCache.fingerprint == fp {
+		return worryCache.set
+	}
+
+	var words []WorryWord
+	db.Raw("SELECT id, keyword, type FROM worrywords ORDER BY id").Scan(&words)
+
+	worryCache.fingerprint = &fp
+	worryCache.set = &WorryWordSet{
+		words:    words,
+		matchers: map[string]*WorryMatcher{},
+	}
+
+	return worryCache.set
+}
+
+// Matcher returns a matcher for these worry words followed by some extra ones.  Each different set of extra words
+// is compiled once.
+func (s *WorryWordSet) Matcher(extra []WorryWord) *WorryMatcher {
+	var key strings.Builder
+	for _, w := range extra {
+		key.WriteString(w.Type)
+		key.WriteByte(0)
+		key.WriteString(w.Keyword)
+		key.WriteByte(0)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.matchers[key.String()]; ok {
+		return m
+	}
+
+	if len(s.matchers) >= maxWorrySets {
+		s.matchers = map[string]*WorryMatcher{}
+	}
+
+	words := make([]WorryWord, 0, len(s.words)+len(extra))
+	words = append(words, s.words...)
+	words = append(words, extra...)
+
+	m := NewWorryMatcher(words)
+	s.matchers[key.String()] = m
+
+	return m
+}
@@ -0,0 +1,236 @@
+// Package contentscan checks text for spam keywords and worry words.
+//
+// Both lists are managed by support in the admin config, and each can have hundreds of entries, so rather than
+// checking each one in turn we compile them into matchers which find them all in one pass over the text.  The
+// compiled matchers are cached; see SpamKeywords and WorryWords.
+package contentscan
+
+import (
+	"regexp"
+	"strings"
+)
+
+// POUND_SIGN is always a worry, as it suggests someone is selling.
+const POUND_SIGN = "£"
+
+const (
+	WORRY_TYPE_ALLOWED = "Allowed"
+	WORRY_TYPE_REVIEW  = "Review"
+)
+
+// WorryWord represents a row from the worrywords table.
+type WorryWord struct {
+	ID      uint64 `json:"id"`
+	Keyword string `json:"keyword"`
+	Type    string `json:"type"`
+}
+
+// WorryMatch represents a worry word found in a message's subject or body.
+type WorryMatch struct {
+	Word      string    `json:"word"`
+	Worryword WorryWord `json:"worryword"`
+}
+
+// SpamKeyword represents a row from the spam_keywords table.
+type SpamKeyword struct {
+	Word    string  `gorm:"column:word"`
+	Type    string  `gorm:"column:type"`
+	Action  string  `gorm:"column:action"`
+	Exclude *string `gorm:"column:exclude"`
+}
+
+// SpamMatcher finds spam keywords in text.
+type SpamMatcher struct {
+	matcher  *matcher
+	keywords []SpamKeyword
+
+	// excludes holds, for each keyword, the pattern which means it's not spam after all, if it has one.
+	excludes []*regexp.Regexp
+}
+
+// NewSpamMatcher compiles spam keywords.  An exclude pattern which doesn't compile is ignored.
+func NewSpamMatcher(keywords []SpamKeyword) *SpamMatcher {
+	s := &SpamMatcher{}
+
+	var patterns []string
+	for _, kw := range keywords {
+		word := strings.TrimSpace(kw.Word)
+		if word == "" {
+			continue
+		}
+
+		var exclude *regexp.Regexp
+		if kw.Exclude != nil && *kw.Exclude != "" {
+			exclude, _ = regexp.Compile(`(?i)` + *kw.Exclude)
+		}
+
+		patterns = append(patterns, strings.ToLower(word))
+		s.keywords = append(s.keywords, kw)
+		s.excludes = append(s.excludes, exclude)
+	}
+
+	s.matcher = newMatcher(patterns)
+
+	return s
+}
+
+// Match returns the first keyword found in the text as a whole word, ignoring case, unless the text also matches
+// the keyword's exclude pattern.
+func (s *SpamMatcher) Match(text string) (SpamKeyword, bool) {
+	lower := strings.ToLower(text)
+
+	var found SpamKeyword
+	ok := false
+
+	s.matcher.each(lower, func(p int, start int, end int) bool {
+		if !wholeWord(lower, start, end) {
+			return true
+		}
+
+		if s.excludes[p] != nil && s.excludes[p].MatchString(text) {
+			return true
+		}
+
+		found = s.keywords[p]
+		ok = true
+		return false
+	})
+
+	return found, ok
+}
+
+// WorryMatcher finds worry words in messages.
+//
+// Allowed words are removed first, so that an innocent word doesn't match a worry word inside it.  Phrases (worry
+// words with a space) match anywhere; other worry words must be a whole word, split on anything which isn't a letter
+// or digit.
+type WorryMatcher struct {
+	words []WorryWord
+
+	allowed *matcher
+	phrases *matcher
+
+	// phraseWords and tokens map phrases and single words to the worry words they came from, in list order.
+	phraseWords []int
+	tokens      map[string][]int
+}
+
+// NewWorryMatcher compiles worry words.  Where the same word is in the list more than once, the first wins.
+func NewWorryMatcher(words []WorryWord) *WorryMatcher {
+	w := &WorryMatcher{
+		words:  words,
+		tokens: map[string][]int{},
+	}
+
+	var allowed, phrases []string
+
+	for i, word := range words {
+		kw := strings.ToLower(strings.TrimSpace(word.Keyword))
+
+		switch {
+		case kw == "":
+		case word.Type == WORRY_TYPE_ALLOWED:
+			allowed = append(allowed, kw)
+		case strings.Contains(kw, " "):
+			phrases = append(phrases, kw)
+			w.phraseWords = append(w.phraseWords, i)
+		default:
+			w.tokens[kw] = append(w.tokens[kw], i)
+		}
+	}
+
+	w.allowed = newMatcher(allowed)
+	w.phrases = newMatcher(phrases)
+
+	return w
+}
+
+// Match returns the worry words in a subject and body, subject first.
+func (w *WorryMatcher) Match(subject string, textbody string) []WorryMatch {
+	var matches []WorryMatch
+	found := map[string]bool{}
+
+	add := func(word WorryWord) {
+		kw := strings.ToLower(word.Keyword)
+		if found[kw] {
+			return
+		}
+
+		found[kw] = true
+		matches = append(matches, WorryMatch{
+			Word:      word.Keyword,
+			Worryword: WorryWord{Keyword: word.Keyword, Type: word.Type},
+		})
+	}
+
+	scans := []string{strings.ToLower(subject), strings.ToLower(textbody)}
+
+	for i, scan := range scans {
+		if strings.Contains(scan, POUND_SIGN) {
+			add(WorryWord{Keyword: POUND_SIGN, Type: WORRY_TYPE_REVIEW})
+		}
+
+		// Phrases are checked in both at once, in list order.
+		if i == 0 && len(w.phraseWords) > 0 {
+			hit := make([]bool, len(w.phraseWords))
+			for _, s := range scans {
+				w.phrases.each(s, func(p int, start int, end int) bool {
+					hit[p] = true
+					return true
+				})
+			}
+
+			for p, h := range hit {
+				if h {
+					add(w.words[w.phraseWords[p]])
+				}
+			}
+		}
+
+		if len(w.tokens) == 0 {
+			continue
+		}
+
+		var allowed [][2]int
+		w.allowed.each(scan, func(p int, start int, end int) bool {
+			if wholeWord(scan, start, end) {
+				allowed = append(allowed, [2]int{start, end})
+			}
+			return true
+		})
+
+		eachToken(scan, func(start int, end int) {
+			for _, a := range allowed {
+				if start < a[1] && end > a[0] {
+					return
+				}
+			}
+
+			for _, j := range w.tokens[scan[start:end]] {
+				add(w.words[j])
+			}
+		})
+	}
+
+	return matches
+}
+
+func isAlnumByte(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// eachToken calls fn with the position of each run of letters and digits in text.
+func eachToken(text string, fn func(start int, end int)) {
+	start := -1
+
+	for i := 0; i <= len(text); i++ {
+		if i < len(text) && isAlnumByte(text[i]) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			fn(start, i)
+			start = -1
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package contentscan
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatcher(t *testing.T) {
+	m := newMatcher([]string{"he", "she", "his", "hers", ""})
+
+	type hit struct{ p, start, end int }
+	var hits []hit
+	m.each("ushers", func(p int, start int, end int) bool {
+		hits = append(hits, hit{p, start, end})
+		return true
+	})
+
+	assert.ElementsMatch(t, []hit{{1, 1, 4}, {0, 2, 4}, {3, 2, 6}}, hits)
+
+	// Stops when asked.
+	count := 0
+	m.each("ushers", func(p int, start int, end int) bool {
+		count++
+		return false
+	})
+	assert.Equal(t, 1, count)
+
+	newMatcher(nil).each("anything", func(p int, start int, end int) bool {
+		t.Error("Empty matcher shouldn't match")
+		return true
+	})
+}
+
+func TestWholeWord(t *testing.T) {
+	assert.True(t, wholeWord("buy viagra now", 4, 10))
+	assert.False(t, wholeWord("buy viagras now", 4, 10))
+	assert.True(t, wholeWord("viagra", 0, 6))
+	assert.False(t, wholeWord("under_score", 0, 5))
+}
+
+func str(s string) *string {
+	return &s
+}
+
+func TestSpamMatcher(t *testing.T) {
+	keywords := []SpamKeyword{
+		{Word: "Western Union", Action: "Spam"},
+		{Word: "loan", Action: "Review", Exclude: str("loan of|on loan")},
+		{Word: "  ", Action: "Spam"},
+		{Word: "bad", Action: "Spam", Exclude: str("(unclosed")},
+		{Word: "c++", Action: "Spam"},
+	}
+
+	s := NewSpamMatcher(keywords)
+
+	// The same as matching each keyword with a regexp, as we used to.
+	old := func(text string) bool {
+		for _, kw := range keywords {
+			if len(kw.Word) == 0 || kw.Word == "  " {
+				continue
+			}
+
+			if regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(kw.Word) + `\b`).MatchString(text) {
+				if kw.Exclude != nil {
+					if ex, err := regexp.Compile(`(?i)` + *kw.Exclude); err == nil && ex.MatchString(text) {
+						continue
+					}
+				}
+
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, text := range []string{
+		"Send it by western union please",
+		"westernunion",
+		"I need a LOAN",
+		"Can I have the loan of your ladder",
+		"loans",
+		"not bad at all",
+		"I know c++ well",
+		"",
+	} {
+		_, ok := s.Match(text)
+		assert.Equal(t, old(text), ok, text)
+	}
+
+	kw, ok := s.Match("I need a LOAN")
+	assert.True(t, ok)
+	assert.Equal(t, "loan", kw.Word)
+}
+
+func TestWorryMatcher(t *testing.T) {
+	w := NewWorryMatcher([]WorryWord{
+		{Keyword: "cocaine", Type: "Regulated"},
+		{Keyword: "Paracetamol", Type: "Medicine"},
+		{Keyword: "air rifle", Type: "Reportable"},
+		{Keyword: "knife block", Type: WORRY_TYPE_ALLOWED},
+		{Keyword: "knife", Type: "Review"},
+		{Keyword: "COCAINE", Type: "Review"},
+		{Keyword: "", Type: "Review"},
+	})
+
+	matches := w.Match("OFFER: Paracetamol and an AIR RIFLE", "It costs £5, not cocaine")
+	assert.Equal(t, []WorryMatch{
+		{Word: "air rifle", Worryword: WorryWord{Keyword: "air rifle", Type: "Reportable"}},
+		{Word: "Paracetamol", Worryword: WorryWord{Keyword: "Paracetamol", Type: "Medicine"}},
+		{Word: POUND_SIGN, Worryword: WorryWord{Keyword: POUND_SIGN, Type: WORRY_TYPE_REVIEW}},
+		{Word: "cocaine", Worryword: WorryWord{Keyword: "cocaine", Type: "Regulated"}},
+	}, matches)
+
+	// Allowed words are removed before looking for single words.
+	assert.Empty(t, w.Match("OFFER: knife block", ""))
+	assert.Len(t, w.Match("OFFER: knife block and a knife", ""), 1)
+
+	// Single words must be whole.
+	assert.Empty(t, w.Match("OFFER: penknife", "cocaines"))
+
+	assert.Empty(t, NewWorryMatcher(nil).Match("OFFER: chair", "Nice chair"))
+}
+
+func TestWorryWordSet(t *testing.T) {
+	s := &WorryWordSet{
+		words:    []WorryWord{{Keyword: "cocaine", Type: "Regulated"}},
+		matchers: map[string]*WorryMatcher{},
+	}
+
+	group := []WorryWord{{Keyword: "sofa", Type: WORRY_TYPE_REVIEW}}
+
+	assert.Same(t, s.Matcher(group), s.Matcher(group))
+	assert.NotSame(t, s.Matcher(group), s.Matcher(nil))
+
+	assert.Len(t, s.Matcher(group).Match("OFFER: sofa", "cocaine"), 2)
+	assert.Len(t, s.Matcher(nil).Match("OFFER: sofa", "cocaine"), 1)
+}
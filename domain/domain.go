@@ -1,6 +1,7 @@
 package domain
 
 import (
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/gofiber/fiber/v2"
 )
@@ -17,7 +18,7 @@ func GetDomain(c *fiber.Ctx) error {
 	domainName := c.Query("domain", "")
 
 	if domainName == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 2, "status": "Missing domain"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Missing domain")
 	}
 
 	db := database.DBConn
@@ -13,6 +13,7 @@ import (
 	"github.com/freegle/iznik-server-go/queue"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 const TYPE_PAYPAL = "PayPal"
@@ -207,47 +208,57 @@ func AddDonation(c *fiber.Ctx) error {
 	transactionID := fmt.Sprintf("External for #%d added at %s%s",
 		req.UserID, time.Now().UTC().Format("2006-01-02 15:04:05"), SOURCE_BANK_TRANSFER)
 
-	// Insert donation with ON DUPLICATE KEY UPDATE (TransactionID is unique).
-	result := db.Exec(`INSERT INTO users_donations
+	// The donation, the Gift Aid prompt and the email go together: if one fails, none of them happen.
+	var donationID uint64
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Insert donation with ON DUPLICATE KEY UPDATE (TransactionID is unique).
+		result := tx.Exec(`INSERT INTO users_donations
 		(userid, Payer, PayerDisplayName, timestamp, TransactionID, GrossAmount, type, source)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 		ON DUPLICATE KEY UPDATE userid = VALUES(userid), timestamp = VALUES(timestamp)`,
-		req.UserID, preferredEmail, name, req.Date, transactionID, req.Amount, TYPE_EXTERNAL, SOURCE_BANK_TRANSFER)
+			req.UserID, preferredEmail, name, req.Date, transactionID, req.Amount, TYPE_EXTERNAL, SOURCE_BANK_TRANSFER)
 
-	if result.Error != nil {
-		log.Printf("Failed to add donation for user %d: %v", req.UserID, result.Error)
-		return fiber.NewError(fiber.StatusInternalServerError, "Add failed")
-	}
+		if result.Error != nil {
+			return result.Error
+		}
 
-	// Get the inserted ID.
-	var donationID uint64
-	db.Raw("SELECT id FROM users_donations WHERE TransactionID = ?", transactionID).Scan(&donationID)
+		// Get the inserted ID.
+		tx.Raw("SELECT id FROM users_donations WHERE TransactionID = ?", transactionID).Scan(&donationID)
 
-	if donationID == 0 {
-		return fiber.NewError(fiber.StatusInternalServerError, "Add failed")
-	}
-
-	// For non-zero amounts: create Gift Aid notification and queue email.
-	if req.Amount > 0 {
-		// Check if user needs a Gift Aid prompt.
-		var giftAidPeriod *string
-		db.Raw("SELECT period FROM giftaid WHERE userid = ? AND deleted IS NULL LIMIT 1", req.UserID).Scan(&giftAidPeriod)
-
-		if giftAidPeriod == nil || *giftAidPeriod == PERIOD_THIS {
-			// Create a GiftAid notification for the user.
-			db.Exec("INSERT INTO users_notifications (touser, type, timestamp, seen) VALUES (?, 'GiftAid', NOW(), 0)",
-				req.UserID)
+		if donationID == 0 {
+			return fmt.Errorf("donation %s not found after insert", transactionID)
 		}
 
-		// Queue email to info@ilovefreegle.org.
-		if err := queue.QueueTask(queue.TaskEmailDonateExternal, map[string]interface{}{
-			"user_id":    req.UserID,
-			"user_name":  name,
-			"user_email": preferredEmail,
-			"amount":     req.Amount,
-		}); err != nil {
-			log.Printf("Failed to queue donate-external email for user %d: %v", req.UserID, err)
+		// For non-zero amounts: create Gift Aid notification and queue email.
+		if req.Amount > 0 {
+			// Check if user needs a Gift Aid prompt.
+			var giftAidPeriod *string
+			tx.Raw("SELECT period FROM giftaid WHERE userid = ? AND deleted IS NULL LIMIT 1", req.UserID).Scan(&giftAidPeriod)
+
+			if giftAidPeriod == nil || *giftAidPeriod == PERIOD_THIS {
+				// Create a GiftAid notification for the user.
+				if err := tx.Exec("INSERT INTO users_notifications (touser, type, timestamp, seen) VALUES (?, 'GiftAid', NOW(), 0)",
+					req.UserID).Error; err != nil {
+					return err
+				}
+			}
+
+			// Queue email to info@ilovefreegle.org.
+			return queue.QueueTaskTx(tx, queue.TaskEmailDonateExternal, map[string]interface{}{
+				"user_id":    req.UserID,
+				"user_name":  name,
+				"user_email": preferredEmail,
+				"amount":     req.Amount,
+			})
 		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("Failed to add donation for user %d: %v", req.UserID, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Add failed")
 	}
 
 	return c.JSON(fiber.Map{
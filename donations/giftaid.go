@@ -4,6 +4,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/user"
@@ -54,9 +55,7 @@ func GetGiftAid(c *fiber.Ctx) error {
 	// Get user ID from JWT
 	userID, _, _ := user.GetJWTFromRequest(c)
 	if userID == 0 {
-		return c.Status(401).JSON(fiber.Map{
-			"error": "Not logged in",
-		})
+		return apierror.ErrNotLoggedIn
 	}
 
 	// Query for user's gift aid record (exclude deleted records)
@@ -70,16 +69,12 @@ func GetGiftAid(c *fiber.Ctx) error {
 	`, userID).Scan(&giftaid)
 
 	if result.Error != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Failed to fetch Gift Aid declaration",
-		})
+		return apierror.ErrInternal.WithMessage("Failed to fetch Gift Aid declaration").WithCause(result.Error)
 	}
 
 	// If no record found (ID will be 0), return 404
 	if giftaid.ID == 0 {
-		return c.Status(404).JSON(fiber.Map{
-			"error": "No Gift Aid declaration found",
-		})
+		return apierror.ErrNotFound.WithMessage("No Gift Aid declaration found")
 	}
 
 	// Return the gift aid data at top level (v2 format)
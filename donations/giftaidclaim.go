@@ -0,0 +1,705 @@
+package donations
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/user"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// A Gift Aid claim is the donations we can claim Gift Aid on which haven't been claimed yet, with the declarations
+// which cover them, in the forms HMRC's Charities Online service takes: the schedule spreadsheet (as CSV) and the
+// body of the GovTalk XML submission.  Creating a claim marks the donations as claimed, so they can't be claimed
+// twice; the claim keeps a copy of what was in it, so it can be downloaded again later.
+//
+// A donation can be claimed if:
+//   - the donor has a declaration which has been reviewed, hasn't been deleted and isn't Declined
+//   - the declaration's period covers the donation (see covers)
+//   - it's within the last four years, which is as far back as HMRC allow
+//   - it isn't through PayPal Giving Fund, eBay or Facebook, who claim Gift Aid themselves
+//   - some of the money is still ours after refunds and disputes; we claim on what's left.
+//
+// Declarations without a valid postcode and house name or number are reported as problems, and their donations are
+// left for a later claim once the declaration has been fixed.
+//
+// Refunds and disputes on donations we've already claimed on are adjustments: we owe HMRC back the Gift Aid on them.
+//
+// We don't use users_donations.giftaidconsent, which the old claim process did; the declarations and adjustments
+// say everything it did.
+//
+// The table and column are created by an iznik-batch migration:
+//
+//	giftaid_claims (id, created, createdby, donations, amount, giftaid, adjustment, schedule JSON)
+//	users_donations.giftaidclaimid NULL
+
+// GIFTAID_RATE is the Gift Aid HMRC add to each pound donated, at the basic rate of tax.
+const GIFTAID_RATE = 0.25
+
+// giftAidClaimYears is how far back HMRC let us claim.
+const giftAidClaimYears = 4
+
+// giftAidClaimedSources are where someone else has already claimed Gift Aid.
+var giftAidClaimedSources = []string{"PayPalGivingFund", "eBay", "Facebook"}
+
+var postcodeRegex = regexp.MustCompile(`^([A-Z]{1,2}[0-9][A-Z0-9]?) ?([0-9][A-Z]{2})$`)
+
+// GiftAidClaimDonation is a donation in a claim.
+type GiftAidClaimDonation struct {
+	Donationid uint64    `json:"donationid"`
+	Userid     uint64    `json:"userid"`
+	Giftaidid  uint64    `json:"giftaidid"`
+	Firstname  string    `json:"firstname"`
+	Lastname   string    `json:"lastname"`
+	House      string    `json:"house"`
+	Postcode   string    `json:"postcode"`
+	Date       time.Time `json:"date"`
+	Amount     float64   `json:"amount"`
+}
+
+// GiftAidClaimAdjustment is a refund or dispute on a donation we'd already claimed on.
+type GiftAidClaimAdjustment struct {
+	Donationid uint64    `json:"donationid"`
+	Adjusts    uint64    `json:"adjusts"`
+	Adjustment string    `json:"adjustment"`
+	Date       time.Time `json:"date"`
+	Amount     float64   `json:"amount"`
+}
+
+// GiftAidClaimProblem is a declaration whose donations can't be claimed until it's fixed.
+type GiftAidClaimProblem struct {
+	Giftaidid uint64  `json:"giftaidid"`
+	Userid    uint64  `json:"userid"`
+	Problem   string  `json:"problem"`
+	Donations int     `json:"donations"`
+	Amount    float64 `json:"amount"`
+}
+
+// GiftAidClaim is a claim, or what would be in one.
+type GiftAidClaim struct {
+	ID          uint64                   `json:"id"`
+	Created     time.Time                `json:"created"`
+	Createdby   uint64                   `json:"createdby"`
+	Donations   []GiftAidClaimDonation   `json:"donations"`
+	Adjustments []GiftAidClaimAdjustment `json:"adjustments"`
+	Problems    []GiftAidClaimProblem    `json:"problems"`
+	Amount      float64                  `json:"amount"`
+	Giftaid     float64                  `json:"giftaid"`
+	Adjustment  float64                  `json:"adjustment"`
+	Earliest    *time.Time               `json:"earliest"`
+}
+
+// GiftAidClaimSummary is a claim without its schedule, for listing.
+type GiftAidClaimSummary struct {
+	ID         uint64    `json:"id"`
+	Created    time.Time `json:"created"`
+	Createdby  uint64    `json:"createdby"`
+	Donations  int       `json:"donations"`
+	Amount     float64   `json:"amount"`
+	Giftaid    float64   `json:"giftaid"`
+	Adjustment float64   `json:"adjustment"`
+}
+
+var errNothingToClaim = errors.New("nothing to claim")
+
+func pence(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+func pounds(p int64) float64 {
+	return float64(p) / 100.0
+}
+
+// covers returns whether a declaration's period covers a donation.  thisDonation is the donor's last donation
+// before they made the declaration, which is the one a "This" declaration is for.
+func covers(period string, declared time.Time, donationID uint64, donated time.Time, thisDonation uint64) bool {
+	switch period {
+	case "Past4YearsAndFuture":
+		return !donated.Before(declared.AddDate(-giftAidClaimYears, 0, 0))
+	case "Since":
+		// Since the day they declared, so including the donation which prompted it.
+		y, m, d := declared.Date()
+		return !donated.Before(time.Date(y, m, d, 0, 0, 0, 0, declared.Location()))
+	case "Future":
+		return !donated.Before(declared)
+	case PERIOD_THIS:
+		return donationID == thisDonation
+	}
+
+	return false
+}
+
+// normalisePostcode returns a UK postcode in the form HMRC want, or "" if it isn't one.
+func normalisePostcode(postcode string) string {
+	p := strings.ToUpper(strings.Join(strings.Fields(postcode), ""))
+
+	if m := postcodeRegex.FindStringSubmatch(p); m != nil {
+		return m[1] + " " + m[2]
+	}
+
+	return ""
+}
+
+// splitName returns the first and last names of a donor who only gave us their full name.
+func splitName(fullname string) (string, string) {
+	words := strings.Fields(fullname)
+	if len(words) < 2 {
+		return "", ""
+	}
+
+	return strings.Join(words[:len(words)-1], " "), words[len(words)-1]
+}
+
+// truncate shortens a string to HMRC's limit for a field.
+func truncate(s string, max int) string {
+	r := []rune(strings.TrimSpace(s))
+	if len(r) > max {
+		r = r[:max]
+	}
+
+	return string(r)
+}
+
+type claimDeclaration struct {
+	Giftaidid         uint64
+	Period            string
+	Declared          time.Time
+	Fullname          string
+	Firstname         *string
+	Lastname          *string
+	Postcode          *string
+	Housenameornumber *string
+}
+
+// donor returns the details HMRC need about a donor, or why we don't have them.
+func (d claimDeclaration) donor() (first string, last string, house string, postcode string, problem string) {
+	if d.Firstname != nil && d.Lastname != nil && strings.TrimSpace(*d.Firstname) != "" && strings.TrimSpace(*d.Lastname) != "" {
+		first, last = *d.Firstname, *d.Lastname
+	} else {
+		first, last = splitName(d.Fullname)
+	}
+
+	if first == "" {
+		return "", "", "", "", "First and last name needed"
+	}
+
+	if d.Housenameornumber == nil || strings.TrimSpace(*d.Housenameornumber) == "" {
+		return "", "", "", "", "House name or number needed"
+	}
+
+	if d.Postcode == nil {
+		return "", "", "", "", "Postcode needed"
+	}
+
+	postcode = normalisePostcode(*d.Postcode)
+	if postcode == "" {
+		return "", "", "", "", "Invalid postcode"
+	}
+
+	return truncate(first, 35), truncate(last, 35), truncate(*d.Housenameornumber, 40), postcode, ""
+}
+
+// buildGiftAidClaim works out what's to be claimed.  When creating a claim, lock the donations so that they can't
+// be claimed by another at the same time.
+func buildGiftAidClaim(tx *gorm.DB, lock bool) (GiftAidClaim, error) {
+	type candidate struct {
+		claimDeclaration
+		Donationid   uint64
+		Userid       uint64
+		Timestamp    time.Time
+		Amount       float64
+		Thisdonation uint64
+	}
+
+	query := `SELECT d.id AS donationid, d.userid, d.timestamp,
+		       d.GrossAmount + COALESCE((SELECT SUM(a.GrossAmount) FROM users_donations a WHERE a.adjusts = d.id), 0) AS amount,
+		       g.id AS giftaidid, g.period, g.timestamp AS declared, g.fullname, g.firstname, g.lastname, g.postcode, g.housenameornumber,
+		       COALESCE((SELECT t.id FROM users_donations t WHERE t.userid = d.userid AND t.adjusts IS NULL AND t.timestamp <= g.timestamp
+		                 ORDER BY t.timestamp DESC LIMIT 1), 0) AS thisdonation
+		FROM users_donations d
+		INNER JOIN giftaid g ON g.userid = d.userid
+		WHERE d.giftaidclaimed IS NULL AND d.adjusts IS NULL AND d.GrossAmount > 0
+		  AND d.timestamp >= DATE_SUB(NOW(), INTERVAL ? YEAR)
+		  AND (d.source IS NULL OR d.source NOT IN ?)
+		  AND g.reviewed IS NOT NULL AND g.deleted IS NULL AND g.period != 'Declined'`
+	args := []interface{}{giftAidClaimYears, giftAidClaimedSources}
+
+	for _, payer := range getExcludedPayers() {
+		query += " AND d.Payer != ?"
+		args = append(args, payer)
+	}
+
+	query += " ORDER BY d.timestamp, d.id"
+
+	if lock {
+		query += " FOR UPDATE"
+	}
+
+	var candidates []candidate
+	if err := tx.Raw(query, args...).Scan(&candidates).Error; err != nil {
+		return GiftAidClaim{}, err
+	}
+
+	claim := GiftAidClaim{
+		Donations:   []GiftAidClaimDonation{},
+		Adjustments: []GiftAidClaimAdjustment{},
+		Problems:    []GiftAidClaimProblem{},
+	}
+
+	var total int64
+	problems := map[uint64]int{}
+
+	for _, c := range candidates {
+		amount := pence(c.Amount)
+
+		if amount <= 0 || !covers(c.Period, c.Declared, c.Donationid, c.Timestamp, c.Thisdonation) {
+			continue
+		}
+
+		first, last, house, postcode, problem := c.donor()
+
+		if problem != "" {
+			i, ok := problems[c.Giftaidid]
+			if !ok {
+				i = len(claim.Problems)
+				problems[c.Giftaidid] = i
+				claim.Problems = append(claim.Problems, GiftAidClaimProblem{Giftaidid: c.Giftaidid, Userid: c.Userid, Problem: problem})
+			}
+
+			claim.Problems[i].Donations++
+			claim.Problems[i].Amount = pounds(pence(claim.Problems[i].Amount) + amount)
+			continue
+		}
+
+		claim.Donations = append(claim.Donations, GiftAidClaimDonation{
+			Donationid: c.Donationid,
+			Userid:     c.Userid,
+			Giftaidid:  c.Giftaidid,
+			Firstname:  first,
+			Lastname:   last,
+			House:      house,
+			Postcode:   postcode,
+			Date:       c.Timestamp,
+			Amount:     pounds(amount),
+		})
+
+		total += amount
+
+		if claim.Earliest == nil {
+			earliest := c.Timestamp
+			claim.Earliest = &earliest
+		}
+	}
+
+	// Refunds and disputes since we claimed.  A dispute we later won cancels out.
+	query = `SELECT a.id AS donationid, a.adjusts, a.adjustment, a.timestamp AS date, a.GrossAmount AS amount
+		FROM users_donations a
+		INNER JOIN users_donations d ON d.id = a.adjusts
+		WHERE a.giftaidclaimed IS NULL AND d.giftaidclaimed IS NOT NULL
+		ORDER BY a.id`
+
+	if lock {
+		query += " FOR UPDATE"
+	}
+
+	if err := tx.Raw(query).Scan(&claim.Adjustments).Error; err != nil {
+		return GiftAidClaim{}, err
+	}
+
+	var adjusted int64
+	for _, a := range claim.Adjustments {
+		adjusted -= pence(a.Amount)
+	}
+
+	claim.Amount = pounds(total)
+	claim.Giftaid = pounds(int64(math.Round(float64(total) * GIFTAID_RATE)))
+
+	// HMRC only take adjustments which reduce a claim.
+	if adjusted > 0 {
+		claim.Adjustment = pounds(int64(math.Round(float64(adjusted) * GIFTAID_RATE)))
+	}
+
+	return claim, nil
+}
+
+// canClaimGiftAid checks the user is logged in and can see Gift Aid declarations.
+func canClaimGiftAid(c *fiber.Ctx) (uint64, error) {
+	myid := user.WhoAmI(c)
+	if myid == 0 {
+		return 0, fiber.NewError(fiber.StatusUnauthorized, "Not logged in")
+	}
+
+	if !isGiftAidAdmin(myid) {
+		return 0, fiber.NewError(fiber.StatusForbidden, "Not authorized")
+	}
+
+	return myid, nil
+}
+
+// GetGiftAidClaim shows what the next Gift Aid claim would contain, or with an id, a claim which has been made.
+// @Summary Preview or download a Gift Aid claim (admin)
+// @Description Without an id, returns the donations which would be in the next claim, the declarations which need fixing before theirs can be, and adjustments for refunds since earlier claims. With an id, returns that claim. format=csv gives the HMRC schedule spreadsheet, format=xml the GovTalk claim body.
+// @Tags donations
+// @Produce json
+// @Param id path integer false "Claim ID"
+// @Param format query string false "json (default), csv or xml"
+// @Success 200 {object} GiftAidClaim
+// @Failure 401 {object} map[string]string "Not logged in"
+// @Failure 403 {object} map[string]string "Not authorized"
+// @Failure 404 {object} map[string]string "Claim not found"
+// @Router /giftaid/claim [get]
+func GetGiftAidClaim(c *fiber.Ctx) error {
+	if _, err := canClaimGiftAid(c); err != nil {
+		return err
+	}
+
+	db := database.DBConn
+
+	if c.Params("id") == "" {
+		claim, err := buildGiftAidClaim(db, false)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to build claim")
+		}
+
+		claim.Created = time.Now()
+		return sendGiftAidClaim(c, claim)
+	}
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid claim id")
+	}
+
+	var schedule string
+	db.Raw("SELECT schedule FROM giftaid_claims WHERE id = ?", id).Scan(&schedule)
+	if schedule == "" {
+		return fiber.NewError(fiber.StatusNotFound, "Claim not found")
+	}
+
+	var claim GiftAidClaim
+	if err := json.Unmarshal([]byte(schedule), &claim); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to read claim")
+	}
+
+	return sendGiftAidClaim(c, claim)
+}
+
+// ListGiftAidClaims returns the claims which have been made, most recent first.
+// @Summary List Gift Aid claims (admin)
+// @Tags donations
+// @Produce json
+// @Success 200 {array} GiftAidClaimSummary
+// @Failure 401 {object} map[string]string "Not logged in"
+// @Failure 403 {object} map[string]string "Not authorized"
+// @Router /giftaid/claims [get]
+func ListGiftAidClaims(c *fiber.Ctx) error {
+	if _, err := canClaimGiftAid(c); err != nil {
+		return err
+	}
+
+	claims := []GiftAidClaimSummary{}
+	database.DBConn.Raw("SELECT id, created, createdby, donations, amount, giftaid, adjustment FROM giftaid_claims ORDER BY id DESC").Scan(&claims)
+
+	return c.JSON(fiber.Map{"claims": claims})
+}
+
+// CreateGiftAidClaim makes a claim of everything which can be claimed, and marks it as claimed.
+// @Summary Create a Gift Aid claim (admin)
+// @Description Claims Gift Aid on all the donations which can be claimed, and marks them as claimed so they're never claimed twice. Returns the claim, in the same formats as GET.
+// @Tags donations
+// @Produce json
+// @Param format query string false "json (default), csv or xml"
+// @Success 200 {object} GiftAidClaim
+// @Failure 401 {object} map[string]string "Not logged in"
+// @Failure 403 {object} map[string]string "Not authorized"
+// @Failure 409 {object} map[string]string "Nothing to claim"
+// @Router /giftaid/claim [post]
+func CreateGiftAidClaim(c *fiber.Ctx) error {
+	myid, err := canClaimGiftAid(c)
+	if err != nil {
+		return err
+	}
+
+	var claim GiftAidClaim
+
+	err = database.DBConn.Transaction(func(tx *gorm.DB) error {
+		var err error
+		claim, err = buildGiftAidClaim(tx, true)
+		if err != nil {
+			return err
+		}
+
+		if len(claim.Donations) == 0 && len(claim.Adjustments) == 0 {
+			return errNothingToClaim
+		}
+
+		claim.Created = time.Now()
+		claim.Createdby = myid
+
+		if err := tx.Exec("INSERT INTO giftaid_claims (created, createdby, donations, amount, giftaid, adjustment) VALUES (?, ?, ?, ?, ?, ?)",
+			claim.Created, myid, len(claim.Donations), claim.Amount, claim.Giftaid, claim.Adjustment).Error; err != nil {
+			return err
+		}
+
+		// Safe within the transaction, which keeps us on the same connection.
+		tx.Raw("SELECT LAST_INSERT_ID()").Scan(&claim.ID)
+		if claim.ID == 0 {
+			return errors.New("claim not found after insert")
+		}
+
+		schedule, err := json.Marshal(claim)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Exec("UPDATE giftaid_claims SET schedule = ? WHERE id = ?", string(schedule), claim.ID).Error; err != nil {
+			return err
+		}
+
+		if len(claim.Donations) > 0 {
+			ids := make([]uint64, len(claim.Donations))
+			for i, d := range claim.Donations {
+				ids[i] = d.Donationid
+			}
+
+			if err := tx.Exec("UPDATE users_donations SET giftaidclaimed = NOW(), giftaidclaimid = ? WHERE id IN ?", claim.ID, ids).Error; err != nil {
+				return err
+			}
+
+			// Refunds so far are netted off in this claim, so they mustn't become adjustments to it later.
+			if err := tx.Exec("UPDATE users_donations SET giftaidclaimed = NOW(), giftaidclaimid = ? WHERE adjusts IN ?", claim.ID, ids).Error; err != nil {
+				return err
+			}
+		}
+
+		if len(claim.Adjustments) > 0 {
+			ids := make([]uint64, len(claim.Adjustments))
+			for i, a := range claim.Adjustments {
+				ids[i] = a.Donationid
+			}
+
+			if err := tx.Exec("UPDATE users_donations SET giftaidclaimed = NOW(), giftaidclaimid = ? WHERE id IN ?", claim.ID, ids).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if errors.Is(err, errNothingToClaim) {
+		return fiber.NewError(fiber.StatusConflict, "Nothing to claim")
+	}
+
+	if err != nil {
+		log.Printf("Failed to create Gift Aid claim: %v", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create claim")
+	}
+
+	log.Printf("User %d created Gift Aid claim %d: %d donations, £%.2f, Gift Aid £%.2f, adjustment £%.2f",
+		myid, claim.ID, len(claim.Donations), claim.Amount, claim.Giftaid, claim.Adjustment)
+
+	return sendGiftAidClaim(c, claim)
+}
+
+// sendGiftAidClaim returns a claim in the format asked for.
+func sendGiftAidClaim(c *fiber.Ctx, claim GiftAidClaim) error {
+	name := "giftaid-claim-" + claim.Created.Format("2006-01-02")
+	if claim.ID > 0 {
+		name = fmt.Sprintf("giftaid-claim-%d", claim.ID)
+	}
+
+	switch c.Query("format") {
+	case "csv":
+		data, err := giftAidClaimCSV(claim)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to write claim")
+		}
+
+		c.Attachment(name + ".csv")
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		return c.Send(data)
+	case "xml":
+		details, ok := giftAidClaimDetailsFromEnv()
+		if !ok {
+			return fiber.NewError(fiber.StatusInternalServerError, "HMRC claim details are not configured")
+		}
+
+		data, err := giftAidClaimXML(claim, details)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to write claim")
+		}
+
+		c.Attachment(name + ".xml")
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationXMLCharsetUTF8)
+		return c.Send(data)
+	}
+
+	return c.JSON(claim)
+}
+
+// giftAidClaimCSV returns the schedule of donations in the layout of HMRC's spreadsheet.  Adjustments aren't part
+// of the schedule; they're entered separately.
+func giftAidClaimCSV(claim GiftAidClaim) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	w.Write([]string{"Title", "First name or initial", "Last name", "House name or number", "Postcode",
+		"Aggregated donations", "Sponsored event", "Donation date", "Amount"})
+
+	for _, d := range claim.Donations {
+		w.Write([]string{"", d.Firstname, d.Lastname, d.House, d.Postcode, "", "", d.Date.Format("02/01/06"),
+			fmt.Sprintf("%.2f", d.Amount)})
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// GiftAidClaimDetails are the details of the charity HMRC need with a claim.
+type GiftAidClaimDetails struct {
+	HMRCRef          string
+	OrgName          string
+	RegulatorNo      string
+	OfficialForename string
+	OfficialSurname  string
+	OfficialPostcode string
+	OfficialPhone    string
+}
+
+// giftAidClaimDetailsFromEnv returns the charity's details, and whether we have the ones HMRC require.
+func giftAidClaimDetailsFromEnv() (GiftAidClaimDetails, bool) {
+	details := GiftAidClaimDetails{
+		HMRCRef:          os.Getenv("GIFTAID_HMRC_REF"),
+		OrgName:          os.Getenv("GIFTAID_ORG_NAME"),
+		RegulatorNo:      os.Getenv("GIFTAID_REGULATOR_NO"),
+		OfficialForename: os.Getenv("GIFTAID_OFFICIAL_FORENAME"),
+		OfficialSurname:  os.Getenv("GIFTAID_OFFICIAL_SURNAME"),
+		OfficialPostcode: os.Getenv("GIFTAID_OFFICIAL_POSTCODE"),
+		OfficialPhone:    os.Getenv("GIFTAID_OFFICIAL_PHONE"),
+	}
+
+	ok := details.HMRCRef != "" && details.OrgName != "" && details.OfficialForename != "" &&
+		details.OfficialSurname != "" && details.OfficialPhone != ""
+
+	return details, ok
+}
+
+// The body of a Charities Online (R68) claim.  The GovTalk envelope and IRmark are added by whatever submits it.
+type r68Envelope struct {
+	XMLName  xml.Name `xml:"IRenvelope"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	IRheader struct {
+		Keys struct {
+			Key struct {
+				Type  string `xml:"Type,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"Key"`
+		} `xml:"Keys"`
+		PeriodEnd       string `xml:"PeriodEnd"`
+		DefaultCurrency string `xml:"DefaultCurrency"`
+		Sender          string `xml:"Sender"`
+	} `xml:"IRheader"`
+	R68 struct {
+		AuthOfficial struct {
+			OffName struct {
+				Fore string `xml:"Fore"`
+				Sur  string `xml:"Sur"`
+			} `xml:"OffName"`
+			OffID struct {
+				Postcode string `xml:"Postcode,omitempty"`
+			} `xml:"OffID"`
+			Phone string `xml:"Phone"`
+		} `xml:"AuthOfficial"`
+		Declaration string `xml:"Declaration"`
+		Claim       struct {
+			OrgName   string        `xml:"OrgName"`
+			HMRCref   string        `xml:"HMRCref"`
+			Regulator *r68Regulator `xml:"Regulator,omitempty"`
+			Repayment struct {
+				GAD            []r68GAD `xml:"GAD"`
+				EarliestGAdate string   `xml:"EarliestGAdate,omitempty"`
+				Adjustment     string   `xml:"Adjustment,omitempty"`
+			} `xml:"Repayment"`
+		} `xml:"Claim"`
+	} `xml:"R68"`
+}
+
+type r68Regulator struct {
+	RegName string `xml:"RegName"`
+	RegNo   string `xml:"RegNo"`
+}
+
+type r68GAD struct {
+	Donor struct {
+		Fore     string `xml:"Fore"`
+		Sur      string `xml:"Sur"`
+		House    string `xml:"House"`
+		Postcode string `xml:"Postcode"`
+	} `xml:"Donor"`
+	Date  string `xml:"Date"`
+	Total string `xml:"Total"`
+}
+
+// giftAidClaimXML returns the claim as the body of a GovTalk submission to Charities Online.
+func giftAidClaimXML(claim GiftAidClaim, details GiftAidClaimDetails) ([]byte, error) {
+	var env r68Envelope
+
+	env.Xmlns = "http://www.govtalk.gov.uk/taxation/charities/r68/2"
+	env.IRheader.Keys.Key.Type = "CHARID"
+	env.IRheader.Keys.Key.Value = details.HMRCRef
+	env.IRheader.PeriodEnd = claim.Created.Format("2006-01-02")
+	env.IRheader.DefaultCurrency = "GBP"
+	env.IRheader.Sender = "Other"
+
+	env.R68.AuthOfficial.OffName.Fore = details.OfficialForename
+	env.R68.AuthOfficial.OffName.Sur = details.OfficialSurname
+	env.R68.AuthOfficial.OffID.Postcode = details.OfficialPostcode
+	env.R68.AuthOfficial.Phone = details.OfficialPhone
+	env.R68.Declaration = "yes"
+
+	env.R68.Claim.OrgName = details.OrgName
+	env.R68.Claim.HMRCref = details.HMRCRef
+
+	if details.RegulatorNo != "" {
+		env.R68.Claim.Regulator = &r68Regulator{RegName: "CCEW", RegNo: details.RegulatorNo}
+	}
+
+	for _, d := range claim.Donations {
+		var gad r68GAD
+		gad.Donor.Fore = d.Firstname
+		gad.Donor.Sur = d.Lastname
+		gad.Donor.House = d.House
+		gad.Donor.Postcode = d.Postcode
+		gad.Date = d.Date.Format("2006-01-02")
+		gad.Total = fmt.Sprintf("%.2f", d.Amount)
+		env.R68.Claim.Repayment.GAD = append(env.R68.Claim.Repayment.GAD, gad)
+	}
+
+	if claim.Earliest != nil {
+		env.R68.Claim.Repayment.EarliestGAdate = claim.Earliest.Format("2006-01-02")
+	}
+
+	if claim.Adjustment > 0 {
+		env.R68.Claim.Repayment.Adjustment = fmt.Sprintf("%.2f", claim.Adjustment)
+	}
+
+	data, err := xml.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), data...), nil
+}
@@ -0,0 +1,113 @@
+package donations
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCovers(t *testing.T) {
+	declared := time.Date(2025, 6, 15, 14, 0, 0, 0, time.UTC)
+	morning := time.Date(2025, 6, 15, 9, 0, 0, 0, time.UTC)
+	later := declared.Add(24 * time.Hour)
+	earlier := declared.AddDate(-3, 0, 0)
+	tooEarly := declared.AddDate(-5, 0, 0)
+
+	assert.True(t, covers("Past4YearsAndFuture", declared, 1, earlier, 0))
+	assert.True(t, covers("Past4YearsAndFuture", declared, 1, later, 0))
+	assert.False(t, covers("Past4YearsAndFuture", declared, 1, tooEarly, 0))
+
+	assert.True(t, covers("Since", declared, 1, morning, 0))
+	assert.False(t, covers("Since", declared, 1, earlier, 0))
+
+	assert.False(t, covers("Future", declared, 1, morning, 0))
+	assert.True(t, covers("Future", declared, 1, later, 0))
+
+	assert.True(t, covers(PERIOD_THIS, declared, 1, morning, 1))
+	assert.False(t, covers(PERIOD_THIS, declared, 2, later, 1))
+
+	assert.False(t, covers("Declined", declared, 1, later, 0))
+}
+
+func TestNormalisePostcode(t *testing.T) {
+	assert.Equal(t, "SW1A 1AA", normalisePostcode("sw1a1aa"))
+	assert.Equal(t, "EH1 2NG", normalisePostcode(" eh1  2ng "))
+	assert.Equal(t, "M1 1AE", normalisePostcode("M1 1AE"))
+	assert.Equal(t, "", normalisePostcode("12345"))
+	assert.Equal(t, "", normalisePostcode(""))
+}
+
+func TestDonor(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	first, last, house, postcode, problem := claimDeclaration{
+		Fullname: "Mary Anne Smith", Housenameornumber: str("12"), Postcode: str("ab1 2cd"),
+	}.donor()
+	assert.Empty(t, problem)
+	assert.Equal(t, "Mary Anne", first)
+	assert.Equal(t, "Smith", last)
+	assert.Equal(t, "12", house)
+	assert.Equal(t, "AB1 2CD", postcode)
+
+	first, last, _, _, _ = claimDeclaration{
+		Fullname: "M Smith", Firstname: str("Mary"), Lastname: str("Smith"), Housenameornumber: str("12"), Postcode: str("AB1 2CD"),
+	}.donor()
+	assert.Equal(t, "Mary", first)
+	assert.Equal(t, "Smith", last)
+
+	_, _, _, _, problem = claimDeclaration{Fullname: "Cher", Housenameornumber: str("12"), Postcode: str("AB1 2CD")}.donor()
+	assert.NotEmpty(t, problem)
+
+	_, _, _, _, problem = claimDeclaration{Fullname: "Mary Smith", Postcode: str("AB1 2CD")}.donor()
+	assert.NotEmpty(t, problem)
+
+	_, _, _, _, problem = claimDeclaration{Fullname: "Mary Smith", Housenameornumber: str("12"), Postcode: str("Nowhere")}.donor()
+	assert.NotEmpty(t, problem)
+}
+
+func testClaim() GiftAidClaim {
+	date := time.Date(2025, 4, 6, 10, 0, 0, 0, time.UTC)
+
+	return GiftAidClaim{
+		ID:      7,
+		Created: time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC),
+		Donations: []GiftAidClaimDonation{
+			{Donationid: 1, Firstname: "Mary", Lastname: "Smith", House: "12", Postcode: "AB1 2CD", Date: date, Amount: 10},
+			{Donationid: 2, Firstname: "Jo", Lastname: "O'Neill, Jr", House: "The Barn", Postcode: "EH1 2NG", Date: date, Amount: 2.5},
+		},
+		Amount:     12.5,
+		Giftaid:    3.13,
+		Adjustment: 1.25,
+		Earliest:   &date,
+	}
+}
+
+func TestGiftAidClaimCSV(t *testing.T) {
+	data, err := giftAidClaimCSV(testClaim())
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, ",Mary,Smith,12,AB1 2CD,,,06/04/25,10.00", lines[1])
+	assert.Equal(t, `,Jo,"O'Neill, Jr",The Barn,EH1 2NG,,,06/04/25,2.50`, lines[2])
+}
+
+func TestGiftAidClaimXML(t *testing.T) {
+	data, err := giftAidClaimXML(testClaim(), GiftAidClaimDetails{
+		HMRCRef: "AB12345", OrgName: "Freegle", OfficialForename: "Pat", OfficialSurname: "Jones", OfficialPhone: "01234 567890",
+	})
+	require.NoError(t, err)
+
+	xml := string(data)
+	assert.Contains(t, xml, `<Key Type="CHARID">AB12345</Key>`)
+	assert.Contains(t, xml, "<PeriodEnd>2025-07-01</PeriodEnd>")
+	assert.Equal(t, 2, strings.Count(xml, "<GAD>"))
+	assert.Contains(t, xml, "<Sur>O&#39;Neill, Jr</Sur>")
+	assert.Contains(t, xml, "<Total>2.50</Total>")
+	assert.Contains(t, xml, "<EarliestGAdate>2025-04-06</EarliestGAdate>")
+	assert.Contains(t, xml, "<Adjustment>1.25</Adjustment>")
+	assert.NotContains(t, xml, "<Regulator>")
+}
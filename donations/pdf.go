@@ -0,0 +1,121 @@
+package donations
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// We only need PDFs of plain text, like donation statements, so rather than take on a library we write them
+// directly: A4 pages of text in Helvetica, which every PDF reader has built in.
+
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+)
+
+// pdfText is some text on a page, positioned from the bottom left in points.
+type pdfText struct {
+	X    float64
+	Y    float64
+	Size float64
+	Bold bool
+	Text string
+}
+
+// pdfDocument is a PDF being built up a page at a time.
+type pdfDocument struct {
+	pages [][]pdfText
+}
+
+// newPage starts a new page, which text is then added to.
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, []pdfText{})
+}
+
+// text adds text to the current page.
+func (d *pdfDocument) text(t pdfText) {
+	if len(d.pages) == 0 {
+		d.newPage()
+	}
+
+	d.pages[len(d.pages)-1] = append(d.pages[len(d.pages)-1], t)
+}
+
+// pdfString encodes text as a PDF string in WinAnsiEncoding, which matches Latin-1 for the characters we use
+// (including £).  Anything else becomes ?.
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r < 256:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+
+	b.WriteByte(')')
+	return b.String()
+}
+
+// bytes returns the finished PDF.
+func (d *pdfDocument) bytes() []byte {
+	if len(d.pages) == 0 {
+		d.newPage()
+	}
+
+	var buf bytes.Buffer
+	var offsets []int
+
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+
+	// Objects 1-4 are the catalog, page tree and fonts; then each page is followed by its contents.
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range d.pages {
+		var content strings.Builder
+		for _, t := range page {
+			font := "F1"
+			if t.Bold {
+				font = "F2"
+			}
+
+			fmt.Fprintf(&content, "BT /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", font, t.Size, t.X, t.Y, pdfString(t.Text))
+		}
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.Bytes()
+}
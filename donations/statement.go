@@ -0,0 +1,346 @@
+package donations
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/user"
+	"github.com/gofiber/fiber/v2"
+)
+
+// StatementDonation is a donation, or an adjustment to one, on a donor's statement.
+type StatementDonation struct {
+	ID             uint64     `json:"id"`
+	Timestamp      time.Time  `json:"timestamp"`
+	Amount         float64    `json:"amount"`
+	Type           string     `json:"type"`
+	Source         *string    `json:"source"`
+	Adjusts        *uint64    `json:"adjusts"`
+	Adjustment     *string    `json:"adjustment"`
+	Giftaidclaimed *time.Time `json:"giftaidclaimed"`
+	Donated        time.Time  `json:"-"`
+}
+
+// StatementYear is what a donor gave in a UK tax year, after refunds, and the Gift Aid we claimed on it.
+type StatementYear struct {
+	Year    string    `json:"year"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Donated float64   `json:"donated"`
+	Giftaid float64   `json:"giftaid"`
+}
+
+// StatementSubscription is a donor's recurring donation.
+type StatementSubscription struct {
+	Amount    float64    `json:"amount"`
+	Status    string     `json:"status"`
+	Created   time.Time  `json:"created"`
+	Lastpaid  *time.Time `json:"lastpaid"`
+	Cancelled *time.Time `json:"cancelled"`
+}
+
+// DonationStatement is everything a donor has given us.
+type DonationStatement struct {
+	Name          string                  `json:"name"`
+	Year          string                  `json:"year,omitempty"`
+	Giftaid       *string                 `json:"giftaid"`
+	Donations     []StatementDonation     `json:"donations"`
+	Years         []StatementYear         `json:"years"`
+	Subscriptions []StatementSubscription `json:"subscriptions"`
+}
+
+// taxYear returns the UK tax year a time falls in, by the year it starts, and when it starts.  They run from 6 April.
+func taxYear(t time.Time) (int, time.Time) {
+	year := t.Year()
+	start := time.Date(year, time.April, 6, 0, 0, 0, 0, t.Location())
+
+	if t.Before(start) {
+		year--
+		start = start.AddDate(-1, 0, 0)
+	}
+
+	return year, start
+}
+
+func taxYearName(year int) string {
+	return fmt.Sprintf("%d/%02d", year, (year+1)%100)
+}
+
+// method describes how a donation was made, or what happened to it.
+func (d StatementDonation) method() string {
+	if d.Adjustment != nil {
+		if *d.Adjustment == ADJUSTMENT_DISPUTE_REVERSAL {
+			return "Dispute reversed"
+		}
+
+		return *d.Adjustment
+	}
+
+	if d.Source != nil && *d.Source != "" {
+		return *d.Source
+	}
+
+	return d.Type
+}
+
+// getDonationStatement returns a user's donations, optionally only those in a tax year.  Adjustments count in the
+// year of the donation they adjust.
+func getDonationStatement(userID uint64, year int) DonationStatement {
+	db := database.DBConn
+
+	statement := DonationStatement{
+		Donations:     []StatementDonation{},
+		Years:         []StatementYear{},
+		Subscriptions: []StatementSubscription{},
+	}
+
+	if year > 0 {
+		statement.Year = taxYearName(year)
+	}
+
+	db.Raw("SELECT COALESCE(fullname, '') FROM users WHERE id = ?", userID).Scan(&statement.Name)
+	db.Raw("SELECT period FROM giftaid WHERE userid = ? AND deleted IS NULL LIMIT 1", userID).Scan(&statement.Giftaid)
+
+	var all []StatementDonation
+	db.Raw(`SELECT d.id, d.timestamp, d.GrossAmount AS amount, d.type, d.source, d.adjusts, d.adjustment, d.giftaidclaimed,
+		       COALESCE(o.timestamp, d.timestamp) AS donated
+		FROM users_donations d
+		LEFT JOIN users_donations o ON o.id = d.adjusts
+		WHERE d.userid = ?
+		ORDER BY d.timestamp, d.id`, userID).Scan(&all)
+
+	// Gift Aid was claimed on what was left of a donation after refunds; later ones were repaid to HMRC.
+	claimed := map[uint64]bool{}
+	for _, d := range all {
+		if d.Adjusts == nil && d.Giftaidclaimed != nil {
+			claimed[d.ID] = true
+		}
+	}
+
+	years := map[int]int{}
+
+	for _, d := range all {
+		y, start := taxYear(d.Donated)
+		if year > 0 && y != year {
+			continue
+		}
+
+		if d.Adjusts != nil {
+			// For an adjustment, this is when HMRC were told about it, which isn't the donor's concern.
+			d.Giftaidclaimed = nil
+		}
+
+		statement.Donations = append(statement.Donations, d)
+
+		i, ok := years[y]
+		if !ok {
+			i = len(statement.Years)
+			years[y] = i
+			statement.Years = append(statement.Years, StatementYear{
+				Year:  taxYearName(y),
+				Start: start,
+				End:   start.AddDate(1, 0, -1),
+			})
+		}
+
+		amount := pence(d.Amount)
+		statement.Years[i].Donated = pounds(pence(statement.Years[i].Donated) + amount)
+
+		original := d.ID
+		if d.Adjusts != nil {
+			original = *d.Adjusts
+		}
+
+		if claimed[original] {
+			statement.Years[i].Giftaid += float64(amount) * GIFTAID_RATE
+		}
+	}
+
+	for i := range statement.Years {
+		statement.Years[i].Giftaid = pounds(int64(math.Round(statement.Years[i].Giftaid)))
+	}
+
+	db.Raw("SELECT amount, status, created, lastpaid, cancelled FROM users_donations_subscriptions WHERE userid = ? ORDER BY created",
+		userID).Scan(&statement.Subscriptions)
+
+	return statement
+}
+
+// GetDonationStatement returns the logged-in user's donations.
+// @Summary Get my donations
+// @Description Returns the logged-in user's donations, refunds, totals and Gift Aid claimed for each UK tax year, and recurring donations. format=csv or format=pdf downloads a statement, e.g. for a tax return.
+// @Tags donations
+// @Produce json
+// @Param year query integer false "Only the tax year starting in this year, e.g. 2024 for 2024/25"
+// @Param format query string false "json (default), csv or pdf"
+// @Success 200 {object} DonationStatement
+// @Failure 401 {object} map[string]string "Not logged in"
+// @Router /donations/statement [get]
+func GetDonationStatement(c *fiber.Ctx) error {
+	myid := user.WhoAmI(c)
+	if myid == 0 {
+		return fiber.NewError(fiber.StatusUnauthorized, "Not logged in")
+	}
+
+	var year int
+	if c.Query("year") != "" {
+		var err error
+		year, err = strconv.Atoi(c.Query("year"))
+		if err != nil || year < 2000 || year > 9999 {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid year")
+		}
+	}
+
+	statement := getDonationStatement(myid, year)
+
+	name := "freegle-donations"
+	if year > 0 {
+		name = fmt.Sprintf("freegle-donations-%d-%02d", year, (year+1)%100)
+	}
+
+	switch c.Query("format") {
+	case "csv":
+		data, err := statementCSV(statement)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to write statement")
+		}
+
+		c.Attachment(name + ".csv")
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		return c.Send(data)
+	case "pdf":
+		c.Attachment(name + ".pdf")
+		c.Set(fiber.HeaderContentType, "application/pdf")
+		return c.Send(statementPDF(statement, time.Now()))
+	}
+
+	return c.JSON(statement)
+}
+
+func statementCSV(statement DonationStatement) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	w.Write([]string{"Date", "Amount", "Method", "Tax year", "Gift Aid claimed"})
+
+	for _, d := range statement.Donations {
+		y, _ := taxYear(d.Donated)
+
+		giftaid := ""
+		if d.Giftaidclaimed != nil {
+			giftaid = d.Giftaidclaimed.Format("2006-01-02")
+		}
+
+		w.Write([]string{d.Timestamp.Format("2006-01-02"), fmt.Sprintf("%.2f", d.Amount), d.method(), taxYearName(y), giftaid})
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func statementPDF(statement DonationStatement, issued time.Time) []byte {
+	const (
+		left   = 50.0
+		top    = pdfPageHeight - 60
+		bottom = 60.0
+		line   = 16.0
+	)
+
+	var doc pdfDocument
+	y := top
+
+	add := func(x float64, text string, bold bool) {
+		doc.text(pdfText{X: x, Y: y, Size: 10, Bold: bold, Text: text})
+	}
+
+	next := func() {
+		y -= line
+		if y < bottom {
+			doc.newPage()
+			y = top
+		}
+	}
+
+	doc.newPage()
+	doc.text(pdfText{X: left, Y: y, Size: 18, Bold: true, Text: "Freegle donation statement"})
+	y -= 2 * line
+
+	if statement.Name != "" {
+		add(left, "For: "+statement.Name, false)
+		next()
+	}
+
+	add(left, "Issued: "+issued.Format("2 January 2006"), false)
+	next()
+
+	if statement.Year != "" {
+		add(left, "Tax year: "+statement.Year, false)
+		next()
+	}
+
+	next()
+
+	if len(statement.Donations) == 0 {
+		add(left, "We have no record of any donations from you.", false)
+		next()
+	} else {
+		add(left, "Date", true)
+		add(left+120, "Amount", true)
+		add(left+220, "Method", true)
+		add(left+350, "Gift Aid claimed", true)
+		next()
+
+		for _, d := range statement.Donations {
+			add(left, d.Timestamp.Format("2 Jan 2006"), false)
+			add(left+120, fmt.Sprintf("£%.2f", d.Amount), false)
+			add(left+220, d.method(), false)
+
+			if d.Giftaidclaimed != nil {
+				add(left+350, d.Giftaidclaimed.Format("2 Jan 2006"), false)
+			}
+
+			next()
+		}
+
+		next()
+		add(left, "Tax year", true)
+		add(left+120, "Donated", true)
+		add(left+220, "Gift Aid claimed", true)
+		next()
+
+		for _, ty := range statement.Years {
+			add(left, ty.Year, false)
+			add(left+120, fmt.Sprintf("£%.2f", ty.Donated), false)
+			add(left+220, fmt.Sprintf("£%.2f", ty.Giftaid), false)
+			next()
+		}
+	}
+
+	if len(statement.Subscriptions) > 0 {
+		next()
+		add(left, "Regular donations", true)
+		next()
+
+		for _, s := range statement.Subscriptions {
+			text := fmt.Sprintf("£%.2f, started %s, %s", s.Amount, s.Created.Format("2 Jan 2006"), s.Status)
+			if s.Lastpaid != nil {
+				text += ", last paid " + s.Lastpaid.Format("2 Jan 2006")
+			}
+
+			add(left, text, false)
+			next()
+		}
+	}
+
+	next()
+	add(left, "Amounts are after any refunds. UK tax years run from 6 April to 5 April.", false)
+	next()
+	add(left, "Thank you for supporting Freegle.", false)
+
+	return doc.bytes()
+}
@@ -0,0 +1,77 @@
+package donations
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaxYear(t *testing.T) {
+	year, start := taxYear(time.Date(2025, 4, 5, 23, 59, 0, 0, time.UTC))
+	assert.Equal(t, 2024, year)
+	assert.Equal(t, time.Date(2024, 4, 6, 0, 0, 0, 0, time.UTC), start)
+
+	year, _ = taxYear(time.Date(2025, 4, 6, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, 2025, year)
+
+	assert.Equal(t, "2024/25", taxYearName(2024))
+	assert.Equal(t, "2099/00", taxYearName(2099))
+}
+
+func testStatement(n int) DonationStatement {
+	refund := ADJUSTMENT_REFUND
+	stripe := "Stripe"
+	claimed := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+	date := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	var adjusts uint64 = 1
+
+	s := DonationStatement{
+		Name: "Test (Donor)",
+		Donations: []StatementDonation{
+			{ID: 1, Timestamp: date, Donated: date, Amount: 10, Type: TYPE_STRIPE, Source: &stripe, Giftaidclaimed: &claimed},
+			{ID: 2, Timestamp: date.AddDate(0, 1, 0), Donated: date, Amount: -4, Type: TYPE_STRIPE, Adjusts: &adjusts, Adjustment: &refund},
+		},
+		Years: []StatementYear{{Year: "2025/26", Donated: 6, Giftaid: 1.5}},
+	}
+
+	for i := 0; i < n; i++ {
+		s.Donations = append(s.Donations, StatementDonation{ID: uint64(10 + i), Timestamp: date, Donated: date, Amount: 1, Type: TYPE_PAYPAL})
+	}
+
+	return s
+}
+
+func TestStatementCSV(t *testing.T) {
+	data, err := statementCSV(testStatement(0))
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, "2025-05-01,10.00,Stripe,2025/26,2025-07-01", lines[1])
+	assert.Equal(t, "2025-06-01,-4.00,Refund,2025/26,", lines[2])
+}
+
+func TestStatementPDF(t *testing.T) {
+	data := statementPDF(testStatement(0), time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC))
+
+	assert.True(t, bytes.HasPrefix(data, []byte("%PDF-1.4\n")))
+	assert.True(t, bytes.HasSuffix(data, []byte("%%EOF\n")))
+	assert.Contains(t, string(data), "/Count 1 ")
+	assert.Contains(t, string(data), `(For: Test \(Donor\))`)
+	assert.Contains(t, string(data), `(\243-4.00)`)
+	assert.Contains(t, string(data), "(Issued: 2 January 2026)")
+
+	// The xref table must point at each object.
+	start := bytes.LastIndex(data, []byte("startxref\n"))
+	var xref int
+	fmt.Sscanf(string(data[start+len("startxref\n"):]), "%d", &xref)
+	assert.True(t, bytes.HasPrefix(data[xref:], []byte("xref\n")))
+
+	// Long statements go over more than one page.
+	assert.Contains(t, string(statementPDF(testStatement(100), time.Now())), "/Count 3 ")
+}
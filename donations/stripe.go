@@ -168,7 +168,7 @@ func CreateSubscription(c *fiber.Ctx) error {
 		name = *fullname
 	}
 
-	log.Printf("Creating Stripe subscription for user %d, amount %d", myid, req.Amount)
+	log.Printf("Creating Stripe subscription for user %d, amount %.2f", myid, float64(req.Amount))
 
 	// Create Stripe customer.
 	custParams := &stripe.CustomerParams{
@@ -190,7 +190,7 @@ func CreateSubscription(c *fiber.Ctx) error {
 
 	// Create a Stripe product for this subscription.
 	prodParams := &stripe.ProductParams{
-		Name: stripe.String(fmt.Sprintf("Freegle Monthly Donation - £%d", req.Amount)),
+		Name: stripe.String(fmt.Sprintf("Freegle Monthly Donation - £%.2f", float64(req.Amount))),
 	}
 	prod, err := product.New(prodParams)
 	if err != nil {
@@ -231,6 +231,12 @@ func CreateSubscription(c *fiber.Ctx) error {
 
 	log.Printf("Stripe subscription created: %s for user %d", sub.ID, myid)
 
+	// It becomes active when the first invoice is paid.
+	if err := db.Exec("INSERT IGNORE INTO users_donations_subscriptions (subscriptionid, customerid, userid, amount, status, created, failures) VALUES (?, ?, ?, ?, ?, NOW(), 0)",
+		sub.ID, cust.ID, myid, float64(req.Amount), SUBSCRIPTION_INCOMPLETE).Error; err != nil {
+		log.Printf("Failed to record Stripe subscription %s for user %d: %v", sub.ID, myid, err)
+	}
+
 	// Extract client secret from the latest invoice's confirmation secret.
 	var clientSecret string
 	if sub.LatestInvoice != nil && sub.LatestInvoice.ConfirmationSecret != nil {
@@ -0,0 +1,326 @@
+package donations
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/freegle/iznik-server-go/database"
+	stripe "github.com/stripe/stripe-go/v82"
+	"gorm.io/gorm"
+)
+
+// When money from a donation goes back - a refund, or a dispute the donor raises with their bank - we don't change
+// the donation.  Instead we add an adjustment: another users_donations row with a negative GrossAmount, which says
+// which donation it adjusts.  So totals are right for any period, and the treasurer can see what happened and when.
+// If we win a dispute, the money comes back, and so does another adjustment.
+//
+// A donation which has lost its money can't have Gift Aid claimed on it.  The adjustments are how the claim knows:
+// it only claims on what's left, and if it's already been claimed, the next claim tells HMRC.  So a lost dispute
+// must always leave an adjustment, even if we never saw the dispute being created.
+//
+// The columns and table are created by an iznik-batch migration:
+//
+//	users_donations.adjusts NULL, users_donations.adjustment ENUM('Refund', 'Dispute', 'DisputeReversal') NULL
+//	users_donations_subscriptions (id, subscriptionid UNIQUE, customerid, userid NULL, amount, status, created,
+//	                               lastpaid NULL, lastfailed NULL, failures, cancelled NULL)
+
+// Kinds of adjustment.
+const (
+	ADJUSTMENT_REFUND           = "Refund"
+	ADJUSTMENT_DISPUTE          = "Dispute"
+	ADJUSTMENT_DISPUTE_REVERSAL = "DisputeReversal"
+)
+
+// Subscription statuses.
+const (
+	SUBSCRIPTION_INCOMPLETE = "Incomplete"
+	SUBSCRIPTION_ACTIVE     = "Active"
+	SUBSCRIPTION_PAST_DUE   = "PastDue"
+	SUBSCRIPTION_CANCELLED  = "Cancelled"
+)
+
+// donationRecord is the part of a donation we need to adjust it.
+type donationRecord struct {
+	ID               uint64
+	Userid           *uint64
+	Payer            string
+	Payerdisplayname string `gorm:"column:PayerDisplayName"`
+	Type             string
+	Source           *string
+	Giftaidclaimed   *string
+}
+
+// findStripeDonation finds the donation for a charge, locking it so that adjustments to it happen one at a time.
+func findStripeDonation(tx *gorm.DB, chargeID string) donationRecord {
+	var d donationRecord
+	tx.Raw("SELECT id, userid, Payer, PayerDisplayName, type, source, giftaidclaimed "+
+		"FROM users_donations WHERE TransactionID = ? AND adjusts IS NULL FOR UPDATE", chargeID).Scan(&d)
+
+	return d
+}
+
+// adjusted returns the total of a donation's adjustments of some kinds, which is negative if money has gone back.
+func adjusted(tx *gorm.DB, donationID uint64, kinds ...string) float64 {
+	var total float64
+	tx.Raw("SELECT COALESCE(SUM(GrossAmount), 0) FROM users_donations WHERE adjusts = ? AND adjustment IN ?", donationID, kinds).Scan(&total)
+
+	return total
+}
+
+// addAdjustment records money going back to the donor (a negative amount) or coming back to us (positive).  The
+// transaction ID is Stripe's ID for what caused it, so the same adjustment can't be recorded twice.
+func addAdjustment(tx *gorm.DB, d donationRecord, transactionID string, kind string, amount float64) error {
+	return tx.Exec("INSERT INTO users_donations (userid, Payer, PayerDisplayName, timestamp, TransactionID, GrossAmount, type, source, giftaidconsent, adjusts, adjustment) "+
+		"VALUES (?, ?, ?, NOW(), ?, ?, ?, ?, 0, ?, ?)",
+		d.Userid, d.Payer, d.Payerdisplayname, transactionID, amount, d.Type, d.Source, d.ID, kind).Error
+}
+
+// giftAidNote returns a note for the ledger about Gift Aid on a donation which has lost its money.  The adjustment
+// already stops it being claimed, so this is only to say if it was too late for that.
+func giftAidNote(d donationRecord) string {
+	if d.Giftaidclaimed == nil {
+		return ""
+	}
+
+	log.Printf("[StripeIPN] Donation %d has lost its money but Gift Aid was claimed on %s", d.ID, *d.Giftaidclaimed)
+
+	return "; Gift Aid already claimed, the next claim adjusts it"
+}
+
+// handleChargeRefunded records a refund.  Stripe tells us the total refunded so far, so a partial refund followed
+// by another is two adjustments.
+func handleChargeRefunded(tx *gorm.DB, event *stripe.Event) (eventResult, error) {
+	var charge stripe.Charge
+	if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+		return eventResult{}, fmt.Errorf("failed to parse charge: %w", err)
+	}
+
+	d := findStripeDonation(tx, charge.ID)
+	if d.ID == 0 {
+		return eventResult{Outcome: EventIgnored, Detail: "Charge not recorded"}, nil
+	}
+
+	refunded := float64(charge.AmountRefunded) / 100.0
+	amount := refunded + adjusted(tx, d.ID, ADJUSTMENT_REFUND)
+
+	if amount <= 0 {
+		return eventResult{Outcome: EventIgnored, Detail: "Refund already recorded", Donationid: d.ID}, nil
+	}
+
+	if err := addAdjustment(tx, d, charge.ID+"-refunded-"+strconv.FormatInt(charge.AmountRefunded, 10), ADJUSTMENT_REFUND, -amount); err != nil {
+		return eventResult{}, err
+	}
+
+	detail := fmt.Sprintf("Refund of £%.2f", amount)
+
+	if charge.Refunded {
+		detail += giftAidNote(d)
+	}
+
+	return eventResult{Outcome: EventRecorded, Detail: detail, Donationid: d.ID}, nil
+}
+
+func parseDispute(event *stripe.Event) (*stripe.Dispute, error) {
+	var dispute stripe.Dispute
+	if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+		return nil, fmt.Errorf("failed to parse dispute: %w", err)
+	}
+
+	if dispute.Charge == nil {
+		return nil, fmt.Errorf("dispute %s has no charge", dispute.ID)
+	}
+
+	return &dispute, nil
+}
+
+// isInquiry returns whether a dispute is only an inquiry, where the bank asks questions but doesn't take the money.
+func isInquiry(status stripe.DisputeStatus) bool {
+	switch status {
+	case stripe.DisputeStatusWarningNeedsResponse, stripe.DisputeStatusWarningUnderReview, stripe.DisputeStatusWarningClosed:
+		return true
+	}
+
+	return false
+}
+
+// handleDisputeCreated records the money Stripe takes back while a dispute is decided.
+func handleDisputeCreated(tx *gorm.DB, event *stripe.Event) (eventResult, error) {
+	dispute, err := parseDispute(event)
+	if err != nil {
+		return eventResult{}, err
+	}
+
+	d := findStripeDonation(tx, dispute.Charge.ID)
+	if d.ID == 0 {
+		return eventResult{Outcome: EventIgnored, Detail: "Charge not recorded"}, nil
+	}
+
+	if isInquiry(dispute.Status) {
+		return eventResult{Outcome: EventIgnored, Detail: "Inquiry only", Donationid: d.ID}, nil
+	}
+
+	amount := float64(dispute.Amount) / 100.0
+
+	if err := addAdjustment(tx, d, dispute.ID, ADJUSTMENT_DISPUTE, -amount); err != nil {
+		return eventResult{}, err
+	}
+
+	return eventResult{Outcome: EventRecorded, Detail: fmt.Sprintf("Dispute of £%.2f", amount), Donationid: d.ID}, nil
+}
+
+// handleDisputeClosed puts the money back if we won.  If we lost, the money stays gone.
+func handleDisputeClosed(tx *gorm.DB, event *stripe.Event) (eventResult, error) {
+	dispute, err := parseDispute(event)
+	if err != nil {
+		return eventResult{}, err
+	}
+
+	d := findStripeDonation(tx, dispute.Charge.ID)
+	if d.ID == 0 {
+		return eventResult{Outcome: EventIgnored, Detail: "Charge not recorded"}, nil
+	}
+
+	// What we took when the dispute was created, if we saw that.
+	var taken float64
+	tx.Raw("SELECT COALESCE(-SUM(GrossAmount), 0) FROM users_donations WHERE adjusts = ? AND TransactionID = ?", d.ID, dispute.ID).Scan(&taken)
+
+	switch dispute.Status {
+	case stripe.DisputeStatusWon:
+		// Only put back what we took, in case we never saw the dispute being created.
+		if taken <= 0 {
+			return eventResult{Outcome: EventIgnored, Detail: "Dispute won, nothing was taken", Donationid: d.ID}, nil
+		}
+
+		if err := addAdjustment(tx, d, dispute.ID+"-won", ADJUSTMENT_DISPUTE_REVERSAL, taken); err != nil {
+			return eventResult{}, err
+		}
+
+		return eventResult{Outcome: EventRecorded, Detail: fmt.Sprintf("Dispute won, £%.2f returned", taken), Donationid: d.ID}, nil
+	case stripe.DisputeStatusLost:
+		if taken <= 0 {
+			if err := addAdjustment(tx, d, dispute.ID, ADJUSTMENT_DISPUTE, -float64(dispute.Amount)/100.0); err != nil {
+				return eventResult{}, err
+			}
+		}
+
+		return eventResult{Outcome: EventRecorded, Detail: "Dispute lost" + giftAidNote(d), Donationid: d.ID}, nil
+	}
+
+	return eventResult{Outcome: EventIgnored, Detail: "Dispute closed as " + string(dispute.Status), Donationid: d.ID}, nil
+}
+
+// subscriptionFromInvoice returns the subscription an invoice is for, if any.
+func subscriptionFromInvoice(event *stripe.Event) (*stripe.Invoice, string, error) {
+	var invoice stripe.Invoice
+	if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+		return nil, "", fmt.Errorf("failed to parse invoice: %w", err)
+	}
+
+	if invoice.Parent == nil || invoice.Parent.SubscriptionDetails == nil || invoice.Parent.SubscriptionDetails.Subscription == nil {
+		return &invoice, "", nil
+	}
+
+	return &invoice, invoice.Parent.SubscriptionDetails.Subscription.ID, nil
+}
+
+// ensureSubscription makes sure we have a row for a subscription, e.g. one set up before we kept them.
+func ensureSubscription(tx *gorm.DB, subscriptionID string, customerID string, email string, amount float64) error {
+	var userID *uint64
+	if email != "" {
+		var uid uint64
+		database.DBConn.Raw("SELECT userid FROM users_emails WHERE email = ? AND userid IS NOT NULL LIMIT 1", email).Scan(&uid)
+		if uid > 0 {
+			userID = &uid
+		}
+	}
+
+	return tx.Exec("INSERT IGNORE INTO users_donations_subscriptions (subscriptionid, customerid, userid, amount, status, created, failures) "+
+		"VALUES (?, ?, ?, ?, ?, NOW(), 0)",
+		subscriptionID, customerID, userID, amount, SUBSCRIPTION_INCOMPLETE).Error
+}
+
+// handleInvoicePaid marks a subscription as active.  The payment itself is recorded from its charge.
+func handleInvoicePaid(tx *gorm.DB, event *stripe.Event) (eventResult, error) {
+	invoice, subscriptionID, err := subscriptionFromInvoice(event)
+	if err != nil {
+		return eventResult{}, err
+	}
+
+	if subscriptionID == "" {
+		return eventResult{Outcome: EventIgnored, Detail: "Not for a subscription"}, nil
+	}
+
+	var customerID string
+	if invoice.Customer != nil {
+		customerID = invoice.Customer.ID
+	}
+
+	amount := float64(invoice.AmountPaid) / 100.0
+
+	if err := ensureSubscription(tx, subscriptionID, customerID, invoice.CustomerEmail, amount); err != nil {
+		return eventResult{}, err
+	}
+
+	if err := tx.Exec("UPDATE users_donations_subscriptions SET status = ?, amount = ?, lastpaid = NOW(), failures = 0 WHERE subscriptionid = ?",
+		SUBSCRIPTION_ACTIVE, amount, subscriptionID).Error; err != nil {
+		return eventResult{}, err
+	}
+
+	return eventResult{Outcome: EventRecorded, Detail: fmt.Sprintf("Subscription %s paid £%.2f", subscriptionID, amount)}, nil
+}
+
+// handleInvoicePaymentFailed records that a subscription payment failed.  Stripe retries it, and cancels the
+// subscription if it keeps failing.
+func handleInvoicePaymentFailed(tx *gorm.DB, event *stripe.Event) (eventResult, error) {
+	invoice, subscriptionID, err := subscriptionFromInvoice(event)
+	if err != nil {
+		return eventResult{}, err
+	}
+
+	if subscriptionID == "" {
+		return eventResult{Outcome: EventIgnored, Detail: "Not for a subscription"}, nil
+	}
+
+	var customerID string
+	if invoice.Customer != nil {
+		customerID = invoice.Customer.ID
+	}
+
+	if err := ensureSubscription(tx, subscriptionID, customerID, invoice.CustomerEmail, float64(invoice.AmountDue)/100.0); err != nil {
+		return eventResult{}, err
+	}
+
+	if err := tx.Exec("UPDATE users_donations_subscriptions SET status = ?, lastfailed = NOW(), failures = failures + 1 WHERE subscriptionid = ?",
+		SUBSCRIPTION_PAST_DUE, subscriptionID).Error; err != nil {
+		return eventResult{}, err
+	}
+
+	return eventResult{Outcome: EventRecorded, Detail: fmt.Sprintf("Subscription %s payment failed", subscriptionID)}, nil
+}
+
+// handleSubscriptionDeleted records that a subscription has ended, whether the donor cancelled it or Stripe gave up
+// on payments.
+func handleSubscriptionDeleted(tx *gorm.DB, event *stripe.Event) (eventResult, error) {
+	var sub stripe.Subscription
+	if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+		return eventResult{}, fmt.Errorf("failed to parse subscription: %w", err)
+	}
+
+	var customerID string
+	if sub.Customer != nil {
+		customerID = sub.Customer.ID
+	}
+
+	if err := ensureSubscription(tx, sub.ID, customerID, "", 0); err != nil {
+		return eventResult{}, err
+	}
+
+	if err := tx.Exec("UPDATE users_donations_subscriptions SET status = ?, cancelled = NOW() WHERE subscriptionid = ?",
+		SUBSCRIPTION_CANCELLED, sub.ID).Error; err != nil {
+		return eventResult{}, err
+	}
+
+	return eventResult{Outcome: EventRecorded, Detail: fmt.Sprintf("Subscription %s cancelled", sub.ID)}, nil
+}
@@ -2,25 +2,115 @@ package donations
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/queue"
 	"github.com/gofiber/fiber/v2"
 	stripe "github.com/stripe/stripe-go/v82"
 	stripecustomer "github.com/stripe/stripe-go/v82/customer"
+	"github.com/stripe/stripe-go/v82/webhook"
+	"gorm.io/gorm"
 )
 
 // MANUAL_THANKS is the minimum one-off donation amount (GBP) that triggers a thank-you request.
 const MANUAL_THANKS = 10.0
 
-// StripeIPN handles Stripe webhook notifications (charge.succeeded).
+// Stripe signs each webhook with the endpoint's secret.  STRIPE_WEBHOOK_SECRET is a comma-separated list of the
+// secrets we accept, so that the live and test endpoints can share this handler, and so that a secret can be rolled
+// without dropping events.
+//
+// Stripe sends events at least once, and sends them again if we don't respond in time, so each event is recorded in
+// a ledger and handled only once.  The table is created by an iznik-batch migration:
+//
+//	stripe_events (id, eventid UNIQUE, type, livemode, created, received, processed NULL, outcome, detail NULL,
+//	               donationid NULL, attempts)
+
+// stripeWebhookTolerance is how old a signature can be.  Older ones might be replays.
+const stripeWebhookTolerance = webhook.DefaultTolerance
+
+// Outcomes of handling a Stripe event.
+const (
+	// EventReceived is recorded while we're handling an event.
+	EventReceived = "Received"
+
+	// EventRecorded means we've changed our records, e.g. added a donation.
+	EventRecorded = "Recorded"
+
+	// EventIgnored means the event didn't need anything doing.
+	EventIgnored = "Ignored"
+
+	// EventFailed means handling the event failed, and nothing was changed.  Stripe will send it again.
+	EventFailed = "Failed"
+
+	// EventDuplicate is returned, but not recorded, for events we've already handled.
+	EventDuplicate = "Duplicate"
+)
+
+var errNoWebhookSecret = errors.New("STRIPE_WEBHOOK_SECRET is not set")
+
+// eventResult is what happened when we handled an event.
+type eventResult struct {
+	Outcome    string
+	Detail     string
+	Donationid uint64
+}
+
+// eventHandler handles one type of event.  Changes should be made in tx, so that they're only kept if the event is
+// recorded as handled.
+type eventHandler func(tx *gorm.DB, event *stripe.Event) (eventResult, error)
+
+var eventHandlers = map[stripe.EventType]eventHandler{
+	stripe.EventTypeChargeSucceeded:             handleChargeSucceeded,
+	stripe.EventTypeChargeRefunded:              handleChargeRefunded,
+	stripe.EventTypeChargeDisputeCreated:        handleDisputeCreated,
+	stripe.EventTypeChargeDisputeClosed:         handleDisputeClosed,
+	stripe.EventTypeInvoicePaid:                 handleInvoicePaid,
+	stripe.EventTypeInvoicePaymentFailed:        handleInvoicePaymentFailed,
+	stripe.EventTypeCustomerSubscriptionDeleted: handleSubscriptionDeleted,
+}
+
+func stripeWebhookSecrets() []string {
+	var secrets []string
+	for _, secret := range strings.Split(os.Getenv("STRIPE_WEBHOOK_SECRET"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return secrets
+}
+
+// verifyStripeSignature checks the Stripe-Signature header against each of our secrets.
+func verifyStripeSignature(payload []byte, header string) error {
+	secrets := stripeWebhookSecrets()
+	if len(secrets) == 0 {
+		return errNoWebhookSecret
+	}
+
+	err := webhook.ErrNoValidSignature
+	for _, secret := range secrets {
+		// Only a signature mismatch might be fixed by trying another secret.
+		if err = webhook.ValidatePayloadWithTolerance(payload, header, secret, stripeWebhookTolerance); err != webhook.ErrNoValidSignature {
+			return err
+		}
+	}
+
+	return err
+}
+
+// StripeIPN handles Stripe webhook notifications.
 // This is the Go equivalent of iznik-server/http/stripeipn.php.
 //
-// Stripe sends a POST with a JSON event body. We parse the event, record the
-// donation, handle gift aid notifications, and queue thank-you emails.
+// Stripe sends a POST with a signed JSON event body.  We check the signature, then handle the event unless we've
+// done so already, and say what happened.
 //
 // @Summary Handle Stripe webhook
 // @Tags donations
@@ -31,33 +121,101 @@ func StripeIPN(c *fiber.Ctx) error {
 	body := c.Body()
 	log.Printf("[StripeIPN] Received webhook, body length %d", len(body))
 
+	if err := verifyStripeSignature(body, c.Get("Stripe-Signature")); err != nil {
+		if err == errNoWebhookSecret {
+			// Stripe will keep trying, so we won't lose events while this is fixed.
+			log.Printf("[StripeIPN] Can't verify webhook: %v", err)
+			return apierror.New(fiber.StatusServiceUnavailable, apierror.CodeUnavailable, "Webhook not configured").WithCause(err)
+		}
+
+		log.Printf("[StripeIPN] Invalid signature from %s: %v", c.IP(), err)
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Invalid signature")
+	}
+
 	// Parse the event JSON.
 	var event stripe.Event
-	if err := json.Unmarshal(body, &event); err != nil {
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" {
 		log.Printf("[StripeIPN] Invalid payload: %v", err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid payload"})
+		return apierror.ErrInvalidBody.WithMessage("Invalid payload")
 	}
 
 	log.Printf("[StripeIPN] Event type: %s, ID: %s", event.Type, event.ID)
 
-	switch event.Type {
-	case "charge.succeeded":
-		return handleChargeSucceeded(c, &event)
-	default:
-		log.Printf("[StripeIPN] Ignoring event type: %s", event.Type)
-		return c.SendStatus(fiber.StatusOK)
+	result, err := processEvent(&event)
+	if err != nil {
+		log.Printf("[StripeIPN] Failed to handle event %s: %v", event.ID, err)
+		return apierror.ErrInternal.WithMessage("Failed to handle event").WithCause(err)
 	}
+
+	log.Printf("[StripeIPN] Event %s: %s %s", event.ID, result.Outcome, result.Detail)
+
+	return c.JSON(fiber.Map{
+		"ret":     0,
+		"status":  "Success",
+		"event":   event.ID,
+		"outcome": result.Outcome,
+		"detail":  result.Detail,
+	})
 }
 
-// handleChargeSucceeded processes a successful Stripe charge.
-func handleChargeSucceeded(c *fiber.Ctx, event *stripe.Event) error {
+// processEvent handles an event, unless it's already been handled, and records the outcome in the ledger along with
+// any changes, in one transaction.
+func processEvent(event *stripe.Event) (eventResult, error) {
 	gdb := database.DBConn
+	var result eventResult
+
+	err := gdb.Transaction(func(tx *gorm.DB) error {
+		// If Stripe sends the event twice at once, the second waits here until the first has finished.
+		if err := tx.Exec("INSERT IGNORE INTO stripe_events (eventid, type, livemode, created, received, outcome, attempts) "+
+			"VALUES (?, ?, ?, FROM_UNIXTIME(?), NOW(), ?, 0)",
+			event.ID, string(event.Type), event.Livemode, event.Created, EventReceived).Error; err != nil {
+			return err
+		}
+
+		var previous string
+		tx.Raw("SELECT outcome FROM stripe_events WHERE eventid = ? FOR UPDATE", event.ID).Scan(&previous)
+
+		if previous == EventRecorded || previous == EventIgnored {
+			result = eventResult{Outcome: EventDuplicate, Detail: "Already " + strings.ToLower(previous)}
+			return nil
+		}
+
+		var err error
+		if handler, ok := eventHandlers[event.Type]; ok {
+			result, err = handler(tx, event)
+			if err != nil {
+				return err
+			}
+		} else {
+			result = eventResult{Outcome: EventIgnored, Detail: "Unhandled event type"}
+		}
+
+		var donationid *uint64
+		if result.Donationid > 0 {
+			donationid = &result.Donationid
+		}
 
+		return tx.Exec("UPDATE stripe_events SET outcome = ?, detail = ?, donationid = ?, processed = NOW(), attempts = attempts + 1 WHERE eventid = ?",
+			result.Outcome, result.Detail, donationid, event.ID).Error
+	})
+
+	if err != nil {
+		// Everything was rolled back, so record the failure on its own.  We'll try again when Stripe resends it.
+		gdb.Exec("INSERT INTO stripe_events (eventid, type, livemode, created, received, outcome, detail, attempts) "+
+			"VALUES (?, ?, ?, FROM_UNIXTIME(?), NOW(), ?, ?, 1) "+
+			"ON DUPLICATE KEY UPDATE outcome = VALUES(outcome), detail = VALUES(detail), attempts = attempts + 1",
+			event.ID, string(event.Type), event.Livemode, event.Created, EventFailed, err.Error())
+	}
+
+	return result, err
+}
+
+// handleChargeSucceeded records a successful Stripe charge as a donation.
+func handleChargeSucceeded(tx *gorm.DB, event *stripe.Event) (eventResult, error) {
 	// Parse the charge object from the event data.
 	var charge stripe.Charge
 	if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
-		log.Printf("[StripeIPN] Failed to parse charge data: %v", err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to parse charge"})
+		return eventResult{}, fmt.Errorf("failed to parse charge: %w", err)
 	}
 
 	// Amount is in pence — convert to pounds.
@@ -73,13 +231,18 @@ func handleChargeSucceeded(c *fiber.Ctx, event *stripe.Event) error {
 		amount, paymentMethod, charge.ID)
 
 	if amount == 0 {
-		log.Printf("[StripeIPN] Zero amount, ignoring")
-		return c.SendStatus(fiber.StatusOK)
+		return eventResult{Outcome: EventIgnored, Detail: "Zero amount"}, nil
 	}
 
 	if paymentMethod == "paypal" {
-		log.Printf("[StripeIPN] PayPal payment, ignoring (handled by PayPal IPN)")
-		return c.SendStatus(fiber.StatusOK)
+		return eventResult{Outcome: EventIgnored, Detail: "PayPal payment, handled by PayPal IPN"}, nil
+	}
+
+	// Events from before we kept the ledger, or a different event for the same charge.
+	var existing uint64
+	tx.Raw("SELECT id FROM users_donations WHERE TransactionID = ? LIMIT 1", charge.ID).Scan(&existing)
+	if existing > 0 {
+		return eventResult{Outcome: EventIgnored, Detail: "Charge already recorded", Donationid: existing}, nil
 	}
 
 	// Try to identify the user.
@@ -92,7 +255,7 @@ func handleChargeSucceeded(c *fiber.Ctx, event *stripe.Event) error {
 	firstRecurring := false
 	if userID > 0 && recurring {
 		var previousCount int64
-		gdb.Raw("SELECT COUNT(*) FROM users_donations WHERE userid = ? AND TransactionType IN ('subscr_payment', 'recurring_payment')", userID).Scan(&previousCount)
+		tx.Raw("SELECT COUNT(*) FROM users_donations WHERE userid = ? AND TransactionType IN ('subscr_payment', 'recurring_payment')", userID).Scan(&previousCount)
 		firstRecurring = previousCount == 0
 		log.Printf("[StripeIPN] User %d previous recurring donations: %d, first=%v", userID, previousCount, firstRecurring)
 	}
@@ -109,41 +272,42 @@ func handleChargeSucceeded(c *fiber.Ctx, event *stripe.Event) error {
 		userIDPtr = &userID
 	}
 
-	result := gdb.Exec(
+	result := tx.Exec(
 		"INSERT INTO users_donations (userid, Payer, PayerDisplayName, timestamp, TransactionID, GrossAmount, source, TransactionType, type) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		userIDPtr, userEmail, userName, time.Now().Format("2006-01-02 15:04:05"),
 		charge.ID, amount, TYPE_STRIPE, transactionType, TYPE_STRIPE,
 	)
 
 	if result.Error != nil {
-		log.Printf("[StripeIPN] Failed to record donation: %v", result.Error)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to record donation"})
+		return eventResult{}, fmt.Errorf("failed to record donation: %w", result.Error)
 	}
 
 	var donationID uint64
-	gdb.Raw("SELECT id FROM users_donations WHERE TransactionID = ? ORDER BY id DESC LIMIT 1", charge.ID).Scan(&donationID)
+	tx.Raw("SELECT id FROM users_donations WHERE TransactionID = ? ORDER BY id DESC LIMIT 1", charge.ID).Scan(&donationID)
 	log.Printf("[StripeIPN] Recorded donation id=%d for user=%d amount=£%.2f", donationID, userID, amount)
 
 	// Handle gift aid notification.
 	if userID > 0 {
-		handleGiftAidNotification(userID)
+		if err := handleGiftAidNotification(tx, userID); err != nil {
+			return eventResult{}, err
+		}
 	}
 
 	// Queue thank-you email for significant donations.
 	if userID > 0 && ((recurring && firstRecurring) || (!recurring && amount >= MANUAL_THANKS)) {
 		log.Printf("[StripeIPN] Queuing thank-you for user %d, amount £%.2f, recurring=%v", userID, amount, recurring)
 
-		if err := queue.QueueTask(queue.TaskEmailDonateExternal, map[string]interface{}{
+		if err := queue.QueueTaskTx(tx, queue.TaskEmailDonateExternal, map[string]interface{}{
 			"user_name":  userName,
 			"user_id":    userID,
 			"user_email": userEmail,
 			"amount":     amount,
 		}); err != nil {
-			log.Printf("[StripeIPN] Failed to queue thank-you email: %v", err)
+			return eventResult{}, err
 		}
 	}
 
-	return c.SendStatus(fiber.StatusOK)
+	return eventResult{Outcome: EventRecorded, Detail: "Donation recorded", Donationid: donationID}, nil
 }
 
 // matchDonorUser tries to identify the Freegle user who made the donation.
@@ -231,19 +395,22 @@ func matchDonorUser(charge *stripe.Charge) (uint64, string, string) {
 }
 
 // handleGiftAidNotification checks if the user needs a gift aid notification.
-func handleGiftAidNotification(userID uint64) {
-	gdb := database.DBConn
-
+func handleGiftAidNotification(tx *gorm.DB, userID uint64) error {
 	type GiftAidRecord struct {
 		Period string
 	}
 
 	var giftaid GiftAidRecord
-	gdb.Raw("SELECT period FROM giftaid WHERE userid = ? ORDER BY id DESC LIMIT 1", userID).Scan(&giftaid)
+	tx.Raw("SELECT period FROM giftaid WHERE userid = ? ORDER BY id DESC LIMIT 1", userID).Scan(&giftaid)
 
 	if giftaid.Period == "" || giftaid.Period == PERIOD_THIS {
 		// No gift aid declaration or only a temporary one — prompt them.
-		gdb.Exec("INSERT IGNORE INTO users_notifications (fromuser, touser, type, timestamp) VALUES (NULL, ?, 'GiftAid', NOW())", userID)
+		if err := tx.Exec("INSERT IGNORE INTO users_notifications (fromuser, touser, type, timestamp) VALUES (NULL, ?, 'GiftAid', NOW())", userID).Error; err != nil {
+			return err
+		}
+
 		log.Printf("[StripeIPN] Created gift aid notification for user %d (period=%s)", userID, giftaid.Period)
 	}
+
+	return nil
 }
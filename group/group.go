@@ -17,6 +17,7 @@ import (
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/log"
+	"github.com/freegle/iznik-server-go/modaudit"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/gofiber/fiber/v2"
@@ -237,7 +238,7 @@ func GetGroup(c *fiber.Ctx) error {
 		// Run independent queries in parallel to reduce latency.
 		myid := user.WhoAmI(c)
 		wantPolygon := c.Query("polygon") == "true"
-		wantTnkey := c.Query("tnkey") == "true" && myid > 0 && auth.IsModOfGroup(myid, id)
+		wantTnkey := c.Query("tnkey") == "true" && myid > 0 && auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, id)
 
 		type PolyResult struct {
 			Poly           *string `gorm:"column:poly"`
@@ -622,6 +623,14 @@ func logGroupEdit(groupid uint64, byuser uint64, text string) {
 		log.LOG_TYPE_GROUP, log.LOG_SUBTYPE_EDIT, groupid, byuser, text)
 }
 
+// auditedGroupColumns are the columns PatchGroup can change which we record.  The polygons are left out, as they're
+// large.
+var auditedGroupColumns = []string{
+	"tagline", "namefull", "welcomemail", "description", "region", "affiliationconfirmed", "onhere", "publish",
+	"microvolunteering", "mentored", "ontn", "onlovejunk", "settings", "rules",
+	"lat", "lng", "altlat", "altlng", "nameshort", "licenserequired", "showonyahoo",
+}
+
 type PatchGroupRequest struct {
 	ID                    uint64   `json:"id"`
 	Tagline               *string  `json:"tagline"`
@@ -675,12 +684,16 @@ func PatchGroup(c *fiber.Ctx) error {
 	}
 
 	// Check authorization: must be mod/owner of the group OR admin/support
-	if !auth.IsModOfGroup(myid, req.ID) {
+	if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, req.ID) {
 		return fiber.NewError(fiber.StatusForbidden, "Permission denied")
 	}
 
 	isAdmin := auth.IsAdminOrSupport(myid)
 
+	// Record what changed, however we return, so that owners can see who changed what and undo it.
+	audit := modaudit.Take(modaudit.TargetGroup, req.ID, req.ID, auditedGroupColumns...)
+	defer modaudit.Record(c, modaudit.ActionSettings, audit)
+
 	// Apply mod/owner settable fields
 	if req.Tagline != nil {
 		db.Exec("UPDATE `groups` SET tagline = ? WHERE id = ?", *req.Tagline, req.ID)
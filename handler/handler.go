@@ -2,15 +2,19 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cache"
 )
 
-type response struct {
+// Location is what the geolocation API tells us about an IP.
+type Location struct {
 	Status    string  `json:"status"`
 	Country   string  `json:"country"`
 	Region    string  `json:"regionName"`
@@ -30,30 +34,41 @@ func CacheRequest(exp time.Duration) fiber.Handler {
 // geoClient is a shared HTTP client with a reasonable timeout for external API calls.
 var geoClient = &http.Client{Timeout: 5 * time.Second}
 
-// GeoLocation fetches the details of the IP from a public http API.
-func GeoLocation(c *fiber.Ctx) error {
-	ip := c.Params("ip")
-
+// LookupIP fetches the details of an IP from a public http API.
+func LookupIP(ip string) (*Location, error) {
 	res, err := geoClient.Get("http://ip-api.com/json/" + ip)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadGateway, "Failed to reach geolocation service")
+		return nil, fmt.Errorf("failed to reach geolocation service: %w", err)
 	}
 	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadGateway, "Failed to read geolocation response")
+		return nil, fmt.Errorf("failed to read geolocation response: %w", err)
+	}
+
+	var loc Location
+	if err := json.Unmarshal(body, &loc); err != nil {
+		return nil, ErrInvalidGeoResponse
 	}
 
-	var resp response
-	if err := json.Unmarshal(body, &resp); err != nil {
+	return &loc, nil
+}
+
+// ErrInvalidGeoResponse is returned when the geolocation API replies with something we can't parse.
+var ErrInvalidGeoResponse = errors.New("invalid geolocation response")
+
+// GeoLocation fetches the details of the IP from a public http API.
+func GeoLocation(c *fiber.Ctx) error {
+	resp, err := LookupIP(c.Params("ip"))
+	if errors.Is(err, ErrInvalidGeoResponse) {
 		return fiber.NewError(fiber.StatusBadGateway, "Invalid geolocation response")
+	} else if err != nil {
+		return fiber.NewError(fiber.StatusBadGateway, "Failed to reach geolocation service")
 	}
 
 	if resp.Status == "fail" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"message": "enter an ip",
-		})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "enter an ip")
 	}
 	return c.Status(fiber.StatusOK).JSON(resp)
 }
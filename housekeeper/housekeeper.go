@@ -5,6 +5,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/queue"
@@ -56,25 +57,17 @@ type HousekeeperTask struct {
 // Notify receives housekeeping task results from the Chrome extension and
 // queues a background task for Laravel to process.
 //
-// Requires system admin authentication via JWT.
+// The route requires support or admin.
 func Notify(c *fiber.Ctx) error {
 	myid := auth.WhoAmI(c)
 
-	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not logged in"})
-	}
-
-	if !auth.IsAdminOrSupport(myid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Admin or support required"})
-	}
-
 	var req NotifyRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid JSON"})
+		return apierror.ErrInvalidBody
 	}
 
 	if req.Task == "" || req.Status == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "task and status are required"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "task and status are required")
 	}
 
 	log.Printf("[Housekeeper] User %d submitted %s result: %s — %s", myid, req.Task, req.Status, req.Summary)
@@ -91,7 +84,7 @@ func Notify(c *fiber.Ctx) error {
 
 	if err != nil {
 		log.Printf("[Housekeeper] Failed to queue task: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to queue"})
+		return apierror.ErrInternal.WithMessage("Failed to queue").WithCause(err)
 	}
 
 	// Upsert registry entries if provided.
@@ -143,21 +136,13 @@ func upsertLastRun(taskKey, status, summary string) {
 
 // CompleteTask marks a placeholder (manual) housekeeping task as done.
 //
-// Requires support or admin authentication via JWT.
+// The route requires support or admin.
 func CompleteTask(c *fiber.Ctx) error {
 	myid := auth.WhoAmI(c)
 
-	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not logged in"})
-	}
-
-	if !auth.IsAdminOrSupport(myid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Support or admin required"})
-	}
-
 	taskKey := c.Params("key")
 	if taskKey == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "task key is required"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "task key is required")
 	}
 
 	db := database.DBConn
@@ -169,11 +154,11 @@ func CompleteTask(c *fiber.Ctx) error {
 
 	if result.Error != nil {
 		log.Printf("[Housekeeper] CompleteTask error: %v", result.Error)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update"})
+		return apierror.ErrInternal.WithMessage("Failed to update").WithCause(result.Error)
 	}
 
 	if result.RowsAffected == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found or not a manual task"})
+		return apierror.ErrNotFound.WithMessage("Task not found or not a manual task")
 	}
 
 	log.Printf("[Housekeeper] User %d marked %s as done", myid, taskKey)
@@ -183,18 +168,8 @@ func CompleteTask(c *fiber.Ctx) error {
 
 // ListTasks returns all housekeeper tasks with an overdue flag.
 //
-// Requires support or admin authentication via JWT.
+// The route requires support or admin.
 func ListTasks(c *fiber.Ctx) error {
-	myid := auth.WhoAmI(c)
-
-	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not logged in"})
-	}
-
-	if !auth.IsAdminOrSupport(myid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Support or admin required"})
-	}
-
 	db := database.DBConn
 
 	var tasks []HousekeeperTask
@@ -315,18 +290,8 @@ func ActiveCronJobCount() int {
 // ListCronJobs returns the static list of Laravel scheduled commands enriched
 // with last-run data from the cron_job_status table.
 //
-// Requires support or admin authentication.
+// The route requires support or admin.
 func ListCronJobs(c *fiber.Ctx) error {
-	myid := auth.WhoAmI(c)
-
-	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not logged in"})
-	}
-
-	if !auth.IsAdminOrSupport(myid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Support or admin required"})
-	}
-
 	db := database.DBConn
 
 	var statuses []cronJobStatus
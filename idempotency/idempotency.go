@@ -0,0 +1,292 @@
+// Package idempotency lets clients safely retry requests which create things, e.g. when a mobile network drops the
+// response.
+//
+// A client which sends an Idempotency-Key header (typically a UUID) gets the same response for every request with
+// that key, for Window after the first.  Only the first request is handled; repeats get the stored response, with
+// an Idempotent-Replayed header.  Reusing a key for a different request is an error, as is repeating a request
+// while the first is still being handled.  Requests without the header are handled as normal.
+//
+// Keys belong to the user, or the IP address if not logged in, so one client can't see another's responses.
+// Failures (server errors, or errors returned by the handler) aren't stored, so that the client can retry them.
+// If the first request never finishes, e.g. because the server was restarted, the key is freed after Lease.
+//
+// Some responses include credentials, e.g. the jwt and persistent token which PUT /message returns when it creates a
+// user.  A client which lost that response has no other way into the account, so a repeat has to get them too.  We
+// store those responses encrypted, so that they're no use to anyone reading the table, and they go with the rest
+// of the key when the window ends.
+//
+// The table is created by an iznik-batch migration:
+//
+//	idempotency_keys (id, scope, idemkey, method, path, fingerprint, status NULL, contenttype NULL,
+//	                  response MEDIUMBLOB NULL, created, expires)
+//	  UNIQUE (scope, idemkey).  status is NULL while the first request is being handled.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// Header is the request header with the key.
+	Header = "Idempotency-Key"
+
+	// ReplayedHeader is set on responses which have been replayed.
+	ReplayedHeader = "Idempotent-Replayed"
+
+	// DefaultWindow is how long we keep responses, unless configured otherwise.
+	DefaultWindow = 24 * time.Hour
+
+	// Lease is how long a key is held by a request which is still being handled.  It's well beyond how long
+	// any request should take.
+	Lease = 2 * time.Minute
+
+	maxKeyLength = 255
+
+	// purgeChance is how often (1 in purgeChance) a new key also removes expired ones.
+	purgeChance = 100
+)
+
+// Config configures the middleware.
+type Config struct {
+	// Window is how long a key is remembered.  0 means DefaultWindow.
+	Window time.Duration
+}
+
+// credentialFields are fields in JSON responses which mean we store the response encrypted.
+var credentialFields = []string{"jwt", "refreshtoken", "persistent", "access_token", "refresh_token", "id_token"}
+
+// sealedPrefix marks an encrypted response.  JSON can't start with it.
+var sealedPrefix = []byte("sealed:")
+
+var errUnseal = errors.New("can't decrypt stored response")
+
+type stored struct {
+	Fingerprint string
+	Method      string
+	Path        string
+	Status      *int
+	Contenttype *string
+	Response    []byte
+}
+
+// fingerprint identifies a request, so that we can tell if a key is reused for a different one.
+func fingerprint(method string, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// scope returns who a key belongs to.
+func scope(c *fiber.Ctx) string {
+	// As in ratelimit, the JWT is enough here; WhoAmI would mark the request as authenticated.
+	if userid, _, _ := auth.GetJWTFromRequest(c); userid > 0 {
+		return "user:" + strconv.FormatUint(userid, 10)
+	}
+
+	return "ip:" + auth.ClientIP(c)
+}
+
+// hasCredentials returns whether a response body includes credentials.
+func hasCredentials(contentType string, body []byte) bool {
+	if !strings.HasPrefix(contentType, fiber.MIMEApplicationJSON) {
+		return false
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return false
+	}
+
+	for _, f := range credentialFields {
+		if _, ok := fields[f]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// responseCipher is the cipher for stored responses which include credentials.
+func responseCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("idempotency-response:" + os.Getenv("JWT_SECRET")))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal returns a response body as we store it: encrypted if it includes credentials, and otherwise as it is.
+func seal(contentType string, body []byte) ([]byte, error) {
+	if !hasCredentials(contentType, body) {
+		return body, nil
+	}
+
+	aead, err := responseCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := append(append([]byte{}, sealedPrefix...), nonce...)
+
+	return aead.Seal(sealed, nonce, body, nil), nil
+}
+
+// unseal reverses seal.
+func unseal(stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, sealedPrefix) {
+		return stored, nil
+	}
+
+	aead, err := responseCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	data := stored[len(sealedPrefix):]
+	if len(data) < aead.NonceSize() {
+		return nil, errUnseal
+	}
+
+	body, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errUnseal
+	}
+
+	return body, nil
+}
+
+// New creates a middleware which makes a route idempotent for requests with an Idempotency-Key.
+func New(config Config) fiber.Handler {
+	window := config.Window
+	if window == 0 {
+		window = DefaultWindow
+	}
+
+	return func(c *fiber.Ctx) error {
+		key := c.Get(Header)
+		if key == "" {
+			return c.Next()
+		}
+
+		if len(key) > maxKeyLength {
+			return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "Idempotency-Key is too long")
+		}
+
+		db := database.DBConn
+		sc := scope(c)
+		fp := fingerprint(c.Method(), c.Path(), c.Body())
+
+		// A key which has expired can be used again, as can one whose first request has been going for longer than
+		// the lease, which it will never finish.
+		db.Exec("DELETE FROM idempotency_keys WHERE scope = ? AND idemkey = ? AND "+
+			"(expires < NOW() OR (status IS NULL AND created < DATE_SUB(NOW(), INTERVAL ? SECOND)))",
+			sc, key, int(Lease.Seconds()))
+
+		result := db.Exec("INSERT IGNORE INTO idempotency_keys (scope, idemkey, method, path, fingerprint, created, expires) "+
+			"VALUES (?, ?, ?, ?, ?, NOW(), DATE_ADD(NOW(), INTERVAL ? SECOND))",
+			sc, key, c.Method(), c.Path(), fp, int(window.Seconds()))
+
+		if result.Error != nil {
+			// Better to handle the request than to fail it because we can't record the key.
+			log.Printf("Failed to record idempotency key for %s: %v", sc, result.Error)
+			return c.Next()
+		}
+
+		if result.RowsAffected == 0 {
+			return replay(c, sc, key, fp)
+		}
+
+		if rand.Intn(purgeChance) == 0 {
+			db.Exec("DELETE FROM idempotency_keys WHERE expires < NOW() LIMIT 1000")
+		}
+
+		err := c.Next()
+		status := c.Response().StatusCode()
+
+		if err != nil || status >= fiber.StatusInternalServerError {
+			// Let the client try again.
+			db.Exec("DELETE FROM idempotency_keys WHERE scope = ? AND idemkey = ?", sc, key)
+			return err
+		}
+
+		contentType := string(c.Response().Header.ContentType())
+
+		response, serr := seal(contentType, c.Response().Body())
+		if serr != nil {
+			// We can't store it safely, so let the client try again instead.
+			log.Printf("Failed to encrypt idempotent response for %s: %v", sc, serr)
+			db.Exec("DELETE FROM idempotency_keys WHERE scope = ? AND idemkey = ?", sc, key)
+			return nil
+		}
+
+		db.Exec("UPDATE idempotency_keys SET status = ?, contenttype = ?, response = ? WHERE scope = ? AND idemkey = ?",
+			status, contentType, response, sc, key)
+
+		return nil
+	}
+}
+
+// replay returns the stored response for a key we've seen before.
+func replay(c *fiber.Ctx, sc string, key string, fp string) error {
+	var s stored
+	database.DBConn.Raw("SELECT fingerprint, method, path, status, contenttype, response FROM idempotency_keys WHERE scope = ? AND idemkey = ?",
+		sc, key).Scan(&s)
+
+	if s.Fingerprint == "" {
+		// It was removed after we tried to add it, because the first request failed.  The client can try again.
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "A request with this Idempotency-Key has just failed - please try again")
+	}
+
+	if s.Fingerprint != fp {
+		return apierror.New(fiber.StatusUnprocessableEntity, apierror.CodeKeyReused,
+			"This Idempotency-Key was used for a different request ("+s.Method+" "+s.Path+")")
+	}
+
+	if s.Status == nil {
+		c.Set(fiber.HeaderRetryAfter, "1")
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "A request with this Idempotency-Key is still being handled")
+	}
+
+	body, err := unseal(s.Response)
+	if err != nil {
+		// JWT_SECRET has changed since.
+		log.Printf("Failed to replay idempotent response for %s: %v", sc, err)
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "The response to this request can no longer be repeated")
+	}
+
+	c.Set(ReplayedHeader, "true")
+
+	if s.Contenttype != nil && *s.Contenttype != "" {
+		c.Set(fiber.HeaderContentType, *s.Contenttype)
+	}
+
+	return c.Status(*s.Status).Send(body)
+}
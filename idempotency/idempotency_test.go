@@ -0,0 +1,87 @@
+package idempotency
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	fp := fingerprint("POST", "/api/newsfeed", []byte(`{"message":"Hello"}`))
+
+	assert.Equal(t, fp, fingerprint("POST", "/api/newsfeed", []byte(`{"message":"Hello"}`)))
+	assert.NotEqual(t, fp, fingerprint("PUT", "/api/newsfeed", []byte(`{"message":"Hello"}`)))
+	assert.NotEqual(t, fp, fingerprint("POST", "/apiv2/newsfeed", []byte(`{"message":"Hello"}`)))
+	assert.NotEqual(t, fp, fingerprint("POST", "/api/newsfeed", []byte(`{"message":"Hello!"}`)))
+}
+
+func TestSeal(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+
+	body := []byte(`{"ret":0,"id":123,"jwt":"x.y.z","refreshtoken":"r","persistent":{"id":1,"series":2,"token":"t"}}`)
+
+	// Responses with credentials are stored encrypted, and come back as they were.
+	sealed, err := seal(fiber.MIMEApplicationJSONCharsetUTF8, body)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(sealed), "x.y.z")
+	assert.NotContains(t, string(sealed), `"token":"t"`)
+
+	unsealed, err := unseal(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, body, unsealed)
+
+	// Each one has its own nonce.
+	other, _ := seal(fiber.MIMEApplicationJSON, body)
+	assert.NotEqual(t, sealed, other)
+
+	// Not if the key has changed, or it's been tampered with.
+	sealed[len(sealed)-1] ^= 1
+	_, err = unseal(sealed)
+	assert.Error(t, err)
+
+	t.Setenv("JWT_SECRET", "other")
+	_, err = unseal(other)
+	assert.Error(t, err)
+
+	// Anything else is stored as it is.
+	for _, b := range [][]byte{[]byte(`{"ret":0,"id":123}`), []byte(`[1,2]`)} {
+		stored, err := seal(fiber.MIMEApplicationJSON, b)
+		assert.NoError(t, err)
+		assert.Equal(t, b, stored)
+
+		unsealed, err = unseal(stored)
+		assert.NoError(t, err)
+		assert.Equal(t, b, unsealed)
+	}
+
+	stored, _ := seal(fiber.MIMETextPlain, body)
+	assert.Equal(t, body, stored)
+}
+
+func testApp() *fiber.App {
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	app.Post("/", New(Config{}), func(c *fiber.Ctx) error {
+		return c.SendString("handled")
+	})
+
+	return app
+}
+
+func TestNoKey(t *testing.T) {
+	// Without a key we don't touch the database at all.
+	resp, _ := testApp().Test(httptest.NewRequest("POST", "/", strings.NewReader("body")))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(ReplayedHeader))
+}
+
+func TestKeyTooLong(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader("body"))
+	req.Header.Set(Header, strings.Repeat("k", maxKeyLength+1))
+
+	resp, _ := testApp().Test(req)
+	assert.Equal(t, 400, resp.StatusCode)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/utils"
+	"github.com/freegle/iznik-server-go/validate"
 	"github.com/gofiber/fiber/v2"
 	"strconv"
 )
@@ -44,17 +45,17 @@ type PostRequest struct {
 	Rotate *int   `json:"rotate"`
 
 	// Type resolution: either imgtype string or boolean flags
-	ImgType        string `json:"imgtype"`
-	Type           string `json:"type"` // Alternative field name for imgtype
+	ImgType        string `json:"imgtype" validate:"oneof=Message Group Newsletter CommunityEvent Volunteering ChatMessage User Newsfeed Story Noticeboard"`
+	Type           string `json:"type" validate:"oneof=Message Group Newsletter CommunityEvent Volunteering ChatMessage User Newsfeed Story Noticeboard"` // Alternative field name for imgtype
 	MsgID          uint64 `json:"msgid"`
 	GroupID        uint64 `json:"groupid"`
-	CommunityEvent any    `json:"communityevent"` // Can be uint64 (parent ID) or bool (type flag)
-	Volunteering   any    `json:"volunteering"`   // Can be uint64 (parent ID) or bool (type flag)
+	CommunityEvent any    `json:"communityevent" validate:"idorflag"` // Can be uint64 (parent ID) or bool (type flag)
+	Volunteering   any    `json:"volunteering" validate:"idorflag"`   // Can be uint64 (parent ID) or bool (type flag)
 	ChatMessage    uint64 `json:"chatmessage"`
-	UserID         any    `json:"user"`       // Can be uint64 (parent ID) or bool (type flag)
+	UserID         any    `json:"user" validate:"idorflag"`        // Can be uint64 (parent ID) or bool (type flag)
 	Newsfeed       uint64 `json:"newsfeed"`
-	Story          any    `json:"story"`      // Can be bool (type flag)
-	Noticeboard    any    `json:"noticeboard"` // Can be bool (type flag)
+	Story          any    `json:"story" validate:"idorflag"`       // Can be bool (type flag)
+	Noticeboard    any    `json:"noticeboard" validate:"idorflag"` // Can be bool (type flag)
 	Newsletter     uint64 `json:"newsletter"`
 }
 
@@ -137,8 +138,8 @@ func Post(c *fiber.Ctx) error {
 	}
 
 	var req PostRequest
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	if err := validate.Body(c, &req); err != nil {
+		return err
 	}
 
 	// Determine operation: rotate if id + rotate present, otherwise create.
@@ -5,9 +5,11 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/freegle/iznik-server-go/utils"
+	"github.com/freegle/iznik-server-go/validate"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -27,13 +29,6 @@ func (Isochrones) TableName() string {
 	return "isochrones"
 }
 
-// validTransports is the whitelist of allowed transport types.
-var validTransports = map[string]bool{
-	"Walk":  true,
-	"Cycle": true,
-	"Drive": true,
-}
-
 func ListIsochrones(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 
@@ -109,7 +104,7 @@ func CreateIsochrone(c *fiber.Ctx) error {
 	}
 
 	type CreateRequest struct {
-		Transport  string           `json:"transport"`
+		Transport  string           `json:"transport" validate:"required,oneof=Walk Cycle Drive"`
 		Minutes    utils.FlexInt    `json:"minutes"`
 		Nickname   string           `json:"nickname"`
 		Locationid utils.FlexUint64 `json:"locationid"`
@@ -135,9 +130,8 @@ func CreateIsochrone(c *fiber.Ctx) error {
 		req.Nickname = c.FormValue("nickname", c.Query("nickname", ""))
 	}
 
-	// Validate transport against whitelist.
-	if !validTransports[req.Transport] {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid transport - must be Walk, Cycle, or Drive")
+	if err := validate.Struct(&req); err != nil {
+		return err
 	}
 
 	// Clamp minutes.
@@ -207,9 +201,9 @@ func EditIsochrone(c *fiber.Ctx) error {
 	}
 
 	type EditRequest struct {
-		ID        utils.FlexUint64 `json:"id"`
+		ID        utils.FlexUint64 `json:"id" validate:"required"`
 		Minutes   utils.FlexInt    `json:"minutes"`
-		Transport string           `json:"transport"`
+		Transport string           `json:"transport" validate:"oneof=Walk Cycle Drive"`
 	}
 
 	var req EditRequest
@@ -229,13 +223,8 @@ func EditIsochrone(c *fiber.Ctx) error {
 		req.Transport = c.FormValue("transport", c.Query("transport", ""))
 	}
 
-	if req.ID == 0 {
-		return fiber.NewError(fiber.StatusBadRequest, "Missing id")
-	}
-
-	// Validate transport if provided - must be Walk/Cycle/Drive.
-	if req.Transport != "" && !validTransports[req.Transport] {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid transport - must be Walk, Cycle, or Drive")
+	if err := validate.Struct(&req); err != nil {
+		return err
 	}
 
 	if req.Minutes < minMinutes {
@@ -339,7 +328,7 @@ func DeleteIsochrone(c *fiber.Ctx) error {
 	var count int64
 	db.Raw("SELECT COUNT(*) FROM isochrones_users WHERE id = ? AND userid = ?", id, myid).Scan(&count)
 	if count == 0 {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": "Access denied"})
+		return apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "Access denied")
 	}
 
 	db.Exec("DELETE FROM isochrones_users WHERE id = ?", id)
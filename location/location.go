@@ -13,6 +13,7 @@ import (
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/utils"
+	"github.com/freegle/iznik-server-go/validate"
 	"github.com/gofiber/fiber/v2"
 	geo "github.com/kellydunn/golang-geo"
 )
@@ -783,7 +784,7 @@ func ExcludeLocation(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "id and groupid are required")
 	}
 
-	if !auth.IsModOfGroup(myid, req.GroupID) {
+	if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, req.GroupID) {
 		return fiber.NewError(fiber.StatusForbidden, "Must be a moderator or owner of the group")
 	}
 
@@ -814,7 +815,7 @@ func ExcludeLocation(c *fiber.Ctx) error {
 
 type ConvertKMLRequest struct {
 	Action string `json:"action"`
-	KML    string `json:"kml"`
+	KML    string `json:"kml" validate:"required"`
 }
 
 type kmlDocument struct {
@@ -849,13 +850,9 @@ func ConvertKML(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusUnauthorized, "Not logged in")
 	}
 
-	var req ConvertKMLRequest
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
-	}
-
-	if req.KML == "" {
-		return fiber.NewError(fiber.StatusBadRequest, "kml is required")
+	req, err := validate.Parsed[ConvertKMLRequest](c)
+	if err != nil {
+		return err
 	}
 
 	var kml kmlDocument
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/log"
@@ -33,7 +34,7 @@ import (
 func GetLogs(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": "Not moderator"})
+		return apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "Not moderator")
 	}
 
 	db := database.DBConn
@@ -59,7 +60,7 @@ func GetLogs(c *fiber.Ctx) error {
 
 	if !isAdmin {
 		if groupid == 0 && userid == 0 {
-			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": "Not moderator"})
+			return apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "Not moderator")
 		}
 
 		// Get all groups this user moderates.
@@ -75,7 +76,7 @@ func GetLogs(c *fiber.Ctx) error {
 				}
 			}
 			if !found {
-				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": "Not moderator"})
+				return apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "Not moderator")
 			}
 		}
 	}
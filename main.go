@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	fiberadapter "github.com/awslabs/aws-lambda-go-api-proxy/fiber"
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/changes"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/misc"
+	"github.com/freegle/iznik-server-go/ratelimit"
 	"github.com/freegle/iznik-server-go/router"
 	"github.com/freegle/iznik-server-go/user"
 	_ "github.com/go-sql-driver/mysql"
@@ -37,34 +40,29 @@ func main() {
 	loc, _ := time.LoadLocation("UTC")
 	time.Local = loc
 
+	// Without TRUSTED_PROXIES, everyone behind our proxy looks like one client, so limits by IP address would lock
+	// out the whole site.  That's too easy to miss in a log, so in production we don't start.
+	if err := auth.CheckTrustedProxies(); err != nil {
+		fmt.Println("ERROR: " + err.Error())
+
+		if !strings.Contains(os.Getenv("USER_SITE"), ".localhost") {
+			os.Exit(1)
+		}
+	}
+
 	app := fiber.New(fiber.Config{
 		ReadBufferSize:  8192,
 		WriteBufferSize: 8192,
-		// Trust proxy headers for client IP extraction.
+		// Trust proxy headers for client IP extraction, but only from the proxies in TRUSTED_PROXIES.
 		// When behind HAProxy/Traefik/nginx, the real client IP is in X-Forwarded-For.
-		// This makes c.IP() return the real client IP instead of the proxy's IP.
-		ProxyHeader: "X-Forwarded-For",
-		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
-			// Map this to a standardised error response.
-			code := fiber.StatusInternalServerError
-
-			var e *fiber.Error
-			if errors.As(err, &e) {
-				code = e.Code
-			}
-
-			// Log server errors and 400s so we can diagnose them.
-			if code >= 500 {
-				fmt.Printf("SERVER ERROR %d %s %s: %v\n", code, ctx.Method(), ctx.OriginalURL(), err)
-			} else if code == 400 {
-				fmt.Printf("BAD REQUEST %d %s %s: %v\n", code, ctx.Method(), ctx.OriginalURL(), err)
-			}
-
-			return ctx.Status(code).JSON(fiber.Map{
-				"error":   code,
-				"message": err.Error(),
-			})
-		},
+		// This makes c.IP() return the real client IP instead of the proxy's IP.  Anyone else could put anything
+		// in that header, so for them c.IP() is the address which connected to us.
+		ProxyHeader:             "X-Forwarded-For",
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          auth.TrustedProxies(),
+		EnableIPValidation:      true,
+		// Map errors to a standardised response, with the v1 shape on /api and the v2 shape on /apiv2.
+		ErrorHandler: apierror.Handler,
 	})
 
 	// Recover from panics so they return 500 instead of crashing the server.
@@ -76,6 +74,10 @@ func main() {
 	if !strings.Contains(os.Getenv("USER_SITE"), ".localhost") {
 		app.Use(compress.New(compress.Config{
 			Level: compress.LevelBestSpeed,
+			// Compressing an event stream would buffer the events.
+			Next: func(c *fiber.Ctx) bool {
+				return strings.HasSuffix(c.Path(), "/chat/stream")
+			},
 		}))
 	}
 
@@ -119,6 +121,12 @@ func main() {
 		},
 	}))
 
+	// Limit how often any one client can call us, after the Loki middleware so that we log the requests we refuse.
+	// Some routes have stricter limits of their own.
+	app.Use(ratelimit.New(ratelimit.Config{Policy: ratelimit.Default, Skip: func(c *fiber.Ctx) bool {
+		return c.Path() == "/api/online" || strings.HasPrefix(c.Path(), "/swagger")
+	}}))
+
 	// Set up swagger routes BEFORE other API routes
 	// Handle swagger redirect - redirect exact /swagger path to /swagger/index.html
 	app.Get("/swagger", func(c *fiber.Ctx) error {
@@ -135,6 +143,11 @@ func main() {
 
 	if len(os.Getenv("FUNCTIONS")) == 0 {
 		// We're running standalone.
+		//
+		// Deliver partner webhooks in the background.  This isn't possible in a functions environment, where
+		// nothing runs between requests.
+		changes.StartWebhookDispatcher()
+
 		//
 		// We can signal to stop using SIGINT.
 		c := make(chan os.Signal, 1)
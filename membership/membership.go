@@ -11,6 +11,7 @@ import (
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/log"
+	"github.com/freegle/iznik-server-go/modaudit"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/gofiber/fiber/v2"
@@ -33,45 +34,6 @@ func logMembershipAction(logType string, subtype string, groupid uint64, userid
 	})
 }
 
-// getRoleForGroup returns the caller's role in the given group ("Owner", "Moderator", "Member"),
-// or "" if not an approved member. Admin/Support users are treated as Owner.
-func getRoleForGroup(myid uint64, groupid uint64) string {
-	if auth.IsAdminOrSupport(myid) {
-		return utils.ROLE_OWNER
-	}
-	db := database.DBConn
-	var role string
-	db.Raw("SELECT role FROM memberships WHERE userid = ? AND groupid = ? AND collection = ?",
-		myid, groupid, utils.COLLECTION_APPROVED).Scan(&role)
-	return role
-}
-
-// isModOfGroup checks if the caller is a Moderator or Owner of the given group,
-// or has Admin/Support system role.
-func isModOfGroup(myid uint64, groupid uint64) bool {
-	db := database.DBConn
-	if db == nil {
-		return false
-	}
-
-	if auth.IsAdminOrSupport(myid) {
-		return true
-	}
-
-	if groupid == 0 {
-		return false
-	}
-
-	var role string
-	result := db.Raw("SELECT role FROM memberships WHERE userid = ? AND groupid = ? AND collection = ?",
-		myid, groupid, utils.COLLECTION_APPROVED).Scan(&role)
-	if result.Error != nil {
-		stdlog.Printf("Failed to check mod role for user %d group %d: %v", myid, groupid, result.Error)
-		return false
-	}
-	return role == utils.ROLE_MODERATOR || role == utils.ROLE_OWNER
-}
-
 // PostMembershipsRequest is the body for POST /memberships (moderator actions).
 type PostMembershipsRequest struct {
 	Userid    uint64  `json:"userid"`
@@ -84,6 +46,16 @@ type PostMembershipsRequest struct {
 	Happiness *string `json:"happiness"`
 }
 
+// auditedActions are the PostMemberships actions we record changes for, and what we record them as.
+var auditedActions = map[string]string{
+	"Hold":                   modaudit.ActionHold,
+	"Release":                modaudit.ActionRelease,
+	"Approve":                modaudit.ActionApprove,
+	"Reject":                 modaudit.ActionReject,
+	"Delete Approved Member": modaudit.ActionDelete,
+	"Ban":                    modaudit.ActionBan,
+}
+
 // PostMemberships handles POST /memberships - moderator actions on memberships.
 // Actions: Hold, Release, Approve, Leave Approved Member, Reject,
 // Delete Approved Member, Ban, Unban, ReviewHold, ReviewRelease, ReviewIgnore, HappinessReviewed.
@@ -118,12 +90,17 @@ func PostMemberships(c *fiber.Ctx) error {
 	}
 
 	// Permission check: caller must be mod/owner of group or admin/support.
-	if !isModOfGroup(myid, req.Groupid) {
+	if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, req.Groupid) {
 		return fiber.NewError(fiber.StatusForbidden, "Not a moderator of this group")
 	}
 
 	db := database.DBConn
 
+	if action, ok := auditedActions[req.Action]; ok {
+		audit := modaudit.Take(modaudit.TargetMember, req.Userid, req.Groupid, "role", "collection", "heldby")
+		defer modaudit.Record(c, action, audit)
+	}
+
 	switch req.Action {
 	case "Hold":
 		if result := db.Exec("UPDATE memberships SET heldby = ? WHERE userid = ? AND groupid = ?",
@@ -337,7 +314,7 @@ func GetMemberships(c *fiber.Ctx) error {
 		}
 		// search across all of the mod's groups when no group selected.
 		// Fall through to the search logic with groupid=0 handled below.
-	} else if !isModOfGroup(myid, groupid) {
+	} else if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_VIEW, groupid) {
 		return fiber.NewError(fiber.StatusForbidden, "Not a moderator of this group")
 	}
 	filter := c.QueryInt("filter", 0)
@@ -530,7 +507,7 @@ func getSpamMembers(c *fiber.Ctx, myid uint64, groupid uint64, limit int) error
 	var modGroupIDs []uint64
 
 	if groupid > 0 {
-		if !isModOfGroup(myid, groupid) {
+		if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_VIEW, groupid) {
 			return fiber.NewError(fiber.StatusForbidden, "Not a moderator of this group")
 		}
 		modGroupIDs = []uint64{groupid}
@@ -583,7 +560,7 @@ func getRelatedMembers(c *fiber.Ctx, myid uint64, groupid uint64, limit int) err
 
 	var modGroupIDs []uint64
 	if groupid > 0 {
-		if !isModOfGroup(myid, groupid) {
+		if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_VIEW, groupid) {
 			return fiber.NewError(fiber.StatusForbidden, "Not a moderator of this group")
 		}
 		modGroupIDs = []uint64{groupid}
@@ -763,7 +740,7 @@ func getHappinessMembers(c *fiber.Ctx, myid uint64, groupid uint64, limit int) e
 	// Determine which group IDs to query.
 	var groupIDs []uint64
 	if groupid > 0 {
-		if !isModOfGroup(myid, groupid) {
+		if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_VIEW, groupid) {
 			return fiber.NewError(fiber.StatusForbidden, "Not a moderator of this group")
 		}
 		groupIDs = []uint64{groupid}
@@ -1113,7 +1090,7 @@ func DeleteMemberships(c *fiber.Ctx) error {
 
 	// Handle ban. V1 parity: delete memberships row entirely, insert into users_banned.
 	if req.Ban != nil && *req.Ban {
-		if !isModOfGroup(myid, req.Groupid) {
+		if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, req.Groupid) {
 			return fiber.NewError(fiber.StatusForbidden, "Not a moderator of this group")
 		}
 		db.Exec("DELETE FROM memberships WHERE userid = ? AND groupid = ?", userid, req.Groupid)
@@ -1126,7 +1103,7 @@ func DeleteMemberships(c *fiber.Ctx) error {
 
 	// Self-leave is always allowed. Non-self removals require mod/owner of the group.
 	if userid != myid {
-		if !isModOfGroup(myid, req.Groupid) {
+		if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, req.Groupid) {
 			return fiber.NewError(fiber.StatusForbidden, "Not a moderator of this group")
 		}
 		logMembershipAction(log.LOG_TYPE_USER, log.LOG_SUBTYPE_DELETED, req.Groupid, userid, myid, "")
@@ -1188,7 +1165,7 @@ func PatchMemberships(c *fiber.Ctx) error {
 	// Users can update their own settings. Moderators can update settings for
 	// members of groups they moderate (e.g. stdmsg newmodstatus/newdelstatus).
 	if userid != myid {
-		if !isModOfGroup(myid, req.Groupid) {
+		if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, req.Groupid) {
 			return fiber.NewError(fiber.StatusForbidden, "Cannot modify another user's settings")
 		}
 	}
@@ -1229,7 +1206,7 @@ func PatchMemberships(c *fiber.Ctx) error {
 
 	if req.OurPostingStatus != nil {
 		// ourPostingStatus is mod-only — users must not change their own moderation status.
-		if !isModOfGroup(myid, req.Groupid) {
+		if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, req.Groupid) {
 			return fiber.NewError(fiber.StatusForbidden, "Only moderators can change posting status")
 		}
 		db.Exec("UPDATE memberships SET ourPostingStatus = ? WHERE userid = ? AND groupid = ?",
@@ -1245,15 +1222,14 @@ func PatchMemberships(c *fiber.Ctx) error {
 		}
 
 		// Must be a mod/owner of the group (or admin/support) to change anyone's role.
-		if !isModOfGroup(myid, req.Groupid) {
+		if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, req.Groupid) {
 			return fiber.NewError(fiber.StatusForbidden, "Only moderators can change roles")
 		}
 
 		// Only owners (or admin/support) can promote to Moderator or Owner.
 		// Moderators can only demote to Member.
-		callerRole := getRoleForGroup(myid, req.Groupid)
 		if targetRole == utils.ROLE_MODERATOR || targetRole == utils.ROLE_OWNER {
-			if callerRole != utils.ROLE_OWNER {
+			if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_OWN, req.Groupid) {
 				return fiber.NewError(fiber.StatusForbidden, "Only owners can promote to moderator or owner")
 			}
 		}
@@ -5,26 +5,30 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/contentscan"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/group"
 	"github.com/freegle/iznik-server-go/item"
 	"github.com/freegle/iznik-server-go/location"
 	flog "github.com/freegle/iznik-server-go/log"
 	"github.com/freegle/iznik-server-go/misc"
+	"github.com/freegle/iznik-server-go/modaudit"
+	"github.com/freegle/iznik-server-go/partner"
 	"github.com/freegle/iznik-server-go/queue"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v4"
 	"gorm.io/gorm"
 )
 
@@ -95,17 +99,10 @@ type MessagePosting struct {
 }
 
 // WorryMatch represents a worry word found in a message's subject or body.
-type WorryMatch struct {
-	Word      string    `json:"word"`
-	Worryword WorryWord `json:"worryword"`
-}
+type WorryMatch = contentscan.WorryMatch
 
 // WorryWord represents a row from the worrywords table.
-type WorryWord struct {
-	ID      uint64 `json:"id"`
-	Keyword string `json:"keyword"`
-	Type    string `json:"type"`
-}
+type WorryWord = contentscan.WorryWord
 
 type MessageEdit struct {
 	ID              uint64     `json:"id"`
@@ -494,9 +491,7 @@ func GetMessagesByIds(myid uint64, ids []string) []Message {
 // checkWorryWords checks message subjects and textbodies against global and
 // group-specific worry words.  Matches are stored in Message.Worry.
 func checkWorryWords(db *gorm.DB, messages []Message) {
-	// Load global worry words from the worrywords table.
-	var globalWords []WorryWord
-	db.Raw("SELECT id, keyword, type FROM worrywords").Scan(&globalWords)
+	globalWords := contentscan.WorryWords(db)
 
 	// Collect unique group IDs from all messages so we can load group-specific
 	// worry words in one pass.
@@ -526,118 +521,20 @@ func checkWorryWords(db *gorm.DB, messages []Message) {
 		}
 	}
 
-	// Build the combined word list per message (global + group-specific).
+	// Match against the global words plus those of the message's groups.
 	for i, msg := range messages {
-		words := make([]WorryWord, len(globalWords))
-		copy(words, globalWords)
+		var extra []WorryWord
 		for _, mg := range msg.MessageGroups {
-			if gw, ok := groupWords[mg.Groupid]; ok {
-				words = append(words, gw...)
-			}
+			extra = append(extra, groupWords[mg.Groupid]...)
 		}
 
-		matches := matchWorryWords(msg.Subject, msg.Textbody, words)
+		matches := globalWords.Matcher(extra).Match(msg.Subject, msg.Textbody)
 		if len(matches) > 0 {
 			messages[i].Worry = matches
 		}
 	}
 }
 
-// matchWorryWords scans subject and textbody for worry word matches.
-// checks for pound sign, removes Allowed words before scanning,
-// uses case-insensitive contains for phrases (keywords with spaces), and
-// levenshtein distance < 1 (i.e. exact match) for single words with
-// length-ratio filtering.
-func matchWorryWords(subject, textbody string, words []WorryWord) []WorryMatch {
-	var matches []WorryMatch
-	found := map[string]bool{}
-
-	subjectLower := strings.ToLower(subject)
-	textbodyLower := strings.ToLower(textbody)
-
-	for _, scan := range []string{subjectLower, textbodyLower} {
-		// Check for pound sign.
-		if strings.Contains(scan, "\u00a3") {
-			if !found["\u00a3"] {
-				matches = append(matches, WorryMatch{
-					Word: "\u00a3",
-					Worryword: WorryWord{Keyword: "\u00a3", Type: "Review"},
-				})
-				found["\u00a3"] = true
-			}
-		}
-
-		// Remove Allowed words before checking.
-		cleaned := scan
-		for _, w := range words {
-			if w.Type == "Allowed" {
-				cleaned = removeWordBoundary(cleaned, strings.ToLower(w.Keyword))
-			}
-		}
-
-		// Check phrases (keywords containing a space) via case-insensitive contains.
-		for _, w := range words {
-			kw := strings.ToLower(w.Keyword)
-			if w.Type == "Allowed" || !strings.Contains(kw, " ") {
-				continue
-			}
-			if found[kw] {
-				continue
-			}
-			if strings.Contains(subjectLower, kw) || strings.Contains(textbodyLower, kw) {
-				matches = append(matches, WorryMatch{
-					Word: w.Keyword,
-					Worryword: WorryWord{Keyword: w.Keyword, Type: w.Type},
-				})
-				found[kw] = true
-			}
-		}
-
-		// Split on word boundaries and check individual words.
-		tokens := splitOnWordBoundary(cleaned)
-		for _, token := range tokens {
-			token = strings.TrimSpace(token)
-			if token == "" {
-				continue
-			}
-			for _, w := range words {
-				kw := strings.ToLower(w.Keyword)
-				if w.Type == "Allowed" || found[kw] || len(kw) == 0 {
-					continue
-				}
-				// V1: ratio 0.75-1.25 and levenshtein < 1 (exact match).
-				ratio := float64(len(token)) / float64(len(kw))
-				if ratio >= 0.75 && ratio <= 1.25 && strings.EqualFold(token, kw) {
-					matches = append(matches, WorryMatch{
-						Word: w.Keyword,
-						Worryword: WorryWord{Keyword: w.Keyword, Type: w.Type},
-					})
-					found[kw] = true
-				}
-			}
-		}
-	}
-
-	return matches
-}
-
-// removeWordBoundary removes all occurrences of a word (case-insensitive,
-// word-boundary aware) from the text.
-func removeWordBoundary(text, word string) string {
-	re, err := regexp.Compile(`(?i)\b` + regexp.QuoteMeta(word) + `\b`)
-	if err != nil {
-		return text
-	}
-	return re.ReplaceAllString(text, "")
-}
-
-// splitOnWordBoundary splits text on non-alphanumeric characters (matching
-// PHP's preg_split("/\b/", ...)).
-func splitOnWordBoundary(text string) []string {
-	re := regexp.MustCompile(`[^a-zA-Z0-9]+`)
-	return re.Split(text, -1)
-}
-
 // sanitiseForEmail returns a lowercase alphanumeric version of a display name
 // suitable for the local part of an email address. Returns empty string if
 // the input yields no usable characters.
@@ -970,12 +867,11 @@ func Search(c *fiber.Ctx) error {
 	nelng, _ := strconv.ParseFloat(c.Query("nelng", "0"), 32)
 	swlat, _ := strconv.ParseFloat(c.Query("swlat", "0"), 32)
 	swlng, _ := strconv.ParseFloat(c.Query("swlng", "0"), 32)
+	lat, _ := strconv.ParseFloat(c.Query("lat", "0"), 64)
+	lng, _ := strconv.ParseFloat(c.Query("lng", "0"), 64)
+	radius, _ := strconv.ParseFloat(c.Query("radius", "0"), 64)
 
-	// We've seen problems with crashes inside Gorm.  Best I can tell, it looks like a Gorm bug exposed when an
-	// array is resized.  So as a workaround we create slices with capacity, then filter out the empty ones at
-	// the end.
 	var res []SearchResult
-	var res2 []SearchResult
 
 	if len(term) > 0 {
 		if term == "" {
@@ -984,35 +880,69 @@ func Search(c *fiber.Ctx) error {
 
 		words := GetWords(term)
 
-		var wg sync.WaitGroup
-		wg.Add(2)
-
-		go func() {
-			defer wg.Done()
-			res = GetWordsExact(db, words, SEARCH_LIMIT, groupids, msgtype, float32(nelat), float32(nelng), float32(swlat), float32(swlng))
-		}()
-
-		go func() {
-			defer wg.Done()
-			// Add in prefix matches, which helps with plurals.
-			res2 = GetWordsStarts(db, words, SEARCH_LIMIT, groupids, msgtype, float32(nelat), float32(nelng), float32(swlat), float32(swlng))
-		}()
-
-		wg.Wait()
+		f := searchFilter{
+			groupids: groupids,
+			msgtype:  msgtype,
+			nelat:    nelat,
+			nelng:    nelng,
+			swlat:    swlat,
+			swlng:    swlng,
+		}
 
-		res = append(res, res2...)
+		// Rank results by distance from the searcher: the point they give, or the middle of the map they're looking
+		// at, or else where we think they are.
+		if lat != 0 || lng != 0 {
+			f.centreLat = lat
+			f.centreLng = lng
+		} else if nelat != 0 && nelng != 0 && swlat != 0 && swlng != 0 {
+			f.centreLat = (nelat + swlat) / 2
+			f.centreLng = (nelng + swlng) / 2
+		} else if myid > 0 {
+			loc := user.GetLatLng(myid)
+			f.centreLat = float64(loc.Lat)
+			f.centreLng = float64(loc.Lng)
+		}
+
+		if radius > 0 {
+			if !f.hasCentre() {
+				return fiber.NewError(fiber.StatusBadRequest, "radius needs lat and lng")
+			}
 
-		if len(res) == 0 {
-			res = GetWordsTypo(db, words, SEARCH_LIMIT, groupids, msgtype, float32(nelat), float32(nelng), float32(swlat), float32(swlng))
+			f.radius = radius
 		}
 
-		if len(res) == 0 {
-			res = GetWordsSounds(db, words, SEARCH_LIMIT, groupids, msgtype, float32(nelat), float32(nelng), float32(swlat), float32(swlng))
+		if indexed, ok := searchWithIndex(db, words, f); ok {
+			res = indexed
+		} else {
+			res = searchWithWords(db, words, groupids, msgtype, nelat, nelng, swlat, swlng)
+
+			// The database search doesn't know about the radius, so apply it here.
+			inRadius := []SearchResult{}
+			for _, r := range res {
+				if f.withinRadius(r.Lat, r.Lng) {
+					inRadius = append(inRadius, r)
+				}
+			}
+			res = inRadius
+
+			// Nor does it know about distance, so put the nearest first as the index would.  The sort is stable so
+			// that equally distant results keep the database's order.
+			if f.hasCentre() {
+				sort.SliceStable(res, func(i, j int) bool {
+					return utils.Haversine(f.centreLat, f.centreLng, res[i].Lat, res[i].Lng) <
+						utils.Haversine(f.centreLat, f.centreLng, res[j].Lat, res[j].Lng)
+				})
+			}
 		}
 
-		// Blur
 		for ix, r := range res {
+			// Blur, and then give the distance to the blurred location so that it doesn't reveal more.
 			res[ix].Lat, res[ix].Lng = utils.Blur(r.Lat, r.Lng, utils.BLUR_USER)
+
+			if f.hasCentre() {
+				miles := math.Round(utils.Haversine(f.centreLat, f.centreLng, res[ix].Lat, res[ix].Lng)*10) / 10
+				res[ix].Distance = &miles
+			}
 		}
 	}
 
@@ -1030,6 +960,44 @@ func Search(c *fiber.Ctx) error {
 	return c.JSON(filtered)
 }
 
+// searchWithWords searches using the word index in the database.  We use this until the in-process index has
+// been built.
+func searchWithWords(db *gorm.DB, words []string, groupids []uint64, msgtype string, nelat float64, nelng float64, swlat float64, swlng float64) []SearchResult {
+	// We've seen problems with crashes inside Gorm.  Best I can tell, it looks like a Gorm bug exposed when an
+	// array is resized.  So as a workaround we create slices with capacity, then filter out the empty ones at
+	// the end.
+	var res []SearchResult
+	var res2 []SearchResult
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		res = GetWordsExact(db, words, SEARCH_LIMIT, groupids, msgtype, float32(nelat), float32(nelng), float32(swlat), float32(swlng))
+	}()
+
+	go func() {
+		defer wg.Done()
+		// Add in prefix matches, which helps with plurals.
+		res2 = GetWordsStarts(db, words, SEARCH_LIMIT, groupids, msgtype, float32(nelat), float32(nelng), float32(swlat), float32(swlng))
+	}()
+
+	wg.Wait()
+
+	res = append(res, res2...)
+
+	if len(res) == 0 {
+		res = GetWordsTypo(db, words, SEARCH_LIMIT, groupids, msgtype, float32(nelat), float32(nelng), float32(swlat), float32(swlng))
+	}
+
+	if len(res) == 0 {
+		res = GetWordsSounds(db, words, SEARCH_LIMIT, groupids, msgtype, float32(nelat), float32(nelng), float32(swlat), float32(swlng))
+	}
+
+	return res
+}
+
 // Activity represents a recent activity in groups
 // swagger:model Activity
 type Activity struct {
@@ -1288,9 +1256,7 @@ func getMessageModContext(db *gorm.DB, myid uint64, msgid uint64) *MessageModCon
 func logAndNotifyMods(db *gorm.DB, subtype string, ctx *MessageModContext, myid uint64, msgid uint64, stdmsgid uint64, text string) {
 	logModAction(db, flog.LOG_TYPE_MESSAGE, subtype, ctx.Groupid, ctx.Fromuser, myid, msgid, stdmsgid, text)
 	for _, gid := range ctx.Groupids {
-		if err := queue.QueueTask(queue.TaskPushNotifyGroupMods, map[string]interface{}{
-			"group_id": gid,
-		}); err != nil {
+		if err := queue.QueuePushNotifyGroupMods(gid); err != nil {
 			log.Printf("Failed to queue push notification for group %d: %v", gid, err)
 		}
 	}
@@ -1311,23 +1277,33 @@ func handleApprove(c *fiber.Ctx, myid uint64, req PostMessageRequest) error {
 	}
 	groupid := ctx.Groupid
 
+	audit := modaudit.Take(modaudit.TargetMessage, req.ID, groupid, "heldby", "messages_groups.collection")
+
 	// Move to Approved with arrival=NOW() so immediate-email recipients get it.
 	// Guard against double-approve by requiring collection != Approved.
+	approved := false
+
 	if req.Groupid != nil && *req.Groupid > 0 {
 		if result := db.Exec("UPDATE messages_groups SET collection = ?, approvedby = ?, approvedat = NOW(), arrival = NOW() WHERE msgid = ? AND groupid = ? AND collection != ?",
 			utils.COLLECTION_APPROVED, myid, req.ID, groupid, utils.COLLECTION_APPROVED); result.Error != nil {
 			log.Printf("Failed to approve message %d group %d: %v", req.ID, groupid, result.Error)
+		} else {
+			approved = result.RowsAffected > 0
 		}
 	} else {
 		if result := db.Exec("UPDATE messages_groups SET collection = ?, approvedby = ?, approvedat = NOW(), arrival = NOW() WHERE msgid = ? AND collection != ?",
 			utils.COLLECTION_APPROVED, myid, req.ID, utils.COLLECTION_APPROVED); result.Error != nil {
 			log.Printf("Failed to approve message %d: %v", req.ID, result.Error)
+		} else {
+			approved = result.RowsAffected > 0
 		}
 	}
 
 	// Release any hold.
 	db.Exec("UPDATE messages SET heldby = NULL WHERE id = ?", req.ID)
 
+	modaudit.Record(c, modaudit.ActionApprove, audit)
+
 	// Mark as ham if it was flagged as spam.
 	var spamtype *string
 	db.Raw("SELECT spamtype FROM messages WHERE id = ?", req.ID).Scan(&spamtype)
@@ -1364,6 +1340,11 @@ func handleApprove(c *fiber.Ctx, myid uint64, req PostMessageRequest) error {
 		}
 	}
 
+	// Tell people whose saved searches match, unless this was a repeat approval.
+	if approved {
+		alertSavedSearches(db, req.ID)
+	}
+
 	return c.JSON(fiber.Map{"ret": 0, "status": "Success"})
 }
 
@@ -1395,6 +1376,8 @@ func handleReject(c *fiber.Ctx, myid uint64, req PostMessageRequest) error {
 	}
 	groupid := ctx.Groupid
 
+	audit := modaudit.Take(modaudit.TargetMessage, req.ID, groupid, "messages_groups.collection", "messages_groups.deleted")
+
 	// With a subject (stdmsg), move to Rejected collection (user can edit and resubmit).
 	// Without a subject (plain delete), mark as deleted.
 	if subject != "" {
@@ -1419,6 +1402,8 @@ func handleReject(c *fiber.Ctx, myid uint64, req PostMessageRequest) error {
 		}
 	}
 
+	modaudit.Record(c, modaudit.ActionReject, audit)
+
 	// Queue rejection email.
 	// The batch processor will also create the mod log entry and notify group moderators.
 	db.Exec("INSERT INTO background_tasks (task_type, data) VALUES (?, JSON_OBJECT('msgid', ?, 'groupid', ?, 'byuser', ?, 'subject', ?, 'body', ?, 'stdmsgid', ?, 'action', ?))",
@@ -1513,8 +1498,11 @@ func handleHold(c *fiber.Ctx, myid uint64, req PostMessageRequest) error {
 		return fiber.NewError(fiber.StatusForbidden, "Not a moderator for this message")
 	}
 
+	audit := modaudit.Take(modaudit.TargetMessage, req.ID, ctx.Groupid, "heldby")
+
 	db.Exec("UPDATE messages SET heldby = ? WHERE id = ?", myid, req.ID)
 
+	modaudit.Record(c, modaudit.ActionHold, audit)
 	logAndNotifyMods(db, flog.LOG_SUBTYPE_HOLD, ctx, myid, req.ID, 0, "")
 
 	return c.JSON(fiber.Map{"ret": 0, "status": "Success"})
@@ -1529,6 +1517,13 @@ func handleBackToPending(c *fiber.Ctx, myid uint64, req PostMessageRequest) erro
 		return fiber.NewError(fiber.StatusForbidden, "Not a moderator for this message")
 	}
 
+	groupid := ctx.Groupid
+	if req.Groupid != nil && *req.Groupid > 0 {
+		groupid = *req.Groupid
+	}
+
+	audit := modaudit.Take(modaudit.TargetMessage, req.ID, groupid, "heldby", "messages_groups.collection")
+
 	// Hold the message for re-review (hold before moving to Pending).
 	db.Exec("UPDATE messages SET heldby = ? WHERE id = ?", myid, req.ID)
 
@@ -1542,6 +1537,7 @@ func handleBackToPending(c *fiber.Ctx, myid uint64, req PostMessageRequest) erro
 	}
 
 	// Log and notify moderators.
+	modaudit.Record(c, modaudit.ActionBackToPending, audit)
 	logAndNotifyMods(db, flog.LOG_SUBTYPE_HOLD, ctx, myid, req.ID, 0, "Back to pending")
 
 	return c.JSON(fiber.Map{"ret": 0, "status": "Success"})
@@ -1556,8 +1552,11 @@ func handleRelease(c *fiber.Ctx, myid uint64, req PostMessageRequest) error {
 		return fiber.NewError(fiber.StatusForbidden, "Not a moderator for this message")
 	}
 
+	audit := modaudit.Take(modaudit.TargetMessage, req.ID, ctx.Groupid, "heldby")
+
 	db.Exec("UPDATE messages SET heldby = NULL WHERE id = ?", req.ID)
 
+	modaudit.Record(c, modaudit.ActionRelease, audit)
 	logAndNotifyMods(db, flog.LOG_SUBTYPE_RELEASE, ctx, myid, req.ID, 0, "")
 
 	return c.JSON(fiber.Map{"ret": 0, "status": "Success"})
@@ -1639,6 +1638,11 @@ func handlePartnerConsent(c *fiber.Ctx, myid uint64, req PostMessageRequest) err
 		return fiber.NewError(fiber.StatusNotFound, "Partner not found")
 	}
 
+	// Only partners we've agreed can use messages with consent.
+	if !partner.PartnerHasScope(partnerID, partner.ScopeMessageConsent) {
+		return fiber.NewError(fiber.StatusForbidden, "Partner can't receive messages with consent")
+	}
+
 	// Record consent in partners_messages.
 	db.Exec("INSERT IGNORE INTO partners_messages (partnerid, msgid) VALUES (?, ?)", partnerID, req.ID)
 
@@ -1935,11 +1939,13 @@ func handleJoinAndPost(c *fiber.Ctx, myid uint64, req PostMessageRequest) error
 		}
 	}
 
+	if collection == utils.COLLECTION_APPROVED {
+		alertSavedSearches(db, req.ID)
+	}
+
 	// Notify group moderators about the new message.
 	if collection == utils.COLLECTION_PENDING {
-		if err := queue.QueueTask(queue.TaskPushNotifyGroupMods, map[string]interface{}{
-			"group_id": groupid,
-		}); err != nil {
+		if err := queue.QueuePushNotifyGroupMods(groupid); err != nil {
 			log.Printf("Failed to queue push notification for group %d on submit: %v", groupid, err)
 		}
 	}
@@ -1958,12 +1964,14 @@ func handleJoinAndPost(c *fiber.Ctx, myid uint64, req PostMessageRequest) error
 	if hasPassword == 0 {
 		// New user without a password — generate one and return it.
 		password := utils.RandomHex(8)
-		salt := auth.GetPasswordSalt()
-		hashed := auth.HashPassword(password, salt)
+		hashed, err := auth.HashPassword(password)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to hash password")
+		}
 
 		// uid must be the user ID (not email) so that VerifyPassword can find the row.
-		db.Exec("INSERT INTO users_logins (userid, type, uid, credentials, salt) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE credentials = VALUES(credentials), salt = VALUES(salt)",
-			myid, utils.LOGIN_TYPE_NATIVE, myid, hashed, salt)
+		db.Exec("INSERT INTO users_logins (userid, type, uid, credentials, salt) VALUES (?, ?, ?, ?, NULL) ON DUPLICATE KEY UPDATE credentials = VALUES(credentials), salt = NULL",
+			myid, utils.LOGIN_TYPE_NATIVE, myid, hashed)
 		resp["newuser"] = true
 		resp["newpassword"] = password
 	}
@@ -2037,6 +2045,13 @@ func PatchMessage(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusForbidden, "Not allowed to modify this message")
 	}
 
+	// Record what mods change in other people's messages, so that it can be undone.
+	var audit *modaudit.Snapshot
+	if isMod && !isOwner {
+		audit = modaudit.Take(modaudit.TargetMessage, req.ID, getPrimaryGroupForMessage(db, req.ID),
+			"subject", "textbody", "type", "availablenow", "deadline", "locationid", "messages_groups.msgtype")
+	}
+
 	// Get old values for edit tracking.
 	type msgValues struct {
 		Subject    string
@@ -2198,6 +2213,10 @@ func PatchMessage(c *fiber.Ctx) error {
 	// Issue 2: Log the edit (type='Message', subtype='Edit').
 	logModAction(db, flog.LOG_TYPE_MESSAGE, flog.LOG_SUBTYPE_EDIT, 0, fromuser, myid, req.ID, 0, "Message edited")
 
+	if audit != nil {
+		modaudit.Record(c, modaudit.ActionEdit, audit)
+	}
+
 	// Update attachment ordering if provided.
 	// req.Attachments is nil when the field is absent from JSON (don't touch).
 	// req.Attachments is [] (empty, non-nil) when all attachments are removed (#338).
@@ -2338,9 +2357,7 @@ func PatchMessage(c *fiber.Ctx) error {
 		// Only notify mods when review is required.
 		if reviewRequired == 1 {
 			for _, gid := range groupIDs {
-				if err := queue.QueueTask(queue.TaskPushNotifyGroupMods, map[string]interface{}{
-					"group_id": gid,
-				}); err != nil {
+				if err := queue.QueuePushNotifyGroupMods(gid); err != nil {
 					log.Printf("Failed to queue push notification for group %d on edit review: %v", gid, err)
 				}
 			}
@@ -2396,18 +2413,18 @@ func DeleteMessageEndpoint(c *fiber.Ctx) error {
 }
 
 // findOrCreateUserForDraft looks up a user by email, or creates one if not found.
-// Returns the user ID, JWT string, persistent token map, and any error.
+// Returns the user ID, JWT and refresh token, persistent token map, and any error.
 // This supports the give/want flow where users post without signing up first.
 //
 // SECURITY: For existing users, we do NOT create a session/JWT. Knowing someone's
 // email address must not grant authentication. A session is only created for
 // brand-new users.
-func findOrCreateUserForDraft(db *gorm.DB, email string) (uint64, string, fiber.Map, error) {
+func findOrCreateUserForDraft(db *gorm.DB, email string) (uint64, auth.Tokens, fiber.Map, error) {
 	email = strings.TrimSpace(email)
 
 	// Basic email validation.
 	if !strings.Contains(email, "@") || len(email) > 254 {
-		return 0, "", nil, fmt.Errorf("invalid email address")
+		return 0, auth.Tokens{}, nil, fmt.Errorf("invalid email address")
 	}
 
 	// Look up existing user by email.
@@ -2417,7 +2434,7 @@ func findOrCreateUserForDraft(db *gorm.DB, email string) (uint64, string, fiber.
 	if existingUID > 0 {
 		// Existing user — return their ID so the draft is linked to them,
 		// but do NOT create a session.  The user must authenticate separately.
-		return existingUID, "", nil, nil
+		return existingUID, auth.Tokens{}, nil, nil
 	}
 
 	// New user — create user, email, session, JWT.
@@ -2426,17 +2443,17 @@ func findOrCreateUserForDraft(db *gorm.DB, email string) (uint64, string, fiber.
 	// SELECT LAST_INSERT_ID() query could land on a different connection.
 	sqlDB, err := db.DB()
 	if err != nil {
-		return 0, "", nil, fmt.Errorf("failed to get DB connection: %w", err)
+		return 0, auth.Tokens{}, nil, fmt.Errorf("failed to get DB connection: %w", err)
 	}
 
 	sqlResult, err := sqlDB.Exec("INSERT INTO users (added) VALUES (NOW())")
 	if err != nil {
-		return 0, "", nil, fmt.Errorf("failed to create user: %w", err)
+		return 0, auth.Tokens{}, nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
 	newUserIDInt, err := sqlResult.LastInsertId()
 	if err != nil || newUserIDInt == 0 {
-		return 0, "", nil, fmt.Errorf("failed to get new user ID")
+		return 0, auth.Tokens{}, nil, fmt.Errorf("failed to get new user ID")
 	}
 	newUserID := uint64(newUserIDInt)
 
@@ -2454,15 +2471,9 @@ func findOrCreateUserForDraft(db *gorm.DB, email string) (uint64, string, fiber.
 	var sessionID uint64
 	db.Raw("SELECT id FROM sessions WHERE userid = ? AND token = ? ORDER BY id DESC LIMIT 1", newUserID, token).Scan(&sessionID)
 
-	// Generate JWT.
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":        fmt.Sprint(newUserID),
-		"sessionid": fmt.Sprint(sessionID),
-		"exp":       time.Now().Unix() + 30*24*60*60,
-	})
-	jwtString, err := jwtToken.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	tokens, err := auth.IssueTokens(newUserID, sessionID)
 	if err != nil {
-		return 0, "", nil, err
+		return 0, auth.Tokens{}, nil, err
 	}
 
 	persistent := fiber.Map{
@@ -2471,7 +2482,7 @@ func findOrCreateUserForDraft(db *gorm.DB, email string) (uint64, string, fiber.
 		"token":  token,
 		"userid": newUserID,
 	}
-	return newUserID, jwtString, persistent, nil
+	return newUserID, tokens, persistent, nil
 }
 
 // PutMessage creates a new message draft (PUT /message).
@@ -2525,17 +2536,21 @@ func PutMessage(c *fiber.Ctx) error {
 	db := database.DBConn
 
 	// Handle unauthenticated user with email — find or create, then generate JWT.
-	var jwtString string
+	var tokens auth.Tokens
 	var persistent fiber.Map
 	if myid == 0 && req.Email != "" {
 		var err error
-		myid, jwtString, persistent, err = findOrCreateUserForDraft(db, req.Email)
+		myid, tokens, persistent, err = findOrCreateUserForDraft(db, req.Email)
 		if err != nil {
 			if strings.Contains(err.Error(), "invalid email") {
 				return fiber.NewError(fiber.StatusBadRequest, "Invalid email address")
 			}
 			return fiber.NewError(fiber.StatusInternalServerError, "Failed to create user")
 		}
+
+		if sessionID, ok := persistent["id"].(uint64); ok {
+			auth.RecordSessionClient(c, sessionID)
+		}
 	}
 
 	if myid == 0 {
@@ -2594,6 +2609,8 @@ func PutMessage(c *fiber.Ctx) error {
 
 	// For Draft collection, store in messages_drafts.
 	// For other collections, add to messages_groups.
+	autoApproved := false
+
 	if req.Collection == "Draft" {
 		db.Exec("INSERT INTO messages_drafts (msgid, groupid, userid) VALUES (?, ?, ?)",
 			newMsgID, req.Groupid, myid)
@@ -2619,6 +2636,7 @@ func PutMessage(c *fiber.Ctx) error {
 
 		db.Exec("INSERT INTO messages_groups (msgid, groupid, collection, arrival) VALUES (?, ?, ?, NOW())",
 			newMsgID, req.Groupid, collection)
+		autoApproved = collection == utils.COLLECTION_APPROVED
 	}
 
 	// Link attachments.
@@ -2667,9 +2685,15 @@ func PutMessage(c *fiber.Ctx) error {
 		}
 	}
 
+	// Posts from unmoderated members go straight to Approved, so tell people whose saved searches match.
+	if autoApproved {
+		alertSavedSearches(db, newMsgID)
+	}
+
 	resp := fiber.Map{"ret": 0, "status": "Success", "id": newMsgID}
-	if jwtString != "" {
-		resp["jwt"] = jwtString
+	if tokens.JWT != "" {
+		resp["jwt"] = tokens.JWT
+		resp["refreshtoken"] = tokens.RefreshToken
 		resp["persistent"] = persistent
 	}
 	return c.JSON(resp)
@@ -3144,10 +3168,12 @@ func handleMove(c *fiber.Ctx, myid uint64, req PostMessageRequest) error {
 	}
 
 	// Must also be mod of the target group.
-	if !user.IsModOfGroup(myid, *req.Groupid) {
+	if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_MODERATE, *req.Groupid) {
 		return fiber.NewError(fiber.StatusForbidden, "Not a moderator on the target group")
 	}
 
+	audit := modaudit.Take(modaudit.TargetMessage, req.ID, getPrimaryGroupForMessage(db, req.ID), "messages_groups.groupid", "messages_groups.collection")
+
 	// Use a transaction to ensure DELETE + INSERT are atomic.
 	// Without this, a failure after DELETE would orphan the message.
 	err := db.Transaction(func(tx *gorm.DB) error {
@@ -3168,6 +3194,9 @@ func handleMove(c *fiber.Ctx, myid uint64, req PostMessageRequest) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to move message: "+err.Error())
 	}
 
+	audit.Moved(*req.Groupid)
+	modaudit.Record(c, modaudit.ActionMove, audit)
+
 	return c.JSON(fiber.Map{"ret": 0, "status": "Success"})
 }
 
@@ -2,6 +2,7 @@ package message
 
 import (
 	"encoding/json"
+	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/misc"
 	"github.com/freegle/iznik-server-go/user"
@@ -100,7 +101,7 @@ func ListMessages(c *fiber.Ctx) error {
 		}
 	} else {
 		if collection != utils.COLLECTION_APPROVED {
-			if !user.IsModOfGroup(myid, groupid) {
+			if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_VIEW, groupid) {
 				return fiber.NewError(fiber.StatusForbidden, "Not a moderator for this group")
 			}
 		}
@@ -360,7 +361,7 @@ func ListMessagesMT(c *fiber.Ctx) error {
 		}
 	} else {
 		if collection != utils.COLLECTION_APPROVED {
-			if !user.IsModOfGroup(myid, groupid) {
+			if !auth.PolicyFor(c).CanInGroup(auth.PERM_GROUP_VIEW, groupid) {
 				return fiber.NewError(fiber.StatusForbidden, "Not a moderator for this group")
 			}
 		}
@@ -26,6 +26,7 @@ type SearchResult struct {
 	Word      string    `json:"word"`
 	Type      string    `json:"type"`
 	Matchedon Matchedon `json:"matchedon" gorm:"-"`
+	Distance  *float64  `json:"distance,omitempty" gorm:"-"`
 }
 
 func GetWords(search string) []string {
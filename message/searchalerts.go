@@ -0,0 +1,87 @@
+package message
+
+import (
+	"log"
+
+	"github.com/freegle/iznik-server-go/queue"
+	"github.com/freegle/iznik-server-go/search"
+	"github.com/freegle/iznik-server-go/utils"
+	"gorm.io/gorm"
+)
+
+type savedSearch struct {
+	ID          uint64
+	Userid      uint64
+	Term        string
+	Lat         *float64
+	Lng         *float64
+	Radius      *float64
+	Isochroneid *uint64
+}
+
+// alertSavedSearches queues an alert to each user with a saved search which matches a newly approved message.
+// Searches are saved by user.SaveUserSearch.  Call it from every path which approves a message; a message which
+// is already approved on another group has been alerted already, so we don't alert it again.
+func alertSavedSearches(db *gorm.DB, msgid uint64) {
+	var approvedOn int64
+	db.Raw("SELECT COUNT(*) FROM messages_groups WHERE msgid = ? AND collection = ?", msgid, utils.COLLECTION_APPROVED).Scan(&approvedOn)
+
+	if approvedOn > 1 {
+		return
+	}
+
+	var msg struct {
+		Fromuser uint64
+		Subject  string
+		Type     string
+		Lat      float64
+		Lng      float64
+	}
+	db.Raw("SELECT COALESCE(fromuser, 0) AS fromuser, COALESCE(subject, '') AS subject, type, COALESCE(lat, 0) AS lat, COALESCE(lng, 0) AS lng FROM messages WHERE id = ?", msgid).Scan(&msg)
+
+	if msg.Subject == "" || (msg.Lat == 0 && msg.Lng == 0) {
+		return
+	}
+
+	// Narrow down in the database by type and area, and then check the terms here.  The radius check is on a
+	// bounding box, which we refine below.
+	var candidates []savedSearch
+	db.Raw("SELECT users_searches.id, users_searches.userid, users_searches.term, users_searches.lat, users_searches.lng, "+
+		"users_searches.radius, users_searches.isochroneid FROM users_searches "+
+		"LEFT JOIN isochrones ON isochrones.id = users_searches.isochroneid "+
+		"WHERE users_searches.alert = 1 AND users_searches.deleted = 0 AND users_searches.userid != ? "+
+		"AND (users_searches.msgtype IS NULL OR users_searches.msgtype = ?) "+
+		"AND ((users_searches.isochroneid IS NOT NULL AND ST_Contains(isochrones.polygon, ST_SRID(POINT(?, ?), ?))) "+
+		"OR (users_searches.isochroneid IS NULL AND ABS(users_searches.lat - ?) <= users_searches.radius / ? "+
+		"AND ABS(users_searches.lng - ?) <= users_searches.radius / ? / COS(RADIANS(?))))",
+		msg.Fromuser, msg.Type, msg.Lng, msg.Lat, utils.SRID, msg.Lat, milesPerDegree, msg.Lng, milesPerDegree, msg.Lat).Scan(&candidates)
+
+	for userid, searchids := range matchingSearches(subjectWords(msg.Subject), msg.Lat, msg.Lng, candidates) {
+		if err := queue.QueueSavedSearchAlert(db, userid, msgid, searchids); err != nil {
+			log.Printf("Failed to queue saved search alert for user %d message %d: %v", userid, msgid, err)
+			continue
+		}
+
+		db.Exec("UPDATE users_searches SET lastalert = NOW() WHERE id IN ?", searchids)
+	}
+}
+
+// matchingSearches returns the IDs of the searches which match a message, by user, so that someone with several
+// matching searches only gets one alert.
+func matchingSearches(words []string, lat float64, lng float64, candidates []savedSearch) map[uint64][]uint64 {
+	ret := map[uint64][]uint64{}
+
+	for _, s := range candidates {
+		if s.Isochroneid == nil {
+			if s.Lat == nil || s.Lng == nil || s.Radius == nil || utils.Haversine(*s.Lat, *s.Lng, lat, lng) > *s.Radius {
+				continue
+			}
+		}
+
+		if search.MatchesAll(GetWords(s.Term), words) {
+			ret[s.Userid] = append(ret[s.Userid], s.ID)
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,297 @@
+package message
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/search"
+	"github.com/freegle/iznik-server-go/utils"
+	"gorm.io/gorm"
+)
+
+// The search index holds the subjects of the messages in messages_spatial, i.e. those which are currently shown
+// on the map.  It is built in the background the first time someone searches, then kept up to date by picking up
+// newly arrived messages every searchIndexRefresh.  Messages which have left messages_spatial are dropped when the
+// index is rebuilt every searchIndexRebuild, and in the meantime are filtered out when we fetch the results.
+
+const (
+	searchIndexRefresh = 15 * time.Second
+	searchIndexRebuild = 10 * time.Minute
+
+	// searchBoxPadding matches the padding in boxFilter.
+	searchBoxPadding = 0.02
+
+	// Results are boosted by up to searchDistanceWeight for being near the searcher.  The boost halves at
+	// searchDistanceScale miles.
+	searchDistanceWeight = 1.0
+	searchDistanceScale  = 10.0
+
+	// Results are boosted by up to searchRecencyWeight for being recent.  The boost decays over searchRecencyScale
+	// days.
+	searchRecencyWeight = 0.5
+	searchRecencyScale  = 14.0
+
+	// milesPerDegree is the length of a degree of latitude.
+	milesPerDegree = 69.0
+)
+
+type indexedMessage struct {
+	Msgid   uint64
+	Groupid uint64
+	Msgtype string
+	Arrival time.Time
+	Lat     float64
+	Lng     float64
+	Subject string
+}
+
+type messageIndex struct {
+	idx    *search.Index
+	mu     sync.RWMutex
+	meta   map[uint64]indexedMessage
+	latest time.Time
+}
+
+var currentSearchIndex atomic.Pointer[messageIndex]
+var searchIndexOnce sync.Once
+
+// subjectWords returns the words we index for a subject.  The location in brackets at the end isn't what the
+// message is about, so we leave it out.
+func subjectWords(subject string) []string {
+	if i := strings.LastIndex(subject, "("); i > 0 {
+		subject = subject[:i]
+	}
+
+	return GetWords(subject)
+}
+
+func loadIndexedMessages(db *gorm.DB, since *time.Time) []indexedMessage {
+	sql := "SELECT messages_spatial.msgid, messages_spatial.groupid, messages_spatial.msgtype, messages_spatial.arrival, " +
+		"ST_Y(point) AS lat, ST_X(point) AS lng, messages.subject FROM messages_spatial " +
+		"INNER JOIN messages ON messages.id = messages_spatial.msgid"
+
+	var rows []indexedMessage
+
+	if since != nil {
+		db.Raw(sql+" WHERE messages_spatial.arrival >= ?", since.Format("2006-01-02 15:04:05")).Scan(&rows)
+	} else {
+		db.Raw(sql).Scan(&rows)
+	}
+
+	return rows
+}
+
+func (m *messageIndex) add(rows []indexedMessage) {
+	for _, r := range rows {
+		m.idx.Add(r.Msgid, subjectWords(r.Subject))
+
+		m.mu.Lock()
+		m.meta[r.Msgid] = r
+
+		if r.Arrival.After(m.latest) {
+			m.latest = r.Arrival
+		}
+		m.mu.Unlock()
+	}
+}
+
+// refresh picks up messages which have arrived (or been reposted) since the newest one we have.  We overlap by a
+// minute in case of messages which were added slightly out of order.
+func (m *messageIndex) refresh(db *gorm.DB) {
+	m.mu.RLock()
+	since := m.latest.Add(-time.Minute)
+	m.mu.RUnlock()
+
+	m.add(loadIndexedMessages(db, &since))
+}
+
+// RefreshSearchIndex rebuilds the search index from scratch and starts using it.
+func RefreshSearchIndex(db *gorm.DB) {
+	m := &messageIndex{
+		idx:  search.NewIndex(),
+		meta: make(map[uint64]indexedMessage),
+	}
+
+	m.add(loadIndexedMessages(db, nil))
+	currentSearchIndex.Store(m)
+}
+
+// startSearchIndex builds the index in the background, and then keeps it up to date.
+func startSearchIndex() {
+	searchIndexOnce.Do(func() {
+		go func() {
+			db := database.DBConn
+			RefreshSearchIndex(db)
+			rebuilt := time.Now()
+
+			for {
+				time.Sleep(searchIndexRefresh)
+
+				if time.Since(rebuilt) > searchIndexRebuild {
+					RefreshSearchIndex(db)
+					rebuilt = time.Now()
+				} else {
+					currentSearchIndex.Load().refresh(db)
+				}
+			}
+		}()
+	})
+}
+
+// searchFilter describes which messages a search should return, and where the searcher is.
+type searchFilter struct {
+	groupids  []uint64
+	msgtype   string
+	nelat     float64
+	nelng     float64
+	swlat     float64
+	swlng     float64
+	centreLat float64
+	centreLng float64
+
+	// radius is in miles from the centre.  0 means no limit.
+	radius float64
+}
+
+func (f searchFilter) hasCentre() bool {
+	return f.centreLat != 0 || f.centreLng != 0
+}
+
+// withinRadius checks whether a point is within the radius of the centre.  We check a bounding box first as that
+// is much cheaper than the distance.
+func (f searchFilter) withinRadius(lat float64, lng float64) bool {
+	if f.radius <= 0 || !f.hasCentre() {
+		return true
+	}
+
+	dlat := f.radius / milesPerDegree
+	dlng := dlat / math.Max(math.Cos(f.centreLat*math.Pi/180), 0.01)
+
+	if math.Abs(lat-f.centreLat) > dlat || math.Abs(lng-f.centreLng) > dlng {
+		return false
+	}
+
+	return utils.Haversine(f.centreLat, f.centreLng, lat, lng) <= f.radius
+}
+
+func (f searchFilter) accepts(m indexedMessage, groups map[uint64]bool) bool {
+	if len(groups) > 0 && !groups[m.Groupid] {
+		return false
+	}
+
+	if (f.msgtype == utils.OFFER || f.msgtype == utils.WANTED) && m.Msgtype != f.msgtype {
+		return false
+	}
+
+	if f.nelat != 0 && f.nelng != 0 && f.swlat != 0 && f.swlng != 0 {
+		if m.Lat > f.nelat+searchBoxPadding || m.Lat < f.swlat-searchBoxPadding ||
+			m.Lng > f.nelng+searchBoxPadding || m.Lng < f.swlng-searchBoxPadding {
+			return false
+		}
+	}
+
+	return f.withinRadius(m.Lat, m.Lng)
+}
+
+// boost returns the multiplier for a message's text score, favouring messages which are near and recent.
+func (f searchFilter) boost(m indexedMessage, now time.Time) float64 {
+	ret := 1.0
+
+	if f.hasCentre() {
+		miles := utils.Haversine(f.centreLat, f.centreLng, m.Lat, m.Lng)
+		ret *= 1 + searchDistanceWeight/(1+miles/searchDistanceScale)
+	}
+
+	days := now.Sub(m.Arrival).Hours() / 24
+	if days < 0 {
+		days = 0
+	}
+
+	ret *= 1 + searchRecencyWeight*math.Exp(-days/searchRecencyScale)
+
+	return ret
+}
+
+// search returns up to limit hits for the words, best first.
+func (m *messageIndex) search(words []string, f searchFilter, limit int) []search.Hit {
+	groups := map[uint64]bool{}
+	for _, gid := range f.groupids {
+		groups[gid] = true
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	hits := m.idx.Search(words, func(id uint64) bool {
+		meta, ok := m.meta[id]
+		return ok && f.accepts(meta, groups)
+	})
+
+	now := time.Now()
+
+	for i := range hits {
+		hits[i].Score *= f.boost(m.meta[hits[i].ID], now)
+	}
+
+	search.SortHits(hits)
+
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	return hits
+}
+
+// searchWithIndex runs a search using the index.  The second return value is false if the index isn't ready yet.
+func searchWithIndex(db *gorm.DB, words []string, f searchFilter) ([]SearchResult, bool) {
+	startSearchIndex()
+
+	m := currentSearchIndex.Load()
+	if m == nil {
+		return nil, false
+	}
+
+	// Ask for more than we need, as some may have left messages_spatial since we indexed them.
+	hits := m.search(words, f, SEARCH_LIMIT*2)
+
+	if len(hits) == 0 {
+		return []SearchResult{}, true
+	}
+
+	ids := make([]uint64, len(hits))
+	for i, h := range hits {
+		ids[i] = h.ID
+	}
+
+	var current []SearchResult
+	db.Raw("SELECT messages_spatial.msgid, messages_spatial.groupid, messages_spatial.arrival, messages_spatial.msgtype AS type, "+
+		"ST_Y(point) AS lat, ST_X(point) AS lng FROM messages_spatial WHERE msgid IN ?", ids).Scan(&current)
+
+	byID := make(map[uint64]SearchResult, len(current))
+	for _, r := range current {
+		byID[r.Msgid] = r
+	}
+
+	res := []SearchResult{}
+
+	for _, h := range hits {
+		r, ok := byID[h.ID]
+		if !ok {
+			continue
+		}
+
+		r.Word = h.Word
+		r.Matchedon = Matchedon{Type: h.Match, Word: h.Word}
+		res = append(res, r)
+
+		if len(res) >= SEARCH_LIMIT {
+			break
+		}
+	}
+
+	return res, true
+}
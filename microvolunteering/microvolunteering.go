@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/user"
@@ -88,9 +89,7 @@ func GetChallenge(c *fiber.Ctx) error {
 	// Get user ID from JWT
 	userID, _, _ := user.GetJWTFromRequest(c)
 	if userID == 0 {
-		return c.Status(401).JSON(fiber.Map{
-			"error": "Not logged in",
-		})
+		return apierror.ErrNotLoggedIn
 	}
 
 	// when list=true, return moderator listing of microactions.
@@ -131,9 +130,7 @@ func GetChallenge(c *fiber.Ctx) error {
 	`, TrustBasic, userID).Scan(&trustLevel).Error
 
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Failed to fetch user trust level",
-		})
+		return apierror.ErrInternal.WithMessage("Failed to fetch user trust level").WithCause(err)
 	}
 
 	// Don't offer challenges to declined/excluded users
@@ -74,11 +74,36 @@ func truncateString(s string) string {
 	return s[:maxStringLength] + "..."
 }
 
-// truncateMap recursively truncates all string values in a map.
+// sensitiveKeys are parameters whose values are credentials, so we don't log any of them.  Even a truncated JWT
+// or refresh token is too much.
+var sensitiveKeys = map[string]bool{
+	"jwt":           true,
+	"refreshtoken":  true,
+	"password":      true,
+	"totp":          true,
+	"recoverycode":  true,
+	"recoverycodes": true,
+	"secret":        true,
+	"token":         true,
+	"k":             true,
+	"client_secret": true,
+	"code_verifier": true,
+	"access_token":  true,
+	"id_token":      true,
+}
+
+// redactedValue replaces the value of a sensitive key.
+const redactedValue = "[redacted]"
+
+// truncateMap recursively truncates all string values in a map, and redacts sensitive ones.
 func truncateMap(data map[string]interface{}) map[string]interface{} {
 	result := make(map[string]interface{})
 	for k, v := range data {
-		result[k] = truncateValue(v)
+		if sensitiveKeys[strings.ToLower(k)] {
+			result[k] = redactedValue
+		} else {
+			result[k] = truncateValue(v)
+		}
 	}
 	return result
 }
@@ -186,7 +211,11 @@ func (l *LokiClient) LogApiRequestFull(version, method, endpoint string, statusC
 	if len(queryParams) > 0 {
 		truncatedParams := make(map[string]string)
 		for k, v := range queryParams {
-			truncatedParams[k] = truncateString(v)
+			if sensitiveKeys[strings.ToLower(k)] {
+				truncatedParams[k] = redactedValue
+			} else {
+				truncatedParams[k] = truncateString(v)
+			}
 		}
 		logData["query_params"] = truncatedParams
 	}
@@ -5,33 +5,12 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"strings"
 
+	"github.com/freegle/iznik-server-go/auth"
 	"github.com/gofiber/fiber/v2"
 	"time"
 )
 
-// getClientIP extracts the real client IP, checking proxy headers first.
-// Checks proxy headers first for HAProxy compatibility.
-func getClientIP(c *fiber.Ctx) string {
-	// X-Forwarded-For can contain multiple IPs: "client, proxy1, proxy2"
-	// The first IP is the original client.
-	if xff := c.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		if clientIP := strings.TrimSpace(ips[0]); clientIP != "" {
-			return clientIP
-		}
-	}
-
-	// X-Real-IP is typically set by nginx/HAProxy.
-	if xri := c.Get("X-Real-IP"); xri != "" {
-		return strings.TrimSpace(xri)
-	}
-
-	// Fall back to Fiber's IP detection.
-	return c.IP()
-}
-
 // LokiMiddlewareConfig configures the Loki logging middleware.
 type LokiMiddlewareConfig struct {
 	Skip func(c *fiber.Ctx) bool
@@ -70,7 +49,7 @@ func NewLokiMiddleware(config LokiMiddlewareConfig) fiber.Handler {
 		// Capture request info before c.Next()
 		method := c.Method()
 		path := c.Path()
-		ip := getClientIP(c)
+		ip := auth.ClientIP(c)
 
 		// Capture query parameters.
 		queryParams := make(map[string]string)
@@ -93,12 +72,8 @@ func NewLokiMiddleware(config LokiMiddlewareConfig) fiber.Handler {
 			userId = config.GetUserId(c)
 		}
 
-		// Generate unique request_id to correlate API logs with headers logs.
-		// Format: timestamp_ms (hex) + random bytes for uniqueness within same ms.
-		timestampMs := time.Now().UnixMilli()
-		randomBytes := make([]byte, 4)
-		rand.Read(randomBytes)
-		requestId := fmt.Sprintf("%x%s", timestampMs, hex.EncodeToString(randomBytes))
+		// Get the request_id to correlate API logs with headers logs.
+		requestId := RequestID(c)
 
 		// Process request
 		err := c.Next()
@@ -174,3 +149,21 @@ func NewLokiMiddleware(config LokiMiddlewareConfig) fiber.Handler {
 		return err
 	}
 }
+
+// RequestID returns a unique ID for the request, which we log to Loki.  Record it elsewhere to find the logs for a
+// request.
+func RequestID(c *fiber.Ctx) string {
+	if id, ok := c.Locals("requestId").(string); ok {
+		return id
+	}
+
+	// Format: timestamp_ms (hex) + random bytes for uniqueness within same ms.
+	timestampMs := time.Now().UnixMilli()
+	randomBytes := make([]byte, 4)
+	rand.Read(randomBytes)
+	id := fmt.Sprintf("%x%s", timestampMs, hex.EncodeToString(randomBytes))
+
+	c.Locals("requestId", id)
+
+	return id
+}
@@ -0,0 +1,268 @@
+package modaudit
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/misc"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// maxEntries is the most entries we return at once.
+const maxEntries = 100
+
+// Entry is a recorded change.
+type Entry struct {
+	ID          uint64            `json:"id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Byuser      uint64            `json:"byuser"`
+	Action      string            `json:"action"`
+	Targettype  string            `json:"targettype"`
+	Targetid    uint64            `json:"targetid"`
+	Groupid     *uint64           `json:"groupid"`
+	Requestid   string            `json:"requestid"`
+	ChangesJSON string            `json:"-" gorm:"column:changes"`
+	Changes     map[string]Change `json:"changes" gorm:"-"`
+	Undoable    bool              `json:"undoable"`
+	Undoneby    *uint64           `json:"undoneby"`
+	Undoneat    *time.Time        `json:"undoneat"`
+	Undoof      *uint64           `json:"undoof"`
+}
+
+const entryColumns = "id, timestamp, byuser, action, targettype, targetid, groupid, requestid, changes, undoable, undoneby, undoneat, undoof"
+
+func (e *Entry) decode() {
+	e.Changes = map[string]Change{}
+	json.Unmarshal([]byte(e.ChangesJSON), &e.Changes)
+}
+
+// canUndo returns whether a user can undo an entry.  For changes in a group they need to be able to moderate it;
+// for other things, such as mod configs, only the person who made the change or support can.
+func canUndo(p *auth.Policy, e *Entry) bool {
+	if p.Can(auth.PERM_SYSTEM_SUPPORT) {
+		return true
+	}
+
+	t := targets[e.Targettype]
+
+	for _, column := range t.supportColumns {
+		if _, ok := e.Changes[column]; ok {
+			return false
+		}
+	}
+
+	if e.Groupid == nil {
+		return e.Byuser == p.UserID
+	}
+
+	if !p.CanInGroup(auth.PERM_GROUP_MODERATE, *e.Groupid) {
+		return false
+	}
+
+	// Moving something back needs permission in the group it's moving out of, too.
+	if change, ok := e.Changes[t.groupColumn]; ok && change.After != nil {
+		groupid, _ := strconv.ParseUint(*change.After, 10, 64)
+		return p.CanInGroup(auth.PERM_GROUP_MODERATE, groupid)
+	}
+
+	return true
+}
+
+// ListAudit returns recorded changes, most recent first, for a group or a target.  Mods see changes in groups they
+// moderate, and changes they made themselves; support see everything.
+//
+// @Summary List moderator changes
+// @Tags modtools
+// @Router /api/modtools/audit [get]
+func ListAudit(c *fiber.Ctx) error {
+	p := auth.PolicyFor(c)
+	if p.UserID == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	var where []string
+	var args []interface{}
+
+	if groupid, _ := strconv.ParseUint(c.Query("groupid"), 10, 64); groupid > 0 {
+		if !p.CanInGroup(auth.PERM_GROUP_MODERATE, groupid) {
+			return apierror.ErrForbidden
+		}
+
+		where = append(where, "groupid = ?")
+		args = append(args, groupid)
+	} else if !p.Can(auth.PERM_SYSTEM_SUPPORT) {
+		groupids := p.GroupsWith(auth.PERM_GROUP_MODERATE)
+		if len(groupids) > 0 {
+			where = append(where, "(groupid IN ? OR byuser = ?)")
+			args = append(args, groupids, p.UserID)
+		} else {
+			where = append(where, "byuser = ?")
+			args = append(args, p.UserID)
+		}
+	}
+
+	if targettype := c.Query("targettype"); targettype != "" {
+		if _, ok := targets[targettype]; !ok {
+			return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "Unknown targettype")
+		}
+
+		where = append(where, "targettype = ?")
+		args = append(args, targettype)
+
+		if targetid, _ := strconv.ParseUint(c.Query("targetid"), 10, 64); targetid > 0 {
+			where = append(where, "targetid = ?")
+			args = append(args, targetid)
+		}
+	}
+
+	if ctx, _ := strconv.ParseUint(c.Query("context"), 10, 64); ctx > 0 {
+		where = append(where, "id < ?")
+		args = append(args, ctx)
+	}
+
+	limit := c.QueryInt("limit", maxEntries)
+	if limit < 1 || limit > maxEntries {
+		limit = maxEntries
+	}
+
+	query := "SELECT " + entryColumns + " FROM mod_audit"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	entries := []Entry{}
+	database.DBConn.Raw(query, args...).Scan(&entries)
+
+	for i := range entries {
+		entries[i].decode()
+	}
+
+	var next uint64
+	if len(entries) == limit {
+		next = entries[len(entries)-1].ID
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":     0,
+		"status":  "Success",
+		"entries": entries,
+		"context": next,
+	})
+}
+
+// Undo puts back what a change replaced, and records that as a change itself.  It fails if the values have been
+// changed again since, as we'd overwrite that.
+//
+// @Summary Undo a moderator change
+// @Tags modtools
+// @Router /api/modtools/audit/{id}/undo [post]
+func Undo(c *fiber.Ctx) error {
+	p := auth.PolicyFor(c)
+	if p.UserID == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil || id == 0 {
+		return apierror.ErrInvalidID
+	}
+
+	var e Entry
+	database.DBConn.Raw("SELECT "+entryColumns+" FROM mod_audit WHERE id = ?", id).Scan(&e)
+	if e.ID == 0 {
+		return apierror.ErrNotFound.WithMessage("Change not found")
+	}
+
+	e.decode()
+
+	if !canUndo(p, &e) {
+		return apierror.ErrForbidden
+	}
+
+	if !e.Undoable {
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "This change can't be undone")
+	}
+
+	if e.Undoneat != nil {
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "This change has already been undone")
+	}
+
+	s := &Snapshot{Targettype: e.Targettype, Targetid: e.Targetid}
+	if e.Groupid != nil {
+		s.Groupid = *e.Groupid
+	}
+
+	for column := range e.Changes {
+		s.Columns = append(s.Columns, column)
+	}
+
+	t := targets[e.Targettype]
+
+	// The target is in the group the change was made in, unless the change moved it.
+	groupid := s.Groupid
+	if moved, ok := e.Changes[t.groupColumn]; ok && moved.After != nil {
+		groupid, _ = strconv.ParseUint(*moved.After, 10, 64)
+	}
+
+	// Only undo if things are still as the change left them.
+	s.Values = s.read(groupid)
+	for column, change := range e.Changes {
+		if (change.After == nil) != (s.Values[column] == nil) || (change.After != nil && *change.After != *s.Values[column]) {
+			return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "This has been changed again since")
+		}
+	}
+
+	err = database.DBConn.Transaction(func(tx *gorm.DB) error {
+		// Claim the entry first, so that two people undoing at once don't both succeed.
+		result := tx.Exec("UPDATE mod_audit SET undoneby = ?, undoneat = NOW() WHERE id = ? AND undoneat IS NULL", p.UserID, e.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "This change has already been undone")
+		}
+
+		for prefix, names := range t.byTable(s.Columns) {
+			tbl := t.table(prefix)
+
+			sets := make([]string, len(names))
+			values := make([]interface{}, len(names))
+			for i, name := range names {
+				sets[i] = "`" + name + "` = ?"
+				values[i] = e.Changes[qualify(prefix, name)].Before
+			}
+
+			if err := tx.Exec("UPDATE "+tbl.name+" SET "+strings.Join(sets, ", ")+" WHERE "+tbl.where,
+				append(values, tbl.args(s.Targetid, groupid)...)...).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return apierror.From(err)
+	}
+
+	reverse := map[string]Change{}
+	for column, change := range e.Changes {
+		reverse[column] = Change{Before: change.After, After: change.Before}
+	}
+
+	insert(p.UserID, misc.RequestID(c), ActionUndo, s, reverse, false, &e.ID)
+
+	return c.JSON(fiber.Map{
+		"ret":    0,
+		"status": "Success",
+	})
+}
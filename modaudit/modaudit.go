@@ -0,0 +1,290 @@
+// Package modaudit records what moderators change, so that group owners can see who changed what and what it was
+// before, and so that some changes can be undone.
+//
+// Before making a change, a handler takes a Snapshot of the columns it might change.  Afterwards it calls Record,
+// which reads them again and stores the ones which differ, along with who made the change and the request ID we
+// log to Loki.  Undoing a change puts the old values back, as long as nobody has changed them since.
+//
+// The table is created by an iznik-batch migration:
+//
+//	mod_audit (id, timestamp, byuser, action, targettype, targetid, groupid NULL, requestid, changes JSON,
+//	           undoable, undoneby NULL, undoneat NULL, undoof NULL)
+//	  changes is {"column": {"before": ..., "after": ...}}, with values as MySQL gives them cast to text.  Columns
+//	  which aren't in the target's main table are prefixed with their table, e.g. "messages_groups.collection".
+//	  Indexed on (groupid, id) and (targettype, targetid, id).
+package modaudit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/misc"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Things we record changes to.
+const (
+	TargetMessage   = "Message"
+	TargetMember    = "Member"
+	TargetGroup     = "Group"
+	TargetModConfig = "ModConfig"
+	TargetStdMsg    = "StdMsg"
+)
+
+// Actions.
+const (
+	ActionApprove       = "Approve"
+	ActionReject        = "Reject"
+	ActionDelete        = "Delete"
+	ActionEdit          = "Edit"
+	ActionMove          = "Move"
+	ActionHold          = "Hold"
+	ActionRelease       = "Release"
+	ActionBackToPending = "BackToPending"
+	ActionBan           = "Ban"
+	ActionSettings      = "Settings"
+	ActionUndo          = "Undo"
+)
+
+// undoable are the actions which can be undone by putting the old values back.  Others have side effects, such as
+// emails to members, which we can't take back.
+var undoable = map[string]bool{
+	ActionHold:     true,
+	ActionRelease:  true,
+	ActionMove:     true,
+	ActionEdit:     true,
+	ActionSettings: true,
+}
+
+// table is a table which holds part of a target.
+type table struct {
+	name  string
+	where string
+	args  func(targetid, groupid uint64) []interface{}
+}
+
+func byID(targetid, groupid uint64) []interface{} {
+	return []interface{}{targetid}
+}
+
+func byIDAndGroup(targetid, groupid uint64) []interface{} {
+	return []interface{}{targetid, groupid}
+}
+
+// target says where a target's columns live.
+type target struct {
+	main  table
+	other map[string]table
+
+	// groupColumn holds a group ID, e.g. when a message is moved.  Undoing a change to it needs permission in both
+	// groups.
+	groupColumn string
+
+	// supportColumns can only be set by support, so only support can undo changes to them.
+	supportColumns []string
+}
+
+var targets = map[string]target{
+	TargetMessage: {
+		main: table{"messages", "id = ?", byID},
+		other: map[string]table{
+			// A message can be on several groups.  The change is to its row for the group it was made in.
+			"messages_groups": {"messages_groups", "msgid = ? AND groupid = ?", byIDAndGroup},
+		},
+		groupColumn: "messages_groups.groupid",
+	},
+	TargetMember: {
+		main: table{"memberships", "userid = ? AND groupid = ?", func(targetid, groupid uint64) []interface{} {
+			return []interface{}{targetid, groupid}
+		}},
+	},
+	TargetGroup: {
+		main:           table{"`groups`", "id = ?", byID},
+		supportColumns: []string{"lat", "lng", "altlat", "altlng", "nameshort", "licenserequired", "showonyahoo"},
+	},
+	TargetModConfig: {
+		main: table{"mod_configs", "id = ?", byID},
+	},
+	TargetStdMsg: {
+		main: table{"mod_stdmsgs", "id = ?", byID},
+	},
+}
+
+// Change is what a column was before and after.  nil is NULL, or no row.
+type Change struct {
+	Before *string `json:"before"`
+	After  *string `json:"after"`
+}
+
+// Snapshot is the values of some of a target's columns.
+type Snapshot struct {
+	Targettype string
+	Targetid   uint64
+	Groupid    uint64
+	Columns    []string
+	Values     map[string]*string
+
+	// movedTo is the group the change moved the target to, if it did.
+	movedTo uint64
+}
+
+// Take reads columns of a target, before changing them.  The groupid is the group the change is for, if any; for
+// members it's also needed to find the membership.
+func Take(targettype string, targetid uint64, groupid uint64, columns ...string) *Snapshot {
+	s := &Snapshot{
+		Targettype: targettype,
+		Targetid:   targetid,
+		Groupid:    groupid,
+		Columns:    columns,
+	}
+
+	s.Values = s.read(groupid)
+
+	return s
+}
+
+// Moved says that the change moved the target to another group, so that Record looks for it there afterwards.
+func (s *Snapshot) Moved(groupid uint64) {
+	s.movedTo = groupid
+}
+
+// split returns the table a column is in ("" for the main one), and its name there.
+func (t target) split(column string) (string, string) {
+	if i := strings.Index(column, "."); i > 0 {
+		if _, ok := t.other[column[:i]]; ok {
+			return column[:i], column[i+1:]
+		}
+	}
+
+	return "", column
+}
+
+func (t target) table(prefix string) table {
+	if prefix == "" {
+		return t.main
+	}
+
+	return t.other[prefix]
+}
+
+func qualify(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "." + name
+}
+
+// byTable groups columns by the table they're in.
+func (t target) byTable(columns []string) map[string][]string {
+	ret := map[string][]string{}
+
+	for _, column := range columns {
+		prefix, name := t.split(column)
+		ret[prefix] = append(ret[prefix], name)
+	}
+
+	return ret
+}
+
+// read reads the snapshot's columns, from the target's rows for a group.
+func (s *Snapshot) read(groupid uint64) map[string]*string {
+	values := map[string]*string{}
+
+	t, ok := targets[s.Targettype]
+	if !ok {
+		log.Printf("Unknown audit target %s", s.Targettype)
+		return values
+	}
+
+	for _, column := range s.Columns {
+		values[column] = nil
+	}
+
+	for prefix, names := range t.byTable(s.Columns) {
+		tbl := t.table(prefix)
+
+		// Cast to text so that we can put things back exactly as they were, whatever the type.
+		selects := make([]string, len(names))
+		for i, name := range names {
+			selects[i] = "CAST(`" + name + "` AS CHAR)"
+		}
+
+		rows, err := database.DBConn.Raw("SELECT "+strings.Join(selects, ", ")+" FROM "+tbl.name+" WHERE "+tbl.where+" LIMIT 1",
+			tbl.args(s.Targetid, groupid)...).Rows()
+		if err != nil {
+			log.Printf("Failed to read %s %d for audit: %v", s.Targettype, s.Targetid, err)
+			continue
+		}
+
+		if rows.Next() {
+			scanned := make([]sql.NullString, len(names))
+			dest := make([]interface{}, len(names))
+			for i := range scanned {
+				dest[i] = &scanned[i]
+			}
+
+			if err := rows.Scan(dest...); err == nil {
+				for i, name := range names {
+					if scanned[i].Valid {
+						v := scanned[i].String
+						values[qualify(prefix, name)] = &v
+					}
+				}
+			}
+		}
+
+		rows.Close()
+	}
+
+	return values
+}
+
+// diff returns the columns which have changed.
+func diff(before, after map[string]*string) map[string]Change {
+	ret := map[string]Change{}
+
+	for column, b := range before {
+		a := after[column]
+
+		if (a == nil) != (b == nil) || (a != nil && *a != *b) {
+			ret[column] = Change{Before: b, After: a}
+		}
+	}
+
+	return ret
+}
+
+// Record stores what has changed since a snapshot was taken.  Nothing is stored if nothing changed.
+func Record(c *fiber.Ctx, action string, before *Snapshot) {
+	groupid := before.Groupid
+	if before.movedTo > 0 {
+		groupid = before.movedTo
+	}
+
+	changes := diff(before.Values, before.read(groupid))
+	if len(changes) == 0 {
+		return
+	}
+
+	insert(auth.WhoAmI(c), misc.RequestID(c), action, before, changes, undoable[action], nil)
+}
+
+func insert(byuser uint64, requestid string, action string, s *Snapshot, changes map[string]Change, canUndo bool, undoof *uint64) {
+	encoded, _ := json.Marshal(changes)
+
+	var groupid *uint64
+	if s.Groupid > 0 {
+		groupid = &s.Groupid
+	}
+
+	if err := database.DBConn.Exec("INSERT INTO mod_audit (timestamp, byuser, action, targettype, targetid, groupid, requestid, changes, undoable, undoof) "+
+		"VALUES (NOW(), ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		byuser, action, s.Targettype, s.Targetid, groupid, requestid, string(encoded), canUndo, undoof).Error; err != nil {
+		log.Printf("Failed to record %s of %s %d by %d: %v", action, s.Targettype, s.Targetid, byuser, err)
+	}
+}
@@ -0,0 +1,44 @@
+package modaudit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestDiff(t *testing.T) {
+	before := map[string]*string{"a": strPtr("1"), "b": strPtr("x"), "c": nil, "d": nil}
+	after := map[string]*string{"a": strPtr("1"), "b": strPtr("y"), "c": strPtr("z"), "d": nil}
+
+	changes := diff(before, after)
+
+	assert.Len(t, changes, 2)
+	assert.Equal(t, "x", *changes["b"].Before)
+	assert.Equal(t, "y", *changes["b"].After)
+	assert.Nil(t, changes["c"].Before)
+	assert.Equal(t, "z", *changes["c"].After)
+
+	// A row which has gone shows as NULLs.
+	changes = diff(map[string]*string{"role": strPtr("Member")}, map[string]*string{})
+	assert.Nil(t, changes["role"].After)
+}
+
+func TestByTable(t *testing.T) {
+	m := targets[TargetMessage]
+
+	tables := m.byTable([]string{"heldby", "messages_groups.collection", "subject", "messages_groups.groupid"})
+	assert.Equal(t, []string{"heldby", "subject"}, tables[""])
+	assert.Equal(t, []string{"collection", "groupid"}, tables["messages_groups"])
+
+	// Only tables the target has are split off.
+	prefix, name := m.split("users.fullname")
+	assert.Equal(t, "", prefix)
+	assert.Equal(t, "users.fullname", name)
+
+	assert.Equal(t, "messages_groups.collection", qualify("messages_groups", "collection"))
+	assert.Equal(t, "heldby", qualify("", "heldby"))
+}
@@ -6,9 +6,11 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/log"
+	"github.com/freegle/iznik-server-go/modaudit"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/gofiber/fiber/v2"
@@ -62,29 +64,29 @@ func (StdMsg) TableName() string {
 }
 
 // canModify checks if the user can modify a config.
-func canModify(myid uint64, cfg *ModConfig) bool {
-	if auth.IsAdminOrSupport(myid) {
+func canModify(p *auth.Policy, cfg *ModConfig) bool {
+	if p.Can(auth.PERM_SYSTEM_SUPPORT) {
 		return true
 	}
 	// Moderator can modify if they created it or it's not protected.
-	if cfg.Createdby != nil && *cfg.Createdby == myid {
+	if cfg.Createdby != nil && *cfg.Createdby == p.UserID {
 		return true
 	}
 	if cfg.Protected == 0 {
 		// Check if they can see it.
-		return canSee(myid, cfg)
+		return canSee(p, cfg)
 	}
 	return false
 }
 
 // canSee checks if a moderator can see this config.
-func canSee(myid uint64, cfg *ModConfig) bool {
+func canSee(p *auth.Policy, cfg *ModConfig) bool {
 	// Admin/Support can see any config.
-	if auth.IsAdminOrSupport(myid) {
+	if p.Can(auth.PERM_SYSTEM_SUPPORT) {
 		return true
 	}
 	// Created by them.
-	if cfg.Createdby != nil && *cfg.Createdby == myid {
+	if cfg.Createdby != nil && *cfg.Createdby == p.UserID {
 		return true
 	}
 	// Default configs visible to all.
@@ -92,12 +94,14 @@ func canSee(myid uint64, cfg *ModConfig) bool {
 		return true
 	}
 	// Used by mods on groups they moderate.
+	groupIDs := p.GroupsWith(auth.PERM_GROUP_MODERATE)
+	if len(groupIDs) == 0 {
+		return false
+	}
+
 	var count int64
-	database.DBConn.Raw("SELECT COUNT(*) FROM memberships m1 "+
-		"INNER JOIN memberships m2 ON m1.groupid = m2.groupid "+
-		"WHERE m1.userid = ? AND m1.role IN (?, ?) "+
-		"AND m2.configid = ? AND m2.role IN (?, ?)",
-		myid, utils.ROLE_MODERATOR, utils.ROLE_OWNER, cfg.ID, utils.ROLE_MODERATOR, utils.ROLE_OWNER).Scan(&count)
+	database.DBConn.Raw("SELECT COUNT(*) FROM memberships WHERE groupid IN ? AND configid = ? AND role IN (?, ?)",
+		groupIDs, cfg.ID, utils.ROLE_MODERATOR, utils.ROLE_OWNER).Scan(&count)
 	return count > 0
 }
 
@@ -140,7 +144,7 @@ func GetModConfig(c *fiber.Ctx) error {
 	}
 
 	// Verify the user can see this config.
-	if !canSee(myid, &cfg) {
+	if !canSee(auth.PolicyFor(c), &cfg) {
 		return fiber.NewError(fiber.StatusForbidden, "Not authorised")
 	}
 
@@ -302,7 +306,7 @@ func PostModConfig(c *fiber.Ctx) error {
 	}
 
 	if !auth.IsSystemMod(myid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 4, "status": "Don't have rights to create configs"})
+		return apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "Don't have rights to create configs").WithRet(4)
 	}
 
 	type CreateRequest struct {
@@ -333,7 +337,7 @@ func PostModConfig(c *fiber.Ctx) error {
 		if srcCfg.ID == 0 {
 			return fiber.NewError(fiber.StatusNotFound, "Source config not found")
 		}
-		if !canSee(myid, &srcCfg) {
+		if !canSee(auth.PolicyFor(c), &srcCfg) {
 			return fiber.NewError(fiber.StatusForbidden, "Not authorised to copy this config")
 		}
 
@@ -411,6 +415,13 @@ func PostModConfig(c *fiber.Ctx) error {
 // @Produce json
 // @Security BearerAuth
 // @Router /api/modconfig [patch]
+// auditedConfigColumns are the columns PatchModConfig can change.
+var auditedConfigColumns = []string{
+	"name", "fromname", "ccrejectto", "ccrejectaddr", "ccfollowupto", "ccfollowupaddr", "ccrejmembto", "ccrejmembaddr",
+	"ccfollmembto", "ccfollmembaddr", "protected", "createdby", "messageorder", "network", "coloursubj", "subjreg",
+	"subjlen", "chatread",
+}
+
 func PatchModConfig(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 	if myid == 0 {
@@ -459,10 +470,12 @@ func PatchModConfig(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusNotFound, "Invalid config id")
 	}
 
-	if !canModify(myid, &cfg) {
+	if !canModify(auth.PolicyFor(c), &cfg) {
 		return fiber.NewError(fiber.StatusForbidden, "Don't have rights to modify config")
 	}
 
+	audit := modaudit.Take(modaudit.TargetModConfig, req.ID, 0, auditedConfigColumns...)
+
 	// Build a single UPDATE with all changed fields.
 	setClauses := []string{}
 	args := []interface{}{}
@@ -548,6 +561,8 @@ func PatchModConfig(c *fiber.Ctx) error {
 		}
 	}
 
+	modaudit.Record(c, modaudit.ActionEdit, audit)
+
 	// Log the edit.
 	db.Exec("INSERT INTO logs (timestamp, type, subtype, byuser, configid) VALUES (NOW(), ?, ?, ?, ?)", log.LOG_TYPE_CONFIG, log.LOG_SUBTYPE_EDIT, myid, req.ID)
 
@@ -580,7 +595,7 @@ func DeleteModConfig(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusNotFound, "Invalid config id")
 	}
 
-	if !canModify(myid, &cfg) {
+	if !canModify(auth.PolicyFor(c), &cfg) {
 		return fiber.NewError(fiber.StatusForbidden, "Don't have rights to modify config")
 	}
 
@@ -588,7 +603,7 @@ func DeleteModConfig(c *fiber.Ctx) error {
 	var inUse int64
 	db.Raw("SELECT COUNT(*) FROM memberships WHERE configid = ? AND role IN (?, ?)", id, utils.ROLE_MODERATOR, utils.ROLE_OWNER).Scan(&inUse)
 	if inUse > 0 {
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"ret": 5, "status": "Config still in use"})
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "Config still in use").WithRet(5)
 	}
 
 	db.Exec("DELETE FROM mod_configs WHERE id = ?", id)
@@ -850,38 +850,29 @@ type PostRequest struct {
 
 // canModifyPost checks if a user can edit/delete a newsfeed post.
 // Allowed: post owner, admin/support, or any group moderator.
-func canModifyPost(myid uint64, nfID uint64) bool {
-	db := database.DBConn
-
+func canModifyPost(p *auth.Policy, nfID uint64) bool {
 	var ownerID uint64
-	db.Raw("SELECT userid FROM newsfeed WHERE id = ?", nfID).Scan(&ownerID)
-
-	if ownerID == myid {
-		return true
-	}
+	database.DBConn.Raw("SELECT userid FROM newsfeed WHERE id = ?", nfID).Scan(&ownerID)
 
-	if auth.IsAdminOrSupport(myid) {
+	if ownerID == p.UserID {
 		return true
 	}
 
-	var modCount int64
-	db.Raw("SELECT COUNT(*) FROM memberships WHERE userid = ? AND role IN (?, ?) AND collection = ?", myid, utils.ROLE_MODERATOR, utils.ROLE_OWNER, utils.COLLECTION_APPROVED).Scan(&modCount)
-
-	return modCount > 0
+	return p.CanInAnyGroup(auth.PERM_GROUP_MODERATE)
 }
 
 // canHidePost checks if a user can hide/unhide a newsfeed post.
 // Requires: isAdminOrSupport() OR member of "ChitChat Moderation" team.
 // This is stricter than canModifyPost - not all moderators can hide posts.
-func canHidePost(myid uint64) bool {
-	if auth.IsAdminOrSupport(myid) {
+func canHidePost(p *auth.Policy) bool {
+	if p.Can(auth.PERM_SYSTEM_SUPPORT) {
 		return true
 	}
 
 	// Check if user is a member of the ChitChat Moderation team
 	db := database.DBConn
 	var teamMemberCount int64
-	db.Raw("SELECT COUNT(*) FROM teams_members tm INNER JOIN teams t ON tm.teamid = t.id WHERE t.name = 'ChitChat Moderation' AND tm.userid = ?", myid).Scan(&teamMemberCount)
+	db.Raw("SELECT COUNT(*) FROM teams_members tm INNER JOIN teams t ON tm.teamid = t.id WHERE t.name = 'ChitChat Moderation' AND tm.userid = ?", p.UserID).Scan(&teamMemberCount)
 
 	return teamMemberCount > 0
 }
@@ -970,14 +961,14 @@ func Post(c *fiber.Ctx) error {
 			}
 		}
 	case "Hide":
-		if req.ID > 0 && canHidePost(myid) {
+		if req.ID > 0 && canHidePost(auth.PolicyFor(c)) {
 			db.Exec("UPDATE newsfeed SET hidden = NOW(), hiddenby = ? WHERE id = ?", myid, req.ID)
 			db.Exec("INSERT INTO logs (timestamp, type, subtype, byuser, text) VALUES (NOW(), ?, ?, ?, 'Newsfeed entry hidden')", log.LOG_TYPE_CHITCHAT, log.LOG_SUBTYPE_HIDDEN, myid)
 		} else if req.ID > 0 {
 			return fiber.NewError(fiber.StatusForbidden, "Permission denied")
 		}
 	case "Unhide":
-		if req.ID > 0 && canHidePost(myid) {
+		if req.ID > 0 && canHidePost(auth.PolicyFor(c)) {
 			db.Exec("UPDATE newsfeed SET hidden = NULL, hiddenby = NULL WHERE id = ?", req.ID)
 			db.Exec("INSERT INTO logs (timestamp, type, subtype, byuser, text) VALUES (NOW(), ?, ?, ?, 'Newsfeed entry unhidden')", log.LOG_TYPE_CHITCHAT, log.LOG_SUBTYPE_UNHIDDEN, myid)
 		} else if req.ID > 0 {
@@ -1298,7 +1289,7 @@ func Edit(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusNotFound, "Newsfeed post not found")
 	}
 
-	if ownerID != myid && !canModifyPost(myid, req.ID) {
+	if ownerID != myid && !canModifyPost(auth.PolicyFor(c), req.ID) {
 		return fiber.NewError(fiber.StatusForbidden, "Not authorized to edit this post")
 	}
 
@@ -1325,7 +1316,7 @@ func Delete(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusNotFound, "Newsfeed post not found")
 	}
 
-	if ownerID != myid && !canModifyPost(myid, id) {
+	if ownerID != myid && !canModifyPost(auth.PolicyFor(c), id) {
 		return fiber.NewError(fiber.StatusForbidden, "Not authorized to delete this post")
 	}
 
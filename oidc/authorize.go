@@ -0,0 +1,328 @@
+package oidc
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/user"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// client is a partner app registered in oauth_clients.
+type client struct {
+	ID           uint64
+	Clientid     string
+	Secret       *string
+	Name         string
+	Redirecturis string
+	Scopes       string
+}
+
+func getClient(clientID string) *client {
+	if clientID == "" {
+		return nil
+	}
+
+	var cl client
+	database.DBConn.Raw("SELECT id, clientid, secret, name, redirecturis, scopes FROM oauth_clients WHERE clientid = ?", clientID).Scan(&cl)
+
+	if cl.ID == 0 {
+		return nil
+	}
+
+	return &cl
+}
+
+// allowsRedirect checks a redirect URI against those registered.  It must match exactly, so that codes can't be
+// sent anywhere else.
+func (cl *client) allowsRedirect(uri string) bool {
+	for _, r := range strings.Fields(cl.Redirecturis) {
+		if r == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authRequest is an authorization request.  The partner sends it to Authorize as query parameters, and the consent
+// page passes it on to us unchanged.
+type authRequest struct {
+	ResponseType        string `json:"response_type" query:"response_type"`
+	ClientID            string `json:"client_id" query:"client_id"`
+	RedirectURI         string `json:"redirect_uri" query:"redirect_uri"`
+	Scope               string `json:"scope" query:"scope"`
+	State               string `json:"state" query:"state"`
+	Nonce               string `json:"nonce" query:"nonce"`
+	CodeChallenge       string `json:"code_challenge" query:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method" query:"code_challenge_method"`
+}
+
+// redirectError is a problem with a request which we tell the partner about by sending the user back to it.
+type redirectError struct {
+	code        string
+	description string
+}
+
+// check validates a request.  If we can't trust the client or redirect URI, it returns an error, and the user must
+// not be sent back.  Otherwise, problems with the rest of the request are returned as a redirectError.
+func (req *authRequest) check() (*client, []string, *redirectError, error) {
+	cl := getClient(req.ClientID)
+	if cl == nil {
+		return nil, nil, nil, apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Unknown client_id")
+	}
+
+	if !cl.allowsRedirect(req.RedirectURI) {
+		return nil, nil, nil, apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "redirect_uri isn't registered for this client")
+	}
+
+	if req.ResponseType != "code" {
+		return cl, nil, &redirectError{"unsupported_response_type", "Only response_type=code is supported"}, nil
+	}
+
+	scopes := splitScopes(req.Scope)
+	if !hasScope(scopes, ScopeOpenID) {
+		return cl, nil, &redirectError{"invalid_scope", "The openid scope is required"}, nil
+	}
+
+	allowed := splitScopes(cl.Scopes)
+	for _, s := range scopes {
+		if !hasScope(supportedScopes, s) || (s != ScopeOpenID && !hasScope(allowed, s)) {
+			return cl, nil, &redirectError{"invalid_scope", "Scope " + s + " isn't available to this client"}, nil
+		}
+	}
+
+	// PKCE is required for everyone, not just public clients, as it also protects against codes being injected.
+	if req.CodeChallengeMethod != "S256" || len(req.CodeChallenge) < 43 {
+		return cl, nil, &redirectError{"invalid_request", "PKCE with code_challenge_method=S256 is required"}, nil
+	}
+
+	return cl, scopes, nil, nil
+}
+
+// redirectURL builds the URL to send the user back to the partner with.
+func (req *authRequest) redirectURL(params url.Values) string {
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+
+	sep := "?"
+	if strings.Contains(req.RedirectURI, "?") {
+		sep = "&"
+	}
+
+	return req.RedirectURI + sep + params.Encode()
+}
+
+// Authorize is the authorization endpoint.  Once we've checked the request, we send the user to the consent page
+// on the user site, which will log them in if need be.
+//
+// @Summary OpenID Connect authorization endpoint
+// @Tags oidc
+// @Router /oidc/authorize [get]
+func Authorize(c *fiber.Ctx) error {
+	if configured() == nil {
+		return ErrNotConfigured
+	}
+
+	var req authRequest
+	if err := c.QueryParser(&req); err != nil {
+		return apierror.ErrInvalidBody
+	}
+
+	_, _, rerr, err := req.check()
+	if err != nil {
+		return err
+	}
+
+	if rerr != nil {
+		return c.Redirect(req.redirectURL(url.Values{"error": {rerr.code}, "error_description": {rerr.description}}))
+	}
+
+	return c.Redirect("https://" + os.Getenv("USER_SITE") + "/oauth/authorize?" + string(c.Request().URI().QueryString()))
+}
+
+// GetConsent tells the consent page what a request is asking for, and whether the user has agreed to it before.
+//
+// @Summary Describe an authorization request
+// @Tags oidc
+// @Router /oidc/consent [get]
+func GetConsent(c *fiber.Ctx) error {
+	myid := user.WhoAmI(c)
+	if myid == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	var req authRequest
+	if err := c.QueryParser(&req); err != nil {
+		return apierror.ErrInvalidBody
+	}
+
+	cl, scopes, rerr, err := req.check()
+	if err != nil {
+		return err
+	}
+
+	if rerr != nil {
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, rerr.description)
+	}
+
+	var consented string
+	database.DBConn.Raw("SELECT scopes FROM oauth_consents WHERE userid = ? AND clientid = ?", myid, cl.ID).Scan(&consented)
+
+	previously := splitScopes(consented)
+	all := consented != ""
+
+	for _, s := range scopes {
+		if !hasScope(previously, s) {
+			all = false
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":       0,
+		"status":    "Success",
+		"client":    fiber.Map{"id": cl.Clientid, "name": cl.Name},
+		"scopes":    scopes,
+		"consented": all,
+	})
+}
+
+// PostConsent records the user's answer to an authorization request.  If they agreed, it issues a code.  Either
+// way, it returns the URL to send them back to the partner with.
+//
+// @Summary Approve or deny an authorization request
+// @Tags oidc
+// @Router /oidc/consent [post]
+func PostConsent(c *fiber.Ctx) error {
+	myid := user.WhoAmI(c)
+	if myid == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	var body struct {
+		authRequest
+		Approve bool `json:"approve"`
+	}
+
+	if err := c.BodyParser(&body); err != nil {
+		return apierror.ErrInvalidBody
+	}
+
+	req := body.authRequest
+
+	cl, scopes, rerr, err := req.check()
+	if err != nil {
+		return err
+	}
+
+	var redirect string
+
+	switch {
+	case rerr != nil:
+		redirect = req.redirectURL(url.Values{"error": {rerr.code}, "error_description": {rerr.description}})
+	case !body.Approve:
+		redirect = req.redirectURL(url.Values{"error": {"access_denied"}})
+	default:
+		db := database.DBConn
+		scope := strings.Join(scopes, " ")
+		code := utils.RandomHex(32)
+
+		db.Exec("INSERT INTO oauth_consents (userid, clientid, scopes, created, updated) VALUES (?, ?, ?, NOW(), NOW()) "+
+			"ON DUPLICATE KEY UPDATE scopes = VALUES(scopes), updated = NOW()", myid, cl.ID, scope)
+
+		result := db.Exec("INSERT INTO oauth_codes (code, clientid, userid, redirecturi, scopes, nonce, codechallenge, expires) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))",
+			hashSecret(code), cl.ID, myid, req.RedirectURI, scope, req.Nonce, req.CodeChallenge, int(codeLifetime.Seconds()))
+
+		if result.Error != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to create code")
+		}
+
+		redirect = req.redirectURL(url.Values{"code": {code}})
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":      0,
+		"status":   "Success",
+		"redirect": redirect,
+	})
+}
+
+// ListConsents returns the partner apps the user has let log them in.
+//
+// @Summary List my partner app consents
+// @Tags oidc
+// @Router /oidc/consents [get]
+func ListConsents(c *fiber.Ctx) error {
+	myid := user.WhoAmI(c)
+	if myid == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	type consentRow struct {
+		Clientid string    `json:"clientid"`
+		Name     string    `json:"name"`
+		Scopes   string    `json:"-"`
+		Created  time.Time `json:"created"`
+		Updated  time.Time `json:"updated"`
+	}
+
+	var rows []consentRow
+	database.DBConn.Raw("SELECT oauth_clients.clientid, oauth_clients.name, oauth_consents.scopes, oauth_consents.created, oauth_consents.updated "+
+		"FROM oauth_consents INNER JOIN oauth_clients ON oauth_clients.id = oauth_consents.clientid "+
+		"WHERE oauth_consents.userid = ? ORDER BY oauth_consents.updated DESC", myid).Scan(&rows)
+
+	consents := []fiber.Map{}
+	for _, r := range rows {
+		consents = append(consents, fiber.Map{
+			"clientid": r.Clientid,
+			"name":     r.Name,
+			"scopes":   splitScopes(r.Scopes),
+			"created":  r.Created,
+			"updated":  r.Updated,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":      0,
+		"status":   "Success",
+		"consents": consents,
+	})
+}
+
+// RevokeConsent withdraws the user's consent for a partner app, and stops its tokens working.
+//
+// @Summary Revoke a partner app consent
+// @Tags oidc
+// @Router /oidc/consents/{clientid} [delete]
+func RevokeConsent(c *fiber.Ctx) error {
+	myid := user.WhoAmI(c)
+	if myid == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	cl := getClient(c.Params("clientid"))
+	if cl == nil {
+		return apierror.ErrNotFound
+	}
+
+	db := database.DBConn
+	result := db.Exec("DELETE FROM oauth_consents WHERE userid = ? AND clientid = ?", myid, cl.ID)
+	db.Exec("DELETE FROM oauth_tokens WHERE userid = ? AND clientid = ?", myid, cl.ID)
+	db.Exec("DELETE FROM oauth_codes WHERE userid = ? AND clientid = ?", myid, cl.ID)
+
+	if result.RowsAffected == 0 {
+		return apierror.ErrNotFound
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":    0,
+		"status": "Success",
+	})
+}
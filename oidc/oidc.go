@@ -0,0 +1,259 @@
+// Package oidc lets partner apps offer "Log in with Freegle", by acting as an OpenID Connect provider.
+//
+// It implements the authorization code flow with PKCE.  A partner sends the user to the authorization endpoint,
+// which passes them on to a consent page on the user site.  Once they have agreed, the site asks us for a code and
+// sends the user back to the partner with it.  The partner swaps the code for an ID token and an access token, and
+// can use the access token to fetch the claims the user agreed to from the userinfo endpoint.
+//
+// Users can see and withdraw their consents at any time, which stops the partner's tokens working.  This is the
+// way for partners to get accounts for our users; the older approach of creating accounts from a partner key
+// (user.GetLoveJunkUser) is kept for existing integrations.
+//
+// The tables are created by iznik-batch migrations:
+//
+//	oauth_clients (id, clientid UNIQUE, secret NULL, name, redirecturis, scopes, partnerid NULL, created)
+//	  secret is the SHA-256 of the client secret, or NULL for public clients (e.g. mobile apps), which rely on PKCE.
+//	  redirecturis and scopes are space-separated; scopes are those the client may ask for.
+//	  partnerid links the client to partners_keys, where it is one of our partners.
+//	oauth_consents (id, userid, clientid, scopes, created, updated), unique on (userid, clientid)
+//	oauth_codes (id, code UNIQUE, clientid, userid, redirecturi, scopes, nonce, codechallenge, expires, used NULL)
+//	  code is the SHA-256 of the code.
+//	oauth_tokens (id, token UNIQUE, codeid, clientid, userid, scopes, expires), indexed on (userid, clientid)
+//	  token is the SHA-256 of the access token.
+//
+// Configuration is from the environment:
+//
+//	OIDC_ISSUER       our issuer URL, e.g. https://api.ilovefreegle.org/api/oidc.
+//	OIDC_PRIVATE_KEY  the PEM-encoded RSA key which signs ID tokens.
+//
+// Without both, the provider is off.  Partners trust ID tokens by their issuer, so it mustn't come from the request.
+package oidc
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Scopes we support.
+const (
+	ScopeOpenID   = "openid"
+	ScopeProfile  = "profile"
+	ScopeEmail    = "email"
+	ScopeLocation = "location"
+)
+
+var supportedScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopeLocation}
+
+const (
+	// codeLifetime is how long a partner has to swap a code for tokens.
+	codeLifetime = time.Minute
+
+	// accessTokenLifetime is how long an access token works for.  Partners send the user through the flow again
+	// to get another, which is quick once they've consented.
+	accessTokenLifetime = time.Hour
+
+	// idTokenLifetime is how long an ID token is valid for.  It's only for the partner to check when it gets it.
+	idTokenLifetime = 5 * time.Minute
+)
+
+// ErrNotConfigured is returned by all the endpoints when we have no signing key or issuer.
+var ErrNotConfigured = apierror.New(fiber.StatusServiceUnavailable, apierror.CodeUnavailable, "Log in with Freegle isn't available")
+
+// signingKey is the parsed OIDC_PRIVATE_KEY, cached until the variable changes.
+type signingKey struct {
+	pem string
+	key *rsa.PrivateKey
+	kid string
+}
+
+var (
+	keyMu     sync.Mutex
+	cachedKey *signingKey
+)
+
+// getSigningKey returns the key for signing ID tokens, or nil if there isn't one.
+func getSigningKey() *signingKey {
+	pemText := os.Getenv("OIDC_PRIVATE_KEY")
+	if pemText == "" {
+		return nil
+	}
+
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	if cachedKey != nil && cachedKey.pem == pemText {
+		return cachedKey
+	}
+
+	key, err := parsePrivateKey(pemText)
+	if err != nil {
+		return nil
+	}
+
+	cachedKey = &signingKey{pem: pemText, key: key, kid: thumbprint(&key.PublicKey)}
+	return cachedKey
+}
+
+func parsePrivateKey(pemText string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemText))
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+
+	return key, nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwk returns the public half of a key in JWK form.
+func jwk(pub *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"n":   b64(pub.N.Bytes()),
+		"e":   b64(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// thumbprint is the RFC 7638 thumbprint of a key, which we use as its kid.
+func thumbprint(pub *rsa.PublicKey) string {
+	k := jwk(pub)
+
+	// The members must be in this order, with no whitespace.
+	canonical := `{"e":"` + k["e"] + `","kty":"RSA","n":"` + k["n"] + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+
+	return b64(sum[:])
+}
+
+// issuer returns our issuer URL, which is also the base for our endpoints, or "" if there isn't one.
+func issuer() string {
+	return strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/")
+}
+
+// configured returns the key for signing ID tokens, or nil if the provider is off.
+func configured() *signingKey {
+	if issuer() == "" {
+		return nil
+	}
+
+	return getSigningKey()
+}
+
+// Discovery returns the OpenID Connect discovery document.
+//
+// @Summary OpenID Connect discovery document
+// @Tags oidc
+// @Router /oidc/.well-known/openid-configuration [get]
+func Discovery(c *fiber.Ctx) error {
+	if configured() == nil {
+		return ErrNotConfigured
+	}
+
+	iss := issuer()
+
+	return c.JSON(fiber.Map{
+		"issuer":                                iss,
+		"authorization_endpoint":                iss + "/authorize",
+		"token_endpoint":                        iss + "/token",
+		"userinfo_endpoint":                     iss + "/userinfo",
+		"revocation_endpoint":                   iss + "/revoke",
+		"jwks_uri":                              iss + "/jwks",
+		"scopes_supported":                      supportedScopes,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{"sub", "iss", "aud", "exp", "iat", "nonce", "name", "picture",
+			"email", "email_verified", "address"},
+	})
+}
+
+// JWKS returns the public keys which partners use to check our ID tokens.
+//
+// @Summary OpenID Connect signing keys
+// @Tags oidc
+// @Router /oidc/jwks [get]
+func JWKS(c *fiber.Ctx) error {
+	key := configured()
+	if key == nil {
+		return ErrNotConfigured
+	}
+
+	k := jwk(&key.key.PublicKey)
+	k["kid"] = key.kid
+	k["use"] = "sig"
+	k["alg"] = "RS256"
+
+	return c.JSON(fiber.Map{"keys": []map[string]string{k}})
+}
+
+// splitScopes parses a space-separated list of scopes, dropping duplicates.
+func splitScopes(s string) []string {
+	var ret []string
+	seen := map[string]bool{}
+
+	for _, scope := range strings.Fields(s) {
+		if !seen[scope] {
+			seen[scope] = true
+			ret = append(ret, scope)
+		}
+	}
+
+	return ret
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// oauthError is an error in the form RFC 6749 uses for the token endpoint.
+func oauthError(c *fiber.Ctx, status int, code string, description string) error {
+	c.Set("Cache-Control", "no-store")
+
+	return c.Status(status).JSON(fiber.Map{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// hashSecret is how we store codes, tokens and client secrets.  They're random, so a fast hash is fine.
+func hashSecret(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return b64(sum[:])
+}
@@ -0,0 +1,91 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The example key and thumbprint from RFC 7638 section 3.1.
+func TestThumbprint(t *testing.T) {
+	n, _ := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint(pub))
+	assert.Equal(t, "AQAB", jwk(pub)["e"])
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	pkcs1 := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	parsed, err := parsePrivateKey(pkcs1)
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(parsed))
+
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	pkcs8 := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	parsed, err = parsePrivateKey(pkcs8)
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(parsed))
+
+	_, err = parsePrivateKey("not a key")
+	assert.Error(t, err)
+
+	t.Setenv("OIDC_PRIVATE_KEY", pkcs8)
+	assert.NotNil(t, getSigningKey())
+	assert.Equal(t, thumbprint(&key.PublicKey), getSigningKey().kid)
+
+	t.Setenv("OIDC_PRIVATE_KEY", "")
+	assert.Nil(t, getSigningKey())
+}
+
+func TestConfigured(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	t.Setenv("OIDC_PRIVATE_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+
+	// The issuer has to be set, rather than taken from the request.
+	t.Setenv("OIDC_ISSUER", "")
+	assert.Nil(t, configured())
+
+	t.Setenv("OIDC_ISSUER", "https://api.example/api/oidc/")
+	assert.NotNil(t, configured())
+	assert.Equal(t, "https://api.example/api/oidc", issuer())
+}
+
+// The example from RFC 7636 appendix B.
+func TestCheckPKCE(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	assert.True(t, checkPKCE(verifier, challenge))
+	assert.False(t, checkPKCE(verifier+"x", challenge))
+	assert.False(t, checkPKCE("short", challenge))
+}
+
+func TestScopes(t *testing.T) {
+	scopes := splitScopes(" openid  profile openid email ")
+	assert.Equal(t, []string{"openid", "profile", "email"}, scopes)
+	assert.True(t, hasScope(scopes, ScopeEmail))
+	assert.False(t, hasScope(scopes, ScopeLocation))
+	assert.Nil(t, splitScopes(""))
+}
+
+func TestRedirectURL(t *testing.T) {
+	req := authRequest{RedirectURI: "https://partner.example/callback", State: "xyz"}
+	u, err := url.Parse(req.redirectURL(url.Values{"code": {"abc"}}))
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", u.Query().Get("code"))
+	assert.Equal(t, "xyz", u.Query().Get("state"))
+
+	req = authRequest{RedirectURI: "https://partner.example/callback?app=1"}
+	assert.Equal(t, "https://partner.example/callback?app=1&error=access_denied",
+		req.redirectURL(url.Values{"error": {"access_denied"}}))
+}
@@ -0,0 +1,260 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/user"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// authenticateClient finds the client making a request to the token or revocation endpoint.  Confidential
+// clients send their secret with HTTP Basic authentication or in the form; public clients just send client_id.
+func authenticateClient(c *fiber.Ctx) *client {
+	clientID := c.FormValue("client_id")
+	secret := c.FormValue("client_secret")
+
+	if basic, ok := strings.CutPrefix(c.Get("Authorization"), "Basic "); ok {
+		decoded, err := base64.StdEncoding.DecodeString(basic)
+		if err != nil {
+			return nil
+		}
+
+		id, pw, _ := strings.Cut(string(decoded), ":")
+		clientID, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(pw)
+	}
+
+	cl := getClient(clientID)
+	if cl == nil {
+		return nil
+	}
+
+	if cl.Secret == nil {
+		if secret != "" {
+			return nil
+		}
+
+		return cl
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(*cl.Secret)) != 1 {
+		return nil
+	}
+
+	return cl
+}
+
+// checkPKCE checks a code verifier against the challenge sent with the authorization request.
+func checkPKCE(verifier string, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(b64(sum[:])), []byte(challenge)) == 1
+}
+
+// Token is the token endpoint, where partners swap a code for an ID token and an access token.
+//
+// @Summary OpenID Connect token endpoint
+// @Tags oidc
+// @Router /oidc/token [post]
+func Token(c *fiber.Ctx) error {
+	key := configured()
+	if key == nil {
+		return ErrNotConfigured
+	}
+
+	if c.FormValue("grant_type") != "authorization_code" {
+		return oauthError(c, fiber.StatusBadRequest, "unsupported_grant_type", "Only authorization_code is supported")
+	}
+
+	cl := authenticateClient(c)
+	if cl == nil {
+		return oauthError(c, fiber.StatusUnauthorized, "invalid_client", "Client authentication failed")
+	}
+
+	db := database.DBConn
+
+	var code struct {
+		ID            uint64
+		Clientid      uint64
+		Userid        uint64
+		Redirecturi   string
+		Scopes        string
+		Nonce         string
+		Codechallenge string
+		Used          bool
+		Expired       bool
+	}
+
+	db.Raw("SELECT id, clientid, userid, redirecturi, scopes, nonce, codechallenge, used IS NOT NULL AS used, expires < NOW() AS expired "+
+		"FROM oauth_codes WHERE code = ?", hashSecret(c.FormValue("code"))).Scan(&code)
+
+	if code.ID == 0 || code.Clientid != cl.ID {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "Unknown code")
+	}
+
+	// A code can only be used once.  If it's used again, someone else may have it, so we withdraw the tokens it
+	// got the first time too.
+	if code.Used || db.Exec("UPDATE oauth_codes SET used = NOW() WHERE id = ? AND used IS NULL", code.ID).RowsAffected != 1 {
+		db.Exec("DELETE FROM oauth_tokens WHERE codeid = ?", code.ID)
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "Code has already been used")
+	}
+
+	if code.Expired {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "Code has expired")
+	}
+
+	if code.Redirecturi != c.FormValue("redirect_uri") {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "redirect_uri doesn't match")
+	}
+
+	if !checkPKCE(c.FormValue("code_verifier"), code.Codechallenge) {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "code_verifier doesn't match")
+	}
+
+	// The user may have withdrawn consent since the code was issued.
+	var consents int64
+	db.Raw("SELECT COUNT(*) FROM oauth_consents WHERE userid = ? AND clientid = ?", code.Userid, cl.ID).Scan(&consents)
+
+	if consents == 0 {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "Consent has been withdrawn")
+	}
+
+	accessToken := utils.RandomHex(32)
+	db.Exec("INSERT INTO oauth_tokens (token, codeid, clientid, userid, scopes, expires) VALUES (?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))",
+		hashSecret(accessToken), code.ID, cl.ID, code.Userid, code.Scopes, int(accessTokenLifetime.Seconds()))
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": issuer(),
+		"sub": strconv.FormatUint(code.Userid, 10),
+		"aud": cl.Clientid,
+		"iat": now.Unix(),
+		"exp": now.Add(idTokenLifetime).Unix(),
+	}
+
+	if code.Nonce != "" {
+		claims["nonce"] = code.Nonce
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = key.kid
+
+	signed, err := idToken.SignedString(key.key)
+	if err != nil {
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "Failed to sign ID token")
+	}
+
+	c.Set("Cache-Control", "no-store")
+
+	return c.JSON(fiber.Map{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(accessTokenLifetime.Seconds()),
+		"id_token":     signed,
+		"scope":        code.Scopes,
+	})
+}
+
+// Userinfo returns the claims the user has agreed to share with the partner whose access token this is.
+//
+// @Summary OpenID Connect userinfo endpoint
+// @Tags oidc
+// @Router /oidc/userinfo [get]
+func Userinfo(c *fiber.Ctx) error {
+	if configured() == nil {
+		return ErrNotConfigured
+	}
+
+	accessToken, ok := strings.CutPrefix(c.Get("Authorization"), "Bearer ")
+	if !ok {
+		accessToken = c.FormValue("access_token")
+	}
+
+	db := database.DBConn
+
+	var token struct {
+		Userid uint64
+		Scopes string
+	}
+
+	db.Raw("SELECT oauth_tokens.userid, oauth_tokens.scopes FROM oauth_tokens "+
+		"INNER JOIN oauth_consents ON oauth_consents.userid = oauth_tokens.userid AND oauth_consents.clientid = oauth_tokens.clientid "+
+		"WHERE oauth_tokens.token = ? AND oauth_tokens.expires > NOW()", hashSecret(strings.TrimSpace(accessToken))).Scan(&token)
+
+	if token.Userid == 0 {
+		c.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return oauthError(c, fiber.StatusUnauthorized, "invalid_token", "Access token is invalid or has expired")
+	}
+
+	u := user.GetUserById(token.Userid, token.Userid)
+	if u.ID == 0 || u.Deleted != nil {
+		c.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return oauthError(c, fiber.StatusUnauthorized, "invalid_token", "User no longer exists")
+	}
+
+	scopes := splitScopes(token.Scopes)
+	claims := fiber.Map{"sub": strconv.FormatUint(token.Userid, 10)}
+
+	if hasScope(scopes, ScopeProfile) {
+		claims["name"] = u.Displayname
+
+		if u.Profile.Path != "" {
+			claims["picture"] = u.Profile.Path
+		}
+	}
+
+	if hasScope(scopes, ScopeEmail) {
+		var email struct {
+			Email    string
+			Verified bool
+		}
+
+		db.Raw("SELECT email, validated IS NOT NULL AS verified FROM users_emails WHERE userid = ? "+
+			"ORDER BY preferred DESC, id ASC LIMIT 1", token.Userid).Scan(&email)
+
+		if email.Email != "" {
+			claims["email"] = email.Email
+			claims["email_verified"] = email.Verified
+		}
+	}
+
+	// Only ever the area, never where they actually are.
+	if hasScope(scopes, ScopeLocation) {
+		if loc := user.GetPublicLocationForUser(token.Userid); loc != nil && loc.Display != "" {
+			claims["address"] = fiber.Map{"locality": loc.Display}
+		}
+	}
+
+	c.Set("Cache-Control", "no-store")
+
+	return c.JSON(claims)
+}
+
+// Revoke lets a partner withdraw an access token, e.g. when the user logs out of their app (RFC 7009).
+//
+// @Summary OAuth token revocation endpoint
+// @Tags oidc
+// @Router /oidc/revoke [post]
+func Revoke(c *fiber.Ctx) error {
+	cl := authenticateClient(c)
+	if cl == nil {
+		return oauthError(c, fiber.StatusUnauthorized, "invalid_client", "Client authentication failed")
+	}
+
+	database.DBConn.Exec("DELETE FROM oauth_tokens WHERE token = ? AND clientid = ?", hashSecret(c.FormValue("token")), cl.ID)
+
+	// The response is the same whether or not the token existed.
+	return c.SendStatus(fiber.StatusOK)
+}
@@ -0,0 +1,329 @@
+package partner
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// DefaultOverlap is how long the old key keeps working after a rotation, unless asked otherwise.
+	DefaultOverlap = 7 * 24 * time.Hour
+
+	// maxOverlap stops a rotation leaving the old key working indefinitely.
+	maxOverlap = 30 * 24 * time.Hour
+
+	// maxAuditRows is the most audit entries we return at once.
+	maxAuditRows = 1000
+)
+
+// KeyInfo describes a key, without the key itself.
+type KeyInfo struct {
+	ID       uint64     `json:"id"`
+	Prefix   string     `json:"prefix"`
+	Scopes   []string   `json:"scopes" gorm:"-"`
+	Quota    *int       `json:"quota"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires"`
+	Lastused *time.Time `json:"lastused"`
+}
+
+// AuditEntry is a call in the audit log.
+type AuditEntry struct {
+	ID        uint64    `json:"id"`
+	Apikeyid  *uint64   `json:"apikeyid"`
+	Prefix    string    `json:"prefix"`
+	Scope     string    `json:"scope"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	IP        string    `json:"ip" gorm:"column:ip"`
+	Result    string    `json:"result"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// partnerParam returns the partner in the id parameter, which must exist.
+func partnerParam(c *fiber.Ctx) (uint64, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, apierror.ErrInvalidID
+	}
+
+	var found uint64
+	database.DBConn.Raw("SELECT id FROM partners_keys WHERE id = ?", id).Scan(&found)
+
+	if found == 0 {
+		return 0, apierror.ErrNotFound.WithMessage("Partner not found")
+	}
+
+	return id, nil
+}
+
+// getKey returns a key by ID, whether or not it has expired.
+func getKey(id uint64) *Key {
+	var k Key
+	database.DBConn.Raw("SELECT partners_apikeys.id, partners_apikeys.partnerid, partners_keys.partner, partners_apikeys.scopes, "+
+		"COALESCE(partners_apikeys.quota, 0) AS quota FROM partners_apikeys "+
+		"INNER JOIN partners_keys ON partners_keys.id = partners_apikeys.partnerid WHERE partners_apikeys.id = ?", id).Scan(&k)
+
+	if k.ID == 0 {
+		return nil
+	}
+
+	return &k
+}
+
+// createKey adds a key for a partner and returns it.  This is the only time the key is available.
+func createKey(partnerID uint64, scopes []string, quota *int, expires *time.Time) (uint64, string, error) {
+	key := newKey()
+
+	db := database.DBConn
+
+	result := db.Exec("INSERT INTO partners_apikeys (partnerid, keyhash, prefix, scopes, quota, created, expires) VALUES (?, ?, ?, ?, ?, NOW(), ?)",
+		partnerID, HashKey(key), keyPrefix(key), strings.Join(scopes, " "), quota, expires)
+
+	if result.Error != nil {
+		return 0, "", result.Error
+	}
+
+	// The hash is unique, so this finds the row we've just added.
+	var id uint64
+	db.Raw("SELECT id FROM partners_apikeys WHERE keyhash = ?", HashKey(key)).Scan(&id)
+
+	return id, key, nil
+}
+
+// checkScopes returns an error if any of the scopes are ones we don't support.
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "At least one scope is required")
+	}
+
+	for _, s := range scopes {
+		if !hasScope(supportedScopes, s) {
+			return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "Unknown scope "+s)
+		}
+	}
+
+	return nil
+}
+
+// ListKeys returns a partner's keys, including expired ones.
+//
+// @Summary List a partner's API keys (admin-only)
+// @Tags partner
+// @Router /api/partners/{id}/keys [get]
+func ListKeys(c *fiber.Ctx) error {
+	partnerID, err := partnerParam(c)
+	if err != nil {
+		return err
+	}
+
+	var rows []struct {
+		KeyInfo
+		Scopestring string `gorm:"column:scopes"`
+	}
+
+	database.DBConn.Raw("SELECT id, prefix, scopes, quota, created, expires, lastused FROM partners_apikeys "+
+		"WHERE partnerid = ? ORDER BY id DESC", partnerID).Scan(&rows)
+
+	keys := []KeyInfo{}
+	for _, r := range rows {
+		k := r.KeyInfo
+		k.Scopes = splitScopes(r.Scopestring)
+		keys = append(keys, k)
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":    0,
+		"status": "Success",
+		"keys":   keys,
+	})
+}
+
+// CreateKey adds a key for a partner.  The key is only returned this once.
+//
+// @Summary Create a partner API key (admin-only)
+// @Tags partner
+// @Router /api/partners/{id}/keys [post]
+func CreateKey(c *fiber.Ctx) error {
+	partnerID, err := partnerParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Scopes  []string   `json:"scopes"`
+		Quota   *int       `json:"quota"`
+		Expires *time.Time `json:"expires"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.ErrInvalidBody
+	}
+
+	if err := checkScopes(req.Scopes); err != nil {
+		return err
+	}
+
+	if req.Quota != nil && *req.Quota <= 0 {
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "quota must be positive")
+	}
+
+	id, key, err := createKey(partnerID, req.Scopes, req.Quota, req.Expires)
+	if err != nil {
+		return apierror.ErrInternal.WithMessage("Failed to create key")
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":    0,
+		"status": "Success",
+		"id":     id,
+		"key":    key,
+	})
+}
+
+// RotateKey replaces a key with a new one with the same scopes and quota.  The old key keeps working for the overlap
+// (in hours), so that the partner can switch over without a gap.
+//
+// @Summary Rotate a partner API key (admin-only)
+// @Tags partner
+// @Router /api/partners/keys/{id}/rotate [post]
+func RotateKey(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil || id == 0 {
+		return apierror.ErrInvalidID
+	}
+
+	var req struct {
+		Overlap *int `json:"overlap"`
+	}
+
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.ErrInvalidBody
+		}
+	}
+
+	overlap := DefaultOverlap
+	if req.Overlap != nil {
+		overlap = time.Duration(*req.Overlap) * time.Hour
+	}
+
+	if overlap < 0 || overlap > maxOverlap {
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "overlap must be between 0 and 720 hours")
+	}
+
+	db := database.DBConn
+
+	var old struct {
+		ID        uint64
+		Partnerid uint64
+		Scopes    string
+		Quota     *int
+		Expires   *time.Time
+		Expired   bool
+	}
+
+	db.Raw("SELECT id, partnerid, scopes, quota, expires, expires IS NOT NULL AND expires <= NOW() AS expired "+
+		"FROM partners_apikeys WHERE id = ?", id).Scan(&old)
+
+	if old.ID == 0 {
+		return apierror.ErrNotFound.WithMessage("Key not found")
+	}
+
+	if old.Expired {
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "Key has already expired")
+	}
+
+	// The new key expires when the old one would have, if it had an expiry; rotating shouldn't extend access.
+	newID, key, err := createKey(old.Partnerid, splitScopes(old.Scopes), old.Quota, old.Expires)
+	if err != nil {
+		return apierror.ErrInternal.WithMessage("Failed to create key")
+	}
+
+	db.Exec("UPDATE partners_apikeys SET expires = LEAST(COALESCE(expires, DATE_ADD(NOW(), INTERVAL ? SECOND)), DATE_ADD(NOW(), INTERVAL ? SECOND)) WHERE id = ?",
+		int(overlap.Seconds()), int(overlap.Seconds()), old.ID)
+
+	var expires time.Time
+	db.Raw("SELECT expires FROM partners_apikeys WHERE id = ?", old.ID).Scan(&expires)
+
+	return c.JSON(fiber.Map{
+		"ret":        0,
+		"status":     "Success",
+		"id":         newID,
+		"key":        key,
+		"oldexpires": expires,
+	})
+}
+
+// RevokeKey stops a key working straight away.  We keep the row so that the audit log still makes sense.
+//
+// @Summary Revoke a partner API key (admin-only)
+// @Tags partner
+// @Router /api/partners/keys/{id} [delete]
+func RevokeKey(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil || id == 0 {
+		return apierror.ErrInvalidID
+	}
+
+	if getKey(id) == nil {
+		return apierror.ErrNotFound.WithMessage("Key not found")
+	}
+
+	database.DBConn.Exec("UPDATE partners_apikeys SET expires = NOW() WHERE id = ? AND (expires IS NULL OR expires > NOW())", id)
+
+	return c.JSON(fiber.Map{
+		"ret":    0,
+		"status": "Success",
+	})
+}
+
+// GetAudit returns a partner's calls, most recent first.  Pass the context from one page to get the next.
+//
+// @Summary Get the audit log for a partner (admin-only)
+// @Tags partner
+// @Router /api/partners/{id}/audit [get]
+func GetAudit(c *fiber.Ctx) error {
+	partnerID, err := partnerParam(c)
+	if err != nil {
+		return err
+	}
+
+	limit := c.QueryInt("limit", 100)
+	if limit < 1 || limit > maxAuditRows {
+		limit = maxAuditRows
+	}
+
+	ctx, _ := strconv.ParseUint(c.Query("context", "0"), 10, 64)
+
+	query := "SELECT id, apikeyid, prefix, scope, method, path, ip, result, timestamp FROM partners_audit WHERE partnerid = ?"
+	args := []interface{}{partnerID}
+
+	if ctx > 0 {
+		query += " AND id < ?"
+		args = append(args, ctx)
+	}
+
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	entries := []AuditEntry{}
+	database.DBConn.Raw(query, args...).Scan(&entries)
+
+	var next uint64
+	if len(entries) == limit {
+		next = entries[len(entries)-1].ID
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":     0,
+		"status":  "Success",
+		"audit":   entries,
+		"context": next,
+	})
+}
@@ -0,0 +1,288 @@
+// Package partner authenticates calls from partner services (e.g. LoveJunk, Trash Nothing) which use API keys
+// rather than user sessions.
+//
+// A partner is a row in partners_keys.  It can have several API keys, each of which has its own scopes and quota,
+// so that a key only lets a partner do what we've agreed it can.  We only store a hash of each key, and every call
+// made with one is written to an audit log, including those which we refuse.
+//
+// To rotate a key, we issue a new one with the same scopes and set the old one to expire a little later, so that
+// the partner has time to switch over.
+//
+// The tables are created by iznik-batch migrations:
+//
+//	partners_apikeys (id, partnerid, keyhash UNIQUE, prefix, scopes, quota NULL, created, expires NULL, lastused NULL)
+//	  keyhash is the SHA-256 of the key, in hex.  prefix is the start of the key, so that people can tell keys apart.
+//	  scopes is space-separated.  quota is calls per hour; NULL means DefaultQuota.
+//	partners_audit (id, partnerid NULL, apikeyid NULL, prefix, scope, method, path, ip, result, timestamp)
+//	  partnerid and apikeyid are NULL for keys we don't recognise.
+//
+// Partners set up before this have their key in the clear in partners_keys.key, which the PHP server still reads.
+// The first time one of those keys is used here we add it to partners_apikeys with the scopes for what it could do
+// before (see legacyScopes), and from then on it's an API key like any other.  An admin can then narrow its scopes or rotate
+// it.  Once all partners have moved to keys issued here, partners_keys.key can be dropped.
+package partner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/ratelimit"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Scopes a key can have.
+const (
+	ScopeChangesRead    = "changes:read"
+	ScopeChatWrite      = "chat:write"
+	ScopeUserForget     = "user:forget"
+	ScopeMessageConsent = "message:consent"
+	ScopeSpammersRead   = "spammers:read"
+)
+
+var supportedScopes = []string{ScopeChangesRead, ScopeChatWrite, ScopeUserForget, ScopeMessageConsent, ScopeSpammersRead}
+
+// DefaultQuota is the number of calls per hour a key can make if it doesn't have its own quota.
+const DefaultQuota = 3600
+
+// Results in the audit log.
+const (
+	ResultAllowed    = "Allowed"
+	ResultInvalidKey = "InvalidKey"
+	ResultNoScope    = "NoScope"
+	ResultQuota      = "Quota"
+)
+
+// prefixLength is how much of a key we keep in the clear.
+const prefixLength = 8
+
+// invalidKeyLimit is how often one IP address can try keys we don't recognise.  Beyond that we stop auditing them,
+// so that someone guessing keys can't fill up the audit log.
+var invalidKeyLimit = ratelimit.Limit{Rate: 1.0 / 60, Burst: 20}
+
+var (
+	ErrKeyRequired = apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "Partner key required")
+	ErrInvalidKey  = apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "Invalid partner key")
+)
+
+// Key is a partner API key.
+type Key struct {
+	ID        uint64 `json:"id"`
+	Partnerid uint64 `json:"partnerid"`
+	Partner   string `json:"partner"`
+	Scopes    string `json:"-"`
+	Quota     int    `json:"quota"`
+}
+
+// HasScope returns whether the key has a scope.
+func (k *Key) HasScope(scope string) bool {
+	return hasScope(splitScopes(k.Scopes), scope)
+}
+
+// limit is the rate limit for the key's quota.  Calls can come in bursts of up to a minute's worth, but not fewer
+// than 10, so that a partner with a small quota can still page through a feed.
+func (k *Key) limit() ratelimit.Limit {
+	quota := k.Quota
+	if quota <= 0 {
+		quota = DefaultQuota
+	}
+
+	burst := quota / 60
+	if burst < 10 {
+		burst = 10
+	}
+
+	if burst > quota {
+		burst = quota
+	}
+
+	return ratelimit.Limit{Rate: float64(quota) / time.Hour.Seconds(), Burst: burst}
+}
+
+// splitScopes parses a space-separated list of scopes.
+func splitScopes(s string) []string {
+	return strings.Fields(s)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HashKey is how we store keys.  They're random, so a fast hash is fine.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func keyPrefix(key string) string {
+	if len(key) > prefixLength {
+		return key[:prefixLength]
+	}
+
+	return key
+}
+
+// newKey returns a new random key.
+func newKey() string {
+	return utils.RandomHex(24)
+}
+
+// findKey returns the current key with a hash, or nil.
+func findKey(hash string) *Key {
+	var k Key
+	database.DBConn.Raw("SELECT partners_apikeys.id, partners_apikeys.partnerid, partners_keys.partner, partners_apikeys.scopes, "+
+		"COALESCE(partners_apikeys.quota, 0) AS quota FROM partners_apikeys "+
+		"INNER JOIN partners_keys ON partners_keys.id = partners_apikeys.partnerid "+
+		"WHERE partners_apikeys.keyhash = ? AND (partners_apikeys.expires IS NULL OR partners_apikeys.expires > NOW())", hash).Scan(&k)
+
+	if k.ID == 0 {
+		return nil
+	}
+
+	return &k
+}
+
+// legacyScopes returns the scopes for what a partner could do with a key in partners_keys.key.  That was anything
+// except acting for LoveJunk users, which only LoveJunk could do.
+func legacyScopes(partnerName string) []string {
+	ret := []string{}
+
+	for _, s := range supportedScopes {
+		if s != ScopeChatWrite || isLoveJunk(partnerName) {
+			ret = append(ret, s)
+		}
+	}
+
+	return ret
+}
+
+// isLoveJunk returns whether a partner is LoveJunk.  The "contains" allows us to run tests.
+func isLoveJunk(partnerName string) bool {
+	return strings.Contains(strings.ToLower(partnerName), "lovejunk")
+}
+
+// adoptLegacyKey adds a key from partners_keys.key to partners_apikeys, and returns it, or nil if there's no such
+// key.  If the key has been in partners_apikeys before and has since expired, e.g. after a rotation, this doesn't
+// bring it back.
+func adoptLegacyKey(key string) *Key {
+	db := database.DBConn
+
+	var legacy struct {
+		ID      uint64
+		Partner string
+	}
+	db.Raw("SELECT id, partner FROM partners_keys WHERE `key` = ? LIMIT 1", key).Scan(&legacy)
+
+	if legacy.ID == 0 {
+		return nil
+	}
+
+	// keyhash is unique, so if two calls race, only one adds it.
+	db.Exec("INSERT IGNORE INTO partners_apikeys (partnerid, keyhash, prefix, scopes, created) VALUES (?, ?, ?, ?, NOW())",
+		legacy.ID, HashKey(key), keyPrefix(key), strings.Join(legacyScopes(legacy.Partner), " "))
+
+	return findKey(HashKey(key))
+}
+
+// Authenticate checks that a key is valid, has a scope, and is within its quota, and records the call in the audit
+// log.  The errors are suitable for returning to the partner.
+func Authenticate(c *fiber.Ctx, key string, scope string) (*Key, error) {
+	if key == "" {
+		return nil, ErrKeyRequired
+	}
+
+	k := findKey(HashKey(key))
+	if k == nil {
+		k = adoptLegacyKey(key)
+	}
+
+	if k == nil {
+		res, err := ratelimit.Take("partner:invalid:"+auth.ClientIP(c), invalidKeyLimit)
+		if err != nil {
+			log.Printf("Partner invalid key store failed: %v", err)
+		} else if !res.Allowed {
+			return nil, ratelimit.TooManyRequests(c, res)
+		}
+
+		audit(c, nil, keyPrefix(key), scope, ResultInvalidKey)
+		return nil, ErrInvalidKey
+	}
+
+	if !k.HasScope(scope) {
+		audit(c, k, keyPrefix(key), scope, ResultNoScope)
+		return nil, apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "Partner key doesn't have the "+scope+" scope")
+	}
+
+	res, err := ratelimit.Take("partner:key:"+strconv.FormatUint(k.ID, 10), k.limit())
+	if err != nil {
+		// As for other rate limits, better to let calls through than to fail them all.
+		log.Printf("Partner quota store failed for key %d: %v", k.ID, err)
+	} else if !res.Allowed {
+		audit(c, k, keyPrefix(key), scope, ResultQuota)
+		return nil, ratelimit.TooManyRequests(c, res)
+	}
+
+	audit(c, k, keyPrefix(key), scope, ResultAllowed)
+
+	// Only once a minute, so that busy partners don't make us write to the row on every call.
+	database.DBConn.Exec("UPDATE partners_apikeys SET lastused = NOW() WHERE id = ? AND (lastused IS NULL OR lastused < DATE_SUB(NOW(), INTERVAL 1 MINUTE))", k.ID)
+
+	return k, nil
+}
+
+// audit records a call.  We log the path but not the query string, which often contains the key.
+func audit(c *fiber.Ctx, k *Key, prefix string, scope string, result string) {
+	var partnerID, keyID *uint64
+
+	if k != nil {
+		partnerID = &k.Partnerid
+		keyID = &k.ID
+	}
+
+	database.DBConn.Exec("INSERT INTO partners_audit (partnerid, apikeyid, prefix, scope, method, path, ip, result, timestamp) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW())", partnerID, keyID, prefix, scope, c.Method(), c.Path(), auth.ClientIP(c), result)
+}
+
+// PartnerHasScope returns whether a partner has a current key with a scope.  It's for checks made on behalf of a
+// partner by someone else, e.g. a mod recording that a message can be shared with it.  A partner whose legacy key
+// hasn't been used here yet has no API keys, so we go by what that key will get when it's adopted.
+func PartnerHasScope(partnerID uint64, scope string) bool {
+	db := database.DBConn
+
+	var keys []struct {
+		Scopes  string
+		Current bool
+	}
+	db.Raw("SELECT scopes, (expires IS NULL OR expires > NOW()) AS current FROM partners_apikeys WHERE partnerid = ?", partnerID).Scan(&keys)
+
+	if len(keys) == 0 {
+		var legacy struct {
+			Partner string
+			Key     string
+		}
+		db.Raw("SELECT partner, COALESCE(`key`, '') AS `key` FROM partners_keys WHERE id = ?", partnerID).Scan(&legacy)
+
+		return legacy.Key != "" && hasScope(legacyScopes(legacy.Partner), scope)
+	}
+
+	for _, k := range keys {
+		if k.Current && hasScope(splitScopes(k.Scopes), scope) {
+			return true
+		}
+	}
+
+	return false
+}
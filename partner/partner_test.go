@@ -0,0 +1,43 @@
+package partner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyLimit(t *testing.T) {
+	// No quota means the default.
+	l := (&Key{}).limit()
+	assert.InDelta(t, float64(DefaultQuota)/time.Hour.Seconds(), l.Rate, 0.0001)
+	assert.Equal(t, DefaultQuota/60, l.Burst)
+
+	// Small quotas still allow a few calls at once, but never more than the quota.
+	assert.Equal(t, 10, (&Key{Quota: 120}).limit().Burst)
+	assert.Equal(t, 5, (&Key{Quota: 5}).limit().Burst)
+	assert.Equal(t, 1000, (&Key{Quota: 60000}).limit().Burst)
+}
+
+func TestKeyHasScope(t *testing.T) {
+	k := &Key{Scopes: "changes:read  spammers:read"}
+
+	assert.True(t, k.HasScope(ScopeChangesRead))
+	assert.True(t, k.HasScope(ScopeSpammersRead))
+	assert.False(t, k.HasScope(ScopeChatWrite))
+	assert.False(t, k.HasScope(""))
+}
+
+func TestHashKey(t *testing.T) {
+	assert.Equal(t, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", HashKey("test"))
+	assert.Len(t, HashKey(newKey()), 64)
+
+	assert.Equal(t, "abcdefgh", keyPrefix("abcdefghijkl"))
+	assert.Equal(t, "abc", keyPrefix("abc"))
+}
+
+func TestCheckScopes(t *testing.T) {
+	assert.NoError(t, checkScopes([]string{ScopeChangesRead, ScopeUserForget}))
+	assert.Error(t, checkScopes(nil))
+	assert.Error(t, checkScopes([]string{ScopeChangesRead, "changes:write"}))
+}
@@ -0,0 +1,224 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// maxTasks is the most tasks we return at once.
+	maxTasks = 100
+
+	// staleAfter is how long a task can be processing before we assume the consumer died while handling it.
+	staleAfter = time.Hour
+
+	// errDuplicateKey is MySQL's error number for a unique key violation.
+	errDuplicateKey = 1062
+)
+
+// Task is a row in background_tasks.
+type Task struct {
+	ID          uint64          `json:"id"`
+	TaskType    string          `json:"task_type"`
+	DataJSON    string          `json:"-" gorm:"column:data"`
+	Data        json.RawMessage `json:"data" gorm:"-"`
+	Status      string          `json:"status"`
+	Priority    int             `json:"priority"`
+	DedupKey    *string         `json:"dedup_key"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   time.Time       `json:"created_at"`
+	ScheduledAt *time.Time      `json:"scheduled_at"`
+	StartedAt   *time.Time      `json:"started_at"`
+	ProcessedAt *time.Time      `json:"processed_at"`
+	FailedAt    *time.Time      `json:"failed_at"`
+	LastError   *string         `json:"last_error"`
+	Stale       bool            `json:"stale" gorm:"-"`
+}
+
+const taskColumns = "id, task_type, data, status, priority, dedup_key, attempts, created_at, scheduled_at, started_at, processed_at, failed_at, last_error"
+
+// TaskCount is how many tasks of a type have a status, and when the oldest was queued.
+type TaskCount struct {
+	TaskType string    `json:"task_type"`
+	Status   string    `json:"status"`
+	Count    int64     `json:"count"`
+	Oldest   time.Time `json:"oldest"`
+}
+
+func (t *Task) decode() {
+	if json.Valid([]byte(t.DataJSON)) {
+		t.Data = json.RawMessage(t.DataJSON)
+	}
+
+	t.Stale = t.Status == StatusProcessing && t.StartedAt != nil && time.Since(*t.StartedAt) > staleAfter
+}
+
+// ListTasks returns tasks, most recent first, and counts of the ones which haven't finished.  Filter with status and
+// type; pass the returned context to get the next page.
+//
+// Task data can include things like login links, so the route requires admin.
+//
+// @Summary List background tasks
+// @Tags queue
+// @Router /api/queue/tasks [get]
+func ListTasks(c *fiber.Ctx) error {
+	var where []string
+	var args []interface{}
+
+	if status := c.Query("status"); status != "" {
+		switch status {
+		case StatusPending, StatusProcessing, StatusDone, StatusFailed:
+		default:
+			return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "Unknown status")
+		}
+
+		where = append(where, "status = ?")
+		args = append(args, status)
+	}
+
+	if taskType := c.Query("type"); taskType != "" {
+		where = append(where, "task_type = ?")
+		args = append(args, taskType)
+	}
+
+	if ctx, _ := strconv.ParseUint(c.Query("context"), 10, 64); ctx > 0 {
+		where = append(where, "id < ?")
+		args = append(args, ctx)
+	}
+
+	limit := c.QueryInt("limit", maxTasks)
+	if limit < 1 || limit > maxTasks {
+		limit = maxTasks
+	}
+
+	query := "SELECT " + taskColumns + " FROM background_tasks"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	db := database.DBConn
+
+	tasks := []Task{}
+	db.Raw(query, args...).Scan(&tasks)
+
+	for i := range tasks {
+		tasks[i].decode()
+	}
+
+	var next uint64
+	if len(tasks) == limit {
+		next = tasks[len(tasks)-1].ID
+	}
+
+	// There are far too many done tasks to count each time.  Pending tasks with processed_at set have been done by
+	// the older consumer.
+	counts := []TaskCount{}
+	db.Raw("SELECT task_type, status, COUNT(*) AS count, MIN(created_at) AS oldest FROM background_tasks "+
+		"WHERE status IN ? AND (status != ? OR processed_at IS NULL) GROUP BY task_type, status ORDER BY task_type, status",
+		[]string{StatusPending, StatusProcessing, StatusFailed}, StatusPending).Scan(&counts)
+
+	return c.JSON(fiber.Map{
+		"ret":     0,
+		"status":  "Success",
+		"tasks":   tasks,
+		"counts":  counts,
+		"context": next,
+	})
+}
+
+// RequeueTask puts a failed task back to pending, with its attempts reset.  A task which has been processing for
+// too long can be requeued too, as the consumer has probably died.
+//
+// @Summary Requeue a background task
+// @Tags queue
+// @Router /api/queue/tasks/{id}/requeue [post]
+func RequeueTask(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil || id == 0 {
+		return apierror.ErrInvalidID
+	}
+
+	var t Task
+	database.DBConn.Raw("SELECT "+taskColumns+" FROM background_tasks WHERE id = ?", id).Scan(&t)
+	if t.ID == 0 {
+		return apierror.ErrNotFound.WithMessage("Task not found")
+	}
+
+	t.decode()
+
+	if t.Status != StatusFailed && !t.Stale {
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "Only failed or stale tasks can be requeued")
+	}
+
+	// Check the status again, in case the consumer has moved it on since we looked.
+	result := database.DBConn.Exec("UPDATE background_tasks SET status = ?, attempts = 0, scheduled_at = NULL, started_at = NULL, failed_at = NULL, processed_at = NULL "+
+		"WHERE id = ? AND status = ?", StatusPending, id, t.Status)
+
+	if result.Error != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(result.Error, &mysqlErr) && mysqlErr.Number == errDuplicateKey {
+			return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "The same task is already pending")
+		}
+
+		return apierror.From(result.Error)
+	}
+
+	if result.RowsAffected == 0 {
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "The task has changed since - please check it again")
+	}
+
+	log.Printf("User %d requeued %s task %d, which was %s after %d attempts", auth.WhoAmI(c), t.TaskType, id, t.Status, t.Attempts)
+
+	return c.JSON(fiber.Map{
+		"ret":    0,
+		"status": "Success",
+	})
+}
+
+// RequeueFailed puts all the failed tasks of a type back to pending, e.g. once whatever made them fail is fixed.
+// Tasks which duplicate one that's already pending are left as they are.
+//
+// @Summary Requeue failed background tasks
+// @Tags queue
+// @Router /api/queue/tasks/requeue [post]
+func RequeueFailed(c *fiber.Ctx) error {
+	type requeueRequest struct {
+		Type string `json:"type"`
+	}
+
+	var req requeueRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.ErrInvalidBody
+	}
+
+	if req.Type == "" {
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "type is required")
+	}
+
+	result := database.DBConn.Exec("UPDATE IGNORE background_tasks SET status = ?, attempts = 0, scheduled_at = NULL, started_at = NULL, failed_at = NULL, processed_at = NULL "+
+		"WHERE task_type = ? AND status = ?", StatusPending, req.Type, StatusFailed)
+
+	if result.Error != nil {
+		return apierror.From(result.Error)
+	}
+
+	log.Printf("User %d requeued %d failed %s tasks", auth.WhoAmI(c), result.RowsAffected, req.Type)
+
+	return c.JSON(fiber.Map{
+		"ret":      0,
+		"status":   "Success",
+		"requeued": result.RowsAffected,
+	})
+}
@@ -1,9 +1,52 @@
+// Package queue adds work to the background_tasks table, which iznik-batch processes.
+//
+// A task queued with QueueTaskTx is part of the caller's transaction, so it's only queued if the change it's about
+// is committed, and is never lost if that change is.  QueueTask is for work which doesn't go with a change.
+//
+// Tasks have a status:
+//
+//	pending     waiting to run, from scheduled_at if set.  Highest priority first, then oldest.
+//	processing  claimed by the consumer, which has added one to attempts.
+//	done        finished; processed_at is when.
+//	failed      gave up after too many attempts; last_error says why.  Admins can requeue these.
+//
+// A consumer which fails a task but will try again puts it back to pending with a later scheduled_at.
+//
+// The batch consumer which predates statuses only sets processed_at, leaving its tasks pending, so anything which
+// needs to know whether a task is still waiting checks processed_at too.
+//
+// The columns beyond id, task_type, data, created_at, processed_at and attempts are added by an iznik-batch
+// migration:
+//
+//	status ENUM('pending', 'processing', 'done', 'failed') DEFAULT 'pending', priority INT DEFAULT 0,
+//	dedup_key NULL, scheduled_at NULL, started_at NULL, failed_at NULL, last_error NULL,
+//	pending_dedup_key AS (IF(status = 'pending' AND processed_at IS NULL, dedup_key, NULL)) UNIQUE
+//	  Indexed on (status, priority, scheduled_at) and (task_type, status).
 package queue
 
 import (
 	"encoding/json"
-	"github.com/freegle/iznik-server-go/database"
+	"fmt"
 	"log"
+	"time"
+
+	"github.com/freegle/iznik-server-go/database"
+	"gorm.io/gorm"
+)
+
+// Task statuses.
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusDone       = "done"
+	StatusFailed     = "failed"
+)
+
+// Priorities.  Any int will do; these are the usual ones.
+const (
+	PriorityLow    = -10
+	PriorityNormal = 0
+	PriorityHigh   = 10
 )
 
 // Task types for the background_tasks queue.
@@ -35,27 +78,99 @@ const (
 
 	// TaskFreebieAlertsRemove removes a post from freebiealerts.app when it's taken/received.
 	TaskFreebieAlertsRemove = "freebie_alerts_remove"
+
+	// TaskSavedSearchAlert tells a user that a newly approved post matches one or more of their saved searches.
+	TaskSavedSearchAlert = "saved_search_alert"
 )
 
+// Options control how a task is queued.
+type Options struct {
+	// Priority is which pending tasks run first; higher is sooner.
+	Priority int
+
+	// DedupKey stops a task being queued while another with the same key is still pending, e.g. so that several
+	// changes to a group in quick succession only notify its mods once.  Tasks which are already being processed, or
+	// have been, don't count, as they may have missed the later change.
+	DedupKey string
+
+	// RunAt is when the task should run.  Zero means now.
+	RunAt time.Time
+}
+
+// DedupKey builds a key from a task type and what the task is about.
+func DedupKey(taskType string, parts ...interface{}) string {
+	key := taskType
+	for _, part := range parts {
+		key += ":" + fmt.Sprint(part)
+	}
+
+	return key
+}
+
 // QueueTask inserts a task into the background_tasks table for async processing by iznik-batch.
 func QueueTask(taskType string, data map[string]interface{}) error {
-	db := database.DBConn
+	return QueueTaskTx(database.DBConn, taskType, data)
+}
+
+// QueueTaskTx queues a task as part of a transaction, so that it's only queued if the transaction commits.
+func QueueTaskTx(tx *gorm.DB, taskType string, data map[string]interface{}) error {
+	_, err := Enqueue(tx, taskType, data, Options{})
+	return err
+}
 
+// Enqueue queues a task with options, as part of a transaction if tx is one.  It returns false if the task wasn't
+// queued because a pending task has the same DedupKey.
+func Enqueue(tx *gorm.DB, taskType string, data map[string]interface{}, opts Options) (bool, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		log.Printf("Failed to marshal task data for type %s: %v", taskType, err)
-		return err
+		return false, err
+	}
+
+	var dedupKey *string
+	if opts.DedupKey != "" {
+		dedupKey = &opts.DedupKey
 	}
 
-	result := db.Exec(
-		"INSERT INTO background_tasks (task_type, data) VALUES (?, ?)",
-		taskType, string(jsonData),
+	var scheduledAt *time.Time
+	if !opts.RunAt.IsZero() {
+		scheduledAt = &opts.RunAt
+	}
+
+	// A duplicate pending_dedup_key means there's already a pending task for this; leave it be.
+	result := tx.Exec(
+		"INSERT INTO background_tasks (task_type, data, status, priority, dedup_key, scheduled_at) VALUES (?, ?, ?, ?, ?, ?) "+
+			"ON DUPLICATE KEY UPDATE id = id",
+		taskType, string(jsonData), StatusPending, opts.Priority, dedupKey, scheduledAt,
 	)
 
 	if result.Error != nil {
 		log.Printf("Failed to queue task type %s: %v", taskType, result.Error)
-		return result.Error
+		return false, result.Error
 	}
 
-	return nil
+	return result.RowsAffected > 0, nil
+}
+
+// QueuePushNotifyGroupMods queues a push notification to a group's mods.  One push is enough to bring them to
+// whatever is waiting, so if one is already pending for the group we don't queue another.
+func QueuePushNotifyGroupMods(groupid uint64) error {
+	_, err := Enqueue(database.DBConn, TaskPushNotifyGroupMods, map[string]interface{}{
+		"group_id": groupid,
+	}, Options{DedupKey: DedupKey(TaskPushNotifyGroupMods, groupid)})
+
+	return err
+}
+
+// QueueSavedSearchAlert queues an alert to a user about a post which matches their saved searches.  If one is
+// already pending for the same user and post, e.g. because the post was approved twice in quick succession, we
+// don't queue another.
+func QueueSavedSearchAlert(tx *gorm.DB, userid uint64, msgid uint64, searchids []uint64) error {
+	_, err := Enqueue(tx, TaskSavedSearchAlert, map[string]interface{}{
+		"userid":    userid,
+		"msgid":     msgid,
+		"searchids": searchids,
+	}, Options{DedupKey: DedupKey(TaskSavedSearchAlert, msgid, userid)})
+
+	return err
 }
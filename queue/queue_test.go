@@ -0,0 +1,13 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupKey(t *testing.T) {
+	assert.Equal(t, "push_notify_group_mods", DedupKey(TaskPushNotifyGroupMods))
+	assert.Equal(t, "push_notify_group_mods:123", DedupKey(TaskPushNotifyGroupMods, uint64(123)))
+	assert.Equal(t, "email_merge:1:2", DedupKey(TaskEmailMerge, 1, "2"))
+}
@@ -0,0 +1,230 @@
+// Package ratelimit limits how often a client can call the API, using token buckets.
+//
+// Each policy has its own buckets, keyed on the user if they're logged in and otherwise on their IP address.  Mods,
+// support and admins are exempt by default, as they legitimately make lots of requests.  We used to rely on HAProxy
+// for this, but that doesn't protect us when we run without it, e.g. under Lambda.
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Policy describes how often a group of requests is allowed.
+type Policy struct {
+	// Name identifies the policy's buckets, so policies with different names don't share them.
+	Name string
+
+	// Requests are allowed per Period on average, with up to Burst at once.  Burst defaults to Requests.
+	Requests int
+	Period   time.Duration
+	Burst    int
+
+	// ByIP keys on the IP address even when the user is logged in, e.g. for requests which don't need login and so
+	// could be spread across many users.
+	ByIP bool
+
+	// Exempt lists system roles which aren't limited.  nil means the default of mods, support and admins; use an
+	// empty list to limit everyone.
+	Exempt []string
+
+	// Match restricts the policy to some requests, e.g. one action on an endpoint.  nil means all.
+	Match func(c *fiber.Ctx) bool
+}
+
+func (p Policy) limit() Limit {
+	burst := p.Burst
+	if burst == 0 {
+		burst = p.Requests
+	}
+
+	return Limit{Rate: float64(p.Requests) / p.Period.Seconds(), Burst: burst}
+}
+
+var defaultExempt = []string{utils.SYSTEMROLE_MODERATOR, utils.SYSTEMROLE_SUPPORT, utils.SYSTEMROLE_ADMIN}
+
+// Policies.  The per-route ones are well above what a person would do, so they only catch scripts.
+var (
+	// Default applies to every request, as a backstop.
+	Default = Policy{Name: "default", Requests: 1200, Period: time.Minute, Burst: 300}
+
+	// LostPassword sends an email, so could be used to spam people.
+	LostPassword = Policy{
+		Name:     "lostpassword",
+		Requests: 10,
+		Period:   time.Hour,
+		ByIP:     true,
+		Match: func(c *fiber.Ctx) bool {
+			var req struct {
+				Action string `json:"action"`
+			}
+
+			_ = c.BodyParser(&req)
+			return req.Action == "LostPassword"
+		},
+	}
+
+	ChatMessage = Policy{Name: "chatmessage", Requests: 30, Period: time.Minute}
+	Shortlink   = Policy{Name: "shortlink", Requests: 20, Period: time.Hour}
+	Image       = Policy{Name: "image", Requests: 60, Period: time.Minute}
+)
+
+// Config configures the rate limit middleware.
+type Config struct {
+	Policy Policy
+
+	// Skip returns true for requests which aren't limited, e.g. health checks.
+	Skip func(c *fiber.Ctx) bool
+
+	// Store holds the buckets.  nil means the in-memory store shared by all policies.
+	Store Store
+
+	// GetRole returns the system role of a user, for exemptions.  nil means look it up in the database.
+	GetRole func(userid uint64) string
+}
+
+var defaultStore Store = NewMemoryStore()
+
+// SetDefaultStore changes the store used by policies which don't specify one, e.g. to share limits between
+// servers.  Call it before setting up routes.
+func SetDefaultStore(s Store) {
+	defaultStore = s
+}
+
+// New creates a middleware which enforces a policy.
+func New(config Config) fiber.Handler {
+	p := config.Policy
+	limit := p.limit()
+
+	store := config.Store
+	if store == nil {
+		store = defaultStore
+	}
+
+	getRole := config.GetRole
+	if getRole == nil {
+		getRole = cachedRole
+	}
+
+	exempt := map[string]bool{}
+
+	roles := p.Exempt
+	if roles == nil {
+		roles = defaultExempt
+	}
+
+	for _, r := range roles {
+		exempt[r] = true
+	}
+
+	return func(c *fiber.Ctx) error {
+		if (config.Skip != nil && config.Skip(c)) || (p.Match != nil && !p.Match(c)) {
+			return c.Next()
+		}
+
+		// We use the JWT rather than WhoAmI, which would make the auth middleware treat this as an authenticated
+		// request.  The JWT is signed, so we can trust the id in it.
+		userid, _, _ := auth.GetJWTFromRequest(c)
+
+		if userid > 0 && len(exempt) > 0 && exempt[getRole(userid)] {
+			return c.Next()
+		}
+
+		key := p.Name + ":ip:" + auth.ClientIP(c)
+		if userid > 0 && !p.ByIP {
+			key = p.Name + ":user:" + strconv.FormatUint(userid, 10)
+		}
+
+		res, err := store.Take(key, limit)
+		if err != nil {
+			// Better to let requests through than to fail them all because the store is down.
+			log.Printf("Rate limit store failed for %s: %v", key, err)
+			return c.Next()
+		}
+
+		c.Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+		c.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+
+		if !res.Allowed {
+			return TooManyRequests(c, res)
+		}
+
+		return c.Next()
+	}
+}
+
+// Take takes a token from a bucket in the default store, for limits which aren't per-route policies, e.g. partner
+// quotas.
+func Take(key string, limit Limit) (Result, error) {
+	return defaultStore.Take(key, limit)
+}
+
+// TooManyRequests returns the error for a request which has been limited, and tells the client when to retry.
+func TooManyRequests(c *fiber.Ctx, res Result) error {
+	secs := int(res.RetryAfter.Seconds())
+	if res.RetryAfter > time.Duration(secs)*time.Second {
+		secs++
+	}
+
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(secs))
+
+	return apierror.New(fiber.StatusTooManyRequests, apierror.CodeRateLimited,
+		fmt.Sprintf("Too many requests - please try again in %d seconds", secs))
+}
+
+// roleCacheTTL is how long we remember a user's system role.  Roles rarely change, and a new mod being limited for
+// a few minutes doesn't matter.
+const roleCacheTTL = 5 * time.Minute
+
+type cachedRoleEntry struct {
+	role    string
+	expires time.Time
+}
+
+var roleCache = struct {
+	sync.Mutex
+	entries map[uint64]cachedRoleEntry
+	purged  time.Time
+}{entries: make(map[uint64]cachedRoleEntry)}
+
+func cachedRole(userid uint64) string {
+	now := time.Now()
+
+	roleCache.Lock()
+	e, ok := roleCache.entries[userid]
+	roleCache.Unlock()
+
+	if ok && now.Before(e.expires) {
+		return e.role
+	}
+
+	var role string
+	database.DBConn.Raw("SELECT systemrole FROM users WHERE id = ?", userid).Scan(&role)
+
+	roleCache.Lock()
+	defer roleCache.Unlock()
+
+	roleCache.entries[userid] = cachedRoleEntry{role: role, expires: now.Add(roleCacheTTL)}
+
+	// Drop expired entries now and then so that the cache doesn't grow forever.
+	if now.Sub(roleCache.purged) > roleCacheTTL {
+		for id, e := range roleCache.entries {
+			if now.After(e.expires) {
+				delete(roleCache.entries, id)
+			}
+		}
+
+		roleCache.purged = now
+	}
+
+	return role
+}
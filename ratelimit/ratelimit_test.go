@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func testStore() (*MemoryStore, *clock) {
+	clk := &clock{t: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	s := NewMemoryStore()
+	s.now = clk.now
+	return s, clk
+}
+
+func TestBucket(t *testing.T) {
+	s, clk := testStore()
+	l := Limit{Rate: 1, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		r, _ := s.Take("k", l)
+		assert.True(t, r.Allowed)
+		assert.Equal(t, i, r.Remaining)
+	}
+
+	r, _ := s.Take("k", l)
+	assert.False(t, r.Allowed)
+	assert.Equal(t, time.Second, r.RetryAfter)
+
+	// Other keys have their own buckets.
+	r, _ = s.Take("other", l)
+	assert.True(t, r.Allowed)
+
+	// Tokens come back at the rate, but never more than the burst.
+	clk.t = clk.t.Add(1500 * time.Millisecond)
+	r, _ = s.Take("k", l)
+	assert.True(t, r.Allowed)
+	r, _ = s.Take("k", l)
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 500*time.Millisecond, r.RetryAfter)
+
+	clk.t = clk.t.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		r, _ = s.Take("k", l)
+		assert.True(t, r.Allowed)
+	}
+
+	r, _ = s.Take("k", l)
+	assert.False(t, r.Allowed)
+}
+
+func TestSweep(t *testing.T) {
+	s, clk := testStore()
+	l := Limit{Rate: 1, Burst: 10}
+
+	s.Take("a", l)
+	s.Take("b", l)
+	assert.Equal(t, 2, s.Len())
+
+	// Once a bucket has refilled it's the same as not having one, so it's dropped.
+	clk.t = clk.t.Add(2 * sweepInterval)
+	s.Take("c", l)
+	assert.Equal(t, 1, s.Len())
+}
+
+func testApp(p Policy, roles map[uint64]string) *fiber.App {
+	s, _ := testStore()
+
+	// Test requests come from 0.0.0.0, which we treat as our proxy.
+	_ = auth.SetTrustedProxies([]string{"0.0.0.0"})
+
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	app.Post("/api/thing", New(Config{
+		Policy: p,
+		Store:  s,
+		GetRole: func(userid uint64) string {
+			return roles[userid]
+		},
+	}), func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"ret": 0})
+	})
+
+	return app
+}
+
+func post(app *fiber.App, ip string, jwt string, body string) int {
+	req := httptest.NewRequest("POST", "/api/thing", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", ip)
+
+	if jwt != "" {
+		req.Header.Set("Authorization", jwt)
+	}
+
+	resp, _ := app.Test(req)
+	return resp.StatusCode
+}
+
+func token(t *testing.T, id string) string {
+	os.Setenv("JWT_SECRET", "ratelimit-test")
+
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id":        id,
+		"sessionid": "1",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("ratelimit-test"))
+	assert.NoError(t, err)
+
+	return s
+}
+
+func TestByIP(t *testing.T) {
+	app := testApp(Policy{Name: "test", Requests: 2, Period: time.Minute}, nil)
+
+	assert.Equal(t, 200, post(app, "1.2.3.4", "", "{}"))
+	assert.Equal(t, 200, post(app, "1.2.3.4", "", "{}"))
+	assert.Equal(t, 429, post(app, "1.2.3.4", "", "{}"))
+	assert.Equal(t, 200, post(app, "5.6.7.8", "", "{}"))
+
+	// Making up an earlier hop doesn't get a new bucket, because the proxy appends the real address.
+	assert.Equal(t, 429, post(app, "9.9.9.9, 1.2.3.4", "", "{}"))
+}
+
+func TestByUserAndExempt(t *testing.T) {
+	app := testApp(Policy{Name: "test", Requests: 1, Period: time.Minute}, map[uint64]string{
+		1: utils.SYSTEMROLE_USER,
+		2: utils.SYSTEMROLE_MODERATOR,
+	})
+
+	user, mod := token(t, "1"), token(t, "2")
+
+	// A logged in user has their own bucket, wherever they are.
+	assert.Equal(t, 200, post(app, "1.2.3.4", user, "{}"))
+	assert.Equal(t, 429, post(app, "5.6.7.8", user, "{}"))
+	assert.Equal(t, 200, post(app, "1.2.3.4", "", "{}"))
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 200, post(app, "1.2.3.4", mod, "{}"))
+	}
+}
+
+func TestMatchAndHeaders(t *testing.T) {
+	p := LostPassword
+	p.Requests = 1
+	app := testApp(p, nil)
+
+	// Only the matching action is limited.
+	assert.Equal(t, 200, post(app, "1.2.3.4", "", `{"action":"LostPassword","email":"test@example.com"}`))
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 200, post(app, "1.2.3.4", "", `{"action":"Unsubscribe","email":"test@example.com"}`))
+	}
+
+	req := httptest.NewRequest("POST", "/api/thing", strings.NewReader(`{"action":"LostPassword"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	resp, _ := app.Test(req)
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "3600", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "0", resp.Header.Get("X-RateLimit-Remaining"))
+}
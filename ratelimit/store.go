@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is the size and refill rate of a token bucket.
+type Limit struct {
+	// Rate is how many tokens are added per second.
+	Rate float64
+
+	// Burst is the size of the bucket, i.e. how many requests can be made at once.
+	Burst int
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed bool
+
+	// Remaining is how many tokens are left in the bucket.
+	Remaining int
+
+	// RetryAfter is how long until there will be a token, if there isn't one now.
+	RetryAfter time.Duration
+}
+
+// Store holds the token buckets.  A store shared between servers (e.g. in Redis) must refill and take atomically,
+// as two servers may take from the same bucket at once.
+type Store interface {
+	// Take refills the bucket for key and then takes a token from it if there is one.  Buckets which don't exist
+	// yet start full.
+	Take(key string, limit Limit) (Result, error)
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+	full   time.Duration
+}
+
+// MemoryStore is a Store for a single server.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+
+	// now is overridden by tests.
+	now func() time.Time
+}
+
+// sweepInterval is how often we drop buckets which have refilled, as those are the same as no bucket.
+const sweepInterval = time.Minute
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStore) Take(key string, limit Limit) (Result, error) {
+	now := s.now()
+	burst := float64(limit.Burst)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) > sweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, at: now}
+		s.buckets[key] = b
+	} else if elapsed := now.Sub(b.at).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*limit.Rate)
+		b.at = now
+	}
+
+	b.full = time.Duration(burst / limit.Rate * float64(time.Second))
+
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / limit.Rate
+		return Result{RetryAfter: time.Duration(math.Ceil(wait * float64(time.Second)))}, nil
+	}
+
+	b.tokens--
+
+	return Result{Allowed: true, Remaining: int(b.tokens)}, nil
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.Sub(b.at) >= b.full {
+			delete(s.buckets, key)
+		}
+	}
+
+	s.swept = now
+}
+
+// Len returns the number of buckets held.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
@@ -0,0 +1,262 @@
+// Package realtime fans out events to connected clients so that they don't have to poll for them.
+//
+// Handlers publish an Event addressed to a set of user IDs.  The event goes via a Backplane, which is what lets
+// several API instances share events, and each instance's Hub delivers it to the local subscribers for those users.
+// The default backplane is in-memory, which is correct for a single instance and for tests.
+package realtime
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Event types pushed to clients.
+const (
+	EventChatMessage = "chatmessage"
+	EventTyping      = "typing"
+	EventNudge       = "nudge"
+	EventRead        = "read"
+)
+
+// subscriptionBuffer is how many events we queue for a slow client before dropping new ones.  Clients resync
+// by fetching the chat when they reconnect, so dropping is safe.
+const subscriptionBuffer = 64
+
+// Event is a single item pushed to a client.
+type Event struct {
+	Type   string      `json:"type"`
+	Chatid uint64      `json:"chatid,omitempty"`
+	Userid uint64      `json:"userid,omitempty"`
+	Date   time.Time   `json:"date"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// Envelope is an event together with the users it should be delivered to.  This is what travels over the backplane.
+type Envelope struct {
+	To    []uint64 `json:"to"`
+	Event Event    `json:"event"`
+}
+
+// Backplane distributes envelopes between hubs.  An implementation backed by a shared store (e.g. Redis pub/sub)
+// allows events published on one API instance to reach clients connected to another.
+type Backplane interface {
+	Publish(env Envelope) error
+	Subscribe(handler func(Envelope)) (cancel func())
+}
+
+// MemoryBackplane delivers envelopes synchronously to handlers in the same process.
+type MemoryBackplane struct {
+	mu       sync.RWMutex
+	next     uint64
+	handlers map[uint64]func(Envelope)
+}
+
+// NewMemoryBackplane creates an empty in-process backplane.
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{
+		handlers: make(map[uint64]func(Envelope)),
+	}
+}
+
+// Publish hands the envelope to every subscribed handler.
+func (b *MemoryBackplane) Publish(env Envelope) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, h := range b.handlers {
+		h(env)
+	}
+
+	return nil
+}
+
+// Subscribe registers a handler and returns a function to remove it.
+func (b *MemoryBackplane) Subscribe(handler func(Envelope)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.next
+	b.next++
+	b.handlers[id] = handler
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}
+}
+
+// Subscription receives the events for one connected client.
+type Subscription struct {
+	Userid uint64
+	C      chan Event
+	hub    *Hub
+	once   sync.Once
+}
+
+// Close removes the subscription from its hub.  It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.remove(s)
+	})
+}
+
+// Hub holds the subscriptions for connected clients on this instance.
+type Hub struct {
+	mu        sync.RWMutex
+	subs      map[uint64]map[*Subscription]struct{}
+	count     int
+	backplane Backplane
+	cancel    func()
+}
+
+// NewHub creates a hub which receives events from the given backplane.
+func NewHub(backplane Backplane) *Hub {
+	h := &Hub{
+		subs: make(map[uint64]map[*Subscription]struct{}),
+	}
+
+	h.SetBackplane(backplane)
+
+	return h
+}
+
+// SetBackplane switches the hub to a different backplane, e.g. a shared one in a multi-instance deployment.
+func (h *Hub) SetBackplane(backplane Backplane) {
+	// Subscribe and unsubscribe outside our lock, because backplanes call deliver (which takes it) under theirs.
+	cancel := backplane.Subscribe(h.deliver)
+
+	h.mu.Lock()
+	old := h.cancel
+	h.backplane = backplane
+	h.cancel = cancel
+	h.mu.Unlock()
+
+	if old != nil {
+		old()
+	}
+}
+
+// Subscribe registers a client for a user.  The caller must Close the subscription when the client goes away.
+func (h *Hub) Subscribe(userid uint64) *Subscription {
+	s := &Subscription{
+		Userid: userid,
+		C:      make(chan Event, subscriptionBuffer),
+		hub:    h,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[userid] == nil {
+		h.subs[userid] = make(map[*Subscription]struct{})
+	}
+
+	h.subs[userid][s] = struct{}{}
+	h.count++
+
+	return s
+}
+
+func (h *Hub) remove(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if userSubs, ok := h.subs[s.Userid]; ok {
+		if _, ok := userSubs[s]; ok {
+			delete(userSubs, s)
+			h.count--
+		}
+
+		if len(userSubs) == 0 {
+			delete(h.subs, s.Userid)
+		}
+	}
+}
+
+// Subscribers returns the number of connected clients on this instance.
+func (h *Hub) Subscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.count
+}
+
+// Listening returns whether anyone might receive a published event.  With the in-memory backplane that means
+// there is a client connected to this instance; with a shared backplane we can't tell, so we assume so.  Callers
+// use this to skip the work of building events nobody will see.
+func (h *Hub) Listening() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if _, local := h.backplane.(*MemoryBackplane); !local {
+		return true
+	}
+
+	return h.count > 0
+}
+
+// Publish sends an event to the given users via the backplane.
+func (h *Hub) Publish(to []uint64, ev Event) {
+	if len(to) == 0 {
+		return
+	}
+
+	if ev.Date.IsZero() {
+		ev.Date = time.Now()
+	}
+
+	h.mu.RLock()
+	backplane := h.backplane
+	h.mu.RUnlock()
+
+	if err := backplane.Publish(Envelope{To: to, Event: ev}); err != nil {
+		fmt.Printf("Failed to publish %s event: %v\n", ev.Type, err)
+	}
+}
+
+// PublishLocal sends an event to the given users' clients on this instance only.  This is for events which every
+// instance discovers for itself, so that going via the backplane would deliver them more than once.
+func (h *Hub) PublishLocal(to []uint64, ev Event) {
+	if ev.Date.IsZero() {
+		ev.Date = time.Now()
+	}
+
+	h.deliver(Envelope{To: to, Event: ev})
+}
+
+// deliver passes an envelope from the backplane to the local subscribers.  It never blocks: if a client's buffer
+// is full the event is dropped for that client.
+func (h *Hub) deliver(env Envelope) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	seen := make(map[uint64]bool, len(env.To))
+
+	for _, userid := range env.To {
+		if seen[userid] {
+			continue
+		}
+
+		seen[userid] = true
+
+		for s := range h.subs[userid] {
+			select {
+			case s.C <- env.Event:
+			default:
+			}
+		}
+	}
+}
+
+var defaultHub *Hub
+var defaultHubOnce sync.Once
+
+// Default returns the process-wide hub, which starts with an in-memory backplane.
+func Default() *Hub {
+	defaultHubOnce.Do(func() {
+		defaultHub = NewHub(NewMemoryBackplane())
+	})
+
+	return defaultHub
+}
@@ -0,0 +1,144 @@
+package realtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(t *testing.T, s *Subscription) *Event {
+	t.Helper()
+
+	select {
+	case ev := <-s.C:
+		return &ev
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestPublishReachesAddressedUsersOnly(t *testing.T) {
+	h := NewHub(NewMemoryBackplane())
+
+	a := h.Subscribe(1)
+	b := h.Subscribe(2)
+	defer a.Close()
+	defer b.Close()
+
+	h.Publish([]uint64{1}, Event{Type: EventTyping, Chatid: 10, Userid: 2})
+
+	ev := receive(t, a)
+	assert.NotNil(t, ev)
+	assert.Equal(t, EventTyping, ev.Type)
+	assert.Equal(t, uint64(10), ev.Chatid)
+	assert.False(t, ev.Date.IsZero())
+
+	assert.Nil(t, receive(t, b))
+}
+
+func TestPublishReachesAllDevicesOnce(t *testing.T) {
+	h := NewHub(NewMemoryBackplane())
+
+	phone := h.Subscribe(1)
+	laptop := h.Subscribe(1)
+	defer phone.Close()
+	defer laptop.Close()
+
+	// Duplicate recipients shouldn't result in duplicate deliveries.
+	h.Publish([]uint64{1, 1}, Event{Type: EventNudge, Chatid: 5})
+
+	assert.NotNil(t, receive(t, phone))
+	assert.NotNil(t, receive(t, laptop))
+	assert.Nil(t, receive(t, phone))
+	assert.Nil(t, receive(t, laptop))
+}
+
+func TestCloseUnsubscribes(t *testing.T) {
+	h := NewHub(NewMemoryBackplane())
+
+	s := h.Subscribe(7)
+	assert.Equal(t, 1, h.Subscribers())
+
+	s.Close()
+	s.Close()
+	assert.Equal(t, 0, h.Subscribers())
+
+	h.Publish([]uint64{7}, Event{Type: EventRead})
+	assert.Nil(t, receive(t, s))
+}
+
+func TestSlowClientDoesNotBlock(t *testing.T) {
+	h := NewHub(NewMemoryBackplane())
+
+	s := h.Subscribe(3)
+	defer s.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		for i := 0; i < subscriptionBuffer*2; i++ {
+			h.Publish([]uint64{3}, Event{Type: EventTyping})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a full subscription")
+	}
+
+	assert.Len(t, s.C, subscriptionBuffer)
+}
+
+func TestHubsShareBackplane(t *testing.T) {
+	// Two hubs on one backplane model two API instances.
+	bp := NewMemoryBackplane()
+	h1 := NewHub(bp)
+	h2 := NewHub(bp)
+
+	s := h2.Subscribe(9)
+	defer s.Close()
+
+	h1.Publish([]uint64{9}, Event{Type: EventChatMessage, Chatid: 1})
+
+	ev := receive(t, s)
+	assert.NotNil(t, ev)
+	assert.Equal(t, EventChatMessage, ev.Type)
+}
+
+func TestSetBackplane(t *testing.T) {
+	old := NewMemoryBackplane()
+	h := NewHub(old)
+
+	s := h.Subscribe(4)
+	defer s.Close()
+
+	h.SetBackplane(NewMemoryBackplane())
+
+	// Events on the old backplane no longer reach us.
+	_ = old.Publish(Envelope{To: []uint64{4}, Event: Event{Type: EventTyping}})
+	assert.Nil(t, receive(t, s))
+
+	h.Publish([]uint64{4}, Event{Type: EventTyping})
+	assert.NotNil(t, receive(t, s))
+}
+
+type sharedBackplane struct {
+	*MemoryBackplane
+}
+
+func TestListening(t *testing.T) {
+	h := NewHub(NewMemoryBackplane())
+	assert.False(t, h.Listening())
+
+	s := h.Subscribe(1)
+	assert.True(t, h.Listening())
+	s.Close()
+	assert.False(t, h.Listening())
+
+	// With a shared backplane someone elsewhere might be listening.
+	h.SetBackplane(sharedBackplane{NewMemoryBackplane()})
+	assert.True(t, h.Listening())
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/freegle/iznik-server-go/admin"
 	"github.com/freegle/iznik-server-go/alert"
 	"github.com/freegle/iznik-server-go/amp"
+	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/authority"
 	"github.com/freegle/iznik-server-go/changes"
 	"github.com/freegle/iznik-server-go/chat"
@@ -41,6 +42,7 @@ import (
 	"github.com/freegle/iznik-server-go/export"
 	"github.com/freegle/iznik-server-go/group"
 	"github.com/freegle/iznik-server-go/housekeeper"
+	"github.com/freegle/iznik-server-go/idempotency"
 	"github.com/freegle/iznik-server-go/image"
 	"github.com/freegle/iznik-server-go/isochrone"
 	"github.com/freegle/iznik-server-go/job"
@@ -52,11 +54,16 @@ import (
 	"github.com/freegle/iznik-server-go/message"
 
 	"github.com/freegle/iznik-server-go/microvolunteering"
+	"github.com/freegle/iznik-server-go/modaudit"
 	"github.com/freegle/iznik-server-go/modconfig"
 	"github.com/freegle/iznik-server-go/misc"
 	"github.com/freegle/iznik-server-go/newsfeed"
 	"github.com/freegle/iznik-server-go/noticeboard"
 	"github.com/freegle/iznik-server-go/notification"
+	"github.com/freegle/iznik-server-go/oidc"
+	"github.com/freegle/iznik-server-go/partner"
+	"github.com/freegle/iznik-server-go/queue"
+	"github.com/freegle/iznik-server-go/ratelimit"
 	"github.com/freegle/iznik-server-go/session"
 	"github.com/freegle/iznik-server-go/shortlink"
 	"github.com/freegle/iznik-server-go/simulation"
@@ -69,6 +76,7 @@ import (
 	"github.com/freegle/iznik-server-go/team"
 	"github.com/freegle/iznik-server-go/tryst"
 	"github.com/freegle/iznik-server-go/user"
+	"github.com/freegle/iznik-server-go/validate"
 	"github.com/freegle/iznik-server-go/visualise"
 	"github.com/freegle/iznik-server-go/volunteering"
 	"github.com/gofiber/fiber/v2"
@@ -82,6 +90,9 @@ func SetupRoutes(app *fiber.App) {
 	api := app.Group("/api")
 	apiv2 := app.Group("/apiv2")
 
+	// Routes which create things can be retried safely by clients which send an Idempotency-Key.
+	idempotent := idempotency.New(idempotency.Config{})
+
 	for _, rg := range []fiber.Router{api, apiv2} {
 		// A/B Test GET
 		// @Router /abtest [get]
@@ -136,7 +147,7 @@ func SetupRoutes(app *fiber.App) {
 		// @Tags address
 		// @Accept json
 		// @Produce json
-		rg.Put("/address", address.Create)
+		rg.Put("/address", auth.Require(), validate.Request[address.CreateRequest](), address.Create)
 
 		// Update Address
 		// @Router /address [patch]
@@ -144,7 +155,7 @@ func SetupRoutes(app *fiber.App) {
 		// @Tags address
 		// @Accept json
 		// @Produce json
-		rg.Patch("/address", address.Update)
+		rg.Patch("/address", auth.Require(), validate.Request[address.UpdateRequest](), address.Update)
 
 		// Delete Address
 		// @Router /address/{id} [delete]
@@ -161,7 +172,7 @@ func SetupRoutes(app *fiber.App) {
 		// @Produce json
 		// @Security BearerAuth
 		// @Success 200 {object} map[string]interface{}
-		rg.Get("/modtools/alert", alert.ListAlerts)
+		rg.Get("/modtools/alert", auth.Require(auth.PERM_SYSTEM_SUPPORT), alert.ListAlerts)
 
 		// @Router /alert/{id} [get]
 		// @Summary Get alert by ID
@@ -180,7 +191,7 @@ func SetupRoutes(app *fiber.App) {
 		// @Produce json
 		// @Security BearerAuth
 		// @Success 200 {object} map[string]interface{}
-		rg.Put("/modtools/alert", alert.CreateAlert)
+		rg.Put("/modtools/alert", auth.Require(auth.PERM_SYSTEM_SUPPORT), alert.CreateAlert)
 
 		// @Router /alert [post]
 		// @Summary Record alert click
@@ -191,6 +202,31 @@ func SetupRoutes(app *fiber.App) {
 		// @Success 200 {object} map[string]interface{}
 		rg.Post("/modtools/alert", alert.RecordAlert)
 
+		// Moderator audit trail
+		// @Router /modtools/audit [get]
+		// @Summary List moderator changes
+		// @Description Returns what moderators changed, with the values before and after, most recent first. Filter by groupid, or by targettype and targetid. Mods see their groups and their own changes.
+		// @Tags modtools
+		// @Produce json
+		// @Param groupid query integer false "Group ID"
+		// @Param targettype query string false "Message, Member, Group, ModConfig or StdMsg"
+		// @Param targetid query integer false "Target ID"
+		// @Param context query integer false "Pagination cursor"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Get("/modtools/audit", modaudit.ListAudit)
+
+		// @Router /modtools/audit/{id}/undo [post]
+		// @Summary Undo a moderator change
+		// @Description Puts back the values a hold, release, move, edit or settings change replaced, unless they've been changed again since
+		// @Tags modtools
+		// @Produce json
+		// @Param id path integer true "Audit entry ID"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		// @Failure 409 {object} fiber.Error "Can't be undone"
+		rg.Post("/modtools/audit/:id/undo", modaudit.Undo)
+
 		// Admin
 		rg.Get("/modtools/admin", admin.ListAdmins)
 		rg.Get("/modtools/admin/:id", admin.GetAdmin)
@@ -255,6 +291,17 @@ func SetupRoutes(app *fiber.App) {
 		// @Success 200 {object} map[string]interface{}
 		rg.Get("/chat/rooms", chat.ListForUserMT)
 
+		// Chat Event Stream
+		// @Router /chat/stream [get]
+		// @Summary Stream chat events
+		// @Description Server-Sent Events stream of new chat messages, typing indicators, nudges and read receipts for the user's chats. Pass the JWT as ?jwt= since EventSource can't set headers.
+		// @Tags chat
+		// @Produce text/event-stream
+		// @Security BearerAuth
+		// @Success 200 {object} realtime.Event
+		// @Failure 401 {object} fiber.Error "Not logged in"
+		rg.Get("/chat/stream", chat.StreamChats)
+
 		// Chat Messages
 		// @Router /chat/{id}/message [get]
 		// @Summary Get chat messages
@@ -276,8 +323,9 @@ func SetupRoutes(app *fiber.App) {
 		// @Param id path integer true "Chat ID"
 		// @Param message body chat.ChatMessage true "Chat message object"
 		// @Security BearerAuth
+		// @Param Idempotency-Key header string false "Key to make retries safe; repeats get the first response"
 		// @Success 200 {object} chat.ChatMessage
-		rg.Post("/chat/:id/message", chat.CreateChatMessage)
+		rg.Post("/chat/:id/message", idempotent, ratelimit.New(ratelimit.Config{Policy: ratelimit.ChatMessage}), chat.CreateChatMessage)
 
 		// Patch Chat Message
 		// @Router /chatmessages [patch]
@@ -366,21 +414,131 @@ func SetupRoutes(app *fiber.App) {
 		// @Produce json
 		// @Param body body chat.ModerationRequest true "Moderation action"
 		// @Security BearerAuth
+		// @Param Idempotency-Key header string false "Key to make retries safe; repeats get the first response"
 		// @Success 200 {object} object
-		rg.Post("/chatmessages", chat.PostChatMessageModeration)
+		rg.Post("/chatmessages", idempotent, ratelimit.New(ratelimit.Config{Policy: ratelimit.ChatMessage}), chat.PostChatMessageModeration)
 
 		// Changes
 		// @Router /changes [get]
-		// @Summary Get changes since timestamp
-		// @Description Returns message changes, user changes, and ratings since a given time. Requires partner key.
+		// @Summary Get changes since timestamp or cursor
+		// @Description Returns message changes, user changes, and ratings since a given time or cursor, in a stable order. Pass limit and then the next cursor from each response to page through them. Requires partner key.
 		// @Tags changes
 		// @Produce json
 		// @Param since query string false "ISO8601 timestamp (defaults to 1 hour ago)"
+		// @Param cursor query string false "Next cursor from a previous response"
+		// @Param limit query integer false "Maximum number of changes (1-1000)"
 		// @Param partner query string true "Partner API key"
-		// @Success 200 {object} map[string]interface{}
+		// @Success 200 {object} changes.ChangesResponse
+		// @Failure 400 {object} fiber.Error "Invalid since, cursor or limit"
 		// @Failure 403 {object} fiber.Error "Invalid partner key"
 		rg.Get("/changes", changes.GetChanges)
 
+		// Change Webhooks
+		// @Router /changes/webhooks [get]
+		// @Summary List change webhooks
+		// @Description Returns the partner's webhook subscriptions to the change feed. Requires partner key.
+		// @Tags changes
+		// @Produce json
+		// @Param partner query string true "Partner API key"
+		// @Success 200 {array} changes.Webhook
+		// @Failure 403 {object} fiber.Error "Invalid partner key"
+		rg.Get("/changes/webhooks", changes.ListWebhooks)
+
+		// @Router /changes/webhooks [put]
+		// @Summary Subscribe a webhook to the change feed
+		// @Description Message changes are posted to the URL in signed batches (see the X-Freegle-Signature header), starting from now. The response includes the signing secret, which is not shown again.
+		// @Tags changes
+		// @Accept json
+		// @Produce json
+		// @Param partner query string true "Partner API key"
+		// @Param body body changes.WebhookRequest true "Webhook URL"
+		// @Success 200 {object} map[string]interface{}
+		// @Failure 400 {object} fiber.Error "Invalid URL"
+		// @Failure 403 {object} fiber.Error "Invalid partner key"
+		rg.Put("/changes/webhooks", changes.CreateWebhook)
+
+		// @Router /changes/webhooks [post]
+		// @Summary Act on a change webhook
+		// @Description Resume re-activates a dead-lettered webhook; delivery continues from where it stopped.
+		// @Tags changes
+		// @Accept json
+		// @Produce json
+		// @Param partner query string true "Partner API key"
+		// @Param body body changes.WebhookRequest true "Webhook ID and action"
+		// @Success 200 {object} map[string]interface{}
+		// @Failure 403 {object} fiber.Error "Invalid partner key"
+		// @Failure 404 {object} fiber.Error "Webhook not found"
+		rg.Post("/changes/webhooks", changes.PostWebhook)
+
+		// @Router /changes/webhooks/{id} [delete]
+		// @Summary Delete a change webhook
+		// @Tags changes
+		// @Param id path integer true "Webhook ID"
+		// @Param partner query string true "Partner API key"
+		// @Success 200 {object} map[string]interface{}
+		// @Failure 403 {object} fiber.Error "Invalid partner key"
+		// @Failure 404 {object} fiber.Error "Webhook not found"
+		rg.Delete("/changes/webhooks/:id", changes.DeleteWebhook)
+
+		// Partner API keys
+		// @Router /partners/{id}/keys [get]
+		// @Summary List a partner's API keys
+		// @Description Keys are identified by their prefix; the keys themselves are only shown when created. Admin only.
+		// @Tags partner
+		// @Produce json
+		// @Param id path integer true "Partner ID"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		// @Failure 403 {object} fiber.Error "Admin role required"
+		rg.Get("/partners/:id/keys", auth.Require(auth.PERM_SYSTEM_ADMIN), partner.ListKeys)
+
+		// @Router /partners/{id}/keys [post]
+		// @Summary Create a partner API key
+		// @Description Scopes are changes:read, chat:write, user:forget, message:consent and spammers:read. Quota is calls per hour. The key is not shown again. Admin only.
+		// @Tags partner
+		// @Accept json
+		// @Produce json
+		// @Param id path integer true "Partner ID"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		// @Failure 400 {object} fiber.Error "Unknown scope or invalid quota"
+		rg.Post("/partners/:id/keys", auth.Require(auth.PERM_SYSTEM_ADMIN), partner.CreateKey)
+
+		// @Router /partners/keys/{id}/rotate [post]
+		// @Summary Rotate a partner API key
+		// @Description Issues a new key with the same scopes and quota. The old key keeps working for overlap hours (default 168). Admin only.
+		// @Tags partner
+		// @Accept json
+		// @Produce json
+		// @Param id path integer true "Key ID"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		// @Failure 404 {object} fiber.Error "Key not found"
+		rg.Post("/partners/keys/:id/rotate", auth.Require(auth.PERM_SYSTEM_ADMIN), partner.RotateKey)
+
+		// @Router /partners/keys/{id} [delete]
+		// @Summary Revoke a partner API key
+		// @Description The key stops working straight away. Admin only.
+		// @Tags partner
+		// @Produce json
+		// @Param id path integer true "Key ID"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		// @Failure 404 {object} fiber.Error "Key not found"
+		rg.Delete("/partners/keys/:id", auth.Require(auth.PERM_SYSTEM_ADMIN), partner.RevokeKey)
+
+		// @Router /partners/{id}/audit [get]
+		// @Summary Get a partner's audit log
+		// @Description Every call made with the partner's keys, including refused ones, most recent first. Admin only.
+		// @Tags partner
+		// @Produce json
+		// @Param id path integer true "Partner ID"
+		// @Param limit query integer false "Maximum number of entries (1-1000)"
+		// @Param context query integer false "Context from the previous page"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Get("/partners/:id/audit", auth.Require(auth.PERM_SYSTEM_ADMIN), partner.GetAudit)
+
 		// Client Logging
 		// @Router /clientlog [post]
 		// @Summary Receive client logs
@@ -457,7 +615,7 @@ func SetupRoutes(app *fiber.App) {
 		// @Produce json
 		// @Security BearerAuth
 		// @Success 200 {object} map[string]interface{}
-		rg.Post("/comment", comment.Create)
+		rg.Post("/comment", auth.Require(), validate.Request[comment.CreateRequest](), comment.Create)
 
 		// @Router /comment [patch]
 		// @Summary Edit a comment
@@ -467,7 +625,7 @@ func SetupRoutes(app *fiber.App) {
 		// @Produce json
 		// @Security BearerAuth
 		// @Success 200 {object} map[string]interface{}
-		rg.Patch("/comment", comment.Edit)
+		rg.Patch("/comment", auth.Require(), validate.Request[comment.PatchRequest](), comment.Edit)
 
 		// @Router /comment/{id} [delete]
 		// @Summary Delete a comment
@@ -712,7 +870,7 @@ func SetupRoutes(app *fiber.App) {
 		// @Produce json
 		// @Security BearerAuth
 		// @Success 200 {object} map[string]interface{}
-		rg.Post("/image", image.Post)
+		rg.Post("/image", ratelimit.New(ratelimit.Config{Policy: ratelimit.Image}), image.Post)
 
 		// Jobs
 		// @Router /job [get]
@@ -794,7 +952,7 @@ func SetupRoutes(app *fiber.App) {
 		// Location Write Operations
 		rg.Put("/locations", location.CreateLocation)
 		rg.Patch("/locations", location.UpdateLocation)
-		rg.Post("/locations/kml", location.ConvertKML)
+		rg.Post("/locations/kml", auth.Require(), validate.Request[location.ConvertKMLRequest](), location.ConvertKML)
 		rg.Post("/locations", location.ExcludeLocation)
 
 		// Message List (moderation queue + public listing)
@@ -840,13 +998,17 @@ func SetupRoutes(app *fiber.App) {
 		// Message Search
 		// @Router /message/search/{term} [get]
 		// @Summary Search messages
-		// @Description Searches messages by term
+		// @Description Searches messages by term, matching plurals, synonyms and typos, and ranking by relevance, distance and recency
 		// @Tags message
 		// @Produce json
 		// @Param term path string true "Search term"
 		// @Param messagetype query string false "Message type filter"
 		// @Param groupids query string false "Group IDs to filter by (comma separated)"
+		// @Param lat query number false "Latitude to rank by distance from (defaults to the map centre or user's location)"
+		// @Param lng query number false "Longitude to rank by distance from"
+		// @Param radius query number false "Only return messages within this many miles"
 		// @Success 200 {array} message.SearchResult
+		// @Failure 400 {object} fiber.Error "radius needs lat and lng"
 		rg.Get("/message/search/:term", message.Search)
 
 		// Messages by ID
@@ -884,7 +1046,7 @@ func SetupRoutes(app *fiber.App) {
 		// @Success 200 {object} map[string]interface{}
 		rg.Post("/message", message.PostMessage)
 		rg.Patch("/message", message.PatchMessage)
-		rg.Put("/message", message.PutMessage)
+		rg.Put("/message", idempotent, message.PutMessage)
 		rg.Delete("/message/:id", message.DeleteMessageEndpoint)
 
 		// User
@@ -911,7 +1073,7 @@ func SetupRoutes(app *fiber.App) {
 		// @Security BearerAuth
 		// @Success 200 {object} fiber.Map
 		rg.Post("/user", user.PostUser)
-		rg.Put("/user", user.PutUser)
+		rg.Put("/user", session.Signup)
 		rg.Patch("/user", user.PatchUser)
 		rg.Delete("/user", user.LimboUser)
 
@@ -958,6 +1120,20 @@ func SetupRoutes(app *fiber.App) {
 		// @Success 200 {object} map[string]interface{}
 		rg.Delete("/usersearch", user.DeleteUserSearch)
 
+		// Save User Search
+		// @Router /usersearch [post]
+		// @Summary Save a search as an alert
+		// @Description Saves a search (from history by id, or a new term) so the user is alerted when matching posts are approved. With alert false, stops alerting.
+		// @Tags usersearch
+		// @Accept json
+		// @Produce json
+		// @Param body body user.SaveSearchRequest true "Search to save"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		// @Failure 400 {object} fiber.Error "Invalid parameters"
+		// @Failure 401 {object} fiber.Error "Not logged in"
+		rg.Post("/usersearch", auth.Require(), validate.Request[user.SaveSearchRequest](), user.SaveUserSearch)
+
 		// Newsfeed Item
 		// @Router /newsfeed/{id} [get]
 		// @Summary Get newsfeed item by ID
@@ -986,7 +1162,7 @@ func SetupRoutes(app *fiber.App) {
 		// @Produce json
 		// @Success 200 {array} newsfeed.Item
 		rg.Get("/newsfeed", newsfeed.Feed)
-		rg.Post("/newsfeed", newsfeed.Post)
+		rg.Post("/newsfeed", idempotent, newsfeed.Post)
 		rg.Patch("/newsfeed", newsfeed.Edit)
 		rg.Delete("/newsfeed/:id", newsfeed.Delete)
 
@@ -1101,11 +1277,115 @@ func SetupRoutes(app *fiber.App) {
 		// @Produce json
 		// @Param body body object true "Action and email"
 		// @Success 200 {object} map[string]interface{}
-		rg.Post("/session", session.PostSession)
+		rg.Post("/session", ratelimit.New(ratelimit.Config{Policy: ratelimit.LostPassword}), session.PostSession)
 		rg.Get("/session", session.GetSession)
 		rg.Patch("/session", session.PatchSession)
 		rg.Delete("/session", session.DeleteSession)
 
+		// My Sessions
+		// @Router /sessions [get]
+		// @Summary List my sessions
+		// @Description Returns the user's sessions, with when and where each was last used, so they can spot ones they don't recognise
+		// @Tags session
+		// @Produce json
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Get("/sessions", session.ListSessions)
+
+		// @Router /sessions/{id} [delete]
+		// @Summary Revoke sessions
+		// @Description Logs out of one session, or without an ID, all sessions except the current one
+		// @Tags session
+		// @Produce json
+		// @Param id path integer false "Session ID"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Delete("/sessions/:id?", session.RevokeSessions)
+
+		// Log in with Freegle (OpenID Connect provider)
+		// @Router /oidc/.well-known/openid-configuration [get]
+		// @Summary OpenID Connect discovery document
+		// @Tags oidc
+		// @Produce json
+		// @Success 200 {object} map[string]interface{}
+		rg.Get("/oidc/.well-known/openid-configuration", oidc.Discovery)
+
+		// @Router /oidc/jwks [get]
+		// @Summary Keys for checking our ID tokens
+		// @Tags oidc
+		// @Produce json
+		// @Success 200 {object} map[string]interface{}
+		rg.Get("/oidc/jwks", oidc.JWKS)
+
+		// @Router /oidc/authorize [get]
+		// @Summary Authorization endpoint
+		// @Description Checks an authorization request from a partner app and sends the user to the consent page
+		// @Tags oidc
+		// @Success 302
+		rg.Get("/oidc/authorize", oidc.Authorize)
+
+		// @Router /oidc/consent [get]
+		// @Summary Describe an authorization request
+		// @Description For the consent page: which app is asking, for what, and whether the user has agreed before
+		// @Tags oidc
+		// @Produce json
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Get("/oidc/consent", oidc.GetConsent)
+
+		// @Router /oidc/consent [post]
+		// @Summary Approve or deny an authorization request
+		// @Description Returns the URL to send the user back to the partner app with, including a code if they agreed
+		// @Tags oidc
+		// @Accept json
+		// @Produce json
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Post("/oidc/consent", oidc.PostConsent)
+
+		// @Router /oidc/consents [get]
+		// @Summary List my partner app consents
+		// @Tags oidc
+		// @Produce json
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Get("/oidc/consents", oidc.ListConsents)
+
+		// @Router /oidc/consents/{clientid} [delete]
+		// @Summary Withdraw consent for a partner app
+		// @Description Also stops the app's access tokens working
+		// @Tags oidc
+		// @Produce json
+		// @Param clientid path string true "Client ID"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Delete("/oidc/consents/:clientid", oidc.RevokeConsent)
+
+		// @Router /oidc/token [post]
+		// @Summary Token endpoint
+		// @Description Swaps an authorization code for an ID token and access token
+		// @Tags oidc
+		// @Accept x-www-form-urlencoded
+		// @Produce json
+		// @Success 200 {object} map[string]interface{}
+		rg.Post("/oidc/token", oidc.Token)
+
+		// @Router /oidc/userinfo [get]
+		// @Summary Userinfo endpoint
+		// @Description Returns the claims the user agreed to share, for an access token
+		// @Tags oidc
+		// @Produce json
+		// @Success 200 {object} map[string]interface{}
+		rg.Get("/oidc/userinfo", oidc.Userinfo)
+		rg.Post("/oidc/userinfo", oidc.Userinfo)
+
+		// @Router /oidc/revoke [post]
+		// @Summary Revoke an access token
+		// @Tags oidc
+		// @Accept x-www-form-urlencoded
+		// @Success 200
+		rg.Post("/oidc/revoke", oidc.Revoke)
+
 		// Shortlinks
 		// @Router /shortlink [get]
 		// @Summary Get shortlinks
@@ -1123,7 +1403,7 @@ func SetupRoutes(app *fiber.App) {
 		// @Tags shortlink
 		// @Accept json
 		// @Produce json
-		rg.Post("/shortlink", shortlink.PostShortlink)
+		rg.Post("/shortlink", ratelimit.New(ratelimit.Config{Policy: ratelimit.Shortlink}), shortlink.PostShortlink)
 
 		// System Status
 		// @Router /status [get]
@@ -1299,6 +1579,18 @@ func SetupRoutes(app *fiber.App) {
 		// @Success 200 {object} donations.DonationsResponse
 		rg.Get("/donations", donations.GetDonations)
 
+		// @Router /donations/statement [get]
+		// @Summary Get my donations
+		// @Description Returns the logged-in user's donations, with totals and Gift Aid claimed for each UK tax year, and recurring donations. format=csv or format=pdf downloads a statement.
+		// @Tags donations
+		// @Produce json
+		// @Param year query integer false "Only the tax year starting in this year, e.g. 2024 for 2024/25"
+		// @Param format query string false "json (default), csv or pdf"
+		// @Security BearerAuth
+		// @Success 200 {object} donations.DonationStatement
+		// @Failure 401 {object} map[string]interface{} "Not logged in"
+		rg.Get("/donations/statement", donations.GetDonationStatement)
+
 		// @Router /donations [put]
 		// @Summary Record external donation
 		// @Description Records an external bank transfer donation
@@ -1306,8 +1598,9 @@ func SetupRoutes(app *fiber.App) {
 		// @Accept json
 		// @Produce json
 		// @Security BearerAuth
+		// @Param Idempotency-Key header string false "Key to make retries safe; repeats get the first response"
 		// @Success 200 {object} map[string]interface{}
-		rg.Put("/donations", donations.AddDonation)
+		rg.Put("/donations", idempotent, donations.AddDonation)
 		rg.Post("/donations/bulk", donations.BulkUploadDonations)
 
 		// @Router /stripecreateintent [post]
@@ -1316,8 +1609,9 @@ func SetupRoutes(app *fiber.App) {
 		// @Tags donations
 		// @Accept json
 		// @Produce json
+		// @Param Idempotency-Key header string false "Key to make retries safe; repeats get the first response"
 		// @Success 200 {object} map[string]interface{}
-		rg.Post("/stripecreateintent", donations.CreateIntent)
+		rg.Post("/stripecreateintent", idempotent, donations.CreateIntent)
 
 		// @Router /stripecreatesubscription [post]
 		// @Summary Create Stripe subscription
@@ -1326,17 +1620,20 @@ func SetupRoutes(app *fiber.App) {
 		// @Accept json
 		// @Produce json
 		// @Security BearerAuth
+		// @Param Idempotency-Key header string false "Key to make retries safe; repeats get the first response"
 		// @Success 200 {object} map[string]interface{}
-		rg.Post("/stripecreatesubscription", donations.CreateSubscription)
+		rg.Post("/stripecreatesubscription", idempotent, donations.CreateSubscription)
 
-		// Stripe webhook (IPN) — called by Stripe when charges succeed.
+		// Stripe webhook (IPN) — called by Stripe when charges succeed, are refunded or disputed, and as subscriptions change.
 		// @Router /stripeipn [post]
 		// @Summary Handle Stripe webhook
-		// @Description Processes Stripe charge.succeeded events, records donations, handles gift aid
+		// @Description Verifies the Stripe-Signature header, then processes Stripe events: charge.succeeded records donations and handles gift aid; charge.refunded and charge.dispute.created/closed record adjustments; invoice.paid, invoice.payment_failed and customer.subscription.deleted track recurring donations. Each event is only handled once.
 		// @Tags donations
 		// @Accept json
 		// @Produce json
-		// @Success 200
+		// @Param Stripe-Signature header string true "Stripe's signature of the event"
+		// @Success 200 {object} map[string]interface{}
+		// @Failure 400 {object} map[string]interface{} "Invalid signature or payload"
 		rg.Post("/stripeipn", donations.StripeIPN)
 
 		// Gift Aid
@@ -1378,6 +1675,48 @@ func SetupRoutes(app *fiber.App) {
 		// @Success 200 {object} map[string]interface{}
 		rg.Delete("/giftaid", donations.DeleteGiftAid)
 
+		// Gift Aid claims for HMRC
+		// @Router /giftaid/claim [get]
+		// @Summary Preview the next Gift Aid claim (admin)
+		// @Description Returns the donations which would be in the next claim, declarations which need fixing first, and adjustments for refunds since earlier claims. format=csv gives HMRC's schedule spreadsheet, format=xml the GovTalk claim body.
+		// @Tags donations
+		// @Produce json
+		// @Param format query string false "json (default), csv or xml"
+		// @Security BearerAuth
+		// @Success 200 {object} donations.GiftAidClaim
+		rg.Get("/giftaid/claim", donations.GetGiftAidClaim)
+
+		// @Router /giftaid/claim [post]
+		// @Summary Create a Gift Aid claim (admin)
+		// @Description Claims Gift Aid on all the donations which can be claimed, and marks them as claimed so they're never claimed twice
+		// @Tags donations
+		// @Produce json
+		// @Param format query string false "json (default), csv or xml"
+		// @Param Idempotency-Key header string false "Key to make retries safe; repeats get the first response"
+		// @Security BearerAuth
+		// @Success 200 {object} donations.GiftAidClaim
+		// @Failure 409 {object} map[string]interface{} "Nothing to claim"
+		rg.Post("/giftaid/claim", idempotent, donations.CreateGiftAidClaim)
+
+		// @Router /giftaid/claim/{id} [get]
+		// @Summary Download a Gift Aid claim (admin)
+		// @Description Returns a claim which has been made, as it was made
+		// @Tags donations
+		// @Produce json
+		// @Param id path integer true "Claim ID"
+		// @Param format query string false "json (default), csv or xml"
+		// @Security BearerAuth
+		// @Success 200 {object} donations.GiftAidClaim
+		rg.Get("/giftaid/claim/:id", donations.GetGiftAidClaim)
+
+		// @Router /giftaid/claims [get]
+		// @Summary List Gift Aid claims (admin)
+		// @Tags donations
+		// @Produce json
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Get("/giftaid/claims", donations.ListGiftAidClaims)
+
 		// Housekeeper — receives task results from Chrome extension
 		// @Router /housekeeper/notify [post]
 		// @Summary Receive housekeeping task result
@@ -1386,10 +1725,25 @@ func SetupRoutes(app *fiber.App) {
 		// @Accept json
 		// @Produce json
 		// @Success 200
-		rg.Post("/housekeeper/notify", housekeeper.Notify)
-		rg.Get("/housekeeper/tasks", housekeeper.ListTasks)
-		rg.Post("/housekeeper/tasks/:key/complete", housekeeper.CompleteTask)
-		rg.Get("/housekeeper/cronjobs", housekeeper.ListCronJobs)
+		rg.Post("/housekeeper/notify", auth.Require(auth.PERM_SYSTEM_SUPPORT), housekeeper.Notify)
+		rg.Get("/housekeeper/tasks", auth.Require(auth.PERM_SYSTEM_SUPPORT), housekeeper.ListTasks)
+		rg.Post("/housekeeper/tasks/:key/complete", auth.Require(auth.PERM_SYSTEM_SUPPORT), housekeeper.CompleteTask)
+		rg.Get("/housekeeper/cronjobs", auth.Require(auth.PERM_SYSTEM_SUPPORT), housekeeper.ListCronJobs)
+
+		// Background task queue — what iznik-batch has still to do, or has given up on
+		// @Router /queue/tasks [get]
+		// @Summary List background tasks
+		// @Description Returns background tasks, filtered by status and type, with counts of unfinished ones by type. Requires admin.
+		// @Tags queue
+		// @Produce json
+		// @Param status query string false "pending, processing, done or failed"
+		// @Param type query string false "Task type"
+		// @Param context query integer false "Return tasks before this ID"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Get("/queue/tasks", auth.Require(auth.PERM_SYSTEM_ADMIN), queue.ListTasks)
+		rg.Post("/queue/tasks/requeue", auth.Require(auth.PERM_SYSTEM_ADMIN), queue.RequeueFailed)
+		rg.Post("/queue/tasks/:id/requeue", auth.Require(auth.PERM_SYSTEM_ADMIN), queue.RequeueTask)
 
 		// GDPR Data Export
 		rg.Post("/export", export.PostExport)
@@ -1523,6 +1877,37 @@ func SetupRoutes(app *fiber.App) {
 		// @Success 200 {array} object
 		rg.Get("/user/:id/logins", user.GetUserLogins)
 
+		// @Router /user/{id}/sessions [get]
+		// @Summary Get sessions for a user
+		// @Description Returns where the user is logged in. IP addresses are only shown to support and admin. Mod-only.
+		// @Tags user-support
+		// @Produce json
+		// @Param id path integer true "User ID"
+		// @Security BearerAuth
+		// @Success 200 {array} object
+		rg.Get("/user/:id/sessions", user.GetUserSessions)
+
+		// @Router /user/{id}/sessions/{sessionid} [delete]
+		// @Summary Revoke sessions for a user
+		// @Description Logs the user out of one session, or without a session ID, all of them. Mod-only.
+		// @Tags user-support
+		// @Produce json
+		// @Param id path integer true "User ID"
+		// @Param sessionid path integer false "Session ID"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Delete("/user/:id/sessions/:sessionid?", user.RevokeUserSessions)
+
+		// @Router /user/{id}/permissions [get]
+		// @Summary Get a user's permissions
+		// @Description Returns the user's system role, the permissions they have everywhere, and the groups where their role gives them more. Users can see their own; support can see anyone's.
+		// @Tags user
+		// @Produce json
+		// @Param id path integer true "User ID"
+		// @Security BearerAuth
+		// @Success 200 {object} map[string]interface{}
+		rg.Get("/user/:id/permissions", user.GetUserPermissions)
+
 		// Mark Notification Seen
 		// @Router /notification/seen [post]
 		// @Summary Mark notification as seen
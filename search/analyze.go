@@ -0,0 +1,155 @@
+package search
+
+import "strings"
+
+// synonymGroups are words which people use interchangeably for the same kind of item.  Searching for any word in a
+// group also finds the others.  Entries are stems, i.e. what Stem returns for the word.
+var synonymGroups = [][]string{
+	{"sofa", "couch", "settee"},
+	{"tv", "television", "telly"},
+	{"fridge", "refrigerator"},
+	{"hoover", "vacuum"},
+	{"pram", "pushchair", "buggy", "stroller"},
+	{"cot", "crib"},
+	{"bike", "bicycle"},
+	{"wardrobe", "closet"},
+	{"cooker", "oven", "stove"},
+	{"jumper", "sweater", "pullover"},
+	{"duvet", "quilt", "comforter"},
+	{"mobile", "cellphone", "smartphone"},
+	{"laptop", "notebook"},
+	{"cupboard", "cabinet"},
+	{"rug", "carpet"},
+	{"tap", "faucet"},
+	{"sideboard", "dresser"},
+}
+
+var synonyms = buildSynonyms()
+
+func buildSynonyms() map[string][]string {
+	ret := map[string][]string{}
+
+	for _, group := range synonymGroups {
+		for _, word := range group {
+			for _, other := range group {
+				if other != word && !contains(ret[word], other) {
+					ret[word] = append(ret[word], other)
+				}
+			}
+		}
+	}
+
+	return ret
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Synonyms returns the other stems which mean the same as a stem.
+func Synonyms(stem string) []string {
+	return synonyms[stem]
+}
+
+// Stem reduces a lower case word to a stem, so that e.g. "chairs" finds "chair".  This is a light stemmer which
+// only handles plurals and the commonest verb endings.  Item names are mostly nouns, and heavier stemmers conflate
+// too many of them.
+func Stem(word string) string {
+	n := len(word)
+
+	switch {
+	case n <= 3:
+		return word
+	case strings.HasSuffix(word, "ies") && n > 4:
+		return word[:n-3] + "y"
+	case strings.HasSuffix(word, "lves"):
+		return word[:n-3] + "f"
+	case strings.HasSuffix(word, "sses"), strings.HasSuffix(word, "xes"), strings.HasSuffix(word, "ches"), strings.HasSuffix(word, "shes"):
+		return word[:n-2]
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"), strings.HasSuffix(word, "is"):
+		return word
+	case strings.HasSuffix(word, "s"):
+		return word[:n-1]
+	case strings.HasSuffix(word, "ing") && n-3 >= 4:
+		return undouble(word[:n-3])
+	case strings.HasSuffix(word, "ed") && n-2 >= 4:
+		return undouble(word[:n-2])
+	}
+
+	return word
+}
+
+// undouble removes a doubled final consonant left by removing a suffix, e.g. "stopp" from "stopped".
+func undouble(stem string) string {
+	n := len(stem)
+
+	if n >= 3 && stem[n-1] == stem[n-2] && !strings.ContainsRune("aeiouls", rune(stem[n-1])) {
+		return stem[:n-1]
+	}
+
+	return stem
+}
+
+// trigrams returns the three letter sequences in a word, padded so that the start and end count.
+func trigrams(word string) []string {
+	padded := "  " + word + " "
+	ret := make([]string, 0, len(padded)-2)
+
+	for i := 0; i+3 <= len(padded); i++ {
+		ret = append(ret, padded[i:i+3])
+	}
+
+	return ret
+}
+
+// maxTypos is how many edits we allow between a query word and an indexed one for it to count as a typo.
+func maxTypos(word string) int {
+	switch {
+	case len(word) < 4:
+		return 0
+	case len(word) < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance is the Damerau-Levenshtein (optimal string alignment) distance between two words, which counts a
+// transposition of adjacent letters as one edit.
+func editDistance(a string, b string) int {
+	la, lb := len(a), len(b)
+	prev2 := make([]int, lb+1)
+	prev := make([]int, lb+1)
+	cur := make([]int, lb+1)
+
+	for j := 0; j <= lb; j++ {
+		prev[j] = j
+	}
+
+	for i := 1; i <= la; i++ {
+		cur[0] = i
+
+		for j := 1; j <= lb; j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+
+		prev2, prev, cur = prev, cur, prev2
+	}
+
+	return prev[lb]
+}
@@ -0,0 +1,365 @@
+// Package search is an in-memory full text index with BM25 ranking.
+//
+// Documents are added as lists of words, which are stemmed so that plurals match.  A query word matches indexed
+// words which are the same, are synonyms, start with it, or (if none of those exist) are a typo away from it.
+// These matches count for progressively less, so that exact matches rank first.  Callers add their own boosts,
+// e.g. for distance, on top of the text score.
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// How a query word matched.
+const (
+	MatchExact      = "Exact"
+	MatchSynonym    = "Synonym"
+	MatchStartsWith = "StartsWith"
+	MatchTypo       = "Typo"
+)
+
+// How much each kind of match counts relative to an exact one.
+var matchWeights = map[string]float64{
+	MatchExact:      1.0,
+	MatchSynonym:    0.9,
+	MatchStartsWith: 0.6,
+	MatchTypo:       0.5,
+}
+
+// BM25 parameters.  k1 limits how much repeating a word helps, and b how much long documents are penalised.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// minPrefix is the shortest query word we'll look for as the start of longer words.
+const minPrefix = 3
+
+// Hit is a matching document.  Word and Match describe the match which contributed most to the score.
+type Hit struct {
+	ID    uint64
+	Score float64
+	Word  string
+	Match string
+}
+
+// Index is safe for concurrent use.
+type Index struct {
+	mu       sync.RWMutex
+	docs     map[uint64][]string
+	postings map[string]map[uint64]int
+	grams    map[string]map[string]struct{}
+	totalLen int
+}
+
+// NewIndex creates an empty index.
+func NewIndex() *Index {
+	return &Index{
+		docs:     make(map[uint64][]string),
+		postings: make(map[string]map[uint64]int),
+		grams:    make(map[string]map[string]struct{}),
+	}
+}
+
+// Len returns the number of documents.
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.docs)
+}
+
+// Add indexes a document, replacing any previous version of it.
+func (x *Index) Add(id uint64, words []string) {
+	stems := make([]string, 0, len(words))
+
+	for _, w := range words {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+			stems = append(stems, Stem(w))
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.remove(id)
+
+	x.docs[id] = stems
+	x.totalLen += len(stems)
+
+	for _, s := range stems {
+		if x.postings[s] == nil {
+			x.postings[s] = make(map[uint64]int)
+
+			for _, g := range trigrams(s) {
+				if x.grams[g] == nil {
+					x.grams[g] = make(map[string]struct{})
+				}
+
+				x.grams[g][s] = struct{}{}
+			}
+		}
+
+		x.postings[s][id]++
+	}
+}
+
+// Remove drops a document.  It does nothing if the document isn't indexed.
+func (x *Index) Remove(id uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(id)
+}
+
+func (x *Index) remove(id uint64) {
+	stems, ok := x.docs[id]
+	if !ok {
+		return
+	}
+
+	for _, s := range stems {
+		delete(x.postings[s], id)
+
+		if len(x.postings[s]) == 0 {
+			// Nothing uses this word any more, so it's no longer a candidate for typos.
+			delete(x.postings, s)
+
+			for _, g := range trigrams(s) {
+				delete(x.grams[g], s)
+
+				if len(x.grams[g]) == 0 {
+					delete(x.grams, g)
+				}
+			}
+		}
+	}
+
+	x.totalLen -= len(stems)
+	delete(x.docs, id)
+}
+
+type expansion struct {
+	stem  string
+	match string
+}
+
+// expand returns the indexed words which a query word matches.  Call with the lock held.
+func (x *Index) expand(word string) []expansion {
+	stem := Stem(word)
+	var ret []expansion
+
+	if _, ok := x.postings[stem]; ok {
+		ret = append(ret, expansion{stem, MatchExact})
+	}
+
+	for _, syn := range Synonyms(stem) {
+		if _, ok := x.postings[syn]; ok {
+			ret = append(ret, expansion{syn, MatchSynonym})
+		}
+	}
+
+	found := len(ret) > 0
+
+	if len(word) >= minPrefix {
+		for s := range x.postings {
+			if s != stem && strings.HasPrefix(s, word) {
+				ret = append(ret, expansion{s, MatchStartsWith})
+			}
+		}
+	}
+
+	if !found {
+		ret = append(ret, x.typos(stem)...)
+	}
+
+	return ret
+}
+
+// typos returns indexed words within a small edit distance of a stem.  We use shared trigrams to find candidates
+// cheaply, and only compute the edit distance for those.  Call with the lock held.
+func (x *Index) typos(stem string) []expansion {
+	k := maxTypos(stem)
+	if k == 0 {
+		return nil
+	}
+
+	shared := map[string]int{}
+
+	for _, g := range trigrams(stem) {
+		for s := range x.grams[g] {
+			shared[s]++
+		}
+	}
+
+	// Each edit can change at most three trigrams.
+	need := len(stem) + 1 - 3*k
+	if need < 1 {
+		need = 1
+	}
+
+	var ret []expansion
+
+	for s, n := range shared {
+		if n >= need && s != stem && editDistance(s, stem) <= k {
+			ret = append(ret, expansion{s, MatchTypo})
+		}
+	}
+
+	return ret
+}
+
+// Search returns the documents which match any of the words, best first.  If accept is not nil, only documents it
+// returns true for are included.
+func (x *Index) Search(words []string, accept func(id uint64) bool) []Hit {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	if len(x.docs) == 0 {
+		return []Hit{}
+	}
+
+	n := float64(len(x.docs))
+	avgLen := float64(x.totalLen) / n
+	hits := map[uint64]*Hit{}
+	best := map[uint64]float64{}
+	seen := map[string]bool{}
+
+	for _, w := range words {
+		w = strings.ToLower(strings.TrimSpace(w))
+
+		if w == "" || seen[Stem(w)] {
+			continue
+		}
+
+		seen[Stem(w)] = true
+
+		// A document scores for each query word by its best match for it, so that matching several synonyms of
+		// one word doesn't count as matching several words.
+		scores := map[uint64]float64{}
+		matches := map[uint64]expansion{}
+
+		expansions := x.expand(w)
+
+		// The expansions are treated as one term for IDF, so that e.g. a rare word which starts with a common one
+		// doesn't outrank exact matches for it.
+		matching := map[uint64]bool{}
+
+		for _, e := range expansions {
+			for id := range x.postings[e.stem] {
+				matching[id] = true
+			}
+		}
+
+		df := float64(len(matching))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+		for _, e := range expansions {
+			for id, tf := range x.postings[e.stem] {
+				if accept != nil && !accept(id) {
+					continue
+				}
+
+				dl := float64(len(x.docs[id]))
+				f := float64(tf)
+				score := matchWeights[e.match] * idf * f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*dl/avgLen))
+
+				if score > scores[id] {
+					scores[id] = score
+					matches[id] = e
+				}
+			}
+		}
+
+		for id, score := range scores {
+			h := hits[id]
+
+			if h == nil {
+				h = &Hit{ID: id}
+				hits[id] = h
+			}
+
+			h.Score += score
+
+			if score > best[id] {
+				best[id] = score
+				h.Word = matches[id].stem
+				h.Match = matches[id].match
+			}
+		}
+	}
+
+	ret := make([]Hit, 0, len(hits))
+
+	for _, h := range hits {
+		ret = append(ret, *h)
+	}
+
+	SortHits(ret)
+
+	return ret
+}
+
+// SortHits orders hits by descending score.  Ties are broken by descending ID, which for messages favours newer ones.
+func SortHits(hits []Hit) {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+
+		return hits[i].ID > hits[j].ID
+	})
+}
+
+// MatchesAll returns whether every query word matches one of the document's words, either exactly, as a synonym,
+// or as the start of it.  Typos don't count: this is for deciding whether to tell someone about a document, where
+// we'd rather miss one than pester them.
+func MatchesAll(query []string, doc []string) bool {
+	stems := make(map[string]bool, len(doc))
+
+	for _, w := range doc {
+		stems[Stem(strings.ToLower(w))] = true
+	}
+
+	matched := 0
+
+	for _, q := range query {
+		q = strings.ToLower(strings.TrimSpace(q))
+		if q == "" {
+			continue
+		}
+
+		if !matchesOne(q, stems) {
+			return false
+		}
+
+		matched++
+	}
+
+	return matched > 0
+}
+
+func matchesOne(word string, stems map[string]bool) bool {
+	stem := Stem(word)
+
+	if stems[stem] {
+		return true
+	}
+
+	for _, syn := range Synonyms(stem) {
+		if stems[syn] {
+			return true
+		}
+	}
+
+	if len(word) >= minPrefix {
+		for s := range stems {
+			if strings.HasPrefix(s, word) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,147 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ids(hits []Hit) []uint64 {
+	ret := []uint64{}
+
+	for _, h := range hits {
+		ret = append(ret, h.ID)
+	}
+
+	return ret
+}
+
+func TestStem(t *testing.T) {
+	for word, stem := range map[string]string{
+		"chairs":    "chair",
+		"batteries": "battery",
+		"boxes":     "box",
+		"glasses":   "glass",
+		"benches":   "bench",
+		"shelves":   "shelf",
+		"gloves":    "glove",
+		"bedding":   "bed",
+		"painted":   "paint",
+		"string":    "string",
+		"speed":     "speed",
+		"tennis":    "tennis",
+		"sofa":      "sofa",
+		"tv":        "tv",
+	} {
+		assert.Equal(t, stem, Stem(word), word)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance("sofa", "sofa"))
+	assert.Equal(t, 1, editDistance("sofa", "sfoa"))
+	assert.Equal(t, 1, editDistance("settee", "setee"))
+	assert.Equal(t, 2, editDistance("wardrobe", "wadrobes"))
+	assert.Equal(t, 4, editDistance("", "sofa"))
+}
+
+func TestSynonyms(t *testing.T) {
+	x := NewIndex()
+	x.Add(1, []string{"sofa", "bed"})
+	x.Add(2, []string{"leather", "settee"})
+	x.Add(3, []string{"kitchen", "table"})
+
+	hits := x.Search([]string{"settee"}, nil)
+	assert.Equal(t, []uint64{2, 1}, ids(hits))
+	assert.Equal(t, MatchExact, hits[0].Match)
+	assert.Equal(t, MatchSynonym, hits[1].Match)
+	assert.Equal(t, "sofa", hits[1].Word)
+
+	assert.ElementsMatch(t, []uint64{1, 2}, ids(x.Search([]string{"couch"}, nil)))
+}
+
+func TestPluralsAndPrefixes(t *testing.T) {
+	x := NewIndex()
+	x.Add(1, []string{"dining", "chairs"})
+	x.Add(2, []string{"bookshelf"})
+
+	hits := x.Search([]string{"chair"}, nil)
+	assert.Equal(t, []uint64{1}, ids(hits))
+	assert.Equal(t, MatchExact, hits[0].Match)
+
+	hits = x.Search([]string{"book"}, nil)
+	assert.Equal(t, []uint64{2}, ids(hits))
+	assert.Equal(t, MatchStartsWith, hits[0].Match)
+}
+
+func TestTypos(t *testing.T) {
+	x := NewIndex()
+	x.Add(1, []string{"wardrobe"})
+	x.Add(2, []string{"chair"})
+
+	hits := x.Search([]string{"wadrobe"}, nil)
+	assert.Equal(t, []uint64{1}, ids(hits))
+	assert.Equal(t, MatchTypo, hits[0].Match)
+
+	// Short words are too easy to confuse, and a word which exists isn't treated as a typo for another.
+	x.Add(3, []string{"hair", "dryer"})
+	assert.Equal(t, []uint64{2}, ids(x.Search([]string{"chair"}, nil)))
+
+	assert.Empty(t, x.Search([]string{"zzzzzz"}, nil))
+}
+
+func TestRanking(t *testing.T) {
+	x := NewIndex()
+	x.Add(1, []string{"table"})
+	x.Add(2, []string{"garden", "table"})
+	x.Add(3, []string{"garden", "chair"})
+	x.Add(4, []string{"tables", "and", "more", "tables", "for", "the", "garden", "party"})
+
+	// Matching both words beats matching one, and a short document beats a long one.
+	hits := x.Search([]string{"garden", "table"}, nil)
+	assert.Equal(t, uint64(2), hits[0].ID)
+	assert.Equal(t, uint64(4), hits[1].ID)
+
+	// Exact matches in similar documents beat weaker ones.
+	x.Add(5, []string{"tablecloth"})
+	hits = x.Search([]string{"table"}, nil)
+	assert.ElementsMatch(t, []uint64{1, 2}, ids(hits[:2]))
+	assert.Contains(t, ids(hits[2:]), uint64(5))
+}
+
+func TestAcceptAndRemove(t *testing.T) {
+	x := NewIndex()
+	x.Add(1, []string{"lamp"})
+	x.Add(2, []string{"lamp"})
+
+	assert.Equal(t, []uint64{2}, ids(x.Search([]string{"lamp"}, func(id uint64) bool { return id == 2 })))
+
+	x.Remove(2)
+	x.Remove(2)
+	assert.Equal(t, 1, x.Len())
+	assert.Equal(t, []uint64{1}, ids(x.Search([]string{"lamp"}, nil)))
+
+	// Re-adding replaces rather than duplicates.
+	x.Add(1, []string{"desk"})
+	assert.Empty(t, x.Search([]string{"lamp"}, nil))
+	assert.Equal(t, []uint64{1}, ids(x.Search([]string{"desk"}, nil)))
+
+	x.Remove(1)
+	assert.Empty(t, x.Search([]string{"desk"}, nil))
+	assert.Empty(t, x.postings)
+	assert.Empty(t, x.grams)
+}
+
+func TestMatchesAll(t *testing.T) {
+	doc := []string{"leather", "settee", "cushions"}
+
+	assert.True(t, MatchesAll([]string{"settee"}, doc))
+	assert.True(t, MatchesAll([]string{"sofa"}, doc))
+	assert.True(t, MatchesAll([]string{"Leather", "cushion"}, doc))
+	assert.True(t, MatchesAll([]string{"leath"}, doc))
+
+	// Every word must match, and typos don't count.
+	assert.False(t, MatchesAll([]string{"leather", "chair"}, doc))
+	assert.False(t, MatchesAll([]string{"setee"}, doc))
+	assert.False(t, MatchesAll([]string{}, doc))
+}
@@ -0,0 +1,226 @@
+package session
+
+import (
+	"fmt"
+	stdlog "log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/log"
+	"github.com/freegle/iznik-server-go/misc"
+	"github.com/freegle/iznik-server-go/queue"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Protection against guessing passwords, whether by trying lots of passwords for one account or a few common
+// passwords across lots of accounts (credential stuffing / password spraying).
+//
+// We record each failed login, and then:
+//   - refuse logins from an IP address which has failed too often recently, whichever accounts it tried;
+//   - make each further attempt on an account wait longer once it has failed a few times;
+//   - lock an account which has failed too often, and email the user a login link which unlocks it.
+//
+// The counts are in the database rather than in memory so that they're shared between servers.  The tables are
+// created by iznik-batch migrations:
+//
+//	login_failures (id, userid NULL, ip, timestamp), indexed on (userid, timestamp) and (ip, timestamp).  userid is
+//	NULL when the email address wasn't known.  iznik-batch purges rows older than a day.
+//
+//	users_lockouts (userid PRIMARY KEY, lockeduntil, created)
+const (
+	// ipFailureLimit failures from one IP address within ipFailureWindow blocks further logins from it.  This is
+	// well above what a shared IP address (e.g. a library) would see from people mistyping passwords.
+	ipFailureLimit  = 30
+	ipFailureWindow = 15 * time.Minute
+
+	// After backoffAfter failures on an account within accountFailureWindow, each attempt must wait twice as long
+	// as the last since the previous failure, up to maxBackoff.
+	backoffAfter         = 3
+	maxBackoff           = 5 * time.Minute
+	accountFailureWindow = time.Hour
+
+	// lockAfter failures on an account within accountFailureWindow locks it for lockDuration.
+	lockAfter    = 10
+	lockDuration = 30 * time.Minute
+)
+
+// loginBackoff returns how long an account with this many recent failures must wait after the last one.
+func loginBackoff(failures int) time.Duration {
+	if failures < backoffAfter {
+		return 0
+	}
+
+	wait := maxBackoff
+	if shift := failures - backoffAfter; shift < 16 {
+		wait = min(time.Duration(1<<shift)*time.Second, maxBackoff)
+	}
+
+	return wait
+}
+
+func tooManyLogins(c *fiber.Ctx, secs int) error {
+	if secs < 1 {
+		secs = 1
+	}
+
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(secs))
+
+	return apierror.New(fiber.StatusTooManyRequests, apierror.CodeRateLimited,
+		fmt.Sprintf("Too many failed logins - please try again in %d seconds.", secs))
+}
+
+func accountLocked(c *fiber.Ctx, secs int) error {
+	if secs < 1 {
+		secs = 1
+	}
+
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(secs))
+
+	return apierror.New(fiber.StatusForbidden, apierror.CodeAccountLocked,
+		"Your account is locked after too many failed logins.  We've emailed you a link to unlock it.")
+}
+
+// checkLogin returns an error if a login attempt shouldn't even be tried.  userid is 0 if the email address
+// wasn't known.  Link logins pass checkLock false, as a login link is how a locked account is unlocked, but they
+// still have to wait out the backoff.
+func checkLogin(c *fiber.Ctx, userid uint64, ip string, checkLock bool) error {
+	db := database.DBConn
+
+	var ipFailures struct {
+		Count int
+		Since int
+	}
+
+	db.Raw("SELECT COUNT(*) AS count, COALESCE(TIMESTAMPDIFF(SECOND, MIN(timestamp), NOW()), 0) AS since "+
+		"FROM login_failures WHERE ip = ? AND timestamp > DATE_SUB(NOW(), INTERVAL ? SECOND)",
+		ip, int(ipFailureWindow.Seconds())).Scan(&ipFailures)
+
+	if ipFailures.Count >= ipFailureLimit {
+		// They can try again once the oldest failure drops out of the window.
+		return tooManyLogins(c, int(ipFailureWindow.Seconds())-ipFailures.Since)
+	}
+
+	if userid == 0 {
+		return nil
+	}
+
+	if checkLock {
+		var lockedFor int
+		db.Raw("SELECT TIMESTAMPDIFF(SECOND, NOW(), lockeduntil) FROM users_lockouts WHERE userid = ? AND lockeduntil > NOW()",
+			userid).Scan(&lockedFor)
+
+		if lockedFor > 0 {
+			return accountLocked(c, lockedFor)
+		}
+	}
+
+	var accountFailures struct {
+		Count int
+		Since int
+	}
+
+	db.Raw("SELECT COUNT(*) AS count, COALESCE(TIMESTAMPDIFF(SECOND, MAX(timestamp), NOW()), 0) AS since "+
+		"FROM login_failures WHERE userid = ? AND timestamp > DATE_SUB(NOW(), INTERVAL ? SECOND)",
+		userid, int(accountFailureWindow.Seconds())).Scan(&accountFailures)
+
+	if wait := int(loginBackoff(accountFailures.Count).Seconds()); accountFailures.Since < wait {
+		return tooManyLogins(c, wait-accountFailures.Since)
+	}
+
+	return nil
+}
+
+// recordLoginFailure records a failed login, and locks the account if it has now failed too often.  It returns
+// true if the account was locked.
+func recordLoginFailure(userid uint64, ip string) bool {
+	db := database.DBConn
+
+	var uid interface{}
+	if userid > 0 {
+		uid = userid
+	}
+
+	db.Exec("INSERT INTO login_failures (userid, ip, timestamp) VALUES (?, ?, NOW())", uid, ip)
+
+	if userid == 0 {
+		return false
+	}
+
+	// Spraying passwords at mod accounts is how someone would get at other people's data, so log each failure
+	// on those where support can see it.
+	var systemrole string
+	db.Raw("SELECT systemrole FROM users WHERE id = ?", userid).Scan(&systemrole)
+
+	if systemrole != utils.SYSTEMROLE_USER && systemrole != "" {
+		logLoginFailure(userid, fmt.Sprintf("Login failed from %s", ip))
+	}
+
+	var failures int
+	db.Raw("SELECT COUNT(*) FROM login_failures WHERE userid = ? AND timestamp > DATE_SUB(NOW(), INTERVAL ? SECOND)",
+		userid, int(accountFailureWindow.Seconds())).Scan(&failures)
+
+	if failures < lockAfter {
+		return false
+	}
+
+	db.Exec("INSERT INTO users_lockouts (userid, lockeduntil, created) VALUES (?, DATE_ADD(NOW(), INTERVAL ? SECOND), NOW()) "+
+		"ON DUPLICATE KEY UPDATE lockeduntil = VALUES(lockeduntil), created = NOW()",
+		userid, int(lockDuration.Seconds()))
+
+	// Start counting again, so that once it's unlocked they don't go straight into the longest backoff.
+	db.Exec("DELETE FROM login_failures WHERE userid = ?", userid)
+
+	logLoginFailure(userid, fmt.Sprintf("Account locked after %d failed logins, last from %s", failures, ip))
+	queueUnlockEmail(userid)
+
+	return true
+}
+
+// recordLoginSuccess forgets previous failures for an account and unlocks it.
+func recordLoginSuccess(userid uint64) {
+	db := database.DBConn
+	db.Exec("DELETE FROM login_failures WHERE userid = ?", userid)
+	db.Exec("DELETE FROM users_lockouts WHERE userid = ?", userid)
+}
+
+func logLoginFailure(userid uint64, text string) {
+	log.Log(log.LogEntry{
+		Type:    log.LOG_TYPE_USER,
+		Subtype: log.LOG_SUBTYPE_FAILURE,
+		User:    &userid,
+		Text:    &text,
+	})
+
+	misc.GetLoki().LogFromLogsTable(log.LOG_TYPE_USER, log.LOG_SUBTYPE_FAILURE, nil, &userid, nil, nil, text)
+}
+
+// queueUnlockEmail sends the user a login link, which unlocks their account when used.  This is the same email
+// as for a forgotten password, which is what they'll most likely need.
+func queueUnlockEmail(userid uint64) {
+	key, err := getOrCreateLoginKey(userid)
+	if err != nil {
+		stdlog.Printf("Failed to get login key to unlock user %d: %v", userid, err)
+		return
+	}
+
+	var email string
+	database.DBConn.Raw("SELECT email FROM users_emails WHERE userid = ? ORDER BY preferred DESC, id ASC LIMIT 1", userid).Scan(&email)
+
+	if email == "" {
+		return
+	}
+
+	unlockURL := fmt.Sprintf("https://%s/settings?u=%d&k=%s&src=unlock", os.Getenv("USER_SITE"), userid, key)
+
+	if err := queue.QueueTask(queue.TaskEmailForgotPassword, map[string]interface{}{
+		"user_id":   userid,
+		"email":     email,
+		"reset_url": unlockURL,
+	}); err != nil {
+		stdlog.Printf("Failed to queue unlock email for user %d: %v", userid, err)
+	}
+}
@@ -12,7 +12,7 @@ import (
 	"os"
 	"time"
 
-	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
@@ -44,82 +44,58 @@ type facebookGraphResponse struct {
 }
 
 // handleFacebookLogin verifies a Facebook access token via the Graph API and logs the user in.
-func handleFacebookLogin(c *fiber.Ctx, accessToken string) error {
+func handleFacebookLogin(c *fiber.Ctx, accessToken string, sf secondFactor) error {
 	client := &http.Client{Timeout: 5 * time.Second}
 	resp, err := client.Get(getFacebookGraphURL() + "/me?fields=id,name,first_name,last_name,email&access_token=" + accessToken)
 	if err != nil {
 		stdlog.Printf("Facebook Graph API request failed: %v", err)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Failed to verify Facebook token",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Failed to verify Facebook token").WithRet(2)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Failed to read Facebook response",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Failed to read Facebook response").WithRet(2)
 	}
 
 	if resp.StatusCode != 200 {
 		stdlog.Printf("Facebook Graph API returned status %d: %s", resp.StatusCode, string(body))
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Invalid Facebook token",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Invalid Facebook token").WithRet(2)
 	}
 
 	var fbResp facebookGraphResponse
 	if err := json.Unmarshal(body, &fbResp); err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Failed to parse Facebook response",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Failed to parse Facebook response").WithRet(2)
 	}
 
 	if fbResp.ID == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Facebook response missing user ID",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Facebook response missing user ID").WithRet(2)
 	}
 
-	return completeFacebookLogin(c, fbResp.ID, fbResp.Email, fbResp.FirstName, fbResp.LastName, fbResp.Name)
+	return completeFacebookLogin(c, fbResp.ID, fbResp.Email, fbResp.FirstName, fbResp.LastName, fbResp.Name, sf)
 }
 
 // handleFacebookLimitedLogin handles Facebook Limited Login by verifying a JWT
 // signed with Facebook's public keys.
-func handleFacebookLimitedLogin(c *fiber.Ctx, jwtToken string) error {
+func handleFacebookLimitedLogin(c *fiber.Ctx, jwtToken string, sf secondFactor) error {
 	// Fetch Facebook's JWKS.
 	client := &http.Client{Timeout: 5 * time.Second}
 	resp, err := client.Get(getFacebookJWKSURL())
 	if err != nil {
 		stdlog.Printf("Facebook JWKS fetch failed: %v", err)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Failed to fetch Facebook public keys",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Failed to fetch Facebook public keys").WithRet(2)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Failed to read Facebook JWKS",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Failed to read Facebook JWKS").WithRet(2)
 	}
 
 	keys, err := parseJWKS(body)
 	if err != nil {
 		stdlog.Printf("Facebook JWKS parse failed: %v", err)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Failed to parse Facebook public keys",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Failed to parse Facebook public keys").WithRet(2)
 	}
 
 	// Parse and verify the JWT.
@@ -144,18 +120,12 @@ func handleFacebookLimitedLogin(c *fiber.Ctx, jwtToken string) error {
 
 	if err != nil {
 		stdlog.Printf("Facebook Limited Login JWT verification failed: %v", err)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Invalid Facebook Limited Login token",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Invalid Facebook Limited Login token").WithRet(2)
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok || !token.Valid {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Invalid Facebook Limited Login claims",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Invalid Facebook Limited Login claims").WithRet(2)
 	}
 
 	// Extract fields from claims.
@@ -166,17 +136,14 @@ func handleFacebookLimitedLogin(c *fiber.Ctx, jwtToken string) error {
 	name, _ := claims["name"].(string)
 
 	if sub == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Facebook Limited Login token missing subject",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Facebook Limited Login token missing subject").WithRet(2)
 	}
 
-	return completeFacebookLogin(c, sub, email, givenName, familyName, name)
+	return completeFacebookLogin(c, sub, email, givenName, familyName, name, sf)
 }
 
 // completeFacebookLogin is shared by both regular and limited Facebook login flows.
-func completeFacebookLogin(c *fiber.Ctx, fbID, email, firstName, lastName, fullName string) error {
+func completeFacebookLogin(c *fiber.Ctx, fbID, email, firstName, lastName, fullName string, sf secondFactor) error {
 	userID, err := socialMatchOrCreate(
 		utils.LOGIN_TYPE_FACEBOOK,
 		fbID,
@@ -187,23 +154,15 @@ func completeFacebookLogin(c *fiber.Ctx, fbID, email, firstName, lastName, fullN
 	)
 	if err != nil {
 		stdlog.Printf("Facebook login socialMatchOrCreate failed: %v", err)
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"ret":    3,
-			"status": fmt.Sprintf("Login failed: %v", err),
-		})
+		return apierror.New(fiber.StatusForbidden, apierror.CodeLoginFailed, "Login failed").WithRet(3)
 	}
 
-	persistent, jwtString, err := auth.CreateSessionAndJWT(userID)
+	mfa, err := checkSecondFactor(c, userID, sf)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create session")
+		return err
 	}
 
-	return c.JSON(fiber.Map{
-		"ret":        0,
-		"status":     "Success",
-		"persistent": persistent,
-		"jwt":        jwtString,
-	})
+	return loginSuccess(c, userID, mfa)
 }
 
 // jwksKey represents a single key from a JWKS response.
@@ -2,14 +2,13 @@ package session
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
 	stdlog "log"
 	"net/http"
 	"os"
 	"time"
 
-	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/gofiber/fiber/v2"
 )
@@ -38,14 +37,11 @@ type googleTokenInfoResponse struct {
 }
 
 // handleGoogleLogin verifies a Google ID token and logs the user in.
-func handleGoogleLogin(c *fiber.Ctx, jwtToken string) error {
+func handleGoogleLogin(c *fiber.Ctx, jwtToken string, sf secondFactor) error {
 	clientID := os.Getenv("GOOGLE_CLIENT_ID")
 	if clientID == "" {
 		stdlog.Printf("GOOGLE_CLIENT_ID not configured")
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"ret":    1,
-			"status": "Google login not configured",
-		})
+		return apierror.New(fiber.StatusInternalServerError, apierror.CodeInternal, "Google login not configured")
 	}
 
 	// Verify the token via Google's tokeninfo endpoint.
@@ -53,51 +49,33 @@ func handleGoogleLogin(c *fiber.Ctx, jwtToken string) error {
 	resp, err := client.Get(getGoogleTokenInfoURL() + "?id_token=" + jwtToken)
 	if err != nil {
 		stdlog.Printf("Google tokeninfo request failed: %v", err)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Failed to verify Google token",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Failed to verify Google token").WithRet(2)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Failed to read Google token response",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Failed to read Google token response").WithRet(2)
 	}
 
 	if resp.StatusCode != 200 {
 		stdlog.Printf("Google tokeninfo returned status %d: %s", resp.StatusCode, string(body))
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Invalid Google token",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Invalid Google token").WithRet(2)
 	}
 
 	var tokenInfo googleTokenInfoResponse
 	if err := json.Unmarshal(body, &tokenInfo); err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Failed to parse Google token info",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Failed to parse Google token info").WithRet(2)
 	}
 
 	// Verify the audience matches our client ID.
 	if tokenInfo.Aud != clientID {
 		stdlog.Printf("Google token audience mismatch: got %s, expected %s", tokenInfo.Aud, clientID)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Google token audience mismatch",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Google token audience mismatch").WithRet(2)
 	}
 
 	if tokenInfo.Sub == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Google token missing subject",
-		})
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeLoginFailed, "Google token missing subject").WithRet(2)
 	}
 
 	// Find or create the user.
@@ -111,21 +89,13 @@ func handleGoogleLogin(c *fiber.Ctx, jwtToken string) error {
 	)
 	if err != nil {
 		stdlog.Printf("Google login socialMatchOrCreate failed: %v", err)
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"ret":    3,
-			"status": fmt.Sprintf("Login failed: %v", err),
-		})
+		return apierror.New(fiber.StatusForbidden, apierror.CodeLoginFailed, "Login failed").WithRet(3)
 	}
 
-	persistent, jwtString, err := auth.CreateSessionAndJWT(userID)
+	mfa, err := checkSecondFactor(c, userID, sf)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create session")
+		return err
 	}
 
-	return c.JSON(fiber.Map{
-		"ret":        0,
-		"status":     "Success",
-		"persistent": persistent,
-		"jwt":        jwtString,
-	})
+	return loginSuccess(c, userID, mfa)
 }
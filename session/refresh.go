@@ -0,0 +1,38 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/gofiber/fiber/v2"
+)
+
+// handleRefresh swaps a refresh token for a new JWT and refresh token.  The old refresh token can't be used again;
+// if it is, the session is ended, as someone has a copy of it.
+func handleRefresh(c *fiber.Ctx, refreshToken string) error {
+	if refreshToken == "" {
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Missing refresh token")
+	}
+
+	userID, sessionID, tokens, err := auth.RefreshSession(refreshToken)
+
+	if errors.Is(err, auth.ErrRefreshTokenReused) {
+		logLoginFailure(userID, fmt.Sprintf("Refresh token reused from %s; ended session %d", auth.ClientIP(c), sessionID))
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	auth.RecordSessionClient(c, sessionID)
+
+	return c.JSON(fiber.Map{
+		"ret":          0,
+		"status":       "Success",
+		"jwt":          tokens.JWT,
+		"refreshtoken": tokens.RefreshToken,
+	})
+}
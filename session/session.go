@@ -13,14 +13,15 @@ import (
 	"sync"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/housekeeper"
+	"github.com/freegle/iznik-server-go/partner"
 	"github.com/freegle/iznik-server-go/queue"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v4"
 )
 
 // fetchDiscourseStats fetches notification and topic counts from the Discourse API.
@@ -194,11 +195,14 @@ type PostSessionRequest struct {
 	FBLogin       FlexBool   `json:"fblogin"`
 	FBAccessToken string     `json:"fbaccesstoken"`
 	FBLimited     FlexBool   `json:"fblimited"`
+	TOTP          string     `json:"totp"`
+	RecoveryCode  string     `json:"recoverycode"`
+	RefreshToken  string     `json:"refreshtoken"`
 }
 
 // PostSession dispatches session write actions.
 //
-// @Summary Session actions (LostPassword, Unsubscribe, Login, Forget, Related)
+// @Summary Session actions (LostPassword, Unsubscribe, Login, Forget, Related, TOTPSetup, TOTPEnable, TOTPRecoveryCodes, TOTPDisable, Refresh)
 // @Tags session
 // @Router /session [post]
 func PostSession(c *fiber.Ctx) error {
@@ -216,22 +220,34 @@ func PostSession(c *fiber.Ctx) error {
 		return handleForget(c, req.Partner, req.ID)
 	case "Related":
 		return handleRelated(c, req.Userlist)
+	case "TOTPSetup":
+		return handleTOTPSetup(c)
+	case "TOTPEnable":
+		return handleTOTPEnable(c, req.TOTP)
+	case "TOTPRecoveryCodes":
+		return handleTOTPRecoveryCodes(c, secondFactor{Code: req.TOTP, RecoveryCode: req.RecoveryCode})
+	case "TOTPDisable":
+		return handleTOTPDisable(c, secondFactor{Code: req.TOTP, RecoveryCode: req.RecoveryCode})
+	case "Refresh":
+		return handleRefresh(c, req.RefreshToken)
 	default:
-		// No action means login attempt.
+		// No action means login attempt.  Users who have set up two-factor authentication send a code too.
+		sf := secondFactor{Code: req.TOTP, RecoveryCode: req.RecoveryCode}
+
 		if req.GoogleLogin && req.GoogleJWT != "" {
-			return handleGoogleLogin(c, req.GoogleJWT)
+			return handleGoogleLogin(c, req.GoogleJWT, sf)
 		}
 		if req.FBLogin.Bool() && req.FBAccessToken != "" {
 			if req.FBLimited.Bool() {
-				return handleFacebookLimitedLogin(c, req.FBAccessToken)
+				return handleFacebookLimitedLogin(c, req.FBAccessToken, sf)
 			}
-			return handleFacebookLogin(c, req.FBAccessToken)
+			return handleFacebookLogin(c, req.FBAccessToken, sf)
 		}
 		if req.Email != "" && req.Password != "" {
-			return handleEmailPasswordLogin(c, req.Email, req.Password)
+			return handleEmailPasswordLogin(c, req.Email, req.Password, sf)
 		}
 		if uint64(req.U) > 0 && req.K != "" {
-			return handleLinkLogin(c, uint64(req.U), req.K)
+			return handleLinkLogin(c, uint64(req.U), req.K, sf)
 		}
 
 		// If we get here with a non-empty action we don't recognise, error.
@@ -261,10 +277,7 @@ func handleLostPassword(c *fiber.Ctx, email string) error {
 
 	if userID == 0 {
 		// Return ret=2 for unknown email.
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"ret":    2,
-			"status": "We don't know that email address.",
-		})
+		return apierror.New(fiber.StatusNotFound, apierror.CodeUnknownEmail, "We don't know that email address.")
 	}
 
 	// Get or create the auto-login key for this user.
@@ -383,8 +396,8 @@ func getOrCreateLoginKey(userID uint64) (string, error) {
 
 // Delegated to auth package to break circular dependency with user package.
 
-// handleEmailPasswordLogin authenticates via email and sha1-hashed password.
-func handleEmailPasswordLogin(c *fiber.Ctx, email string, password string) error {
+// handleEmailPasswordLogin authenticates via email and password.
+func handleEmailPasswordLogin(c *fiber.Ctx, email string, password string, sf secondFactor) error {
 	db := database.DBConn
 
 	// Find user by email. Deleted users can still log in so they see the
@@ -395,35 +408,37 @@ func handleEmailPasswordLogin(c *fiber.Ctx, email string, password string) error
 		"WHERE ue.email = ? "+
 		"LIMIT 1", email).Scan(&userID)
 
+	ip := auth.ClientIP(c)
+
+	if err := checkLogin(c, userID, ip, true); err != nil {
+		return err
+	}
+
 	if userID == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"ret":    2,
-			"status": "We don't know that email address.",
-		})
+		recordLoginFailure(0, ip)
+		return apierror.New(fiber.StatusNotFound, apierror.CodeUnknownEmail, "We don't know that email address.")
 	}
 
 	if !auth.VerifyPassword(userID, password) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"ret":    3,
-			"status": "The password is wrong.",
-		})
+		if recordLoginFailure(userID, ip) {
+			return accountLocked(c, int(lockDuration.Seconds()))
+		}
+
+		return apierror.New(fiber.StatusForbidden, apierror.CodeLoginFailed, "The password is wrong.").WithRet(3)
 	}
 
-	persistent, jwtString, err := auth.CreateSessionAndJWT(userID)
+	mfa, err := checkSecondFactor(c, userID, sf)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create session")
+		return err
 	}
 
-	return c.JSON(fiber.Map{
-		"ret":        0,
-		"status":     "Success",
-		"persistent": persistent,
-		"jwt":        jwtString,
-	})
+	recordLoginSuccess(userID)
+
+	return loginSuccess(c, userID, mfa)
 }
 
 // handleLinkLogin authenticates via userid + link key.
-func handleLinkLogin(c *fiber.Ctx, uid uint64, key string) error {
+func handleLinkLogin(c *fiber.Ctx, uid uint64, key string, sf secondFactor) error {
 	db := database.DBConn
 
 	// Verify the user exists. Deleted users can still log in so they see the
@@ -431,11 +446,18 @@ func handleLinkLogin(c *fiber.Ctx, uid uint64, key string) error {
 	var exists uint64
 	db.Raw("SELECT id FROM users WHERE id = ? LIMIT 1", uid).Scan(&exists)
 
+	// The keys are too long to guess, but we still count failures by IP and against the account, to stop someone
+	// trying.  We don't check whether the account is locked, because logging in with a link is how it gets
+	// unlocked.
+	ip := auth.ClientIP(c)
+
+	if err := checkLogin(c, uid, ip, false); err != nil {
+		return err
+	}
+
 	if exists == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Unknown user.",
-		})
+		recordLoginFailure(0, ip)
+		return apierror.New(fiber.StatusNotFound, apierror.CodeNotFound, "Unknown user.")
 	}
 
 	// Verify the link key.
@@ -443,37 +465,29 @@ func handleLinkLogin(c *fiber.Ctx, uid uint64, key string) error {
 	db.Raw("SELECT credentials FROM users_logins WHERE userid = ? AND type = ? LIMIT 1", uid, utils.LOGIN_TYPE_LINK).Scan(&storedKey)
 
 	if storedKey == "" || subtle.ConstantTimeCompare([]byte(storedKey), []byte(key)) != 1 {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"ret":    3,
-			"status": "Invalid key.",
-		})
+		recordLoginFailure(uid, ip)
+		return apierror.New(fiber.StatusForbidden, apierror.CodeLoginFailed, "Invalid key.").WithRet(3)
 	}
 
-	persistent, jwtString, err := auth.CreateSessionAndJWT(uid)
+	mfa, err := checkSecondFactor(c, uid, sf)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create session")
+		return err
 	}
 
-	return c.JSON(fiber.Map{
-		"ret":        0,
-		"status":     "Success",
-		"persistent": persistent,
-		"jwt":        jwtString,
-	})
+	recordLoginSuccess(uid)
+
+	return loginSuccess(c, uid, mfa)
 }
 
 // handleForget puts a user into "limbo" — soft-deleted but recoverable for ~14 days.
 // Supports two flows: partner-authenticated (for integrated services) and self-service.
-func handleForget(c *fiber.Ctx, partner string, targetID uint64) error {
+func handleForget(c *fiber.Ctx, partnerKey string, targetID uint64) error {
 	db := database.DBConn
 
-	if partner != "" {
+	if partnerKey != "" {
 		// Partner flow: a partner service can delete users it manages.
-		var partnerID uint64
-		db.Raw("SELECT id FROM partners_keys WHERE `key` = ?", partner).Scan(&partnerID)
-
-		if partnerID == 0 {
-			return fiber.NewError(fiber.StatusForbidden, "Invalid partner key")
+		if _, err := partner.Authenticate(c, partnerKey, partner.ScopeUserForget); err != nil {
+			return err
 		}
 
 		if targetID == 0 {
@@ -508,10 +522,7 @@ func handleForget(c *fiber.Ctx, partner string, targetID uint64) error {
 	db.Raw("SELECT role FROM memberships WHERE userid = ? AND role IN (?, ?) LIMIT 1", myid, utils.ROLE_MODERATOR, utils.ROLE_OWNER).Scan(&modRole)
 
 	if modRole != "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"ret":    2,
-			"status": "Please demote yourself to a member first",
-		})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Please demote yourself to a member first")
 	}
 
 	// Spammers cannot delete their own accounts (prevents evasion of tracking).
@@ -519,10 +530,7 @@ func handleForget(c *fiber.Ctx, partner string, targetID uint64) error {
 	db.Raw("SELECT COUNT(*) FROM spam_users WHERE userid = ? AND collection IN (?, ?)", myid, utils.SPAM_COLLECTION_SPAMMER, utils.SPAM_COLLECTION_PENDING_ADD).Scan(&spammerCount)
 
 	if spammerCount > 0 {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"ret":    3,
-			"status": "We can't do this.",
-		})
+		return apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "We can't do this.").WithRet(3)
 	}
 
 	// Signal the auth middleware to skip the post-handler session check.
@@ -614,12 +622,14 @@ func GetSession(c *fiber.Ctx) error {
 
 	myid := user.WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ret":    1,
-			"status": "Not logged in",
-		})
+		return apierror.ErrNotLoggedIn
 	}
 
+	// The session making this request, rather than any of the user's others.
+	jwtUser, _, jwtExpiry := auth.GetJWTFromRequest(c)
+	sessionID := auth.SessionFromRequest(c)
+	auth.RecordSessionClient(c, sessionID)
+
 	db := database.DBConn
 
 	// Record app/web version in users_builddates.
@@ -721,7 +731,7 @@ func GetSession(c *fiber.Ctx) error {
 	}()
 	go func() {
 		defer wg.Done()
-		db.Raw("SELECT id, series, token FROM sessions WHERE userid = ? LIMIT 1", myid).Scan(&sessionRow)
+		db.Raw("SELECT id, series, token FROM sessions WHERE id = ? AND userid = ?", sessionID, myid).Scan(&sessionRow)
 	}()
 	go func() {
 		defer wg.Done()
@@ -1258,17 +1268,17 @@ func GetSession(c *fiber.Ctx) error {
 		profile = &p
 	}
 
-	// Build JWT from session.
+	// Build JWT from session.  This mustn't extend a JWT's life, or it would be a way round refreshing, so if the
+	// request came with one then the new one expires at the same time.  Old clients which only send the persistent
+	// token get a new short-lived one.
 	var jwtString string
 	if sessionRow.ID > 0 {
-		jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"id":        strconv.FormatUint(myid, 10),
-			"sessionid": strconv.FormatUint(sessionRow.ID, 10),
-			"exp":       time.Now().Unix() + 30*24*60*60,
-		})
-		secret := os.Getenv("JWT_SECRET")
 		var jwtErr error
-		jwtString, jwtErr = jwtToken.SignedString([]byte(secret))
+		if jwtUser == myid && jwtExpiry > 0 {
+			jwtString, jwtErr = auth.SignAccessToken(myid, sessionRow.ID, int64(jwtExpiry))
+		} else {
+			jwtString, jwtErr = auth.NewAccessToken(myid, sessionRow.ID)
+		}
 		if jwtErr != nil {
 			stdlog.Printf("Failed to sign JWT for user %d: %v", myid, jwtErr)
 		}
@@ -1579,12 +1589,16 @@ func PatchSession(c *fiber.Ctx) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			salt := auth.GetPasswordSalt()
-			hashed := auth.HashPassword(*req.Password, salt)
+			hashed, err := auth.HashPassword(*req.Password)
+			if err != nil {
+				stdlog.Printf("Failed to hash password for user %d: %v", myid, err)
+				return
+			}
+
 			uid := strconv.FormatUint(myid, 10)
-			db.Exec("INSERT INTO users_logins (userid, type, uid, credentials, salt) VALUES (?, ?, ?, ?, ?) "+
-				"ON DUPLICATE KEY UPDATE credentials = ?, salt = ?",
-				myid, utils.LOGIN_TYPE_NATIVE, uid, hashed, salt, hashed, salt)
+			db.Exec("INSERT INTO users_logins (userid, type, uid, credentials, salt) VALUES (?, ?, ?, ?, NULL) "+
+				"ON DUPLICATE KEY UPDATE credentials = ?, salt = NULL",
+				myid, utils.LOGIN_TYPE_NATIVE, uid, hashed, hashed)
 		}()
 	}
 
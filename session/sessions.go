@@ -0,0 +1,72 @@
+package session
+
+import (
+	"strconv"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/user"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ListSessions returns the places the user is logged in, so that they can spot any they don't recognise.
+//
+// @Summary List my sessions
+// @Tags session
+// @Router /sessions [get]
+func ListSessions(c *fiber.Ctx) error {
+	myid := user.WhoAmI(c)
+	if myid == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":      0,
+		"status":   "Success",
+		"sessions": auth.ListSessions(myid, auth.SessionFromRequest(c), true),
+	})
+}
+
+// RevokeSessions logs the user out of one of their sessions, or if no ID is given, all of them except this one.
+//
+// @Summary Revoke one or all other sessions
+// @Tags session
+// @Router /sessions/{id} [delete]
+func RevokeSessions(c *fiber.Ctx) error {
+	myid := user.WhoAmI(c)
+	if myid == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	current := auth.SessionFromRequest(c)
+
+	if c.Params("id") == "" {
+		count := auth.RevokeOtherSessions(myid, current)
+
+		return c.JSON(fiber.Map{
+			"ret":     0,
+			"status":  "Success",
+			"revoked": count,
+		})
+	}
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil || id == 0 {
+		return apierror.ErrInvalidID
+	}
+
+	if id == current {
+		// This is logging out, so the session will have gone by the time the auth middleware checks it.
+		c.Locals("skipPostAuthCheck", true)
+	}
+
+	if !auth.RevokeUserSession(myid, id) {
+		return apierror.ErrNotFound.WithMessage("Session not found")
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":     0,
+		"status":  "Success",
+		"revoked": 1,
+	})
+}
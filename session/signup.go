@@ -0,0 +1,69 @@
+package session
+
+import (
+	"strings"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/user"
+	"github.com/gofiber/fiber/v2"
+)
+
+type signupRequest struct {
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	TOTP         string `json:"totp"`
+	RecoveryCode string `json:"recoverycode"`
+}
+
+// Signup creates a new user, as user.PutUser does.  If the email address is already in use and they give the right
+// password, we log them in instead, which saves them switching to the login screen and entering it again.  That
+// makes it a login form, so it has the same protection against guessing, and needs the same second factor, as
+// handleEmailPasswordLogin.
+//
+// @Summary Create/signup a new user
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param body body user.UserPutRequest true "Signup details"
+// @Success 200 {object} map[string]interface{}
+// @Router /user [put]
+func Signup(c *fiber.Ctx) error {
+	var req signupRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	var userID uint64
+	if email := strings.TrimSpace(req.Email); email != "" && req.Password != "" {
+		database.DBConn.Raw("SELECT userid FROM users_emails WHERE email = ? LIMIT 1", email).Scan(&userID)
+	}
+
+	if userID == 0 {
+		return user.PutUser(c)
+	}
+
+	ip := auth.ClientIP(c)
+
+	if err := checkLogin(c, userID, ip, true); err != nil {
+		return err
+	}
+
+	if !auth.VerifyPassword(userID, req.Password) {
+		if recordLoginFailure(userID, ip) {
+			return accountLocked(c, int(lockDuration.Seconds()))
+		}
+
+		return apierror.New(fiber.StatusConflict, apierror.CodeEmailInUse, "That email is already in use").WithRet(2)
+	}
+
+	mfa, err := checkSecondFactor(c, userID, secondFactor{Code: req.TOTP, RecoveryCode: req.RecoveryCode})
+	if err != nil {
+		return err
+	}
+
+	recordLoginSuccess(userID)
+
+	return loginSuccess(c, userID, mfa)
+}
@@ -0,0 +1,227 @@
+package session
+
+import (
+	"time"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/user"
+	"github.com/gofiber/fiber/v2"
+)
+
+// secondFactor is what a user who has enrolled for two-factor authentication sends with their login: either a
+// code from their authenticator app or one of their recovery codes.
+type secondFactor struct {
+	Code         string
+	RecoveryCode string
+}
+
+// checkSecondFactor checks the second factor for a user whose first factor was right.  It returns true if they
+// used one, so that the session can be marked.
+func checkSecondFactor(c *fiber.Ctx, userID uint64, sf secondFactor) (bool, error) {
+	if !auth.HasTOTP(userID) {
+		return false, nil
+	}
+
+	if sf.Code == "" && sf.RecoveryCode == "" {
+		return false, apierror.New(fiber.StatusUnauthorized, apierror.CodeMFARequired,
+			"Please enter the code from your authenticator app.")
+	}
+
+	if !auth.VerifySecondFactor(userID, sf.Code, sf.RecoveryCode) {
+		if recordLoginFailure(userID, auth.ClientIP(c)) {
+			return false, accountLocked(c, int(lockDuration.Seconds()))
+		}
+
+		return false, apierror.New(fiber.StatusUnauthorized, apierror.CodeMFAFailed, "That code is wrong.").WithRet(3)
+	}
+
+	return true, nil
+}
+
+// confirmSecondFactor checks the second factor from a logged-in user who is changing their two-factor settings.
+// Wrong codes count as failed logins, as for checkSecondFactor, so that someone with a stolen session can't keep
+// guessing until they can turn two-factor authentication off.
+func confirmSecondFactor(c *fiber.Ctx, userID uint64, sf secondFactor) error {
+	ip := auth.ClientIP(c)
+
+	if err := checkLogin(c, userID, ip, true); err != nil {
+		return err
+	}
+
+	if !auth.VerifySecondFactor(userID, sf.Code, sf.RecoveryCode) {
+		if recordLoginFailure(userID, ip) {
+			return accountLocked(c, int(lockDuration.Seconds()))
+		}
+
+		return apierror.New(fiber.StatusForbidden, apierror.CodeMFAFailed, "That code is wrong.").WithRet(3)
+	}
+
+	recordLoginSuccess(userID)
+
+	return nil
+}
+
+// loginSuccess creates a session for a user who has logged in, and returns it.
+func loginSuccess(c *fiber.Ctx, userID uint64, mfa bool) error {
+	persistent, tokens, err := auth.CreateSessionAndJWT(userID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create session")
+	}
+
+	sessionID, _ := persistent["id"].(uint64)
+	auth.RecordSessionClient(c, sessionID)
+
+	if mfa {
+		auth.SetSessionSecondFactor(sessionID)
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":          0,
+		"status":       "Success",
+		"id":           userID,
+		"persistent":   persistent,
+		"jwt":          tokens.JWT,
+		"refreshtoken": tokens.RefreshToken,
+	})
+}
+
+// handleTOTPSetup starts enrolment by creating a secret for the user to add to their authenticator app.  It isn't
+// used until they confirm it with handleTOTPEnable.
+func handleTOTPSetup(c *fiber.Ctx) error {
+	myid := user.WhoAmI(c)
+	if myid == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	if auth.HasTOTP(myid) {
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "Two-factor authentication is already set up.")
+	}
+
+	db := database.DBConn
+
+	var email string
+	db.Raw("SELECT email FROM users_emails WHERE userid = ? ORDER BY preferred DESC, id ASC LIMIT 1", myid).Scan(&email)
+
+	secret := auth.NewTOTPSecret()
+	db.Exec("INSERT INTO users_totp (userid, secret, enabled, lastused, created) VALUES (?, ?, 0, 0, NOW()) "+
+		"ON DUPLICATE KEY UPDATE secret = VALUES(secret), enabled = 0, lastused = 0, created = NOW()",
+		myid, secret)
+
+	return c.JSON(fiber.Map{
+		"ret":    0,
+		"status": "Success",
+		"secret": secret,
+		"uri":    auth.TOTPURI(secret, email),
+	})
+}
+
+// handleTOTPEnable finishes enrolment once the user has shown that their app gives the right codes.  The current
+// session counts as having used a second factor, as it just has.
+func handleTOTPEnable(c *fiber.Ctx, code string) error {
+	myid, sessionID, _ := auth.GetJWTFromRequest(c)
+	if myid == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	db := database.DBConn
+
+	var totp struct {
+		Secret  string
+		Enabled bool
+	}
+	db.Raw("SELECT secret, enabled FROM users_totp WHERE userid = ?", myid).Scan(&totp)
+
+	if totp.Secret == "" {
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Please set up two-factor authentication first.")
+	}
+
+	if totp.Enabled {
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "Two-factor authentication is already set up.")
+	}
+
+	step, ok := auth.CheckTOTP(totp.Secret, code, 0, time.Now())
+	if !ok {
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeMFAFailed, "That code is wrong.").WithRet(3)
+	}
+
+	db.Exec("UPDATE users_totp SET enabled = 1, lastused = ? WHERE userid = ?", step, myid)
+	auth.SetSessionSecondFactor(sessionID)
+
+	return c.JSON(fiber.Map{
+		"ret":           0,
+		"status":        "Success",
+		"recoverycodes": newRecoveryCodes(myid),
+	})
+}
+
+// handleTOTPRecoveryCodes replaces the user's recovery codes, e.g. if they've used most of them.
+func handleTOTPRecoveryCodes(c *fiber.Ctx, sf secondFactor) error {
+	myid := user.WhoAmI(c)
+	if myid == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	if !auth.HasTOTP(myid) {
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Two-factor authentication isn't set up.")
+	}
+
+	if err := confirmSecondFactor(c, myid, sf); err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"ret":           0,
+		"status":        "Success",
+		"recoverycodes": newRecoveryCodes(myid),
+	})
+}
+
+// handleTOTPDisable turns off two-factor authentication, unless the user's role needs it.
+func handleTOTPDisable(c *fiber.Ctx, sf secondFactor) error {
+	myid := user.WhoAmI(c)
+	if myid == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	if !auth.HasTOTP(myid) {
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Two-factor authentication isn't set up.")
+	}
+
+	db := database.DBConn
+
+	var systemrole string
+	db.Raw("SELECT systemrole FROM users WHERE id = ?", myid).Scan(&systemrole)
+
+	if auth.TOTPRequiredForRole(systemrole) {
+		return apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "You need two-factor authentication for your role.")
+	}
+
+	if err := confirmSecondFactor(c, myid, sf); err != nil {
+		return err
+	}
+
+	db.Exec("DELETE FROM users_totp WHERE userid = ?", myid)
+	db.Exec("DELETE FROM users_totp_recovery WHERE userid = ?", myid)
+
+	return c.JSON(fiber.Map{
+		"ret":    0,
+		"status": "Success",
+	})
+}
+
+// newRecoveryCodes replaces a user's recovery codes, and returns the new ones.  We only store hashes, so this is
+// the only time they can be shown.
+func newRecoveryCodes(userID uint64) []string {
+	db := database.DBConn
+	codes, hashes := auth.NewRecoveryCodes()
+
+	db.Exec("DELETE FROM users_totp_recovery WHERE userid = ?", userID)
+
+	for _, h := range hashes {
+		db.Exec("INSERT INTO users_totp_recovery (userid, code) VALUES (?, ?)", userID, h)
+	}
+
+	return codes
+}
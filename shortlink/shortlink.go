@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/gofiber/fiber/v2"
 )
@@ -51,7 +52,7 @@ func GetShortlink(c *fiber.Ctx) error {
 		db.Raw("SELECT * FROM shortlinks WHERE id = ?", id).Scan(&s)
 
 		if s.ID == 0 {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"ret": 2, "status": "Not found"})
+			return apierror.ErrNotFound
 		}
 
 		resolveShortlinkURL(&s, userSite)
@@ -134,14 +135,14 @@ func PostShortlink(c *fiber.Ctx) error {
 	}
 
 	if req.Name == "" || req.Groupid == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 2, "status": "Invalid parameters"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Invalid parameters")
 	}
 
 	// Check if name already exists.
 	var existing uint64
 	db.Raw("SELECT id FROM shortlinks WHERE name LIKE ?", req.Name).Scan(&existing)
 	if existing > 0 {
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"ret": 3, "status": "Name already in use"})
+		return apierror.New(fiber.StatusConflict, apierror.CodeConflict, "Name already in use")
 	}
 
 	// Create the shortlink.
@@ -150,11 +151,11 @@ func PostShortlink(c *fiber.Ctx) error {
 	// parallel load (GORM's connection pool may assign a different connection).
 	sqlDB, err := db.DB()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ret": 1, "status": "Database error"})
+		return apierror.New(fiber.StatusInternalServerError, apierror.CodeInternal, "Database error")
 	}
 	sqlResult, err := sqlDB.Exec("INSERT INTO shortlinks (name, type, groupid) VALUES (?, 'Group', ?)", req.Name, req.Groupid)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ret": 1, "status": "Failed to create shortlink"})
+		return apierror.New(fiber.StatusInternalServerError, apierror.CodeInternal, "Failed to create shortlink")
 	}
 
 	var newID uint64
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"strconv"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/user"
@@ -25,11 +26,11 @@ import (
 func GetSimulation(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ret": 1, "status": "Not logged in"})
+		return apierror.ErrNotLoggedIn
 	}
 
 	if !auth.IsSystemMod(myid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": "Permission denied"})
+		return apierror.ErrForbidden
 	}
 
 	action := c.Query("action", "")
@@ -115,7 +116,7 @@ func listRuns(c *fiber.Ctx) error {
 func getRun(c *fiber.Ctx) error {
 	runID, _ := strconv.ParseUint(c.Query("runid", "0"), 10, 64)
 	if runID == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 2, "status": "Missing runid"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Missing runid")
 	}
 
 	db := database.DBConn
@@ -138,7 +139,7 @@ func getRun(c *fiber.Ctx) error {
 		"FROM simulation_message_isochrones_runs WHERE id = ?", runID).Scan(&r)
 
 	if r.ID == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"ret": 2, "status": "Not found"})
+		return apierror.ErrNotFound
 	}
 
 	entry := map[string]interface{}{
@@ -183,7 +184,7 @@ func getMessage(c *fiber.Ctx) error {
 	index, _ := strconv.ParseUint(c.Query("index", "0"), 10, 64)
 
 	if runID == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 2, "status": "Missing runid"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Missing runid")
 	}
 
 	db := database.DBConn
@@ -210,7 +211,7 @@ func getMessage(c *fiber.Ctx) error {
 		runID, index).Scan(&msg)
 
 	if msg.ID == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"ret": 2, "status": "Message not found"})
+		return apierror.New(fiber.StatusNotFound, apierror.CodeNotFound, "Message not found")
 	}
 
 	// Get expansions for this message.
@@ -6,6 +6,7 @@ import (
 
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/partner"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/gofiber/fiber/v2"
@@ -26,14 +27,9 @@ import (
 // @Router /api/spammers [get]
 func GetSpammers(c *fiber.Ctx) error {
 	// Partners with a valid key can access the spammer list without a user session.
-	partner := c.Query("partner", "")
-	if partner != "" {
-		db := database.DBConn
-		var partnerID uint64
-		db.Raw("SELECT id FROM partners_keys WHERE `key` = ?", partner).Scan(&partnerID)
-
-		if partnerID == 0 {
-			return fiber.NewError(fiber.StatusForbidden, "Invalid partner key")
+	if key := c.Query("partner", ""); key != "" {
+		if _, err := partner.Authenticate(c, key, partner.ScopeSpammersRead); err != nil {
+			return err
 		}
 		// Valid partner — fall through to the query logic.
 	} else {
@@ -275,14 +271,9 @@ func PatchSpammer(c *fiber.Ctx) error {
 // @Router /api/spammers/export [get]
 func ExportSpammers(c *fiber.Ctx) error {
 	// Accept either partner key or moderator session.
-	partner := c.Query("partner", "")
-	if partner != "" {
-		db := database.DBConn
-		var partnerID uint64
-		db.Raw("SELECT id FROM partners_keys WHERE `key` = ?", partner).Scan(&partnerID)
-
-		if partnerID == 0 {
-			return fiber.NewError(fiber.StatusForbidden, "Invalid partner key")
+	if key := c.Query("partner", ""); key != "" {
+		if _, err := partner.Authenticate(c, key, partner.ScopeSpammersRead); err != nil {
+			return err
 		}
 	} else {
 		myid := user.WhoAmI(c)
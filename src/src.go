@@ -2,6 +2,7 @@ package src
 
 import (
 	"context"
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/gofiber/fiber/v2"
@@ -26,16 +27,12 @@ func RecordSource(c *fiber.Ctx) error {
 
 	// Parse request body
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid request format",
-		})
+		return apierror.ErrInvalidBody.WithCause(err)
 	}
 
 	// Validate required field
 	if req.Src == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "Source parameter is required",
-		})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, "Source parameter is required")
 	}
 
 	// Get user ID if logged in (may be 0)
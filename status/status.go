@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -36,12 +37,8 @@ func init() {
 func GetStatus(c *fiber.Ctx) error {
 	data, err := os.ReadFile("/tmp/iznik.status")
 	if err != nil {
-		// Status file not available (batch system may not have written it yet).
-		// Return 200 with ret:1 - this is not a server error, just no data yet.
-		return c.JSON(fiber.Map{
-			"ret":    1,
-			"status": "Cannot access status file",
-		})
+		// Status file not available (batch system may not have written it yet).  v1 clients still get ret 1.
+		return apierror.New(fiber.StatusServiceUnavailable, apierror.CodeUnavailable, "Cannot access status file").WithRet(1).WithCause(err)
 	}
 
 	// The file contains valid JSON - return it directly.
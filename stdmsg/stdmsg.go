@@ -4,8 +4,10 @@ import (
 	"strings"
 	"strconv"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/modaudit"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/gofiber/fiber/v2"
 )
@@ -27,8 +29,8 @@ type StdMsg struct {
 }
 
 // canModifyConfig checks if user can modify the parent config.
-func canModifyConfig(myid uint64, configid uint64) bool {
-	if auth.IsAdminOrSupport(myid) {
+func canModifyConfig(p *auth.Policy, configid uint64) bool {
+	if p.Can(auth.PERM_SYSTEM_SUPPORT) {
 		return true
 	}
 
@@ -37,7 +39,7 @@ func canModifyConfig(myid uint64, configid uint64) bool {
 	database.DBConn.Raw("SELECT createdby FROM mod_configs WHERE id = ?", configid).Scan(&createdby)
 	database.DBConn.Raw("SELECT protected FROM mod_configs WHERE id = ?", configid).Scan(&protected)
 
-	if createdby != nil && *createdby == myid {
+	if createdby != nil && *createdby == p.UserID {
 		return true
 	}
 	if protected == 0 {
@@ -58,14 +60,14 @@ func canModifyConfig(myid uint64, configid uint64) bool {
 func GetStdMsg(c *fiber.Ctx) error {
 	id, _ := strconv.ParseUint(c.Query("id", "0"), 10, 64)
 	if id == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"ret": 2, "status": "Invalid stdmsg id"})
+		return apierror.New(fiber.StatusNotFound, apierror.CodeNotFound, "Invalid stdmsg id")
 	}
 
 	db := database.DBConn
 	var msg StdMsg
 	db.Raw("SELECT * FROM mod_stdmsgs WHERE id = ?", id).Scan(&msg)
 	if msg.ID == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"ret": 2, "status": "Invalid stdmsg id"})
+		return apierror.New(fiber.StatusNotFound, apierror.CodeNotFound, "Invalid stdmsg id")
 	}
 
 	return c.JSON(fiber.Map{
@@ -86,11 +88,11 @@ func GetStdMsg(c *fiber.Ctx) error {
 func PostStdMsg(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ret": 1, "status": "Not logged in"})
+		return apierror.ErrNotLoggedIn
 	}
 
 	if !auth.IsSystemMod(myid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 4, "status": "Don't have rights to create configs"})
+		return apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "Don't have rights to create configs").WithRet(4)
 	}
 
 	type CreateRequest struct {
@@ -120,10 +122,10 @@ func PostStdMsg(c *fiber.Ctx) error {
 	}
 
 	if req.Title == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 3, "status": "Must supply title"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Must supply title").WithRet(3)
 	}
 	if req.Configid == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 3, "status": "Must supply configid"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Must supply configid").WithRet(3)
 	}
 
 	db := database.DBConn
@@ -133,11 +135,11 @@ func PostStdMsg(c *fiber.Ctx) error {
 	// parallel load (GORM's connection pool may assign a different connection).
 	sqlDB, err := db.DB()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ret": 1, "status": "Database error"})
+		return apierror.New(fiber.StatusInternalServerError, apierror.CodeInternal, "Database error")
 	}
 	sqlResult, err := sqlDB.Exec("INSERT INTO mod_stdmsgs (configid, title) VALUES (?, ?)", req.Configid, req.Title)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ret": 1, "status": "Create failed"})
+		return apierror.New(fiber.StatusInternalServerError, apierror.CodeInternal, "Create failed")
 	}
 
 	var newID uint64
@@ -180,7 +182,7 @@ func PostStdMsg(c *fiber.Ctx) error {
 func PatchStdMsg(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ret": 1, "status": "Not logged in"})
+		return apierror.ErrNotLoggedIn
 	}
 
 	type PatchRequest struct {
@@ -207,7 +209,7 @@ func PatchStdMsg(c *fiber.Ctx) error {
 	}
 
 	if req.ID == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"ret": 2, "status": "Invalid stdmsg id"})
+		return apierror.New(fiber.StatusNotFound, apierror.CodeNotFound, "Invalid stdmsg id")
 	}
 
 	db := database.DBConn
@@ -216,13 +218,16 @@ func PatchStdMsg(c *fiber.Ctx) error {
 	var configid uint64
 	db.Raw("SELECT configid FROM mod_stdmsgs WHERE id = ?", req.ID).Scan(&configid)
 	if configid == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"ret": 2, "status": "Invalid stdmsg id"})
+		return apierror.New(fiber.StatusNotFound, apierror.CodeNotFound, "Invalid stdmsg id")
 	}
 
-	if !canModifyConfig(myid, configid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 4, "status": "Don't have rights to modify config"})
+	if !canModifyConfig(auth.PolicyFor(c), configid) {
+		return apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "Don't have rights to modify config").WithRet(4)
 	}
 
+	audit := modaudit.Take(modaudit.TargetStdMsg, req.ID, 0,
+		"title", "action", "subjpref", "subjsuff", "body", "rarelyused", "autosend", "newmodstatus", "newdelstatus", "edittext", "insert")
+
 	if req.Title != nil {
 		db.Exec("UPDATE mod_stdmsgs SET title = ? WHERE id = ?", *req.Title, req.ID)
 	}
@@ -257,6 +262,8 @@ func PatchStdMsg(c *fiber.Ctx) error {
 		db.Exec("UPDATE mod_stdmsgs SET `insert` = ? WHERE id = ?", *req.Insert, req.ID)
 	}
 
+	modaudit.Record(c, modaudit.ActionEdit, audit)
+
 	return c.JSON(fiber.Map{"ret": 0, "status": "Success"})
 }
 
@@ -271,12 +278,12 @@ func PatchStdMsg(c *fiber.Ctx) error {
 func DeleteStdMsg(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ret": 1, "status": "Not logged in"})
+		return apierror.ErrNotLoggedIn
 	}
 
 	id, _ := strconv.ParseUint(c.Query("id", "0"), 10, 64)
 	if id == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"ret": 2, "status": "Invalid stdmsg id"})
+		return apierror.New(fiber.StatusNotFound, apierror.CodeNotFound, "Invalid stdmsg id")
 	}
 
 	db := database.DBConn
@@ -284,11 +291,11 @@ func DeleteStdMsg(c *fiber.Ctx) error {
 	var configid uint64
 	db.Raw("SELECT configid FROM mod_stdmsgs WHERE id = ?", id).Scan(&configid)
 	if configid == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"ret": 2, "status": "Invalid stdmsg id"})
+		return apierror.New(fiber.StatusNotFound, apierror.CodeNotFound, "Invalid stdmsg id")
 	}
 
-	if !canModifyConfig(myid, configid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 4, "status": "Don't have rights to modify config"})
+	if !canModifyConfig(auth.PolicyFor(c), configid) {
+		return apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "Don't have rights to modify config").WithRet(4)
 	}
 
 	db.Exec("DELETE FROM mod_stdmsgs WHERE id = ?", id)
@@ -15,6 +15,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/freegle/iznik-server-go/user"
@@ -106,6 +107,10 @@ func RequireModeratorMiddleware() fiber.Handler {
 
 		// Admin and Support can access everything.
 		if userInfo.Systemrole == utils.SYSTEMROLE_SUPPORT || userInfo.Systemrole == utils.SYSTEMROLE_ADMIN {
+			if err := auth.RequireSecondFactor(userID, sessionID, userInfo.Systemrole); err != nil {
+				return err
+			}
+
 			c.Locals("systemrole", userInfo.Systemrole)
 			c.Locals("userid", userID)
 			return c.Next()
@@ -119,6 +124,11 @@ func RequireModeratorMiddleware() fiber.Handler {
 			return fiber.NewError(fiber.StatusForbidden, "Moderator role required")
 		}
 
+		// Group mods may not have the Moderator system role, but they can see the same logs.
+		if err := auth.RequireSecondFactor(userID, sessionID, utils.SYSTEMROLE_MODERATOR); err != nil {
+			return err
+		}
+
 		c.Locals("systemrole", userInfo.Systemrole)
 		c.Locals("userid", userID)
 		return c.Next()
@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/utils"
@@ -60,8 +61,7 @@ func GetTeam(c *fiber.Ctx) error {
 	if name != "" {
 		db.Raw("SELECT id FROM teams WHERE name LIKE ?", name).Scan(&id)
 		if id == 0 {
-			// Team not found is a search result, not a resource error - return 200.
-			return c.JSON(fiber.Map{"ret": 2, "status": "Not found"})
+			return apierror.ErrNotFound.WithMessage("Team not found")
 		}
 	}
 
@@ -70,7 +70,7 @@ func GetTeam(c *fiber.Ctx) error {
 		var t Team
 		db.Raw("SELECT * FROM teams WHERE id = ?", id).Scan(&t)
 		if t.ID == 0 {
-			return c.JSON(fiber.Map{"ret": 2, "status": "Not found"})
+			return apierror.ErrNotFound.WithMessage("Team not found")
 		}
 
 		var members []TeamMember
@@ -243,11 +243,11 @@ func getUserProfile(userid uint64, imageOverride *string) map[string]interface{}
 func PostTeam(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ret": 1, "status": "Not logged in"})
+		return apierror.ErrNotLoggedIn
 	}
 
 	if !hasTeamsPermission(myid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": "Permission denied"})
+		return apierror.ErrForbidden
 	}
 
 	type CreateRequest struct {
@@ -265,7 +265,7 @@ func PostTeam(c *fiber.Ctx) error {
 	}
 
 	if req.Name == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 2, "status": "Missing name"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Missing name")
 	}
 
 	db := database.DBConn
@@ -275,12 +275,12 @@ func PostTeam(c *fiber.Ctx) error {
 	// parallel load (GORM's connection pool may assign a different connection).
 	sqlDB, err := db.DB()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ret": 1, "status": "Database error"})
+		return apierror.New(fiber.StatusInternalServerError, apierror.CodeInternal, "Database error")
 	}
 	sqlResult, err := sqlDB.Exec("INSERT INTO teams (name, email, description) VALUES (?, ?, ?)",
 		req.Name, req.Email, req.Description)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ret": 1, "status": "Create failed"})
+		return apierror.New(fiber.StatusInternalServerError, apierror.CodeInternal, "Create failed")
 	}
 
 	var newID uint64
@@ -302,11 +302,11 @@ func PostTeam(c *fiber.Ctx) error {
 func PatchTeam(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ret": 1, "status": "Not logged in"})
+		return apierror.ErrNotLoggedIn
 	}
 
 	if !hasTeamsPermission(myid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": "Permission denied"})
+		return apierror.ErrForbidden
 	}
 
 	type PatchRequest struct {
@@ -328,7 +328,7 @@ func PatchTeam(c *fiber.Ctx) error {
 	}
 
 	if req.ID == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 2, "status": "Missing id"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Missing id")
 	}
 
 	db := database.DBConn
@@ -336,13 +336,13 @@ func PatchTeam(c *fiber.Ctx) error {
 	switch req.Action {
 	case "Add":
 		if req.Userid == 0 {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 2, "status": "Missing userid"})
+			return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Missing userid")
 		}
 		db.Exec("REPLACE INTO teams_members (userid, teamid, description) VALUES (?, ?, ?)",
 			req.Userid, req.ID, req.Description)
 	case "Remove":
 		if req.Userid == 0 {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 2, "status": "Missing userid"})
+			return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Missing userid")
 		}
 		db.Exec("DELETE FROM teams_members WHERE userid = ? AND teamid = ?",
 			req.Userid, req.ID)
@@ -375,16 +375,16 @@ func PatchTeam(c *fiber.Ctx) error {
 func DeleteTeam(c *fiber.Ctx) error {
 	myid := user.WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ret": 1, "status": "Not logged in"})
+		return apierror.ErrNotLoggedIn
 	}
 
 	if !hasTeamsPermission(myid) {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": "Permission denied"})
+		return apierror.ErrForbidden
 	}
 
 	id, _ := strconv.ParseUint(c.Query("id", "0"), 10, 64)
 	if id == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 2, "status": "Missing id"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Missing id")
 	}
 
 	db := database.DBConn
@@ -4,6 +4,7 @@ import (
 	json2 "encoding/json"
 	"fmt"
 	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/partner"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net/http/httptest"
@@ -29,12 +30,9 @@ func TestChangesInvalidPartnerKey(t *testing.T) {
 
 func TestChangesValidPartner(t *testing.T) {
 	prefix := uniquePrefix("changes")
-	db := database.DBConn
 
 	// Create a test partner key.
-	partnerKey := prefix + "_key"
-	db.Exec("INSERT INTO partners_keys (partner, `key`) VALUES (?, ?)", prefix+"_partner", partnerKey)
-	defer db.Exec("DELETE FROM partners_keys WHERE partner = ?", prefix+"_partner")
+	_, partnerKey := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
 
 	// Request changes with valid partner key.
 	req := httptest.NewRequest("GET", fmt.Sprintf("/api/changes?partner=%s", partnerKey), nil)
@@ -59,12 +57,9 @@ func TestChangesValidPartner(t *testing.T) {
 
 func TestChangesWithSince(t *testing.T) {
 	prefix := uniquePrefix("changes_since")
-	db := database.DBConn
 
 	// Create a test partner key.
-	partnerKey := prefix + "_key"
-	db.Exec("INSERT INTO partners_keys (partner, `key`) VALUES (?, ?)", prefix+"_partner", partnerKey)
-	defer db.Exec("DELETE FROM partners_keys WHERE partner = ?", prefix+"_partner")
+	_, partnerKey := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
 
 	// Request with a since parameter far in the future — should return empty results.
 	futureTime := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
@@ -90,9 +85,7 @@ func TestChangesMessageOutcome(t *testing.T) {
 	db := database.DBConn
 
 	// Create partner key.
-	partnerKey := prefix + "_key"
-	db.Exec("INSERT INTO partners_keys (partner, `key`) VALUES (?, ?)", prefix+"_partner", partnerKey)
-	defer db.Exec("DELETE FROM partners_keys WHERE partner = ?", prefix+"_partner")
+	_, partnerKey := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
 
 	// Create a test user, group, and message.
 	groupID := CreateTestGroup(t, prefix)
@@ -138,9 +131,7 @@ func TestChangesRatings(t *testing.T) {
 	db := database.DBConn
 
 	// Create partner key.
-	partnerKey := prefix + "_key"
-	db.Exec("INSERT INTO partners_keys (partner, `key`) VALUES (?, ?)", prefix+"_partner", partnerKey)
-	defer db.Exec("DELETE FROM partners_keys WHERE partner = ?", prefix+"_partner")
+	_, partnerKey := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
 
 	// Create two test users.
 	raterID := CreateTestUser(t, prefix+"_rater", "User")
@@ -179,12 +170,9 @@ func TestChangesRatings(t *testing.T) {
 
 func TestChangesInvalidSince(t *testing.T) {
 	prefix := uniquePrefix("changes_bad")
-	db := database.DBConn
 
 	// Create partner key.
-	partnerKey := prefix + "_key"
-	db.Exec("INSERT INTO partners_keys (partner, `key`) VALUES (?, ?)", prefix+"_partner", partnerKey)
-	defer db.Exec("DELETE FROM partners_keys WHERE partner = ?", prefix+"_partner")
+	_, partnerKey := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
 
 	// Request with invalid since parameter.
 	req := httptest.NewRequest("GET", fmt.Sprintf("/api/changes?partner=%s&since=not-a-date", partnerKey), nil)
@@ -192,3 +180,90 @@ func TestChangesInvalidSince(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, 400, resp.StatusCode)
 }
+
+func TestChangesInvalidCursorAndLimit(t *testing.T) {
+	prefix := uniquePrefix("changes_cursor_bad")
+
+	_, partnerKey := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
+
+	for _, query := range []string{"cursor=not-a-cursor", "cursor=abc.def", "limit=0", "limit=100000", "limit=abc"} {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/changes?partner=%s&%s", partnerKey, query), nil)
+		resp, err := getApp().Test(req, -1)
+		require.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode, query)
+	}
+}
+
+func TestChangesCursorPagingSharedTimestamp(t *testing.T) {
+	prefix := uniquePrefix("changes_page")
+	db := database.DBConn
+
+	_, partnerKey := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
+
+	groupID := CreateTestGroup(t, prefix)
+	defer db.Exec("DELETE FROM `groups` WHERE id = ?", groupID)
+
+	userID := CreateTestUser(t, prefix, "User")
+	defer db.Exec("DELETE FROM users WHERE id = ?", userID)
+
+	// Pick a second in the past which nothing else is likely to use, and give lots of changes that timestamp.
+	shared := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(time.Now().UnixNano()%(365*86400)) * time.Second)
+	sharedStr := shared.Format("2006-01-02 15:04:05")
+
+	want := map[uint64]int{}
+
+	for i := 0; i < 23; i++ {
+		msgID := CreateTestMessage(t, userID, groupID, fmt.Sprintf("OFFER: %s item %d", prefix, i), 55.95, -3.19)
+		defer db.Exec("DELETE FROM messages WHERE id = ?", msgID)
+
+		db.Exec("INSERT INTO messages_outcomes (msgid, outcome, timestamp) VALUES (?, 'Taken', ?)", msgID, sharedStr)
+		defer db.Exec("DELETE FROM messages_outcomes WHERE msgid = ?", msgID)
+
+		want[msgID] = 0
+	}
+
+	// Page through from just before the shared second with a small page size.
+	got := map[uint64]int{}
+	url := fmt.Sprintf("/api/changes?partner=%s&limit=5&since=%s", partnerKey, shared.Add(-time.Second).Format(time.RFC3339))
+
+	for page := 0; page < 50; page++ {
+		req := httptest.NewRequest("GET", url, nil)
+		resp, err := getApp().Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var result struct {
+			Changes struct {
+				Messages []struct {
+					ID   uint64 `json:"id"`
+					Type string `json:"type"`
+				} `json:"messages"`
+				Users   []interface{} `json:"users"`
+				Ratings []interface{} `json:"ratings"`
+			} `json:"changes"`
+			Next string `json:"next"`
+		}
+		json2.Unmarshal(rsp(resp), &result)
+		require.NotEmpty(t, result.Next)
+
+		count := len(result.Changes.Messages) + len(result.Changes.Users) + len(result.Changes.Ratings)
+		assert.LessOrEqual(t, count, 5)
+
+		for _, m := range result.Changes.Messages {
+			if _, ours := want[m.ID]; ours && m.Type == "Taken" {
+				got[m.ID]++
+			}
+		}
+
+		if len(got) == len(want) || count == 0 {
+			break
+		}
+
+		url = fmt.Sprintf("/api/changes?partner=%s&limit=5&cursor=%s", partnerKey, result.Next)
+	}
+
+	// Every change appears exactly once across the pages.
+	for id := range want {
+		assert.Equal(t, 1, got[id], "message %d", id)
+	}
+}
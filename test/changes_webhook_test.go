@@ -0,0 +1,225 @@
+package test
+
+import (
+	"bytes"
+	json2 "encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/freegle/iznik-server-go/changes"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/partner"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver is a fake partner endpoint which records what it is sent.
+type webhookReceiver struct {
+	mu         sync.Mutex
+	status     int
+	bodies     [][]byte
+	signatures []string
+}
+
+func (w *webhookReceiver) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.bodies = append(w.bodies, body)
+	w.signatures = append(w.signatures, r.Header.Get(changes.SignatureHeader))
+	rw.WriteHeader(w.status)
+}
+
+func (w *webhookReceiver) changes() []changes.FeedItem {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var ret []changes.FeedItem
+	for _, b := range w.bodies {
+		var payload changes.WebhookPayload
+		json2.Unmarshal(b, &payload)
+		ret = append(ret, payload.Changes...)
+	}
+
+	return ret
+}
+
+func createTestPartner(t *testing.T, prefix string) string {
+	_, key := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
+	return key
+}
+
+func createTestWebhook(t *testing.T, key string, url string) (uint64, string) {
+	body := fmt.Sprintf(`{"url":"%s"}`, url)
+	req := httptest.NewRequest("PUT", "/api/changes/webhooks?partner="+key, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := getApp().Test(req, -1)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var result struct {
+		ID     uint64 `json:"id"`
+		Secret string `json:"secret"`
+	}
+	json2.Unmarshal(rsp(resp), &result)
+	require.NotZero(t, result.ID)
+	require.NotEmpty(t, result.Secret)
+
+	db := database.DBConn
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM partners_webhooks WHERE id = ?", result.ID)
+	})
+
+	// Start the feed an hour ago so that the test changes are included.
+	db.Exec("UPDATE partners_webhooks SET cursor_ts = DATE_SUB(NOW(), INTERVAL 1 HOUR) WHERE id = ?", result.ID)
+
+	return result.ID, result.Secret
+}
+
+func TestChangesWebhookInvalidPartner(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/changes/webhooks?partner=invalid_key_xyz", nil)
+	resp, _ := getApp().Test(req, -1)
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestChangesWebhookRejectsInsecureURL(t *testing.T) {
+	key := createTestPartner(t, uniquePrefix("webhook_url"))
+
+	req := httptest.NewRequest("PUT", "/api/changes/webhooks?partner="+key, strings.NewReader(`{"url":"http://partner.example.com/hook"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := getApp().Test(req, -1)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestChangesWebhookDelivery(t *testing.T) {
+	prefix := uniquePrefix("webhook_deliver")
+	db := database.DBConn
+	key := createTestPartner(t, prefix)
+
+	receiver := &webhookReceiver{status: 200}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	id, secret := createTestWebhook(t, key, server.URL)
+
+	groupID := CreateTestGroup(t, prefix)
+	userID := CreateTestUser(t, prefix, "User")
+	msgID := CreateTestMessage(t, userID, groupID, "OFFER: "+prefix+" item", 55.95, -3.19)
+	db.Exec("INSERT INTO messages_outcomes (msgid, outcome, timestamp) VALUES (?, 'Taken', DATE_SUB(NOW(), INTERVAL 30 SECOND))", msgID)
+	defer db.Exec("DELETE FROM messages_outcomes WHERE msgid = ?", msgID)
+
+	changes.DeliverWebhooks(db)
+
+	found := false
+	for _, c := range receiver.changes() {
+		if c.ID == msgID && c.Type == "Taken" {
+			found = true
+		}
+	}
+	assert.True(t, found, "Expected outcome to be delivered")
+
+	// Deliveries are signed with the secret.
+	receiver.mu.Lock()
+	require.NotEmpty(t, receiver.bodies)
+	sig := receiver.signatures[0]
+	body := receiver.bodies[0]
+	receiver.mu.Unlock()
+
+	var ts int64
+	fmt.Sscanf(sig, "t=%d,", &ts)
+	assert.Equal(t, changes.Sign(secret, ts, body), sig)
+
+	// A second pass sends nothing new.
+	before := len(receiver.changes())
+	changes.DeliverWebhooks(db)
+	for _, c := range receiver.changes()[before:] {
+		assert.NotEqual(t, msgID, c.ID, "Change delivered twice")
+	}
+
+	// The webhook is listed without its secret.
+	req := httptest.NewRequest("GET", "/api/changes/webhooks?partner="+key, nil)
+	resp, _ := getApp().Test(req, -1)
+	assert.Equal(t, 200, resp.StatusCode)
+	listed := rsp(resp)
+	assert.Contains(t, string(listed), fmt.Sprintf(`"id":%d`, id))
+	assert.NotContains(t, string(listed), secret)
+}
+
+func TestChangesWebhookRetryAndDeadLetter(t *testing.T) {
+	prefix := uniquePrefix("webhook_fail")
+	db := database.DBConn
+	key := createTestPartner(t, prefix)
+
+	receiver := &webhookReceiver{status: 500}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	id, _ := createTestWebhook(t, key, server.URL)
+
+	groupID := CreateTestGroup(t, prefix)
+	userID := CreateTestUser(t, prefix, "User")
+	msgID := CreateTestMessage(t, userID, groupID, "OFFER: "+prefix+" item", 55.95, -3.19)
+	db.Exec("INSERT INTO messages_outcomes (msgid, outcome, timestamp) VALUES (?, 'Taken', DATE_SUB(NOW(), INTERVAL 30 SECOND))", msgID)
+	defer db.Exec("DELETE FROM messages_outcomes WHERE msgid = ?", msgID)
+
+	changes.DeliverWebhooks(db)
+
+	var w changes.Webhook
+	db.Raw("SELECT * FROM partners_webhooks WHERE id = ?", id).Scan(&w)
+	assert.Equal(t, 1, w.Attempts)
+	assert.Equal(t, changes.WebhookActive, w.Status)
+	assert.NotNil(t, w.Nextattempt)
+	assert.NotNil(t, w.Lasterror)
+
+	// Not retried before the backoff has elapsed.
+	sent := len(receiver.changes())
+	changes.DeliverWebhooks(db)
+	assert.Equal(t, sent, len(receiver.changes()))
+
+	// Once we reach the limit the webhook is dead-lettered.
+	db.Exec("UPDATE partners_webhooks SET attempts = 9, nextattempt = NULL WHERE id = ?", id)
+	changes.DeliverWebhooks(db)
+	db.Raw("SELECT * FROM partners_webhooks WHERE id = ?", id).Scan(&w)
+	assert.Equal(t, changes.WebhookDeadLetter, w.Status)
+
+	// Resuming redelivers from the same position once the partner is back.
+	receiver.mu.Lock()
+	receiver.status = 200
+	receiver.mu.Unlock()
+
+	body, _ := json2.Marshal(map[string]interface{}{"id": id, "action": "Resume"})
+	req := httptest.NewRequest("POST", "/api/changes/webhooks?partner="+key, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := getApp().Test(req, -1)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	changes.DeliverWebhooks(db)
+	db.Raw("SELECT * FROM partners_webhooks WHERE id = ?", id).Scan(&w)
+	assert.Equal(t, changes.WebhookActive, w.Status)
+	assert.Equal(t, 0, w.Attempts)
+	assert.NotNil(t, w.Lastdelivered)
+}
+
+func TestChangesWebhookDeleteOtherPartner(t *testing.T) {
+	prefix := uniquePrefix("webhook_delete")
+	key := createTestPartner(t, prefix)
+	otherKey := createTestPartner(t, prefix+"_other")
+
+	id, _ := createTestWebhook(t, key, "https://partner.example.com/hook")
+
+	// Another partner can't delete it.
+	req := httptest.NewRequest("DELETE", fmt.Sprintf("/api/changes/webhooks/%d?partner=%s", id, otherKey), nil)
+	resp, _ := getApp().Test(req, -1)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/api/changes/webhooks/%d?partner=%s", id, key), nil)
+	resp, _ = getApp().Test(req, -1)
+	assert.Equal(t, 200, resp.StatusCode)
+}
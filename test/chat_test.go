@@ -2210,8 +2210,8 @@ func TestModReplyToUser2ModChat(t *testing.T) {
 
 	// Send a message as the mod to the User2Mod chat
 	payload := `{"message":"Mod reply to user"}`
-	req := httptest.NewRequest("POST", fmt.Sprintf("/apiv2/chat/%d/message?jwt=%s", chatID, token),
-		bytes.NewBufferString(payload))
+	req := withJWT(httptest.NewRequest("POST", fmt.Sprintf("/apiv2/chat/%d/message", chatID),
+		bytes.NewBufferString(payload)), token)
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ := getApp().Test(req)
 
@@ -2238,8 +2238,8 @@ func TestModReplyToUser2ModChatNotMod(t *testing.T) {
 	_, otherToken := CreateTestSession(t, otherID)
 
 	payload := `{"message":"I am not a mod"}`
-	req := httptest.NewRequest("POST", fmt.Sprintf("/apiv2/chat/%d/message?jwt=%s", chatID, otherToken),
-		bytes.NewBufferString(payload))
+	req := withJWT(httptest.NewRequest("POST", fmt.Sprintf("/apiv2/chat/%d/message", chatID),
+		bytes.NewBufferString(payload)), otherToken)
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ := getApp().Test(req)
 
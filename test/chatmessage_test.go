@@ -60,17 +60,16 @@ func postChatmessages(t *testing.T, path string, body map[string]interface{}, to
 	t.Helper()
 	bodyBytes, _ := json.Marshal(body)
 
-	url := path
-	if token != "" {
-		url += "?jwt=" + token
-	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(bodyBytes))
+	req, err := http.NewRequest("POST", path, bytes.NewBuffer(bodyBytes))
 	if err != nil {
 		t.Fatalf("Failed to create request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
+	if token != "" {
+		withJWT(req, token)
+	}
+
 	resp, err := getApp().Test(req, -1)
 	if err != nil {
 		t.Fatalf("Failed to execute request: %v", err)
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"bytes"
+	json2 "encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/freegle/iznik-server-go/realtime"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitForEvent returns the first event of the given type on the subscription, or nil after a short wait.
+func waitForEvent(sub *realtime.Subscription, evType string) *realtime.Event {
+	timeout := time.After(2 * time.Second)
+
+	for {
+		select {
+		case ev := <-sub.C:
+			if ev.Type == evType {
+				return &ev
+			}
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+func postChatRoomAction(t *testing.T, token string, payload map[string]interface{}) {
+	t.Helper()
+	s, _ := json2.Marshal(payload)
+	request := httptest.NewRequest("POST", "/api/chatrooms?jwt="+token, bytes.NewBuffer(s))
+	request.Header.Set("Content-Type", "application/json")
+	resp, _ := getApp().Test(request)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+}
+
+func TestChatStreamNotLoggedIn(t *testing.T) {
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/chat/stream", nil))
+	assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestChatStreamTyping(t *testing.T) {
+	prefix := uniquePrefix("streamtyping")
+	user1ID := CreateTestUser(t, prefix+"_u1", "User")
+	user2ID := CreateTestUser(t, prefix+"_u2", "User")
+	chatid := CreateTestChatRoom(t, user1ID, &user2ID, nil, "User2User")
+	_, token := CreateTestSession(t, user1ID)
+
+	other := realtime.Default().Subscribe(user2ID)
+	defer other.Close()
+	me := realtime.Default().Subscribe(user1ID)
+	defer me.Close()
+
+	postChatRoomAction(t, token, map[string]interface{}{"id": chatid, "action": "Typing"})
+
+	ev := waitForEvent(other, realtime.EventTyping)
+	assert.NotNil(t, ev)
+	if ev != nil {
+		assert.Equal(t, chatid, ev.Chatid)
+		assert.Equal(t, user1ID, ev.Userid)
+	}
+
+	// We aren't told about our own typing.
+	assert.Nil(t, waitForEvent(me, realtime.EventTyping))
+}
+
+func TestChatStreamNudge(t *testing.T) {
+	prefix := uniquePrefix("streamnudge")
+	user1ID := CreateTestUser(t, prefix+"_u1", "User")
+	user2ID := CreateTestUser(t, prefix+"_u2", "User")
+	chatid := CreateTestChatRoom(t, user1ID, &user2ID, nil, "User2User")
+	_, token := CreateTestSession(t, user1ID)
+
+	other := realtime.Default().Subscribe(user2ID)
+	defer other.Close()
+
+	postChatRoomAction(t, token, map[string]interface{}{"id": chatid, "action": "Nudge"})
+
+	ev := waitForEvent(other, realtime.EventNudge)
+	assert.NotNil(t, ev)
+	if ev != nil {
+		assert.Equal(t, chatid, ev.Chatid)
+		assert.NotNil(t, ev.Data)
+	}
+}
+
+func TestChatStreamReadReceipt(t *testing.T) {
+	prefix := uniquePrefix("streamread")
+	user1ID := CreateTestUser(t, prefix+"_u1", "User")
+	user2ID := CreateTestUser(t, prefix+"_u2", "User")
+	chatid := CreateTestChatRoom(t, user1ID, &user2ID, nil, "User2User")
+	msgid := CreateTestChatMessage(t, chatid, user2ID, "Read me")
+	_, token := CreateTestSession(t, user1ID)
+
+	sender := realtime.Default().Subscribe(user2ID)
+	defer sender.Close()
+
+	postChatRoomAction(t, token, map[string]interface{}{"id": chatid, "lastmsgseen": msgid})
+
+	ev := waitForEvent(sender, realtime.EventRead)
+	assert.NotNil(t, ev)
+	if ev != nil {
+		data, _ := json2.Marshal(ev.Data)
+		assert.Contains(t, string(data), fmt.Sprint(msgid))
+	}
+}
+
+func TestChatStreamOwnMessage(t *testing.T) {
+	prefix := uniquePrefix("streamown")
+	user1ID := CreateTestUser(t, prefix+"_u1", "User")
+	user2ID := CreateTestUser(t, prefix+"_u2", "User")
+	chatid := CreateTestChatRoom(t, user1ID, &user2ID, nil, "User2User")
+	_, token := CreateTestSession(t, user1ID)
+
+	me := realtime.Default().Subscribe(user1ID)
+	defer me.Close()
+	other := realtime.Default().Subscribe(user2ID)
+	defer other.Close()
+
+	s, _ := json2.Marshal(map[string]interface{}{"message": "Hello " + prefix})
+	request := httptest.NewRequest("POST", fmt.Sprintf("/api/chat/%d/message?jwt=%s", chatid, token), bytes.NewBuffer(s))
+	request.Header.Set("Content-Type", "application/json")
+	resp, _ := getApp().Test(request)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	// Our other devices see it straight away.
+	ev := waitForEvent(me, realtime.EventChatMessage)
+	assert.NotNil(t, ev)
+
+	// The other user doesn't until it has been processed.
+	assert.Nil(t, waitForEvent(other, realtime.EventChatMessage))
+}
@@ -72,7 +72,7 @@ func TestCommunityEvent_V2Path(t *testing.T) {
 	prefix := uniquePrefix("eventv2")
 	_, token := CreateFullTestUser(t, prefix)
 
-	resp, _ := getApp().Test(httptest.NewRequest("GET", "/apiv2/communityevent?jwt="+token, nil))
+	resp, _ := getApp().Test(withJWT(httptest.NewRequest("GET", "/apiv2/communityevent", nil), token))
 	assert.Equal(t, 200, resp.StatusCode)
 }
 
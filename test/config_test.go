@@ -5,6 +5,7 @@ import (
 	json2 "encoding/json"
 	"fmt"
 	"github.com/freegle/iznik-server-go/config"
+	"github.com/freegle/iznik-server-go/contentscan"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/stretchr/testify/assert"
 	"net/http/httptest"
@@ -389,3 +390,36 @@ func TestSpamKeywords_IntegrationWhitelist(t *testing.T) {
 	db := database.DBConn
 	db.Delete(&config.SpamKeyword{}, keyword.ID)
 }
+
+func TestWorryWords_ScannerReloads(t *testing.T) {
+	prefix := uniquePrefix("worryreload")
+	supportUserID := CreateTestUser(t, prefix, "Support")
+	_, token := CreateTestSession(t, supportUserID)
+	db := database.DBConn
+
+	keyword := "reloadtest" + fmt.Sprint(supportUserID)
+	scan := func() int {
+		return len(contentscan.WorryWords(db).Matcher(nil).Match("OFFER: "+keyword, ""))
+	}
+
+	assert.Equal(t, 0, scan())
+
+	body, _ := json2.Marshal(config.CreateWorryWordRequest{Keyword: keyword, Type: "Review"})
+	req := httptest.NewRequest("POST", "/api/config/admin/worry_words?jwt="+token, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := getApp().Test(req)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var word config.WorryWord
+	json2.Unmarshal(rsp(resp), &word)
+	assert.Equal(t, 1, scan())
+
+	// Changes made directly in the database are picked up too.
+	db.Exec("UPDATE worrywords SET keyword = ? WHERE id = ?", keyword+"x", word.ID)
+	assert.Equal(t, 0, scan())
+	db.Exec("UPDATE worrywords SET keyword = ? WHERE id = ?", keyword, word.ID)
+
+	resp, _ = getApp().Test(httptest.NewRequest("DELETE", fmt.Sprintf("/api/config/admin/worry_words/%d?jwt=%s", word.ID, token), nil))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 0, scan())
+}
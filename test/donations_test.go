@@ -8,8 +8,10 @@ import (
 	"testing"
 
 	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/donations"
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetDonations(t *testing.T) {
@@ -328,3 +330,76 @@ func TestAddDonationSkipsGiftAidNotifWhenExisting(t *testing.T) {
 	db.Raw("SELECT COUNT(*) FROM users_notifications WHERE touser = ? AND type = 'GiftAid'", targetUserID).Scan(&notifCount)
 	assert.Equal(t, int64(0), notifCount)
 }
+
+func TestDonationStatement(t *testing.T) {
+	prefix := uniquePrefix("donstatement")
+	db := database.DBConn
+
+	userID, token := CreateFullTestUser(t, prefix)
+	_, otherToken := CreateFullTestUser(t, prefix+"_other")
+
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/donations/statement", nil))
+	assert.Equal(t, 401, resp.StatusCode)
+
+	// Two donations in the 2024/25 tax year, one in 2025/26, and a refund of part of one which was claimed on.
+	insert := func(tx string, amount float64, when string) uint64 {
+		db.Exec("INSERT INTO users_donations (userid, Payer, PayerDisplayName, timestamp, TransactionID, GrossAmount, type, source) VALUES (?, 'test', 'test', ?, ?, ?, 'Stripe', 'Stripe')",
+			userID, when, tx, amount)
+
+		var id uint64
+		db.Raw("SELECT id FROM users_donations WHERE TransactionID = ?", tx).Scan(&id)
+		require.NotZero(t, id)
+		return id
+	}
+
+	claimedID := insert(prefix+"_1", 20, "2024-06-01 10:00:00")
+	insert(prefix+"_2", 5, "2025-04-05 10:00:00")
+	insert(prefix+"_3", 10, "2025-04-06 10:00:00")
+
+	db.Exec("UPDATE users_donations SET giftaidclaimed = '2024-07-01' WHERE id = ?", claimedID)
+	db.Exec("INSERT INTO users_donations (userid, Payer, PayerDisplayName, timestamp, TransactionID, GrossAmount, type, source, adjusts, adjustment) VALUES (?, 'test', 'test', '2025-05-01 10:00:00', ?, -8, 'Stripe', 'Stripe', ?, 'Refund')",
+		userID, prefix+"_1_refund", claimedID)
+
+	defer db.Exec("DELETE FROM users_donations WHERE TransactionID LIKE ?", prefix+"%")
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/donations/statement?jwt="+token, nil))
+	require.Equal(t, 200, resp.StatusCode)
+
+	var statement donations.DonationStatement
+	json2.Unmarshal(rsp(resp), &statement)
+	assert.Len(t, statement.Donations, 4)
+	require.Len(t, statement.Years, 2)
+
+	// The refund counts against the year of the donation it refunds.
+	assert.Equal(t, "2024/25", statement.Years[0].Year)
+	assert.Equal(t, 17.0, statement.Years[0].Donated)
+	assert.Equal(t, 3.0, statement.Years[0].Giftaid)
+	assert.Equal(t, "2025/26", statement.Years[1].Year)
+	assert.Equal(t, 10.0, statement.Years[1].Donated)
+	assert.Equal(t, 0.0, statement.Years[1].Giftaid)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/donations/statement?year=2025&jwt="+token, nil))
+	require.Equal(t, 200, resp.StatusCode)
+	json2.Unmarshal(rsp(resp), &statement)
+	assert.Len(t, statement.Donations, 1)
+	assert.Equal(t, "2025/26", statement.Year)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/donations/statement?year=soon&jwt="+token, nil))
+	assert.Equal(t, 400, resp.StatusCode)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/donations/statement?format=csv&year=2024&jwt="+token, nil))
+	require.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Disposition"), "freegle-donations-2024-25.csv")
+	assert.Contains(t, string(rsp(resp)), "2024-06-01,20.00,Stripe,2024/25,2024-07-01")
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/donations/statement?format=pdf&jwt="+token, nil))
+	require.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "application/pdf", resp.Header.Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(string(rsp(resp)), "%PDF-"))
+
+	// Other people can't see them.
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/donations/statement?jwt="+otherToken, nil))
+	require.Equal(t, 200, resp.StatusCode)
+	json2.Unmarshal(rsp(resp), &statement)
+	assert.Empty(t, statement.Donations)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/donations"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetGiftAid_NotLoggedIn(t *testing.T) {
@@ -17,9 +18,10 @@ func TestGetGiftAid_NotLoggedIn(t *testing.T) {
 	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/giftaid", nil))
 	assert.Equal(t, 401, resp.StatusCode)
 
-	var result map[string]string
+	var result map[string]interface{}
 	json2.Unmarshal(rsp(resp), &result)
-	assert.Equal(t, "Not logged in", result["error"])
+	assert.Equal(t, "Not logged in", result["message"])
+	assert.Equal(t, "not_logged_in", result["code"])
 }
 
 func TestGetGiftAid_NoRecord(t *testing.T) {
@@ -36,9 +38,10 @@ func TestGetGiftAid_NoRecord(t *testing.T) {
 
 	assert.Equal(t, 404, resp.StatusCode)
 
-	var result map[string]string
+	var result map[string]interface{}
 	json2.Unmarshal(rsp(resp), &result)
-	assert.Equal(t, "No Gift Aid declaration found", result["error"])
+	assert.Equal(t, "No Gift Aid declaration found", result["message"])
+	assert.Equal(t, "not_found", result["code"])
 }
 
 func TestGetGiftAid_Success(t *testing.T) {
@@ -124,9 +127,10 @@ func TestGetGiftAid_DeletedRecordNotReturned(t *testing.T) {
 
 	assert.Equal(t, 404, resp.StatusCode)
 
-	var result map[string]string
+	var result map[string]interface{}
 	json2.Unmarshal(rsp(resp), &result)
-	assert.Equal(t, "No Gift Aid declaration found", result["error"])
+	assert.Equal(t, "No Gift Aid declaration found", result["message"])
+	assert.Equal(t, "not_found", result["code"])
 
 	// Cleanup
 	db.Exec("DELETE FROM giftaid WHERE userid = ?", userID)
@@ -507,3 +511,151 @@ func TestSearchGiftAid(t *testing.T) {
 	assert.True(t, ok)
 	assert.Greater(t, len(giftaids), 0)
 }
+
+func TestGiftAidClaim(t *testing.T) {
+	prefix := uniquePrefix("giftaidclaim")
+	db := database.DBConn
+
+	adminID := CreateTestUser(t, prefix+"_admin", "Admin")
+	_, adminToken := CreateTestSession(t, adminID)
+	_, userToken := CreateFullTestUser(t, prefix+"_user")
+
+	donorID := CreateTestUser(t, prefix+"_donor", "User")
+	db.Exec(`INSERT INTO giftaid (userid, period, fullname, homeaddress, postcode, housenameornumber, reviewed, timestamp)
+		VALUES (?, 'Past4YearsAndFuture', 'Test Donor', '12 Test Street', 'ab1 2cd', '12', NOW(), DATE_SUB(NOW(), INTERVAL 1 DAY))`, donorID)
+
+	// An unreviewed declaration isn't claimed on.
+	pendingID := CreateTestUser(t, prefix+"_pending", "User")
+	db.Exec(`INSERT INTO giftaid (userid, period, fullname, homeaddress, postcode, housenameornumber)
+		VALUES (?, 'Past4YearsAndFuture', 'Test Pending', '1 Test Street', 'AB1 2CD', '1')`, pendingID)
+
+	// Nor is one without a valid postcode, but it's reported.
+	badID := CreateTestUser(t, prefix+"_bad", "User")
+	db.Exec(`INSERT INTO giftaid (userid, period, fullname, homeaddress, postcode, housenameornumber, reviewed)
+		VALUES (?, 'Past4YearsAndFuture', 'Test Bad', '1 Test Street', 'Nowhere', '1', NOW())`, badID)
+
+	donate := func(userID uint64, tx string, amount float64, source string) uint64 {
+		db.Exec("INSERT INTO users_donations (userid, Payer, PayerDisplayName, timestamp, TransactionID, GrossAmount, type, source) VALUES (?, 'test', 'test', NOW(), ?, ?, 'Stripe', ?)",
+			userID, tx, amount, source)
+
+		var id uint64
+		db.Raw("SELECT id FROM users_donations WHERE TransactionID = ?", tx).Scan(&id)
+		require.NotZero(t, id)
+		return id
+	}
+
+	donationID := donate(donorID, prefix+"_1", 20, "Stripe")
+	ppgfID := donate(donorID, prefix+"_2", 5, "PayPalGivingFund")
+	donate(pendingID, prefix+"_3", 5, "Stripe")
+	donate(badID, prefix+"_4", 5, "Stripe")
+
+	// A partial refund is netted off.
+	db.Exec("INSERT INTO users_donations (userid, Payer, PayerDisplayName, timestamp, TransactionID, GrossAmount, type, source, adjusts, adjustment) VALUES (?, 'test', 'test', NOW(), ?, -4, 'Stripe', 'Stripe', ?, 'Refund')",
+		donorID, prefix+"_1_refund", donationID)
+
+	// A lost dispute leaves nothing to claim on.
+	disputedID := donate(donorID, prefix+"_5", 10, "Stripe")
+	db.Exec("INSERT INTO users_donations (userid, Payer, PayerDisplayName, timestamp, TransactionID, GrossAmount, type, source, adjusts, adjustment) VALUES (?, 'test', 'test', NOW(), ?, -10, 'Stripe', 'Stripe', ?, 'Dispute')",
+		donorID, prefix+"_5_dispute", disputedID)
+
+	defer func() {
+		db.Exec("DELETE FROM users_donations WHERE TransactionID LIKE ?", prefix+"%")
+		db.Exec("DELETE FROM giftaid WHERE userid IN (?, ?, ?)", donorID, pendingID, badID)
+	}()
+
+	find := func(claim donations.GiftAidClaim) *donations.GiftAidClaimDonation {
+		for i, d := range claim.Donations {
+			if d.Donationid == ppgfID {
+				t.Errorf("PayPal Giving Fund donation shouldn't be claimed")
+			}
+			if d.Donationid == disputedID {
+				t.Errorf("Disputed donation shouldn't be claimed")
+			}
+			if d.Userid == pendingID || d.Userid == badID {
+				t.Errorf("Donation %d shouldn't be claimed", d.Donationid)
+			}
+			if d.Donationid == donationID {
+				return &claim.Donations[i]
+			}
+		}
+		return nil
+	}
+
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/giftaid/claim?jwt="+userToken, nil))
+	assert.Equal(t, 403, resp.StatusCode)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/giftaid/claim?jwt="+adminToken, nil))
+	require.Equal(t, 200, resp.StatusCode)
+
+	var preview donations.GiftAidClaim
+	json2.Unmarshal(rsp(resp), &preview)
+
+	d := find(preview)
+	require.NotNil(t, d)
+	assert.Equal(t, 16.0, d.Amount)
+	assert.Equal(t, "Test", d.Firstname)
+	assert.Equal(t, "Donor", d.Lastname)
+	assert.Equal(t, "AB1 2CD", d.Postcode)
+
+	found := false
+	for _, p := range preview.Problems {
+		if p.Userid == badID {
+			found = true
+			assert.Equal(t, 1, p.Donations)
+		}
+	}
+	assert.True(t, found, "Invalid postcode should be reported")
+
+	// Previewing doesn't claim anything.
+	var claimed *string
+	db.Raw("SELECT giftaidclaimed FROM users_donations WHERE id = ?", donationID).Scan(&claimed)
+	assert.Nil(t, claimed)
+
+	resp, _ = getApp().Test(httptest.NewRequest("POST", "/api/giftaid/claim?jwt="+adminToken, nil))
+	require.Equal(t, 200, resp.StatusCode)
+
+	var claim donations.GiftAidClaim
+	json2.Unmarshal(rsp(resp), &claim)
+	assert.NotZero(t, claim.ID)
+	require.NotNil(t, find(claim))
+	defer db.Exec("DELETE FROM giftaid_claims WHERE id = ?", claim.ID)
+
+	var claimID uint64
+	db.Raw("SELECT giftaidclaimid FROM users_donations WHERE id = ?", donationID).Scan(&claimID)
+	assert.Equal(t, claim.ID, claimID)
+
+	db.Raw("SELECT giftaidclaimid FROM users_donations WHERE id = ?", disputedID).Scan(&claimID)
+	assert.Zero(t, claimID)
+
+	// So it's not in the next one.
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/giftaid/claim?jwt="+adminToken, nil))
+	require.Equal(t, 200, resp.StatusCode)
+	json2.Unmarshal(rsp(resp), &preview)
+	assert.Nil(t, find(preview))
+
+	// A refund after claiming is an adjustment in the next one.
+	db.Exec("INSERT INTO users_donations (userid, Payer, PayerDisplayName, timestamp, TransactionID, GrossAmount, type, source, adjusts, adjustment) VALUES (?, 'test', 'test', NOW(), ?, -16, 'Stripe', 'Stripe', ?, 'Refund')",
+		donorID, prefix+"_1_refund2", donationID)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/giftaid/claim?jwt="+adminToken, nil))
+	require.Equal(t, 200, resp.StatusCode)
+	json2.Unmarshal(rsp(resp), &preview)
+
+	adjusted := 0
+	for _, a := range preview.Adjustments {
+		if a.Adjusts == donationID {
+			adjusted++
+			assert.Equal(t, -16.0, a.Amount)
+		}
+	}
+	assert.Equal(t, 1, adjusted, "Only the refund since the claim is an adjustment")
+
+	// The claim can be downloaded again as HMRC's spreadsheet.
+	resp, _ = getApp().Test(httptest.NewRequest("GET", fmt.Sprintf("/api/giftaid/claim/%d?format=csv&jwt=%s", claim.ID, adminToken), nil))
+	require.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/csv")
+	assert.Contains(t, string(rsp(resp)), "Test,Donor,12,AB1 2CD")
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/giftaid/claim/0?jwt="+adminToken, nil))
+	assert.Equal(t, 404, resp.StatusCode)
+}
@@ -0,0 +1,189 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	json2 "encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/idempotency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func idempotentPost(url string, key string, body string) (int, string, string) {
+	req := httptest.NewRequest("POST", url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	if key != "" {
+		req.Header.Set(idempotency.Header, key)
+	}
+
+	resp, _ := getApp().Test(req)
+
+	return resp.StatusCode, string(rsp(resp)), resp.Header.Get(idempotency.ReplayedHeader)
+}
+
+// idemFingerprint is how the middleware identifies a request.
+func idemFingerprint(method string, path string, body string) string {
+	sum := sha256.Sum256([]byte(method + " " + path + "\n" + body))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestIdempotencyReplaysFirstResponse(t *testing.T) {
+	prefix := uniquePrefix("idem_replay")
+	db := database.DBConn
+
+	userID := CreateTestUser(t, prefix, "User")
+	_, token := CreateTestSession(t, userID)
+	nfID := CreateTestNewsfeed(t, userID, 52.2, -0.1, "Thread head "+prefix)
+
+	url := "/api/newsfeed?jwt=" + token
+	key := prefix + "_key"
+	body := fmt.Sprintf(`{"message":"Reply %s","replyto":%d}`, prefix, nfID)
+
+	status, first, replayed := idempotentPost(url, key, body)
+	require.Equal(t, 200, status)
+	assert.Empty(t, replayed)
+
+	status, second, replayed := idempotentPost(url, key, body)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "true", replayed)
+	assert.Equal(t, first, second)
+
+	var count int64
+	db.Raw("SELECT COUNT(*) FROM newsfeed WHERE userid = ? AND replyto = ? AND message = ?", userID, nfID, "Reply "+prefix).Scan(&count)
+	assert.Equal(t, int64(1), count)
+
+	// The same key with a different body is a mistake by the client.
+	status, _, _ = idempotentPost(url, key, fmt.Sprintf(`{"message":"Other %s","replyto":%d}`, prefix, nfID))
+	assert.Equal(t, 422, status)
+
+	// Without a key, repeats are handled as normal.
+	idempotentPost(url, "", body)
+	idempotentPost(url, "", body)
+	db.Raw("SELECT COUNT(*) FROM newsfeed WHERE userid = ? AND replyto = ? AND message = ?", userID, nfID, "Reply "+prefix).Scan(&count)
+	assert.Equal(t, int64(3), count)
+}
+
+func TestIdempotencyKeysBelongToUser(t *testing.T) {
+	prefix := uniquePrefix("idem_scope")
+	db := database.DBConn
+
+	user1 := CreateTestUser(t, prefix+"_1", "User")
+	user2 := CreateTestUser(t, prefix+"_2", "User")
+	_, token1 := CreateTestSession(t, user1)
+	_, token2 := CreateTestSession(t, user2)
+	nfID := CreateTestNewsfeed(t, user1, 52.2, -0.1, "Thread head "+prefix)
+
+	key := prefix + "_key"
+	body := fmt.Sprintf(`{"message":"Reply %s","replyto":%d}`, prefix, nfID)
+
+	status, _, _ := idempotentPost("/api/newsfeed?jwt="+token1, key, body)
+	require.Equal(t, 200, status)
+
+	// Someone else using the same key gets their own response.
+	status, _, replayed := idempotentPost("/api/newsfeed?jwt="+token2, key, body)
+	assert.Equal(t, 200, status)
+	assert.Empty(t, replayed)
+
+	var count int64
+	db.Raw("SELECT COUNT(*) FROM newsfeed WHERE replyto = ? AND message = ?", nfID, "Reply "+prefix).Scan(&count)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestIdempotencyFailuresNotStored(t *testing.T) {
+	prefix := uniquePrefix("idem_fail")
+	db := database.DBConn
+
+	userID := CreateTestUser(t, prefix, "User")
+	_, token := CreateTestSession(t, userID)
+
+	key := prefix + "_key"
+
+	// Not logged in, so this fails, and the key isn't kept.
+	status, _, _ := idempotentPost("/api/newsfeed", key, `{"message":"Hello"}`)
+	assert.NotEqual(t, 200, status)
+
+	var count int64
+	db.Raw("SELECT COUNT(*) FROM idempotency_keys WHERE idemkey = ?", key).Scan(&count)
+	assert.Equal(t, int64(0), count)
+
+	nfID := CreateTestNewsfeed(t, userID, 52.2, -0.1, "Thread head "+prefix)
+	status, _, replayed := idempotentPost("/api/newsfeed?jwt="+token, key, fmt.Sprintf(`{"message":"Reply %s","replyto":%d}`, prefix, nfID))
+	assert.Equal(t, 200, status)
+	assert.Empty(t, replayed)
+}
+
+func TestIdempotencyStaleKeyFreed(t *testing.T) {
+	prefix := uniquePrefix("idem_stale")
+	db := database.DBConn
+
+	userID := CreateTestUser(t, prefix, "User")
+	_, token := CreateTestSession(t, userID)
+	nfID := CreateTestNewsfeed(t, userID, 52.2, -0.1, "Thread head "+prefix)
+
+	url := "/api/newsfeed?jwt=" + token
+	key := prefix + "_key"
+	body := fmt.Sprintf(`{"message":"Reply %s","replyto":%d}`, prefix, nfID)
+
+	// The first request with this key was never finished, e.g. because the server died.
+	db.Exec("INSERT INTO idempotency_keys (scope, idemkey, method, path, fingerprint, created, expires) "+
+		"VALUES (?, ?, 'POST', '/api/newsfeed', 'x', DATE_SUB(NOW(), INTERVAL 10 MINUTE), DATE_ADD(NOW(), INTERVAL 1 DAY))",
+		fmt.Sprintf("user:%d", userID), key)
+
+	status, _, replayed := idempotentPost(url, key, body)
+	assert.Equal(t, 200, status)
+	assert.Empty(t, replayed)
+
+	// While a request is recent, it still holds the key.
+	key2 := prefix + "_key2"
+	db.Exec("INSERT INTO idempotency_keys (scope, idemkey, method, path, fingerprint, created, expires) "+
+		"VALUES (?, ?, 'POST', '/api/newsfeed', ?, NOW(), DATE_ADD(NOW(), INTERVAL 1 DAY))",
+		fmt.Sprintf("user:%d", userID), key2, idemFingerprint("POST", "/api/newsfeed", body))
+
+	status, _, _ = idempotentPost(url, key2, body)
+	assert.Equal(t, 409, status)
+}
+
+func TestIdempotencyReplaysNewUserCredentials(t *testing.T) {
+	prefix := uniquePrefix("idem_newuser")
+	db := database.DBConn
+
+	groupID := CreateTestGroup(t, prefix)
+	key := prefix + "_key"
+	body := fmt.Sprintf(`{"type":"Offer","subject":"Test offer","item":"Test item","email":"%s@test.com","groupid":%d}`, prefix, groupID)
+
+	put := func() (int, map[string]interface{}, string) {
+		req := httptest.NewRequest("PUT", "/api/message", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotency.Header, key)
+		resp, _ := getApp().Test(req)
+
+		var result map[string]interface{}
+		json2.Unmarshal(rsp(resp), &result)
+
+		return resp.StatusCode, result, resp.Header.Get(idempotency.ReplayedHeader)
+	}
+
+	// This creates a user and logs them in.
+	status, first, _ := put()
+	require.Equal(t, 200, status)
+	require.NotEmpty(t, first["jwt"])
+
+	// A client which lost that response can still get into the account.
+	status, second, replayed := put()
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "true", replayed)
+	assert.Equal(t, first["jwt"], second["jwt"])
+	assert.Equal(t, first["persistent"], second["persistent"])
+
+	// But the credentials aren't readable in the table.
+	var stored []byte
+	db.Raw("SELECT response FROM idempotency_keys WHERE idemkey = ?", key).Scan(&stored)
+	assert.NotContains(t, string(stored), first["jwt"].(string))
+}
@@ -2,37 +2,31 @@ package test
 
 import (
 	"fmt"
-	"net/http"
 	"os"
 	"testing"
 
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/partner"
 	"github.com/freegle/iznik-server-go/router"
 	"github.com/freegle/iznik-server-go/user"
 	"github.com/gofiber/fiber/v2"
 )
 
-// TestApp wraps fiber.App to override the default Test timeout from 1s to 30s.
-type TestApp struct {
-	*fiber.App
-}
-
-// Test shadows fiber.App.Test with a 30-second default timeout instead of 1s.
-// Fiber's default 1s is too tight for CI environments under load.
-func (a *TestApp) Test(req *http.Request, msTimeout ...int) (*http.Response, error) {
-	if len(msTimeout) == 0 {
-		msTimeout = []int{30000}
-	}
-	return a.App.Test(req, msTimeout...)
-}
-
-var app *TestApp
-
 func init() {
 	// Set environment variables needed for tests
 	os.Setenv("LOVEJUNK_PARTNER_KEY", "testkey123")
 
-	app = &TestApp{fiber.New()}
+	// The webhook tests deliver to servers on this machine, which production doesn't allow.
+	os.Setenv("WEBHOOK_ALLOW_LOOPBACK", "true")
+
+	// Test requests come from 0.0.0.0.  Treat that as our proxy, as TRUSTED_PROXIES does in production (see
+	// CircleCI.md), so that tests can set the client IP with X-Forwarded-For.  TestForwardedForNeedsTrustedProxy
+	// checks what happens without it.
+	auth.SetTrustedProxies([]string{"0.0.0.0"})
+
+	app = &TestApp{fiber.New(fiber.Config{ErrorHandler: apierror.Handler})}
 	app.Use(user.NewAuthMiddleware(user.Config{}))
 	database.InitDatabase()
 
@@ -109,6 +103,8 @@ func setupLocationTestData() {
 
 	// LoveJunk partner key for TestCreateChatMessageLoveJunk
 	db.Exec("INSERT IGNORE INTO partners_keys (partner, `key`) VALUES ('lovejunk', 'testkey123')")
+	db.Exec("INSERT IGNORE INTO partners_apikeys (partnerid, keyhash, prefix, scopes, created) "+
+		"SELECT id, ?, 'testkey1', ?, NOW() FROM partners_keys WHERE partner = 'lovejunk'", partner.HashKey("testkey123"), partner.ScopeChatWrite)
 }
 
 // verifyRequiredTables checks that tables created by Laravel migrations exist.
@@ -116,7 +112,7 @@ func setupLocationTestData() {
 // If missing, it means migrations haven't been run before tests.
 func verifyRequiredTables() {
 	db := database.DBConn
-	for _, table := range []string{"background_tasks", "cron_job_status"} {
+	for _, table := range []string{"background_tasks", "cron_job_status", "partners_webhooks", "login_failures", "users_lockouts", "users_totp", "users_totp_recovery", "sessions_refresh", "oauth_clients", "oauth_consents", "oauth_codes", "oauth_tokens", "partners_apikeys", "partners_audit", "mod_audit", "idempotency_keys", "stripe_events", "users_donations_subscriptions", "giftaid_claims"} {
 		var count int64
 		db.Raw("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?", table).Scan(&count)
 		if count == 0 {
@@ -145,8 +141,3 @@ func cleanupTestGroups() {
 		fmt.Printf("Cleaned up %d test groups\n", result.RowsAffected)
 	}
 }
-
-func getApp() *TestApp {
-	// We use this so that we only initialise fiber once.
-	return app
-}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/partner"
 	"github.com/freegle/iznik-server-go/log"
 	"github.com/freegle/iznik-server-go/message"
 	"github.com/freegle/iznik-server-go/queue"
@@ -1181,8 +1182,7 @@ func TestPostMessagePartnerConsent(t *testing.T) {
 
 	// Create a test partner.
 	partnerName := prefix + "_partner"
-	db.Exec("INSERT INTO partners_keys (partner, `key`) VALUES (?, ?)", partnerName, prefix+"_key")
-	defer db.Exec("DELETE FROM partners_keys WHERE partner = ?", partnerName)
+	CreateTestPartnerKey(t, prefix, partner.ScopeMessageConsent)
 
 	body := map[string]interface{}{
 		"id":      msgID,
@@ -5149,7 +5149,7 @@ func TestGetMessageItemLocationForMod(t *testing.T) {
 	defer db.Exec("DELETE FROM items WHERE id = ?", itemID)
 
 	// Fetch the message as the mod (not the owner)
-	req := httptest.NewRequest("GET", fmt.Sprintf("/apiv2/message/%d?jwt=%s", msgID, modToken), nil)
+	req := withJWT(httptest.NewRequest("GET", fmt.Sprintf("/apiv2/message/%d", msgID), nil), modToken)
 	resp, _ := getApp().Test(req)
 	assert.Equal(t, 200, resp.StatusCode)
 
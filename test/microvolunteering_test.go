@@ -17,9 +17,10 @@ func TestGetMicrovolunteering_NotLoggedIn(t *testing.T) {
 	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/microvolunteering", nil))
 	assert.Equal(t, 401, resp.StatusCode)
 
-	var result map[string]string
+	var result map[string]interface{}
 	json2.Unmarshal(rsp(resp), &result)
-	assert.Equal(t, "Not logged in", result["error"])
+	assert.Equal(t, "Not logged in", result["message"])
+	assert.Equal(t, "not_logged_in", result["code"])
 }
 
 func TestGetMicrovolunteering_NoChallenge(t *testing.T) {
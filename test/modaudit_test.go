@@ -0,0 +1,257 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/modaudit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// auditEntries returns the entries for a target, most recent first.
+func auditEntries(t *testing.T, token string, targettype string, targetid uint64) []map[string]interface{} {
+	status, result := jsonRequest("GET", fmt.Sprintf("/api/modtools/audit?targettype=%s&targetid=%d&jwt=%s", targettype, targetid, token), nil)
+	require.Equal(t, 200, status)
+
+	var entries []map[string]interface{}
+	for _, e := range result["entries"].([]interface{}) {
+		entries = append(entries, e.(map[string]interface{}))
+	}
+
+	return entries
+}
+
+func auditChange(e map[string]interface{}, column string) map[string]interface{} {
+	change, _ := e["changes"].(map[string]interface{})[column].(map[string]interface{})
+	return change
+}
+
+func TestModAuditHoldAndUndo(t *testing.T) {
+	prefix := uniquePrefix("modaudit_hold")
+	db := database.DBConn
+
+	groupID := CreateTestGroup(t, prefix)
+	posterID := CreateTestUser(t, prefix+"_poster", "User")
+	modID := CreateTestUser(t, prefix+"_mod", "User")
+	otherModID := CreateTestUser(t, prefix+"_othermod", "User")
+	CreateTestMembership(t, posterID, groupID, "Member")
+	CreateTestMembership(t, modID, groupID, "Moderator")
+	CreateTestMembership(t, otherModID, groupID, "Moderator")
+	_, modToken := CreateTestSession(t, modID)
+	_, otherModToken := CreateTestSession(t, otherModID)
+	_, posterToken := CreateTestSession(t, posterID)
+
+	msgID := createPendingMessage(t, posterID, groupID, prefix)
+
+	status, _ := jsonRequest("POST", "/api/message?jwt="+modToken, map[string]interface{}{"id": msgID, "action": "Hold"})
+	require.Equal(t, 200, status)
+
+	entries := auditEntries(t, otherModToken, modaudit.TargetMessage, msgID)
+	require.Len(t, entries, 1)
+	e := entries[0]
+	assert.Equal(t, modaudit.ActionHold, e["action"])
+	assert.Equal(t, float64(modID), e["byuser"])
+	assert.Equal(t, float64(groupID), e["groupid"])
+	assert.NotEmpty(t, e["requestid"])
+	assert.Equal(t, true, e["undoable"])
+	assert.Nil(t, auditChange(e, "heldby")["before"])
+	assert.Equal(t, fmt.Sprint(modID), auditChange(e, "heldby")["after"])
+
+	entryID := uint64(e["id"].(float64))
+	undoURL := fmt.Sprintf("/api/modtools/audit/%d/undo?jwt=", entryID)
+
+	// Members can't see or undo mod changes.
+	assert.Len(t, auditEntries(t, posterToken, modaudit.TargetMessage, msgID), 0)
+	status, _ = jsonRequest("POST", undoURL+posterToken, nil)
+	assert.Equal(t, 403, status)
+
+	// Another mod can undo it, once.
+	status, _ = jsonRequest("POST", undoURL+otherModToken, nil)
+	assert.Equal(t, 200, status)
+
+	var heldby *uint64
+	db.Raw("SELECT heldby FROM messages WHERE id = ?", msgID).Scan(&heldby)
+	assert.Nil(t, heldby)
+
+	status, _ = jsonRequest("POST", undoURL+otherModToken, nil)
+	assert.Equal(t, 409, status)
+
+	entries = auditEntries(t, modToken, modaudit.TargetMessage, msgID)
+	require.Len(t, entries, 2)
+	assert.Equal(t, modaudit.ActionUndo, entries[0]["action"])
+	assert.Equal(t, float64(entryID), entries[0]["undoof"])
+	assert.Equal(t, float64(otherModID), entries[1]["undoneby"])
+}
+
+func TestModAuditApproveCantBeUndone(t *testing.T) {
+	prefix := uniquePrefix("modaudit_approve")
+
+	groupID := CreateTestGroup(t, prefix)
+	posterID := CreateTestUser(t, prefix+"_poster", "User")
+	modID := CreateTestUser(t, prefix+"_mod", "User")
+	CreateTestMembership(t, posterID, groupID, "Member")
+	CreateTestMembership(t, modID, groupID, "Moderator")
+	_, modToken := CreateTestSession(t, modID)
+
+	msgID := createPendingMessage(t, posterID, groupID, prefix)
+
+	status, _ := jsonRequest("POST", "/api/message?jwt="+modToken, map[string]interface{}{"id": msgID, "action": "Approve"})
+	require.Equal(t, 200, status)
+
+	entries := auditEntries(t, modToken, modaudit.TargetMessage, msgID)
+	require.Len(t, entries, 1)
+	assert.Equal(t, modaudit.ActionApprove, entries[0]["action"])
+	assert.Equal(t, false, entries[0]["undoable"])
+	assert.Equal(t, "Pending", auditChange(entries[0], "messages_groups.collection")["before"])
+	assert.Equal(t, "Approved", auditChange(entries[0], "messages_groups.collection")["after"])
+
+	// The poster has been emailed, so we can't take it back.
+	status, _ = jsonRequest("POST", fmt.Sprintf("/api/modtools/audit/%d/undo?jwt=%s", uint64(entries[0]["id"].(float64)), modToken), nil)
+	assert.Equal(t, 409, status)
+}
+
+func TestModAuditMultiGroupMessage(t *testing.T) {
+	prefix := uniquePrefix("modaudit_multi")
+	db := database.DBConn
+
+	groupA := CreateTestGroup(t, prefix+"_a")
+	groupB := CreateTestGroup(t, prefix+"_b")
+	posterID := CreateTestUser(t, prefix+"_poster", "User")
+	modID := CreateTestUser(t, prefix+"_mod", "User")
+	CreateTestMembership(t, posterID, groupA, "Member")
+	CreateTestMembership(t, posterID, groupB, "Member")
+	CreateTestMembership(t, modID, groupB, "Moderator")
+	_, modToken := CreateTestSession(t, modID)
+
+	// Approved on one group, and still pending on the other.
+	msgID := createPendingMessage(t, posterID, groupB, prefix)
+	db.Exec("INSERT INTO messages_groups (msgid, groupid, arrival, collection, autoreposts) VALUES (?, ?, NOW(), 'Approved', 0)", msgID, groupA)
+
+	status, _ := jsonRequest("POST", "/api/message?jwt="+modToken, map[string]interface{}{"id": msgID, "action": "Approve", "groupid": groupB})
+	require.Equal(t, 200, status)
+
+	// The change recorded is to the group it was approved on, not whichever row came first.
+	entries := auditEntries(t, modToken, modaudit.TargetMessage, msgID)
+	require.Len(t, entries, 1)
+	assert.Equal(t, float64(groupB), entries[0]["groupid"])
+	assert.Equal(t, "Pending", auditChange(entries[0], "messages_groups.collection")["before"])
+	assert.Equal(t, "Approved", auditChange(entries[0], "messages_groups.collection")["after"])
+}
+
+func TestModAuditMoveAndUndo(t *testing.T) {
+	prefix := uniquePrefix("modaudit_move")
+	db := database.DBConn
+
+	fromGroupID := CreateTestGroup(t, prefix+"_from")
+	toGroupID := CreateTestGroup(t, prefix+"_to")
+	posterID := CreateTestUser(t, prefix+"_poster", "User")
+	modID := CreateTestUser(t, prefix+"_mod", "User")
+	fromModID := CreateTestUser(t, prefix+"_frommod", "User")
+	CreateTestMembership(t, posterID, fromGroupID, "Member")
+	CreateTestMembership(t, modID, fromGroupID, "Moderator")
+	CreateTestMembership(t, modID, toGroupID, "Moderator")
+	CreateTestMembership(t, fromModID, fromGroupID, "Moderator")
+	_, modToken := CreateTestSession(t, modID)
+	_, fromModToken := CreateTestSession(t, fromModID)
+
+	msgID := CreateTestMessage(t, posterID, fromGroupID, prefix+" offer", 55.9533, -3.1883)
+
+	status, _ := jsonRequest("POST", "/api/message?jwt="+modToken, map[string]interface{}{"id": msgID, "action": "Move", "groupid": toGroupID})
+	require.Equal(t, 200, status)
+
+	// The owners of the group it was moved out of can see that.
+	status, result := jsonRequest("GET", fmt.Sprintf("/api/modtools/audit?groupid=%d&jwt=%s", fromGroupID, fromModToken), nil)
+	require.Equal(t, 200, status)
+	entries := result["entries"].([]interface{})
+	require.Len(t, entries, 1)
+	e := entries[0].(map[string]interface{})
+	assert.Equal(t, modaudit.ActionMove, e["action"])
+	assert.Equal(t, fmt.Sprint(fromGroupID), auditChange(e, "messages_groups.groupid")["before"])
+	assert.Equal(t, fmt.Sprint(toGroupID), auditChange(e, "messages_groups.groupid")["after"])
+
+	undoURL := fmt.Sprintf("/api/modtools/audit/%d/undo?jwt=", uint64(e["id"].(float64)))
+
+	// Moving it back needs permission on the group it's now on.
+	status, _ = jsonRequest("POST", undoURL+fromModToken, nil)
+	assert.Equal(t, 403, status)
+
+	status, _ = jsonRequest("POST", undoURL+modToken, nil)
+	require.Equal(t, 200, status)
+
+	var row struct {
+		Groupid    uint64
+		Collection string
+	}
+	db.Raw("SELECT groupid, collection FROM messages_groups WHERE msgid = ?", msgID).Scan(&row)
+	assert.Equal(t, fromGroupID, row.Groupid)
+	assert.Equal(t, "Approved", row.Collection)
+}
+
+func TestModAuditGroupSettings(t *testing.T) {
+	prefix := uniquePrefix("modaudit_group")
+	db := database.DBConn
+
+	groupID := CreateTestGroup(t, prefix)
+	ownerID := CreateTestUser(t, prefix+"_owner", "User")
+	userID := CreateTestUser(t, prefix+"_user", "User")
+	CreateTestMembership(t, ownerID, groupID, "Owner")
+	CreateTestMembership(t, userID, groupID, "Member")
+	_, ownerToken := CreateTestSession(t, ownerID)
+	_, userToken := CreateTestSession(t, userID)
+
+	db.Exec("UPDATE `groups` SET tagline = 'Original' WHERE id = ?", groupID)
+
+	patch := func(tagline string) {
+		status, _ := jsonRequest("PATCH", "/api/group?jwt="+ownerToken, map[string]interface{}{"id": groupID, "tagline": tagline})
+		require.Equal(t, 200, status)
+	}
+
+	patch("First")
+	patch("Second")
+
+	// Patching without changing anything isn't recorded.
+	patch("Second")
+
+	entries := auditEntries(t, ownerToken, modaudit.TargetGroup, groupID)
+	require.Len(t, entries, 2)
+	assert.Equal(t, modaudit.ActionSettings, entries[0]["action"])
+	assert.Equal(t, map[string]interface{}{"before": "First", "after": "Second"}, auditChange(entries[0], "tagline"))
+	assert.Equal(t, map[string]interface{}{"before": "Original", "after": "First"}, auditChange(entries[1], "tagline"))
+
+	status, _ := jsonRequest("GET", fmt.Sprintf("/api/modtools/audit?groupid=%d&jwt=%s", groupID, userToken), nil)
+	assert.Equal(t, 403, status)
+
+	// The first change has been changed again since, so undoing it would lose the second.
+	status, _ = jsonRequest("POST", fmt.Sprintf("/api/modtools/audit/%d/undo?jwt=%s", uint64(entries[1]["id"].(float64)), ownerToken), nil)
+	assert.Equal(t, 409, status)
+
+	status, _ = jsonRequest("POST", fmt.Sprintf("/api/modtools/audit/%d/undo?jwt=%s", uint64(entries[0]["id"].(float64)), ownerToken), nil)
+	assert.Equal(t, 200, status)
+
+	var tagline string
+	db.Raw("SELECT tagline FROM `groups` WHERE id = ?", groupID).Scan(&tagline)
+	assert.Equal(t, "First", tagline)
+}
+
+func TestModAuditMemberBan(t *testing.T) {
+	prefix := uniquePrefix("modaudit_ban")
+
+	groupID := CreateTestGroup(t, prefix)
+	memberID := CreateTestUser(t, prefix+"_member", "User")
+	modID := CreateTestUser(t, prefix+"_mod", "User")
+	CreateTestMembership(t, memberID, groupID, "Member")
+	CreateTestMembership(t, modID, groupID, "Moderator")
+	_, modToken := CreateTestSession(t, modID)
+
+	status, _ := jsonRequest("POST", "/api/memberships?jwt="+modToken, map[string]interface{}{"userid": memberID, "groupid": groupID, "action": "Ban"})
+	require.Equal(t, 200, status)
+
+	entries := auditEntries(t, modToken, modaudit.TargetMember, memberID)
+	require.Len(t, entries, 1)
+	assert.Equal(t, modaudit.ActionBan, entries[0]["action"])
+	assert.Equal(t, "Member", auditChange(entries[0], "role")["before"])
+	assert.Nil(t, auditChange(entries[0], "role")["after"])
+	assert.Equal(t, false, entries[0]["undoable"])
+}
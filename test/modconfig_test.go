@@ -282,7 +282,7 @@ func TestGetModConfigV2Path(t *testing.T) {
 	modID := CreateTestUser(t, prefix+"_mod", "Admin")
 	_, token := CreateTestSession(t, modID)
 
-	req := httptest.NewRequest("GET", fmt.Sprintf("/apiv2/modtools/modconfig?id=0&jwt=%s", token), nil)
+	req := withJWT(httptest.NewRequest("GET", "/apiv2/modtools/modconfig?id=0", nil), token)
 	resp, _ := getApp().Test(req)
 	assert.Equal(t, 200, resp.StatusCode)
 }
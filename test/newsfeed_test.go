@@ -97,7 +97,7 @@ func TestNewsfeed_V2Path(t *testing.T) {
 	prefix := uniquePrefix("feedv2")
 	_, token := CreateFullTestUser(t, prefix)
 
-	resp, _ := getApp().Test(httptest.NewRequest("GET", "/apiv2/newsfeed?jwt="+token, nil))
+	resp, _ := getApp().Test(withJWT(httptest.NewRequest("GET", "/apiv2/newsfeed", nil), token))
 	assert.Equal(t, 200, resp.StatusCode)
 }
 
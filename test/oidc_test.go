@@ -0,0 +1,302 @@
+package test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const oidcRedirect = "https://partner.example/callback"
+
+// setupOIDC turns on the provider and registers a confidential client, returning its ID and secret.
+func setupOIDC(t *testing.T, prefix string) (string, string) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	t.Setenv("OIDC_PRIVATE_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	t.Setenv("OIDC_ISSUER", "https://api.example/api/oidc")
+
+	clientID := prefix + "_client"
+	secret := "secret_" + prefix
+	sum := sha256.Sum256([]byte(secret))
+
+	database.DBConn.Exec("INSERT INTO oauth_clients (clientid, secret, name, redirecturis, scopes, created) VALUES (?, ?, ?, ?, ?, NOW())",
+		clientID, base64.RawURLEncoding.EncodeToString(sum[:]), "Test Partner", oidcRedirect, "profile email location")
+
+	t.Cleanup(func() {
+		database.DBConn.Exec("DELETE FROM oauth_clients WHERE clientid = ?", clientID)
+	})
+
+	return clientID, secret
+}
+
+func pkcePair() (string, string) {
+	verifier := strings.Repeat("v", 20) + base64.RawURLEncoding.EncodeToString([]byte(uniquePrefix("pkce")))
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func authParams(clientID string, challenge string) url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {oidcRedirect},
+		"scope":                 {"openid profile email"},
+		"state":                 {"st4te"},
+		"nonce":                 {"n0nce"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// approve gets a code for the user, as the consent page would.
+func approve(t *testing.T, token string, params url.Values) string {
+	body := map[string]interface{}{"approve": true}
+	for k := range params {
+		body[k] = params.Get(k)
+	}
+
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/api/oidc/consent?jwt="+token, strings.NewReader(string(b)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := getApp().Test(req)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var result map[string]interface{}
+	json.Unmarshal(rsp(resp), &result)
+
+	u, _ := url.Parse(result["redirect"].(string))
+	assert.Equal(t, "st4te", u.Query().Get("state"))
+
+	return u.Query().Get("code")
+}
+
+func postToken(clientID string, secret string, form url.Values) (*http.Response, map[string]interface{}) {
+	req := httptest.NewRequest("POST", "/api/oidc/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, secret)
+	resp, _ := getApp().Test(req)
+
+	var result map[string]interface{}
+	json.Unmarshal(rsp(resp), &result)
+
+	return resp, result
+}
+
+func getUserinfo(accessToken string) (*http.Response, map[string]interface{}) {
+	req := httptest.NewRequest("GET", "/api/oidc/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, _ := getApp().Test(req)
+
+	var result map[string]interface{}
+	json.Unmarshal(rsp(resp), &result)
+
+	return resp, result
+}
+
+func TestOIDCNotConfigured(t *testing.T) {
+	t.Setenv("OIDC_PRIVATE_KEY", "")
+
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/oidc/.well-known/openid-configuration", nil))
+	assert.Equal(t, 503, resp.StatusCode)
+
+	// A key isn't enough without an issuer; we don't take it from the Host header.
+	setupOIDC(t, uniquePrefix("oidc_noiss"))
+	t.Setenv("OIDC_ISSUER", "")
+
+	req := httptest.NewRequest("GET", "/api/oidc/.well-known/openid-configuration", nil)
+	req.Host = "evil.example"
+	resp, _ = getApp().Test(req)
+	assert.Equal(t, 503, resp.StatusCode)
+}
+
+func TestOIDCDiscoveryAndJWKS(t *testing.T) {
+	setupOIDC(t, uniquePrefix("oidc_disc"))
+
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/oidc/.well-known/openid-configuration", nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var disc map[string]interface{}
+	json.Unmarshal(rsp(resp), &disc)
+	assert.Equal(t, "https://api.example/api/oidc", disc["issuer"])
+	assert.Equal(t, "https://api.example/api/oidc/token", disc["token_endpoint"])
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/oidc/jwks", nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	json.Unmarshal(rsp(resp), &jwks)
+	assert.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "RS256", jwks.Keys[0]["alg"])
+	assert.NotEmpty(t, jwks.Keys[0]["kid"])
+}
+
+func TestOIDCAuthorizeChecksRequest(t *testing.T) {
+	prefix := uniquePrefix("oidc_authz")
+	clientID, _ := setupOIDC(t, prefix)
+	_, challenge := pkcePair()
+
+	// A good request goes to the consent page.
+	params := authParams(clientID, challenge)
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/oidc/authorize?"+params.Encode(), nil))
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Location"), "/oauth/authorize?")
+
+	// We never redirect to somewhere that isn't registered.
+	params.Set("redirect_uri", "https://evil.example/callback")
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/oidc/authorize?"+params.Encode(), nil))
+	assert.Equal(t, 400, resp.StatusCode)
+
+	params = authParams("nosuchclient", challenge)
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/oidc/authorize?"+params.Encode(), nil))
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Other problems go back to the partner.
+	params = authParams(clientID, challenge)
+	params.Del("code_challenge")
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/oidc/authorize?"+params.Encode(), nil))
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Location"), oidcRedirect+"?")
+	assert.Contains(t, resp.Header.Get("Location"), "error=invalid_request")
+
+	params = authParams(clientID, challenge)
+	params.Set("scope", "openid admin")
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/oidc/authorize?"+params.Encode(), nil))
+	assert.Contains(t, resp.Header.Get("Location"), "error=invalid_scope")
+}
+
+func TestOIDCFlow(t *testing.T) {
+	prefix := uniquePrefix("oidc_flow")
+	clientID, secret := setupOIDC(t, prefix)
+	userID := CreateTestUser(t, prefix, "User")
+	_, token := CreateTestSession(t, userID)
+	verifier, challenge := pkcePair()
+	params := authParams(clientID, challenge)
+
+	// Not agreed yet.
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/oidc/consent?jwt="+token+"&"+params.Encode(), nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var consent map[string]interface{}
+	json.Unmarshal(rsp(resp), &consent)
+	assert.Equal(t, false, consent["consented"])
+	assert.Equal(t, "Test Partner", consent["client"].(map[string]interface{})["name"])
+
+	code := approve(t, token, params)
+	assert.NotEmpty(t, code)
+
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {oidcRedirect}, "code_verifier": {"wrong" + verifier}}
+
+	// The wrong secret or verifier doesn't work.
+	resp, result := postToken(clientID, "wrong", form)
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "invalid_client", result["error"])
+
+	resp, result = postToken(clientID, secret, form)
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Equal(t, "invalid_grant", result["error"])
+
+	// Codes are single-use, so even the right verifier doesn't work now.
+	form.Set("code_verifier", verifier)
+	resp, _ = postToken(clientID, secret, form)
+	assert.Equal(t, 400, resp.StatusCode)
+
+	code = approve(t, token, params)
+	form.Set("code", code)
+	resp, result = postToken(clientID, secret, form)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "Bearer", result["token_type"])
+	assert.Equal(t, "openid profile email", result["scope"])
+
+	// The ID token checks out with the published key.
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/oidc/jwks", nil))
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	json.Unmarshal(rsp(resp), &jwks)
+
+	n, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0]["n"])
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+
+	claims := jwt.MapClaims{}
+	idToken, err := jwt.ParseWithClaims(result["id_token"].(string), claims, func(tok *jwt.Token) (interface{}, error) {
+		assert.Equal(t, jwks.Keys[0]["kid"], tok.Header["kid"])
+		return pub, nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, idToken.Valid)
+	assert.Equal(t, fmt.Sprint(userID), claims["sub"])
+	assert.Equal(t, clientID, claims["aud"])
+	assert.Equal(t, "n0nce", claims["nonce"])
+	assert.Equal(t, "https://api.example/api/oidc", claims["iss"])
+
+	// Userinfo has what they agreed to, and no more.
+	accessToken := result["access_token"].(string)
+	resp, info := getUserinfo(accessToken)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, fmt.Sprint(userID), info["sub"])
+	assert.Equal(t, prefix+"@test.com", info["email"])
+	assert.NotEmpty(t, info["name"])
+	_, hasAddress := info["address"]
+	assert.False(t, hasAddress)
+
+	// They've agreed now, so the consent page can skip asking.
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/oidc/consent?jwt="+token+"&"+params.Encode(), nil))
+	json.Unmarshal(rsp(resp), &consent)
+	assert.Equal(t, true, consent["consented"])
+
+	// Reusing the code withdraws the token it got.
+	resp, _ = postToken(clientID, secret, form)
+	assert.Equal(t, 400, resp.StatusCode)
+
+	resp, _ = getUserinfo(accessToken)
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestOIDCRevokeConsent(t *testing.T) {
+	prefix := uniquePrefix("oidc_revoke")
+	clientID, secret := setupOIDC(t, prefix)
+	userID := CreateTestUser(t, prefix, "User")
+	_, token := CreateTestSession(t, userID)
+	verifier, challenge := pkcePair()
+
+	code := approve(t, token, authParams(clientID, challenge))
+	_, result := postToken(clientID, secret, url.Values{"grant_type": {"authorization_code"}, "code": {code},
+		"redirect_uri": {oidcRedirect}, "code_verifier": {verifier}})
+	accessToken, _ := result["access_token"].(string)
+
+	resp, _ := getUserinfo(accessToken)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/oidc/consents?jwt="+token, nil))
+	var consents struct {
+		Consents []map[string]interface{} `json:"consents"`
+	}
+	json.Unmarshal(rsp(resp), &consents)
+	assert.Len(t, consents.Consents, 1)
+	assert.Equal(t, clientID, consents.Consents[0]["clientid"])
+
+	resp, _ = getApp().Test(httptest.NewRequest("DELETE", "/api/oidc/consents/"+clientID+"?jwt="+token, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, _ = getUserinfo(accessToken)
+	assert.Equal(t, 401, resp.StatusCode)
+
+	resp, _ = getApp().Test(httptest.NewRequest("DELETE", "/api/oidc/consents/"+clientID+"?jwt="+token, nil))
+	assert.Equal(t, 404, resp.StatusCode)
+}
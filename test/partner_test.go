@@ -0,0 +1,352 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/partner"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartnerKeyScopes(t *testing.T) {
+	prefix := uniquePrefix("partner_scope")
+	_, key := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
+
+	status, _ := jsonRequest("GET", "/api/changes?partner="+key, nil)
+	assert.Equal(t, 200, status)
+
+	// The key can't be used for things it hasn't been given.
+	status, result := jsonRequest("GET", "/api/modtools/spammers?partner="+key, nil)
+	assert.Equal(t, 403, status)
+	assert.Contains(t, result["message"], partner.ScopeSpammersRead)
+
+	status, _ = jsonRequest("POST", "/api/session", map[string]interface{}{"action": "Forget", "partner": key, "id": 1})
+	assert.Equal(t, 403, status)
+
+	// A LoveJunk-style call needs chat:write, whatever the partner is called.
+	ljuserid := uint64(1)
+	status, _ = jsonRequest("POST", "/api/chat/lovejunk", map[string]interface{}{
+		"ljuserid": ljuserid, "partnerkey": key, "refmsgid": 1, "message": "Hello",
+	})
+	assert.Equal(t, 403, status)
+}
+
+func TestPartnerKeyAudit(t *testing.T) {
+	prefix := uniquePrefix("partner_audit")
+	partnerID, key := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
+	db := database.DBConn
+
+	jsonRequest("GET", "/api/changes?partner="+key, nil)
+	jsonRequest("GET", "/api/modtools/spammers?partner="+key, nil)
+
+	var entries []struct {
+		Scope  string
+		Path   string
+		Result string
+	}
+	db.Raw("SELECT scope, path, result FROM partners_audit WHERE partnerid = ? ORDER BY id", partnerID).Scan(&entries)
+
+	require.Len(t, entries, 2)
+	assert.Equal(t, partner.ScopeChangesRead, entries[0].Scope)
+	assert.Equal(t, "/api/changes", entries[0].Path)
+	assert.Equal(t, partner.ResultAllowed, entries[0].Result)
+	assert.Equal(t, partner.ScopeSpammersRead, entries[1].Scope)
+	assert.Equal(t, partner.ResultNoScope, entries[1].Result)
+
+	// Keys we don't know are logged too, by prefix only.
+	bogus := utils.RandomHex(16)
+	jsonRequest("GET", "/api/changes?partner="+bogus, nil)
+
+	var result string
+	db.Raw("SELECT result FROM partners_audit WHERE partnerid IS NULL AND prefix = ? ORDER BY id DESC LIMIT 1", bogus[:8]).Scan(&result)
+	assert.Equal(t, partner.ResultInvalidKey, result)
+	db.Exec("DELETE FROM partners_audit WHERE partnerid IS NULL AND prefix = ?", bogus[:8])
+
+	// The key's last use is recorded.
+	var used int64
+	db.Raw("SELECT COUNT(*) FROM partners_apikeys WHERE partnerid = ? AND lastused IS NOT NULL", partnerID).Scan(&used)
+	assert.Equal(t, int64(1), used)
+}
+
+func TestPartnerLegacyKey(t *testing.T) {
+	prefix := uniquePrefix("partner_legacy")
+	db := database.DBConn
+
+	// A partner set up before API keys, with only the key in partners_keys.
+	key := prefix + "_key"
+	db.Exec("INSERT INTO partners_keys (partner, `key`) VALUES (?, ?)", prefix+"_partner", key)
+
+	var partnerID uint64
+	db.Raw("SELECT id FROM partners_keys WHERE partner = ?", prefix+"_partner").Scan(&partnerID)
+	require.NotZero(t, partnerID)
+
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM partners_audit WHERE partnerid = ?", partnerID)
+		db.Exec("DELETE FROM partners_apikeys WHERE partnerid = ?", partnerID)
+		db.Exec("DELETE FROM partners_keys WHERE id = ?", partnerID)
+	})
+
+	// It still works, and it's now an API key with everything it could do before.
+	status, _ := jsonRequest("GET", "/api/changes?partner="+key, nil)
+	assert.Equal(t, 200, status)
+
+	var k struct {
+		ID     uint64
+		Scopes string
+	}
+	db.Raw("SELECT id, scopes FROM partners_apikeys WHERE partnerid = ? AND keyhash = ?", partnerID, partner.HashKey(key)).Scan(&k)
+	require.NotZero(t, k.ID)
+	assert.Contains(t, k.Scopes, partner.ScopeSpammersRead)
+
+	// Only LoveJunk could act for LoveJunk users, so other partners' keys don't get that.
+	assert.NotContains(t, k.Scopes, partner.ScopeChatWrite)
+
+	ljuserid := uint64(time.Now().UnixNano())
+	status, _ = jsonRequest("POST", "/api/chat/lovejunk", map[string]interface{}{
+		"partnerkey": key, "ljuserid": ljuserid, "refmsgid": 1, "message": "Hello",
+	})
+	assert.Equal(t, 403, status)
+
+	status, _ = jsonRequest("GET", "/api/changes?partner="+key, nil)
+	assert.Equal(t, 200, status)
+
+	var count int64
+	db.Raw("SELECT COUNT(*) FROM partners_apikeys WHERE partnerid = ?", partnerID).Scan(&count)
+	assert.Equal(t, int64(1), count)
+
+	// Once it has expired, e.g. after a rotation, the raw key doesn't bring it back.
+	db.Exec("UPDATE partners_apikeys SET expires = DATE_SUB(NOW(), INTERVAL 1 SECOND) WHERE id = ?", k.ID)
+	status, _ = jsonRequest("GET", "/api/changes?partner="+key, nil)
+	assert.Equal(t, 403, status)
+}
+
+func TestPartnerLoveJunkOnly(t *testing.T) {
+	prefix := uniquePrefix("partner_notlj")
+
+	// Even with the scope, a partner which isn't LoveJunk can't create LoveJunk users.
+	_, key := CreateTestPartnerKey(t, prefix, partner.ScopeChatWrite)
+	ljuserid := uint64(time.Now().UnixNano())
+
+	status, _ := jsonRequest("POST", "/api/chat/lovejunk", map[string]interface{}{
+		"partnerkey": key, "ljuserid": ljuserid, "refmsgid": 1, "message": "Hello",
+	})
+	assert.Equal(t, 401, status)
+
+	var count int64
+	database.DBConn.Raw("SELECT COUNT(*) FROM users WHERE ljuserid = ?", ljuserid).Scan(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestPartnerInvalidKeyLimit(t *testing.T) {
+	ip := testLoginIP()
+	bogus := utils.RandomHex(16)
+
+	t.Cleanup(func() {
+		database.DBConn.Exec("DELETE FROM partners_audit WHERE ip = ?", ip)
+	})
+
+	// Someone guessing keys is stopped after a while, and the audit log doesn't grow beyond that.
+	var status int
+	for i := 0; i < 25 && status != 429; i++ {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/changes?partner=%s%d", bogus, i), nil)
+		req.Header.Set("X-Forwarded-For", ip)
+		resp, _ := getApp().Test(req)
+		status = resp.StatusCode
+	}
+
+	assert.Equal(t, 429, status)
+
+	var audited int64
+	database.DBConn.Raw("SELECT COUNT(*) FROM partners_audit WHERE ip = ?", ip).Scan(&audited)
+	assert.Equal(t, int64(20), audited)
+}
+
+func TestPartnerKeyQuota(t *testing.T) {
+	prefix := uniquePrefix("partner_quota")
+	partnerID, key := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
+	database.DBConn.Exec("UPDATE partners_apikeys SET quota = 3 WHERE partnerid = ?", partnerID)
+
+	for i := 0; i < 3; i++ {
+		status, _ := jsonRequest("GET", "/api/changes?partner="+key, nil)
+		assert.Equal(t, 200, status)
+	}
+
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/changes?partner="+key, nil))
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	var quota int64
+	database.DBConn.Raw("SELECT COUNT(*) FROM partners_audit WHERE partnerid = ? AND result = ?", partnerID, partner.ResultQuota).Scan(&quota)
+	assert.Equal(t, int64(1), quota)
+}
+
+func TestPartnerKeyAdmin(t *testing.T) {
+	prefix := uniquePrefix("partner_admin")
+	partnerID, _ := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
+
+	adminID := CreateTestUser(t, prefix+"_admin", "Admin")
+	_, adminToken := CreateTestSession(t, adminID)
+	userID := CreateTestUser(t, prefix+"_user", "User")
+	_, userToken := CreateTestSession(t, userID)
+
+	keysURL := fmt.Sprintf("/api/partners/%d/keys", partnerID)
+
+	// Only admins can manage keys.
+	status, _ := jsonRequest("GET", keysURL+"?jwt="+userToken, nil)
+	assert.Equal(t, 403, status)
+
+	status, _ = jsonRequest("GET", "/api/partners/0/keys?jwt="+adminToken, nil)
+	assert.Equal(t, 400, status)
+
+	// Unknown scopes are refused.
+	status, _ = jsonRequest("POST", keysURL+"?jwt="+adminToken, map[string]interface{}{"scopes": []string{"everything"}})
+	assert.Equal(t, 400, status)
+
+	status, result := jsonRequest("POST", keysURL+"?jwt="+adminToken, map[string]interface{}{
+		"scopes": []string{partner.ScopeSpammersRead},
+		"quota":  100,
+	})
+	require.Equal(t, 200, status)
+	newKey := result["key"].(string)
+	newID := uint64(result["id"].(float64))
+	assert.NotZero(t, newID)
+
+	status, _ = jsonRequest("GET", "/api/modtools/spammers?partner="+newKey, nil)
+	assert.Equal(t, 200, status)
+
+	// The key itself isn't stored or listed.
+	status, result = jsonRequest("GET", keysURL+"?jwt="+adminToken, nil)
+	assert.Equal(t, 200, status)
+	keys := result["keys"].([]interface{})
+	assert.Len(t, keys, 2)
+	assert.Equal(t, newKey[:8], keys[0].(map[string]interface{})["prefix"])
+	assert.NotContains(t, string(mustJSON(result)), newKey)
+
+	// Revoking stops the key working straight away.
+	status, _ = jsonRequest("DELETE", fmt.Sprintf("/api/partners/keys/%d?jwt=%s", newID, adminToken), nil)
+	assert.Equal(t, 200, status)
+
+	status, _ = jsonRequest("GET", "/api/modtools/spammers?partner="+newKey, nil)
+	assert.Equal(t, 403, status)
+
+	// The audit log shows the calls.
+	status, result = jsonRequest("GET", fmt.Sprintf("/api/partners/%d/audit?jwt=%s", partnerID, adminToken), nil)
+	assert.Equal(t, 200, status)
+	assert.Len(t, result["audit"], 2)
+}
+
+func TestPartnerKeyRotation(t *testing.T) {
+	prefix := uniquePrefix("partner_rotate")
+	partnerID, oldKey := CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
+	db := database.DBConn
+
+	adminID := CreateTestUser(t, prefix+"_admin", "Admin")
+	_, adminToken := CreateTestSession(t, adminID)
+
+	var oldID uint64
+	db.Raw("SELECT id FROM partners_apikeys WHERE partnerid = ?", partnerID).Scan(&oldID)
+
+	status, _ := jsonRequest("POST", fmt.Sprintf("/api/partners/keys/%d/rotate?jwt=%s", oldID, adminToken), map[string]interface{}{"overlap": 1000})
+	assert.Equal(t, 400, status)
+
+	status, result := jsonRequest("POST", fmt.Sprintf("/api/partners/keys/%d/rotate?jwt=%s", oldID, adminToken), map[string]interface{}{"overlap": 24})
+	require.Equal(t, 200, status)
+	newKey := result["key"].(string)
+	assert.NotEmpty(t, result["oldexpires"])
+
+	// Both keys work during the overlap, with the same scopes.
+	status, _ = jsonRequest("GET", "/api/changes?partner="+oldKey, nil)
+	assert.Equal(t, 200, status)
+	status, _ = jsonRequest("GET", "/api/changes?partner="+newKey, nil)
+	assert.Equal(t, 200, status)
+	status, _ = jsonRequest("GET", "/api/modtools/spammers?partner="+newKey, nil)
+	assert.Equal(t, 403, status)
+
+	// Once the overlap is over, only the new one does.
+	db.Exec("UPDATE partners_apikeys SET expires = DATE_SUB(NOW(), INTERVAL 1 SECOND) WHERE id = ?", oldID)
+
+	status, _ = jsonRequest("GET", "/api/changes?partner="+oldKey, nil)
+	assert.Equal(t, 403, status)
+	status, _ = jsonRequest("GET", "/api/changes?partner="+newKey, nil)
+	assert.Equal(t, 200, status)
+
+	// An expired key can't be rotated.
+	status, _ = jsonRequest("POST", fmt.Sprintf("/api/partners/keys/%d/rotate?jwt=%s", oldID, adminToken), nil)
+	assert.Equal(t, 409, status)
+}
+
+func TestPartnerConsentNeedsScope(t *testing.T) {
+	prefix := uniquePrefix("partner_consent")
+
+	groupID := CreateTestGroup(t, prefix)
+	posterID := CreateTestUser(t, prefix+"_poster", "User")
+	modID := CreateTestUser(t, prefix+"_mod", "User")
+	CreateTestMembership(t, posterID, groupID, "Member")
+	CreateTestMembership(t, modID, groupID, "Moderator")
+	_, modToken := CreateTestSession(t, modID)
+
+	msgID := CreateTestMessage(t, posterID, groupID, prefix+" offer item", 52.5, -1.8)
+
+	// A partner without message:consent can't be given messages.
+	CreateTestPartnerKey(t, prefix, partner.ScopeChangesRead)
+
+	status, _ := jsonRequest("POST", "/api/message?jwt="+modToken, map[string]interface{}{
+		"id":      msgID,
+		"action":  "PartnerConsent",
+		"partner": prefix + "_partner",
+	})
+	assert.Equal(t, 403, status)
+
+	var count int64
+	database.DBConn.Raw("SELECT COUNT(*) FROM partners_messages WHERE msgid = ?", msgID).Scan(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestPartnerConsentLegacyKey(t *testing.T) {
+	prefix := uniquePrefix("partner_consent_legacy")
+	db := database.DBConn
+
+	groupID := CreateTestGroup(t, prefix)
+	posterID := CreateTestUser(t, prefix+"_poster", "User")
+	modID := CreateTestUser(t, prefix+"_mod", "User")
+	CreateTestMembership(t, posterID, groupID, "Member")
+	CreateTestMembership(t, modID, groupID, "Moderator")
+	_, modToken := CreateTestSession(t, modID)
+
+	msgID := CreateTestMessage(t, posterID, groupID, prefix+" offer item", 52.5, -1.8)
+
+	// A partner whose legacy key hasn't been used here yet, so it has no API keys.
+	db.Exec("INSERT INTO partners_keys (partner, `key`) VALUES (?, ?)", prefix+"_partner", prefix+"_key")
+
+	var partnerID uint64
+	db.Raw("SELECT id FROM partners_keys WHERE partner = ?", prefix+"_partner").Scan(&partnerID)
+	require.NotZero(t, partnerID)
+
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM partners_messages WHERE partnerid = ?", partnerID)
+		db.Exec("DELETE FROM partners_keys WHERE id = ?", partnerID)
+	})
+
+	// Mods can still record consent for it, as they could before.
+	status, _ := jsonRequest("POST", "/api/message?jwt="+modToken, map[string]interface{}{
+		"id":      msgID,
+		"action":  "PartnerConsent",
+		"partner": prefix + "_partner",
+	})
+	assert.Equal(t, 200, status)
+
+	var count int64
+	db.Raw("SELECT COUNT(*) FROM partners_messages WHERE msgid = ? AND partnerid = ?", msgID, partnerID).Scan(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func mustJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
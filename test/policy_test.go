@@ -0,0 +1,104 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getPermissions(t *testing.T, userID uint64, token string) (int, map[string]interface{}) {
+	resp, _ := getApp().Test(httptest.NewRequest("GET", fmt.Sprintf("/api/user/%d/permissions?jwt=%s", userID, token), nil))
+
+	var result map[string]interface{}
+	json.Unmarshal(rsp(resp), &result)
+
+	return resp.StatusCode, result
+}
+
+func TestUserPermissions(t *testing.T) {
+	prefix := uniquePrefix("policy_perms")
+
+	groupID := CreateTestGroup(t, prefix)
+	otherGroupID := CreateTestGroup(t, prefix+"_other")
+
+	modID := CreateTestUser(t, prefix+"_mod", "Moderator")
+	CreateTestMembership(t, modID, groupID, "Owner")
+	CreateTestMembership(t, modID, otherGroupID, "Member")
+	database.DBConn.Exec("UPDATE users SET permissions = 'newsletter' WHERE id = ?", modID)
+	_, modToken := CreateTestSession(t, modID)
+
+	supportID := CreateTestUser(t, prefix+"_support", "Support")
+	_, supportToken := CreateTestSession(t, supportID)
+
+	status, result := getPermissions(t, modID, modToken)
+	require.Equal(t, 200, status)
+	assert.Equal(t, "Moderator", result["systemrole"])
+	assert.ElementsMatch(t, []interface{}{auth.PERM_NEWSLETTER, auth.PERM_SYSTEM_MODERATE}, result["permissions"])
+
+	// Only groups where their role gives them something are listed.
+	groups := result["groups"].([]interface{})
+	require.Len(t, groups, 1)
+	g := groups[0].(map[string]interface{})
+	assert.Equal(t, float64(groupID), g["groupid"])
+	assert.Equal(t, "Owner", g["role"])
+	assert.Contains(t, g["permissions"], auth.PERM_GROUP_OWN)
+
+	// Mods can't see other people's; support can.
+	status, _ = getPermissions(t, supportID, modToken)
+	assert.Equal(t, 403, status)
+
+	status, result = getPermissions(t, modID, supportToken)
+	assert.Equal(t, 200, status)
+	assert.Len(t, result["groups"], 1)
+
+	status, _ = getPermissions(t, modID, "")
+	assert.Equal(t, 401, status)
+}
+
+func TestPolicyPendingMembershipIsNotMod(t *testing.T) {
+	prefix := uniquePrefix("policy_pending")
+
+	groupID := CreateTestGroup(t, prefix)
+	userID := CreateTestUser(t, prefix, "User")
+	CreateTestMembership(t, userID, groupID, "Moderator")
+	_, token := CreateTestSession(t, userID)
+
+	assert.True(t, auth.PolicyForUser(userID).CanInGroup(auth.PERM_GROUP_MODERATE, groupID))
+
+	// A role only counts once the membership is approved.
+	database.DBConn.Exec("UPDATE memberships SET collection = 'Pending' WHERE userid = ? AND groupid = ?", userID, groupID)
+
+	assert.False(t, auth.PolicyForUser(userID).CanInGroup(auth.PERM_GROUP_MODERATE, groupID))
+
+	status, result := getPermissions(t, userID, token)
+	assert.Equal(t, 200, status)
+	assert.Len(t, result["groups"], 0)
+}
+
+func TestRouteRequiresPermission(t *testing.T) {
+	prefix := uniquePrefix("policy_route")
+
+	userID := CreateTestUser(t, prefix+"_user", "User")
+	_, userToken := CreateTestSession(t, userID)
+	supportID := CreateTestUser(t, prefix+"_support", "Support")
+	_, supportToken := CreateTestSession(t, supportID)
+
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/housekeeper/tasks", nil))
+	assert.Equal(t, 401, resp.StatusCode)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/housekeeper/tasks?jwt="+userToken, nil))
+	assert.Equal(t, 403, resp.StatusCode)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/housekeeper/tasks?jwt="+supportToken, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Partner keys need admin, not just support.
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/partners/1/keys?jwt="+supportToken, nil))
+	assert.Equal(t, 403, resp.StatusCode)
+}
@@ -1,11 +1,16 @@
 package test
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/queue"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -99,3 +104,148 @@ func TestQueueMultipleTasks(t *testing.T) {
 	// Clean up.
 	db.Exec("DELETE FROM background_tasks WHERE data LIKE ?", fmt.Sprintf("%%%s%%", prefix))
 }
+
+func countTasks(taskType string, marker string) int64 {
+	var count int64
+	database.DBConn.Raw("SELECT COUNT(*) FROM background_tasks WHERE task_type = ? AND JSON_UNQUOTE(JSON_EXTRACT(data, '$.marker')) = ?",
+		taskType, marker).Scan(&count)
+	return count
+}
+
+func TestQueueTaskTxFollowsTransaction(t *testing.T) {
+	marker := uniquePrefix("queue_tx")
+	taskType := "test_queue_tx"
+
+	// Rolled back, so never queued.
+	database.DBConn.Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, queue.QueueTaskTx(tx, taskType, map[string]interface{}{"marker": marker}))
+		return errors.New("roll back")
+	})
+	assert.Equal(t, int64(0), countTasks(taskType, marker))
+
+	err := database.DBConn.Transaction(func(tx *gorm.DB) error {
+		return queue.QueueTaskTx(tx, taskType, map[string]interface{}{"marker": marker})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), countTasks(taskType, marker))
+
+	var status string
+	database.DBConn.Raw("SELECT status FROM background_tasks WHERE task_type = ? AND JSON_UNQUOTE(JSON_EXTRACT(data, '$.marker')) = ?",
+		taskType, marker).Scan(&status)
+	assert.Equal(t, queue.StatusPending, status)
+
+	database.DBConn.Exec("DELETE FROM background_tasks WHERE task_type = ?", taskType)
+}
+
+func TestQueueDedupKey(t *testing.T) {
+	marker := uniquePrefix("queue_dedup")
+	taskType := "test_queue_dedup"
+	db := database.DBConn
+
+	opts := queue.Options{DedupKey: queue.DedupKey(taskType, marker), Priority: queue.PriorityHigh}
+
+	queued, err := queue.Enqueue(db, taskType, map[string]interface{}{"marker": marker}, opts)
+	require.NoError(t, err)
+	assert.True(t, queued)
+
+	// Already pending, so not queued again.
+	queued, err = queue.Enqueue(db, taskType, map[string]interface{}{"marker": marker}, opts)
+	require.NoError(t, err)
+	assert.False(t, queued)
+	assert.Equal(t, int64(1), countTasks(taskType, marker))
+
+	// Once it's being processed, a new one can be queued.
+	db.Exec("UPDATE background_tasks SET status = ?, started_at = NOW(), attempts = 1 WHERE dedup_key = ?", queue.StatusProcessing, opts.DedupKey)
+
+	queued, err = queue.Enqueue(db, taskType, map[string]interface{}{"marker": marker}, opts)
+	require.NoError(t, err)
+	assert.True(t, queued)
+	assert.Equal(t, int64(2), countTasks(taskType, marker))
+
+	// The older consumer only sets processed_at, leaving the status pending.  That still lets a new one be queued.
+	db.Exec("UPDATE background_tasks SET processed_at = NOW() WHERE dedup_key = ? AND status = ?", opts.DedupKey, queue.StatusPending)
+
+	queued, err = queue.Enqueue(db, taskType, map[string]interface{}{"marker": marker}, opts)
+	require.NoError(t, err)
+	assert.True(t, queued)
+	assert.Equal(t, int64(3), countTasks(taskType, marker))
+
+	db.Exec("DELETE FROM background_tasks WHERE task_type = ?", taskType)
+}
+
+func TestQueueListAndRequeue(t *testing.T) {
+	prefix := uniquePrefix("queue_api")
+	taskType := "test_queue_api"
+	db := database.DBConn
+
+	adminID := CreateTestUser(t, prefix+"_admin", "Admin")
+	supportID := CreateTestUser(t, prefix+"_support", "Support")
+	_, adminToken := CreateTestSession(t, adminID)
+	_, supportToken := CreateTestSession(t, supportID)
+
+	require.NoError(t, queue.QueueTask(taskType, map[string]interface{}{"marker": prefix}))
+
+	var taskID uint64
+	db.Raw("SELECT id FROM background_tasks WHERE task_type = ? ORDER BY id DESC LIMIT 1", taskType).Scan(&taskID)
+	require.NotZero(t, taskID)
+
+	// Task data can be sensitive, so support can't see it.
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/queue/tasks?jwt="+supportToken, nil))
+	assert.Equal(t, 403, resp.StatusCode)
+
+	requeueURL := fmt.Sprintf("/api/queue/tasks/%d/requeue?jwt=%s", taskID, adminToken)
+
+	// Pending tasks don't need requeueing.
+	resp, _ = getApp().Test(httptest.NewRequest("POST", requeueURL, nil))
+	assert.Equal(t, 409, resp.StatusCode)
+
+	db.Exec("UPDATE background_tasks SET status = ?, attempts = 5, failed_at = NOW(), last_error = 'Boom' WHERE id = ?", queue.StatusFailed, taskID)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/queue/tasks?status=failed&type="+taskType+"&jwt="+adminToken, nil))
+	require.Equal(t, 200, resp.StatusCode)
+
+	var result struct {
+		Tasks  []queue.Task      `json:"tasks"`
+		Counts []queue.TaskCount `json:"counts"`
+	}
+	json.Unmarshal(rsp(resp), &result)
+	require.Len(t, result.Tasks, 1)
+	assert.Equal(t, taskID, result.Tasks[0].ID)
+	assert.Equal(t, 5, result.Tasks[0].Attempts)
+	assert.Equal(t, "Boom", *result.Tasks[0].LastError)
+	assert.JSONEq(t, fmt.Sprintf(`{"marker":"%s"}`, prefix), string(result.Tasks[0].Data))
+
+	found := false
+	for _, count := range result.Counts {
+		if count.TaskType == taskType && count.Status == queue.StatusFailed {
+			found = true
+			assert.Equal(t, int64(1), count.Count)
+		}
+	}
+	assert.True(t, found)
+
+	resp, _ = getApp().Test(httptest.NewRequest("POST", requeueURL, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var row struct {
+		Status   string
+		Attempts int
+	}
+	db.Raw("SELECT status, attempts FROM background_tasks WHERE id = ?", taskID).Scan(&row)
+	assert.Equal(t, queue.StatusPending, row.Status)
+	assert.Equal(t, 0, row.Attempts)
+
+	// Requeue all the failed ones of a type.
+	db.Exec("UPDATE background_tasks SET status = ? WHERE id = ?", queue.StatusFailed, taskID)
+
+	req := httptest.NewRequest("POST", "/api/queue/tasks/requeue?jwt="+adminToken, bytes.NewBufferString(fmt.Sprintf(`{"type":"%s"}`, taskType)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ = getApp().Test(req)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var requeued map[string]interface{}
+	json.Unmarshal(rsp(resp), &requeued)
+	assert.Equal(t, float64(1), requeued["requeued"])
+
+	db.Exec("DELETE FROM background_tasks WHERE task_type = ?", taskType)
+}
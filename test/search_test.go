@@ -6,6 +6,7 @@ import (
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/message"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"net/http/httptest"
 	"strconv"
 	"testing"
@@ -135,3 +136,111 @@ func TestAPISearch_V2Path(t *testing.T) {
 	resp, _ := getApp().Test(httptest.NewRequest("GET", "/apiv2/message/search/chair", nil), 60000)
 	assert.Equal(t, 200, resp.StatusCode)
 }
+
+func searchGroup(t *testing.T, term string, groupID uint64) []message.SearchResult {
+	resp, _ := getApp().Test(httptest.NewRequest("GET", fmt.Sprintf("/api/message/search/%s?groupids=%d", term, groupID), nil), 60000)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var results []message.SearchResult
+	json2.Unmarshal(rsp(resp), &results)
+	return results
+}
+
+func TestSearchIndexSynonymsAndTypos(t *testing.T) {
+	prefix := uniquePrefix("searchindex")
+	groupID := CreateTestGroup(t, prefix)
+	userID := CreateTestUser(t, prefix, "User")
+	CreateTestMembership(t, userID, groupID, "Member")
+	setteeID := CreateTestMessage(t, userID, groupID, "OFFER: Leather settee (Edinburgh EH1)", 55.9533, -3.1883)
+	chairsID := CreateTestMessage(t, userID, groupID, "OFFER: Dining chairs (Edinburgh EH1)", 55.9533, -3.1883)
+
+	message.RefreshSearchIndex(database.DBConn)
+
+	// A synonym finds the settee.
+	results := searchGroup(t, "sofa", groupID)
+	require.Equal(t, 1, len(results))
+	assert.Equal(t, setteeID, results[0].Msgid)
+	assert.Equal(t, "Synonym", results[0].Matchedon.Type)
+
+	// So does a typo.
+	results = searchGroup(t, "setee", groupID)
+	require.Equal(t, 1, len(results))
+	assert.Equal(t, setteeID, results[0].Msgid)
+	assert.Equal(t, "Typo", results[0].Matchedon.Type)
+
+	// Singular finds plural.
+	results = searchGroup(t, "chair", groupID)
+	require.Equal(t, 1, len(results))
+	assert.Equal(t, chairsID, results[0].Msgid)
+	assert.Equal(t, "Exact", results[0].Matchedon.Type)
+
+	// The location isn't indexed.
+	assert.Equal(t, 0, len(searchGroup(t, "edinburgh", groupID)))
+}
+
+func TestSearchIndexPrefersNearer(t *testing.T) {
+	prefix := uniquePrefix("searchnear")
+	groupID := CreateTestGroup(t, prefix)
+	userID := CreateTestUser(t, prefix, "User")
+	CreateTestMembership(t, userID, groupID, "Member")
+	nearID := CreateTestMessage(t, userID, groupID, "OFFER: Wardrobe", 55.9533, -3.1883)
+	farID := CreateTestMessage(t, userID, groupID, "OFFER: Wardrobe", 51.5074, -0.1278)
+
+	message.RefreshSearchIndex(database.DBConn)
+
+	// The map covers both Edinburgh and London, but its centre is nearer Edinburgh.  The London one is newer, so
+	// this checks that distance counts for more than a small difference in age.
+	resp, _ := getApp().Test(httptest.NewRequest("GET", fmt.Sprintf("/api/message/search/wardrobe?groupids=%d&nelat=57.0&nelng=-0.1&swlat=51.4&swlng=-3.3", groupID), nil), 60000)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var results []message.SearchResult
+	json2.Unmarshal(rsp(resp), &results)
+	require.Equal(t, 2, len(results))
+	assert.Equal(t, nearID, results[0].Msgid)
+	assert.Equal(t, farID, results[1].Msgid)
+}
+
+func TestSearchRadius(t *testing.T) {
+	prefix := uniquePrefix("searchradius")
+	groupID := CreateTestGroup(t, prefix)
+	userID := CreateTestUser(t, prefix, "User")
+	CreateTestMembership(t, userID, groupID, "Member")
+	nearID := CreateTestMessage(t, userID, groupID, "OFFER: Bookcase", 55.9533, -3.1883)
+	farID := CreateTestMessage(t, userID, groupID, "OFFER: Bookcase", 51.5074, -0.1278)
+
+	message.RefreshSearchIndex(database.DBConn)
+
+	search := func(query string) []message.SearchResult {
+		resp, _ := getApp().Test(httptest.NewRequest("GET", fmt.Sprintf("/api/message/search/bookcase?groupids=%d&%s", groupID, query), nil), 60000)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var results []message.SearchResult
+		json2.Unmarshal(rsp(resp), &results)
+		return results
+	}
+
+	// Within 20 miles of Edinburgh we only find the Edinburgh one, with its distance.
+	results := search("lat=55.95&lng=-3.19&radius=20")
+	require.Equal(t, 1, len(results))
+	assert.Equal(t, nearID, results[0].Msgid)
+	require.NotNil(t, results[0].Distance)
+	assert.Less(t, *results[0].Distance, 20.0)
+
+	// Without a radius we find both, nearest first.
+	results = search("lat=55.95&lng=-3.19")
+	require.Equal(t, 2, len(results))
+	assert.Equal(t, nearID, results[0].Msgid)
+	assert.Equal(t, farID, results[1].Msgid)
+	require.NotNil(t, results[1].Distance)
+	assert.Greater(t, *results[1].Distance, 300.0)
+
+	// Searching from London reverses the order.
+	results = search("lat=51.5&lng=-0.13")
+	require.Equal(t, 2, len(results))
+	assert.Equal(t, farID, results[0].Msgid)
+	assert.Equal(t, nearID, results[1].Msgid)
+
+	// A radius needs somewhere to measure from.
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/message/search/bookcase?radius=10", nil), 60000)
+	assert.Equal(t, 400, resp.StatusCode)
+}
@@ -14,8 +14,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func postSession(body string) *http.Response {
@@ -533,6 +535,275 @@ func TestLoginNullUid(t *testing.T) {
 	assert.NotEmpty(t, result["jwt"])
 }
 
+func TestLoginUpgradesLegacyHash(t *testing.T) {
+	prefix := uniquePrefix("login_upgrade")
+	userID, email := createPasswordUser(t, prefix, "User", "mypassword")
+	ip := testLoginIP()
+
+	// Logging in with an old SHA-1 hash replaces it with an argon2id one, which has its own salt, once we've said so.
+	t.Setenv("PASSWORD_REHASH", "true")
+
+	resp, _ := postLogin(ip, map[string]interface{}{"email": email, "password": "mypassword"})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var login struct {
+		Credentials string
+		Salt        *string
+	}
+	db := database.DBConn
+	db.Raw("SELECT credentials, salt FROM users_logins WHERE userid = ? AND type = 'Native'", userID).Scan(&login)
+	assert.True(t, strings.HasPrefix(login.Credentials, "$argon2id$"), login.Credentials)
+	assert.Nil(t, login.Salt)
+
+	// The new hash works, and the wrong password still doesn't.
+	resp, _ = postLogin(ip, map[string]interface{}{"email": email, "password": "mypassword"})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, _ = postLogin(ip, map[string]interface{}{"email": email, "password": "notmypassword"})
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestLoginKeepsLegacyHash(t *testing.T) {
+	prefix := uniquePrefix("login_keep")
+	userID, email := createPasswordUser(t, prefix, "User", "mypassword")
+
+	var before string
+	db := database.DBConn
+	db.Raw("SELECT credentials FROM users_logins WHERE userid = ? AND type = 'Native'", userID).Scan(&before)
+
+	// PHP still needs to read it, so by default it's left alone.
+	t.Setenv("PASSWORD_REHASH", "")
+
+	resp, _ := postLogin(testLoginIP(), map[string]interface{}{"email": email, "password": "mypassword"})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var after string
+	db.Raw("SELECT credentials FROM users_logins WHERE userid = ? AND type = 'Native'", userID).Scan(&after)
+	assert.Equal(t, before, after)
+}
+
+func TestSetPasswordUsesModernHash(t *testing.T) {
+	prefix := uniquePrefix("setpw_modern")
+	userID, email := createPasswordUser(t, prefix, "User", "oldpassword")
+	_, token := CreateTestSession(t, userID)
+
+	body, _ := json.Marshal(map[string]interface{}{"password": "newpassword"})
+	req := httptest.NewRequest("PATCH", "/api/session?jwt="+token, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := getApp().Test(req, 5000)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var credentials string
+	database.DBConn.Raw("SELECT credentials FROM users_logins WHERE userid = ? AND type = 'Native'", userID).Scan(&credentials)
+	assert.True(t, strings.HasPrefix(credentials, "$argon2id$"), credentials)
+
+	resp, _ = postLogin(testLoginIP(), map[string]interface{}{"email": email, "password": "newpassword"})
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+// ---------------------------------------------------------------------------
+// POST /session - Brute-force protection
+// ---------------------------------------------------------------------------
+
+// createPasswordUser creates a user with a Native login, returning the id and email.
+func createPasswordUser(t *testing.T, prefix string, role string, password string) (uint64, string) {
+	userID := CreateTestUser(t, prefix, role)
+
+	salt := os.Getenv("PASSWORD_SALT")
+	if salt == "" {
+		salt = "zzzz"
+	}
+
+	h := sha1.New()
+	h.Write([]byte(password + salt))
+	database.DBConn.Exec("INSERT INTO users_logins (userid, type, uid, credentials, salt) VALUES (?, 'Native', ?, ?, ?)",
+		userID, strconv.FormatUint(userID, 10), hex.EncodeToString(h.Sum(nil)), salt)
+
+	return userID, fmt.Sprintf("%s@test.com", prefix)
+}
+
+// testLoginIP returns an IP address which no other test uses, so that failures from other tests don't count.
+func testLoginIP() string {
+	n := time.Now().UnixNano()
+	return fmt.Sprintf("2001:db8:%x:%x:%x::1", (n>>32)&0xffff, (n>>16)&0xffff, n&0xffff)
+}
+
+func postLogin(ip string, body map[string]interface{}) (*http.Response, map[string]interface{}) {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/api/session", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", ip)
+	resp, _ := getApp().Test(req, 5000)
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	return resp, result
+}
+
+func TestLoginBackoff(t *testing.T) {
+	prefix := uniquePrefix("login_backoff")
+	userID, email := createPasswordUser(t, prefix, "User", "correctpassword")
+	ip := testLoginIP()
+
+	// A few recent failures mean the next attempt has to wait, even with the right password.
+	db := database.DBConn
+	for i := 0; i < 4; i++ {
+		db.Exec("INSERT INTO login_failures (userid, ip, timestamp) VALUES (?, ?, NOW())", userID, ip)
+	}
+
+	resp, result := postLogin(ip, map[string]interface{}{"email": email, "password": "correctpassword"})
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "rate_limited", result["code"])
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// Once they've waited long enough, it works, and the failures are forgotten.
+	db.Exec("UPDATE login_failures SET timestamp = DATE_SUB(NOW(), INTERVAL 10 MINUTE) WHERE userid = ?", userID)
+
+	resp, result = postLogin(ip, map[string]interface{}{"email": email, "password": "correctpassword"})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.NotEmpty(t, result["jwt"])
+
+	var failures int64
+	db.Raw("SELECT COUNT(*) FROM login_failures WHERE userid = ?", userID).Scan(&failures)
+	assert.Equal(t, int64(0), failures)
+}
+
+func TestLoginLockout(t *testing.T) {
+	prefix := uniquePrefix("login_lockout")
+	userID, email := createPasswordUser(t, prefix, "User", "correctpassword")
+	ip := testLoginIP()
+
+	// Nine earlier failures, long enough ago that there's no backoff, so the next one locks the account.
+	db := database.DBConn
+	for i := 0; i < 9; i++ {
+		db.Exec("INSERT INTO login_failures (userid, ip, timestamp) VALUES (?, ?, DATE_SUB(NOW(), INTERVAL 10 MINUTE))", userID, ip)
+	}
+
+	resp, result := postLogin(ip, map[string]interface{}{"email": email, "password": "wrongpassword"})
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Equal(t, "account_locked", result["code"])
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// The right password doesn't work while it's locked.
+	resp, result = postLogin(ip, map[string]interface{}{"email": email, "password": "correctpassword"})
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Equal(t, "account_locked", result["code"])
+
+	// The lock is logged.
+	var logCount int64
+	db.Raw("SELECT COUNT(*) FROM logs WHERE user = ? AND type = 'User' AND subtype = 'Failure' AND text LIKE 'Account locked%'", userID).Scan(&logCount)
+	assert.Equal(t, int64(1), logCount)
+
+	// They're emailed a login link, which unlocks the account.
+	var resetURL string
+	db.Raw("SELECT JSON_UNQUOTE(JSON_EXTRACT(data, '$.reset_url')) FROM background_tasks WHERE task_type = 'email_forgot_password' AND JSON_EXTRACT(data, '$.user_id') = ? ORDER BY id DESC LIMIT 1", userID).Scan(&resetURL)
+	assert.Contains(t, resetURL, "src=unlock")
+
+	var linkKey string
+	db.Raw("SELECT credentials FROM users_logins WHERE userid = ? AND type = 'Link' LIMIT 1", userID).Scan(&linkKey)
+	assert.Contains(t, resetURL, "k="+linkKey)
+
+	resp, _ = postLogin(ip, map[string]interface{}{"u": userID, "k": linkKey})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, _ = postLogin(ip, map[string]interface{}{"email": email, "password": "correctpassword"})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var locks int64
+	db.Raw("SELECT COUNT(*) FROM users_lockouts WHERE userid = ?", userID).Scan(&locks)
+	assert.Equal(t, int64(0), locks)
+}
+
+func TestLoginIPLimit(t *testing.T) {
+	prefix := uniquePrefix("login_iplimit")
+	_, email := createPasswordUser(t, prefix, "User", "correctpassword")
+	ip := testLoginIP()
+
+	// Lots of failures from one IP, e.g. trying a common password against many emails, block it altogether.
+	db := database.DBConn
+	for i := 0; i < 30; i++ {
+		db.Exec("INSERT INTO login_failures (userid, ip, timestamp) VALUES (NULL, ?, NOW())", ip)
+	}
+
+	resp, result := postLogin(ip, map[string]interface{}{"email": email, "password": "correctpassword"})
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "rate_limited", result["code"])
+
+	resp, _ = postLogin(ip, map[string]interface{}{"u": 1, "k": "guess"})
+	assert.Equal(t, 429, resp.StatusCode)
+
+	// Other IPs aren't affected.
+	resp, _ = postLogin(testLoginIP(), map[string]interface{}{"email": email, "password": "correctpassword"})
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestLoginFailureCounted(t *testing.T) {
+	ip := testLoginIP()
+
+	resp, _ := postLogin(ip, map[string]interface{}{"email": uniquePrefix("login_unknown") + "@test.com", "password": "guess"})
+	assert.Equal(t, 404, resp.StatusCode)
+
+	userID, _ := createPasswordUser(t, uniquePrefix("login_linkfail"), "User", "correctpassword")
+	resp, _ = postLogin(ip, map[string]interface{}{"u": userID, "k": "guess"})
+	assert.Equal(t, 403, resp.StatusCode)
+
+	var failures int64
+	database.DBConn.Raw("SELECT COUNT(*) FROM login_failures WHERE ip = ?", ip).Scan(&failures)
+	assert.Equal(t, int64(2), failures)
+
+	// The wrong link key counts against the account as well as the IP.
+	database.DBConn.Raw("SELECT COUNT(*) FROM login_failures WHERE userid = ?", userID).Scan(&failures)
+	assert.Equal(t, int64(1), failures)
+}
+
+func TestLinkLoginBackoff(t *testing.T) {
+	prefix := uniquePrefix("login_linkbackoff")
+	userID, _ := createPasswordUser(t, prefix, "User", "correctpassword")
+
+	linkKey := fmt.Sprintf("%032x", time.Now().UnixNano())
+	database.DBConn.Exec("INSERT INTO users_logins (userid, type, uid, credentials) VALUES (?, 'Link', ?, ?)",
+		userID, strconv.FormatUint(userID, 10), linkKey)
+
+	// Guessing keys from lots of IPs doesn't get round the limit, because the failures count against the account.
+	for i := 0; i < 3; i++ {
+		resp, _ := postLogin(testLoginIP(), map[string]interface{}{"u": userID, "k": fmt.Sprintf("guess%d", i)})
+		assert.Equal(t, 403, resp.StatusCode)
+	}
+
+	resp, result := postLogin(testLoginIP(), map[string]interface{}{"u": userID, "k": linkKey})
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "rate_limited", result["code"])
+}
+
+func TestLoginIPLimitNotSpoofable(t *testing.T) {
+	prefix := uniquePrefix("login_xff")
+	_, email := createPasswordUser(t, prefix, "User", "correctpassword")
+	ip := testLoginIP()
+
+	db := database.DBConn
+	for i := 0; i < 30; i++ {
+		db.Exec("INSERT INTO login_failures (userid, ip, timestamp) VALUES (NULL, ?, NOW())", ip)
+	}
+
+	// Putting a made-up address in front of the one our proxy added doesn't help.
+	resp, _ := postLogin(testLoginIP()+", "+ip, map[string]interface{}{"email": email, "password": "correctpassword"})
+	assert.Equal(t, 429, resp.StatusCode)
+}
+
+func TestLoginFailureLoggedForMods(t *testing.T) {
+	prefix := uniquePrefix("login_modfail")
+	userID, email := createPasswordUser(t, prefix, "Moderator", "correctpassword")
+	ip := testLoginIP()
+
+	resp, _ := postLogin(ip, map[string]interface{}{"email": email, "password": "wrongpassword"})
+	assert.Equal(t, 403, resp.StatusCode)
+
+	var logCount int64
+	database.DBConn.Raw("SELECT COUNT(*) FROM logs WHERE user = ? AND type = 'User' AND subtype = 'Failure' AND text = ?", userID, "Login failed from "+ip).Scan(&logCount)
+	assert.Equal(t, int64(1), logCount)
+}
+
 // ---------------------------------------------------------------------------
 // PATCH /session
 // ---------------------------------------------------------------------------
@@ -2547,3 +2818,74 @@ func TestGetSessionInventsNameFromEmail(t *testing.T) {
 		assert.Equal(t, localPart, me["displayname"], "Session should invent display name from email local part")
 	})
 }
+
+func putSignup(ip string, body map[string]interface{}) (*http.Response, map[string]interface{}) {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest("PUT", "/api/user", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", ip)
+	resp, _ := getApp().Test(req, 5000)
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	return resp, result
+}
+
+func TestSignupAsLoginLockout(t *testing.T) {
+	prefix := uniquePrefix("signup_lockout")
+	userID, email := createPasswordUser(t, prefix, "User", "correctpassword")
+	ip := testLoginIP()
+	db := database.DBConn
+
+	// Signing up again with the right password logs in.
+	resp, result := putSignup(ip, map[string]interface{}{"email": email, "password": "correctpassword"})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, float64(userID), result["id"])
+	assert.NotEmpty(t, result["jwt"])
+
+	// A wrong password is a failed login, even though it looks like a signup.
+	resp, result = putSignup(ip, map[string]interface{}{"email": email, "password": "wrongpassword"})
+	assert.Equal(t, 409, resp.StatusCode)
+	assert.Equal(t, "email_in_use", result["code"])
+
+	var failures int64
+	db.Raw("SELECT COUNT(*) FROM login_failures WHERE userid = ?", userID).Scan(&failures)
+	assert.Equal(t, int64(1), failures)
+
+	// Enough of them lock the account, and then the right password doesn't work here either.
+	for i := 0; i < 8; i++ {
+		db.Exec("INSERT INTO login_failures (userid, ip, timestamp) VALUES (?, ?, NOW())", userID, ip)
+	}
+
+	db.Exec("UPDATE login_failures SET timestamp = DATE_SUB(NOW(), INTERVAL 10 MINUTE) WHERE userid = ?", userID)
+
+	resp, result = putSignup(ip, map[string]interface{}{"email": email, "password": "wrongpassword"})
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Equal(t, "account_locked", result["code"])
+
+	resp, result = putSignup(ip, map[string]interface{}{"email": email, "password": "correctpassword"})
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Equal(t, "account_locked", result["code"])
+}
+
+func TestForwardedForNeedsTrustedProxy(t *testing.T) {
+	prefix := uniquePrefix("login_noproxy")
+	userID, email := createPasswordUser(t, prefix, "User", "correctpassword")
+	db := database.DBConn
+
+	// Without a trusted proxy, X-Forwarded-For is whatever the client says, so we use the address which connected
+	// to us.  That's why production needs TRUSTED_PROXIES: behind a proxy, this would be the proxy for everyone.
+	require.NoError(t, auth.SetTrustedProxies(nil))
+	t.Cleanup(func() {
+		auth.SetTrustedProxies([]string{"0.0.0.0"})
+		db.Exec("DELETE FROM login_failures WHERE userid = ?", userID)
+	})
+
+	resp, _ := postLogin(testLoginIP(), map[string]interface{}{"email": email, "password": "wrongpassword"})
+	assert.Equal(t, 403, resp.StatusCode)
+
+	var ips []string
+	db.Raw("SELECT ip FROM login_failures WHERE userid = ?", userID).Scan(&ips)
+	assert.Equal(t, []string{"0.0.0.0"}, ips)
+}
@@ -0,0 +1,164 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func listSessions(t *testing.T, url string) []map[string]interface{} {
+	resp, _ := getApp().Test(httptest.NewRequest("GET", url, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var result struct {
+		Sessions []map[string]interface{} `json:"sessions"`
+	}
+	json.Unmarshal(rsp(resp), &result)
+
+	return result.Sessions
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	prefix := uniquePrefix("sessions_mine")
+	_, email := createPasswordUser(t, prefix, "User", "mypassword")
+
+	ip1 := testLoginIP()
+	_, first := postLogin(ip1, map[string]interface{}{"email": email, "password": "mypassword"})
+	_, second := postLogin(testLoginIP(), map[string]interface{}{"email": email, "password": "mypassword"})
+	_, third := postLogin(testLoginIP(), map[string]interface{}{"email": email, "password": "mypassword"})
+
+	token := first["jwt"].(string)
+	firstID := first["persistent"].(map[string]interface{})["id"].(float64)
+	secondID := second["persistent"].(map[string]interface{})["id"].(float64)
+
+	sessions := listSessions(t, "/api/sessions?jwt="+token)
+	assert.Len(t, sessions, 3)
+
+	for _, s := range sessions {
+		assert.Equal(t, s["id"] == firstID, s["current"])
+		if s["id"] == firstID {
+			assert.Equal(t, ip1, s["ip"])
+		}
+	}
+
+	// End one.
+	resp, _ := getApp().Test(httptest.NewRequest("DELETE", fmt.Sprintf("/api/sessions/%d?jwt=%s", uint64(secondID), token), nil))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Len(t, listSessions(t, "/api/sessions?jwt="+token), 2)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/session?jwt="+second["jwt"].(string), nil))
+	assert.Equal(t, 401, resp.StatusCode)
+
+	// Again, or someone else's, isn't found.
+	resp, _ = getApp().Test(httptest.NewRequest("DELETE", fmt.Sprintf("/api/sessions/%d?jwt=%s", uint64(secondID), token), nil))
+	assert.Equal(t, 404, resp.StatusCode)
+
+	otherID := CreateTestUser(t, prefix+"_other", "User")
+	otherSession, _ := CreateTestSession(t, otherID)
+	resp, _ = getApp().Test(httptest.NewRequest("DELETE", fmt.Sprintf("/api/sessions/%d?jwt=%s", otherSession, token), nil))
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// End all the others.
+	resp, _ = getApp().Test(httptest.NewRequest("DELETE", "/api/sessions?jwt="+token, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	sessions = listSessions(t, "/api/sessions?jwt="+token)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, firstID, sessions[0]["id"])
+
+	resp, _ = postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": third["refreshtoken"]})
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestSessionsNotLoggedIn(t *testing.T) {
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/sessions", nil))
+	assert.Equal(t, 401, resp.StatusCode)
+
+	resp, _ = getApp().Test(httptest.NewRequest("DELETE", "/api/sessions", nil))
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestModRevokeUserSessions(t *testing.T) {
+	prefix := uniquePrefix("sessions_mod")
+	groupID := CreateTestGroup(t, prefix)
+	modID := CreateTestUser(t, prefix+"_mod", "Moderator")
+	targetID, email := createPasswordUser(t, prefix+"_target", "User", "mypassword")
+	CreateTestMembership(t, modID, groupID, "Moderator")
+	CreateTestMembership(t, targetID, groupID, "Member")
+	_, modToken := CreateTestSession(t, modID)
+
+	_, login := postLogin(testLoginIP(), map[string]interface{}{"email": email, "password": "mypassword"})
+	targetToken := login["jwt"].(string)
+	_, targetOwnToken := CreateTestSession(t, targetID)
+
+	// Other users can't see them.
+	strangerID := CreateTestUser(t, prefix+"_stranger", "User")
+	_, strangerToken := CreateTestSession(t, strangerID)
+
+	url := fmt.Sprintf("/api/user/%d/sessions?jwt=%s", targetID, strangerToken)
+	resp, _ := getApp().Test(httptest.NewRequest("GET", url, nil))
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Mods can, but without IP addresses.
+	url = fmt.Sprintf("/api/user/%d/sessions?jwt=%s", targetID, modToken)
+	resp, _ = getApp().Test(httptest.NewRequest("GET", url, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var sessions []map[string]interface{}
+	json.Unmarshal(rsp(resp), &sessions)
+	assert.Len(t, sessions, 2)
+
+	for _, s := range sessions {
+		_, hasIP := s["ip"]
+		assert.False(t, hasIP)
+	}
+
+	url = fmt.Sprintf("/api/user/%d/sessions?jwt=%s", targetID, modToken)
+	resp, _ = getApp().Test(httptest.NewRequest("DELETE", url, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	for _, tok := range []string{targetToken, targetOwnToken} {
+		resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/session?jwt="+tok, nil))
+		assert.Equal(t, 401, resp.StatusCode)
+	}
+
+	var count int64
+	database.DBConn.Raw("SELECT COUNT(*) FROM logs WHERE user = ? AND byuser = ? AND type = 'User' AND subtype = 'Logout'", targetID, modID).Scan(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestModCannotRevokeSeniorSessions(t *testing.T) {
+	prefix := uniquePrefix("sessions_senior")
+	groupID := CreateTestGroup(t, prefix)
+	modID := CreateTestUser(t, prefix+"_mod", "Moderator")
+	otherModID := CreateTestUser(t, prefix+"_othermod", "Moderator")
+	adminID := CreateTestUser(t, prefix+"_admin", "Admin")
+	CreateTestMembership(t, modID, groupID, "Moderator")
+	CreateTestMembership(t, otherModID, groupID, "Moderator")
+	CreateTestMembership(t, adminID, groupID, "Member")
+	_, modToken := CreateTestSession(t, modID)
+	_, adminToken := CreateTestSession(t, adminID)
+	_, otherModToken := CreateTestSession(t, otherModID)
+
+	// A group mod can't log out an admin, or another mod, who is a member of their group.
+	for _, target := range []uint64{adminID, otherModID} {
+		url := fmt.Sprintf("/api/user/%d/sessions?jwt=%s", target, modToken)
+		resp, _ := getApp().Test(httptest.NewRequest("DELETE", url, nil))
+		assert.Equal(t, 403, resp.StatusCode)
+	}
+
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/session?jwt="+adminToken, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// An admin can log out the mod.
+	url := fmt.Sprintf("/api/user/%d/sessions?jwt=%s", otherModID, adminToken)
+	resp, _ = getApp().Test(httptest.NewRequest("DELETE", url, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/session?jwt="+otherModToken, nil))
+	assert.Equal(t, 401, resp.StatusCode)
+}
@@ -102,6 +102,27 @@ func TestPostShortlinkMissingParams(t *testing.T) {
 	var result map[string]interface{}
 	json2.Unmarshal(rsp(resp), &result)
 	assert.Equal(t, float64(2), result["ret"])
+	assert.Equal(t, "bad_request", result["code"])
+}
+
+func TestGetShortlinkNotFound(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/shortlink?id=999999999", nil)
+	resp, _ := getApp().Test(req)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	var result map[string]interface{}
+	json2.Unmarshal(rsp(resp), &result)
+	assert.Equal(t, float64(2), result["ret"])
+	assert.Equal(t, "Not found", result["status"])
+	assert.Equal(t, "not_found", result["code"])
+
+	req = httptest.NewRequest("GET", "/apiv2/shortlink?id=999999999", nil)
+	resp, _ = getApp().Test(req)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	result = map[string]interface{}{}
+	json2.Unmarshal(rsp(resp), &result)
+	assert.Equal(t, "not_found", result["error"].(map[string]interface{})["code"])
 }
 
 func TestGetShortlinkV2Path(t *testing.T) {
@@ -88,10 +88,18 @@ func TestSimulationUnauthorized(t *testing.T) {
 	var result map[string]interface{}
 	json2.Unmarshal(rsp(resp), &result)
 	assert.Equal(t, float64(1), result["ret"])
+	assert.Equal(t, "Not logged in", result["status"])
+	assert.Equal(t, "not_logged_in", result["code"])
 }
 
 func TestGetSimulationV2Path(t *testing.T) {
 	req := httptest.NewRequest("GET", "/apiv2/simulation?action=listruns", nil)
 	resp, _ := getApp().Test(req)
 	assert.Equal(t, 401, resp.StatusCode)
+
+	// v2 errors don't have ret/status.
+	var result map[string]interface{}
+	json2.Unmarshal(rsp(resp), &result)
+	assert.NotContains(t, result, "ret")
+	assert.Equal(t, "not_logged_in", result["error"].(map[string]interface{})["code"])
 }
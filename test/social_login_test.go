@@ -10,7 +10,6 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"strings"
 	"testing"
 	"time"
 
@@ -514,7 +513,10 @@ func TestSocialMatchOrCreateTNUser(t *testing.T) {
 	var result map[string]interface{}
 	json.NewDecoder(resp.Body).Decode(&result)
 	assert.Equal(t, float64(3), result["ret"])
-	assert.True(t, strings.Contains(result["status"].(string), "TN user"))
+	assert.Equal(t, "login_failed", result["code"])
+
+	// The reason is logged, not shown.
+	assert.Equal(t, "Login failed", result["message"])
 
 	// Cleanup.
 	db.Exec("DELETE FROM users_emails WHERE userid = ?", userID)
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/partner"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -171,12 +172,9 @@ func TestDeleteSpammerNotAdmin(t *testing.T) {
 
 func TestGetSpammersPartnerKey(t *testing.T) {
 	prefix := uniquePrefix("SpamPart")
-	db := database.DBConn
 
 	// Create a test partner key.
-	partnerKey := prefix + "_key"
-	db.Exec("INSERT INTO partners_keys (partner, `key`) VALUES (?, ?)", prefix+"_partner", partnerKey)
-	defer db.Exec("DELETE FROM partners_keys WHERE partner = ?", prefix+"_partner")
+	_, partnerKey := CreateTestPartnerKey(t, prefix, partner.ScopeSpammersRead)
 
 	targetID := CreateTestUser(t, prefix+"_target", "User")
 	createTestSpammer(t, targetID, "Spammer", "Partner test")
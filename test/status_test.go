@@ -31,11 +31,12 @@ func TestGetStatusMissing(t *testing.T) {
 	os.Remove("/tmp/iznik.status")
 
 	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/status", nil))
-	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 503, resp.StatusCode)
 
 	var result map[string]interface{}
 	json2.Unmarshal(rsp(resp), &result)
 	assert.Equal(t, float64(1), result["ret"])
+	assert.Equal(t, "unavailable", result["code"])
 	assert.Equal(t, "Cannot access status file", result["status"])
 }
 
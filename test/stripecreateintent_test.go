@@ -29,7 +29,7 @@ func TestCreateIntent_RejectsBelowMinimum(t *testing.T) {
 	_, jwt := CreateTestSession(t, userID)
 
 	body := []byte(`{"amount": 0.10, "test": true}`)
-	req := httptest.NewRequest("POST", "/apiv2/stripecreateintent?jwt="+jwt, bytes.NewBuffer(body))
+	req := withJWT(httptest.NewRequest("POST", "/apiv2/stripecreateintent", bytes.NewBuffer(body)), jwt)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := getApp().Test(req)
@@ -46,7 +46,7 @@ func TestCreateIntent_RejectsAboveMaximum(t *testing.T) {
 	_, jwt := CreateTestSession(t, userID)
 
 	body := []byte(`{"amount": 300.00, "test": true}`)
-	req := httptest.NewRequest("POST", "/apiv2/stripecreateintent?jwt="+jwt, bytes.NewBuffer(body))
+	req := withJWT(httptest.NewRequest("POST", "/apiv2/stripecreateintent", bytes.NewBuffer(body)), jwt)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := getApp().Test(req)
@@ -65,7 +65,7 @@ func TestCreateIntent_AcceptsAmountAsString(t *testing.T) {
 	_, jwt := CreateTestSession(t, userID)
 
 	body := []byte(`{"amount": "5.00", "test": true}`)
-	req := httptest.NewRequest("POST", "/apiv2/stripecreateintent?jwt="+jwt, bytes.NewBuffer(body))
+	req := withJWT(httptest.NewRequest("POST", "/apiv2/stripecreateintent", bytes.NewBuffer(body)), jwt)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := getApp().Test(req)
@@ -83,7 +83,7 @@ func TestCreateIntent_AcceptsAmountAsNumber(t *testing.T) {
 	_, jwt := CreateTestSession(t, userID)
 
 	body := []byte(`{"amount": 5.00, "test": true}`)
-	req := httptest.NewRequest("POST", "/apiv2/stripecreateintent?jwt="+jwt, bytes.NewBuffer(body))
+	req := withJWT(httptest.NewRequest("POST", "/apiv2/stripecreateintent", bytes.NewBuffer(body)), jwt)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := getApp().Test(req)
@@ -102,7 +102,7 @@ func TestCreateSubscription_AcceptsAmountAsString(t *testing.T) {
 	_, jwt := CreateTestSession(t, userID)
 
 	body := []byte(`{"amount": "3", "test": true}`)
-	req := httptest.NewRequest("POST", "/apiv2/stripecreatesubscription?jwt="+jwt, bytes.NewBuffer(body))
+	req := withJWT(httptest.NewRequest("POST", "/apiv2/stripecreatesubscription", bytes.NewBuffer(body)), jwt)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := getApp().Test(req)
@@ -4,13 +4,33 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/donations"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v82/webhook"
 )
 
+const testStripeWebhookSecret = "whsec_test_secret"
+
+// postStripeEvent sends an event to the webhook, signed as Stripe would.
+func postStripeEvent(t *testing.T, body []byte) (*http.Response, error) {
+	t.Setenv("STRIPE_WEBHOOK_SECRET", testStripeWebhookSecret)
+
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: body, Secret: testStripeWebhookSecret})
+
+	req := httptest.NewRequest("POST", "/api/stripeipn", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", signed.Header)
+
+	return getApp().Test(req)
+}
+
 func makeChargeEvent(chargeID string, amountPence int64, metadata map[string]string, billingEmail string, description string) []byte {
 	metaJSON, _ := json.Marshal(metadata)
 
@@ -45,9 +65,7 @@ func TestStripeIPN_ChargeSucceeded(t *testing.T) {
 	chargeID := "ch_test_" + prefix
 	body := makeChargeEvent(chargeID, 1000, map[string]string{"uid": fmt.Sprint(userID)}, email, "One-time donation")
 
-	req := httptest.NewRequest("POST", "/api/stripeipn", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := getApp().Test(req)
+	resp, err := postStripeEvent(t, body)
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 
@@ -82,9 +100,7 @@ func TestStripeIPN_MatchByBillingEmail(t *testing.T) {
 	chargeID := "ch_test_" + prefix
 	body := makeChargeEvent(chargeID, 500, map[string]string{}, email, "")
 
-	req := httptest.NewRequest("POST", "/api/stripeipn", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := getApp().Test(req)
+	resp, err := postStripeEvent(t, body)
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 
@@ -104,9 +120,7 @@ func TestStripeIPN_UnmatchedUser(t *testing.T) {
 	chargeID := "ch_test_" + prefix
 	body := makeChargeEvent(chargeID, 2000, map[string]string{}, "unknown@nowhere.com", "")
 
-	req := httptest.NewRequest("POST", "/api/stripeipn", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := getApp().Test(req)
+	resp, err := postStripeEvent(t, body)
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 
@@ -142,9 +156,7 @@ func TestStripeIPN_PayPalIgnored(t *testing.T) {
 		}
 	}`)
 
-	req := httptest.NewRequest("POST", "/api/stripeipn", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := getApp().Test(req)
+	resp, err := postStripeEvent(t, body)
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 
@@ -158,9 +170,7 @@ func TestStripeIPN_ZeroAmount(t *testing.T) {
 
 	body := makeChargeEvent("ch_test_zero", 0, map[string]string{}, "test@test.com", "")
 
-	req := httptest.NewRequest("POST", "/api/stripeipn", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := getApp().Test(req)
+	resp, err := postStripeEvent(t, body)
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 
@@ -172,17 +182,13 @@ func TestStripeIPN_ZeroAmount(t *testing.T) {
 func TestStripeIPN_UnknownEventType(t *testing.T) {
 	body := []byte(`{"id": "evt_test_unknown", "type": "payment_intent.created", "data": {"object": {}}}`)
 
-	req := httptest.NewRequest("POST", "/api/stripeipn", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := getApp().Test(req)
+	resp, err := postStripeEvent(t, body)
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 }
 
 func TestStripeIPN_InvalidPayload(t *testing.T) {
-	req := httptest.NewRequest("POST", "/api/stripeipn", bytes.NewBufferString("not json"))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := getApp().Test(req)
+	resp, err := postStripeEvent(t, []byte("not json"))
 	assert.NoError(t, err)
 	assert.Equal(t, 400, resp.StatusCode)
 }
@@ -198,9 +204,7 @@ func TestStripeIPN_RecurringFirstDonation(t *testing.T) {
 	chargeID := "ch_test_" + prefix
 	body := makeChargeEvent(chargeID, 500, map[string]string{"uid": fmt.Sprint(userID)}, email, "Subscription creation")
 
-	req := httptest.NewRequest("POST", "/api/stripeipn", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := getApp().Test(req)
+	resp, err := postStripeEvent(t, body)
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 
@@ -230,9 +234,7 @@ func TestStripeIPN_GiftAidNotification(t *testing.T) {
 	chargeID := "ch_test_" + prefix
 	body := makeChargeEvent(chargeID, 1000, map[string]string{"uid": fmt.Sprint(userID)}, email, "")
 
-	req := httptest.NewRequest("POST", "/api/stripeipn", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := getApp().Test(req)
+	resp, err := postStripeEvent(t, body)
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 
@@ -244,3 +246,272 @@ func TestStripeIPN_GiftAidNotification(t *testing.T) {
 	db.Exec("DELETE FROM users_donations WHERE TransactionID = ?", chargeID)
 	db.Exec("DELETE FROM users_notifications WHERE touser = ? AND type = 'GiftAid'", userID)
 }
+
+func TestStripeIPN_Signature(t *testing.T) {
+	prefix := uniquePrefix("stripesig")
+	db := database.DBConn
+
+	chargeID := "ch_test_" + prefix
+	body := makeChargeEvent(chargeID, 1000, map[string]string{}, "unknown@nowhere.com", "")
+
+	send := func(header string) int {
+		req := httptest.NewRequest("POST", "/api/stripeipn", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		if header != "" {
+			req.Header.Set("Stripe-Signature", header)
+		}
+
+		resp, err := getApp().Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	sign := func(secret string, at time.Time) string {
+		return webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: body, Secret: secret, Timestamp: at}).Header
+	}
+
+	// Until it's configured we can't check anything, so Stripe should try again later.
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "")
+	assert.Equal(t, 503, send(sign(testStripeWebhookSecret, time.Now())))
+
+	// We accept the old and new secrets while rolling it.
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "whsec_old, "+testStripeWebhookSecret)
+
+	assert.Equal(t, 400, send(""))
+	assert.Equal(t, 400, send(sign("whsec_forged", time.Now())))
+	assert.Equal(t, 400, send(sign(testStripeWebhookSecret, time.Now().Add(-time.Hour))))
+
+	var count int64
+	db.Raw("SELECT COUNT(*) FROM users_donations WHERE TransactionID = ?", chargeID).Scan(&count)
+	assert.Equal(t, int64(0), count, "Unverified events shouldn't be recorded")
+
+	assert.Equal(t, 200, send(sign(testStripeWebhookSecret, time.Now())))
+
+	db.Raw("SELECT COUNT(*) FROM users_donations WHERE TransactionID = ?", chargeID).Scan(&count)
+	assert.Equal(t, int64(1), count)
+
+	db.Exec("DELETE FROM users_donations WHERE TransactionID = ?", chargeID)
+	db.Exec("DELETE FROM stripe_events WHERE eventid = ?", "evt_test_"+chargeID)
+}
+
+func TestStripeIPN_RedeliveryIsNoOp(t *testing.T) {
+	prefix := uniquePrefix("striperedeliver")
+	db := database.DBConn
+
+	userID := CreateTestUser(t, prefix+"_donor", "User")
+	chargeID := "ch_test_" + prefix
+	eventID := "evt_test_" + chargeID
+	body := makeChargeEvent(chargeID, 2500, map[string]string{"uid": fmt.Sprint(userID)}, prefix+"_donor@test.com", "")
+
+	outcome := func() string {
+		resp, err := postStripeEvent(t, body)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var result map[string]interface{}
+		json.Unmarshal(rsp(resp), &result)
+		return fmt.Sprint(result["outcome"])
+	}
+
+	assert.Equal(t, donations.EventRecorded, outcome())
+	assert.Equal(t, donations.EventDuplicate, outcome())
+	assert.Equal(t, donations.EventDuplicate, outcome())
+
+	var donationID uint64
+	var count int64
+	db.Raw("SELECT COUNT(*) FROM users_donations WHERE TransactionID = ?", chargeID).Scan(&count)
+	assert.Equal(t, int64(1), count, "Redelivered events shouldn't add donations")
+	db.Raw("SELECT id FROM users_donations WHERE TransactionID = ?", chargeID).Scan(&donationID)
+
+	var ledger struct {
+		Outcome    string
+		Donationid *uint64
+		Attempts   int
+	}
+	db.Raw("SELECT outcome, donationid, attempts FROM stripe_events WHERE eventid = ?", eventID).Scan(&ledger)
+	assert.Equal(t, donations.EventRecorded, ledger.Outcome)
+	require.NotNil(t, ledger.Donationid)
+	assert.Equal(t, donationID, *ledger.Donationid)
+	assert.Equal(t, 1, ledger.Attempts)
+
+	// A different event for the same charge doesn't add another either.
+	other := bytes.Replace(body, []byte(eventID), []byte(eventID+"_other"), 1)
+	resp, err := postStripeEvent(t, other)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	db.Raw("SELECT COUNT(*) FROM users_donations WHERE TransactionID = ?", chargeID).Scan(&count)
+	assert.Equal(t, int64(1), count)
+
+	db.Exec("DELETE FROM users_donations WHERE TransactionID = ?", chargeID)
+	db.Exec("DELETE FROM stripe_events WHERE eventid IN (?, ?)", eventID, eventID+"_other")
+	db.Exec("DELETE FROM users_notifications WHERE touser = ? AND type = 'GiftAid'", userID)
+	db.Exec("DELETE FROM background_tasks WHERE task_type = 'email_donate_external' AND JSON_EXTRACT(data, '$.user_id') = ?", userID)
+}
+
+// sendStripeEvent posts an event of a type wrapping an object, and returns the outcome.
+func sendStripeEvent(t *testing.T, eventID string, eventType string, object string) string {
+	body := fmt.Sprintf(`{"id": "%s", "type": "%s", "data": {"object": %s}}`, eventID, eventType, object)
+
+	resp, err := postStripeEvent(t, []byte(body))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var result map[string]interface{}
+	json.Unmarshal(rsp(resp), &result)
+	return fmt.Sprint(result["outcome"])
+}
+
+func TestStripeIPN_Refunds(t *testing.T) {
+	prefix := uniquePrefix("stripe_refund")
+	db := database.DBConn
+
+	userID := CreateTestUser(t, prefix+"_donor", "User")
+	chargeID := "ch_test_" + prefix
+
+	resp, err := postStripeEvent(t, makeChargeEvent(chargeID, 2000, map[string]string{"uid": fmt.Sprint(userID)}, prefix+"_donor@test.com", ""))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var donationID uint64
+	db.Raw("SELECT id FROM users_donations WHERE TransactionID = ?", chargeID).Scan(&donationID)
+	require.NotZero(t, donationID)
+
+	refund := func(eventID string, refundedPence int64, full bool) string {
+		return sendStripeEvent(t, eventID, "charge.refunded",
+			fmt.Sprintf(`{"id": "%s", "amount": 2000, "amount_refunded": %d, "refunded": %t}`, chargeID, refundedPence, full))
+	}
+
+	net := func() float64 {
+		var total float64
+		db.Raw("SELECT SUM(GrossAmount) FROM users_donations WHERE id = ? OR adjusts = ?", donationID, donationID).Scan(&total)
+		return total
+	}
+
+	// A partial refund leaves the rest to be claimed on.
+	assert.Equal(t, donations.EventRecorded, refund("evt_"+prefix+"_1", 500, false))
+	assert.Equal(t, 15.0, net())
+
+	// Stripe sends the total refunded so far, so a second event for the same refund adds nothing.
+	assert.Equal(t, donations.EventIgnored, refund("evt_"+prefix+"_1b", 500, false))
+	assert.Equal(t, 15.0, net())
+
+	// Refunding the rest leaves nothing.
+	assert.Equal(t, donations.EventRecorded, refund("evt_"+prefix+"_2", 2000, true))
+	assert.Equal(t, 0.0, net())
+
+	var adjustments int64
+	db.Raw("SELECT COUNT(*) FROM users_donations WHERE adjusts = ? AND adjustment = ?", donationID, donations.ADJUSTMENT_REFUND).Scan(&adjustments)
+	assert.Equal(t, int64(2), adjustments)
+
+	// Refunds of charges we never recorded are ignored.
+	assert.Equal(t, donations.EventIgnored, sendStripeEvent(t, "evt_"+prefix+"_unknown", "charge.refunded",
+		`{"id": "ch_test_unknown_`+prefix+`", "amount": 100, "amount_refunded": 100, "refunded": true}`))
+
+	db.Exec("DELETE FROM users_donations WHERE adjusts = ?", donationID)
+	db.Exec("DELETE FROM users_donations WHERE id = ?", donationID)
+	db.Exec("DELETE FROM stripe_events WHERE eventid LIKE ?", "evt_%"+prefix+"%")
+	db.Exec("DELETE FROM users_notifications WHERE touser = ? AND type = 'GiftAid'", userID)
+}
+
+func TestStripeIPN_Disputes(t *testing.T) {
+	prefix := uniquePrefix("stripe_dispute")
+	db := database.DBConn
+
+	userID := CreateTestUser(t, prefix+"_donor", "User")
+	chargeID := "ch_test_" + prefix
+	disputeID := "dp_test_" + prefix
+
+	resp, err := postStripeEvent(t, makeChargeEvent(chargeID, 1000, map[string]string{"uid": fmt.Sprint(userID)}, prefix+"_donor@test.com", ""))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var donationID uint64
+	db.Raw("SELECT id FROM users_donations WHERE TransactionID = ?", chargeID).Scan(&donationID)
+	require.NotZero(t, donationID)
+
+	dispute := func(eventID string, eventType string, status string) string {
+		return sendStripeEvent(t, eventID, eventType,
+			fmt.Sprintf(`{"id": "%s", "amount": 1000, "charge": "%s", "status": "%s"}`, disputeID, chargeID, status))
+	}
+
+	net := func() float64 {
+		var total float64
+		db.Raw("SELECT SUM(GrossAmount) FROM users_donations WHERE id = ? OR adjusts = ?", donationID, donationID).Scan(&total)
+		return total
+	}
+
+	// Inquiries don't take money.
+	assert.Equal(t, donations.EventIgnored, dispute("evt_"+prefix+"_inquiry", "charge.dispute.created", "warning_needs_response"))
+	assert.Equal(t, 10.0, net())
+
+	assert.Equal(t, donations.EventRecorded, dispute("evt_"+prefix+"_created", "charge.dispute.created", "needs_response"))
+	assert.Equal(t, 0.0, net())
+
+	assert.Equal(t, donations.EventRecorded, dispute("evt_"+prefix+"_closed", "charge.dispute.closed", "won"))
+	assert.Equal(t, 10.0, net())
+
+	var kinds []string
+	db.Raw("SELECT adjustment FROM users_donations WHERE adjusts = ? ORDER BY id", donationID).Scan(&kinds)
+	assert.Equal(t, []string{donations.ADJUSTMENT_DISPUTE, donations.ADJUSTMENT_DISPUTE_REVERSAL}, kinds)
+
+	// If we lose a dispute we never saw being created, the money still goes, so it can't be claimed on.
+	disputeID = "dp_test_" + prefix + "_2"
+	assert.Equal(t, donations.EventRecorded, dispute("evt_"+prefix+"_lost", "charge.dispute.closed", "lost"))
+	assert.Equal(t, 0.0, net())
+
+	// Another event for it doesn't take it twice.
+	dispute("evt_"+prefix+"_lost2", "charge.dispute.closed", "lost")
+	assert.Equal(t, 0.0, net())
+
+	db.Exec("DELETE FROM users_donations WHERE adjusts = ?", donationID)
+	db.Exec("DELETE FROM users_donations WHERE id = ?", donationID)
+	db.Exec("DELETE FROM stripe_events WHERE eventid LIKE ?", "evt_"+prefix+"%")
+	db.Exec("DELETE FROM users_notifications WHERE touser = ? AND type = 'GiftAid'", userID)
+}
+
+func TestStripeIPN_SubscriptionLifecycle(t *testing.T) {
+	prefix := uniquePrefix("stripe_sub")
+	db := database.DBConn
+
+	userID := CreateTestUser(t, prefix+"_donor", "User")
+	subID := "sub_test_" + prefix
+
+	invoice := fmt.Sprintf(`{"id": "in_test_%s", "customer": "cus_test_%s", "customer_email": "%s_donor@test.com", "amount_paid": 500, "amount_due": 500,
+		"parent": {"type": "subscription_details", "subscription_details": {"subscription": "%s"}}}`, prefix, prefix, prefix, subID)
+
+	type subscription struct {
+		Userid   *uint64
+		Amount   float64
+		Status   string
+		Failures int
+	}
+
+	get := func() subscription {
+		var s subscription
+		db.Raw("SELECT userid, amount, status, failures FROM users_donations_subscriptions WHERE subscriptionid = ?", subID).Scan(&s)
+		return s
+	}
+
+	assert.Equal(t, donations.EventRecorded, sendStripeEvent(t, "evt_"+prefix+"_paid", "invoice.paid", invoice))
+	s := get()
+	assert.Equal(t, donations.SUBSCRIPTION_ACTIVE, s.Status)
+	assert.Equal(t, 5.0, s.Amount)
+	require.NotNil(t, s.Userid)
+	assert.Equal(t, userID, *s.Userid)
+
+	assert.Equal(t, donations.EventRecorded, sendStripeEvent(t, "evt_"+prefix+"_failed", "invoice.payment_failed", invoice))
+	s = get()
+	assert.Equal(t, donations.SUBSCRIPTION_PAST_DUE, s.Status)
+	assert.Equal(t, 1, s.Failures)
+
+	assert.Equal(t, donations.EventRecorded, sendStripeEvent(t, "evt_"+prefix+"_deleted", "customer.subscription.deleted",
+		fmt.Sprintf(`{"id": "%s", "customer": "cus_test_%s", "status": "canceled"}`, subID, prefix)))
+	assert.Equal(t, donations.SUBSCRIPTION_CANCELLED, get().Status)
+
+	// Invoices which aren't for a subscription are ignored.
+	assert.Equal(t, donations.EventIgnored, sendStripeEvent(t, "evt_"+prefix+"_oneoff", "invoice.paid",
+		fmt.Sprintf(`{"id": "in_test_%s_oneoff", "amount_paid": 500}`, prefix)))
+
+	db.Exec("DELETE FROM users_donations_subscriptions WHERE subscriptionid = ?", subID)
+	db.Exec("DELETE FROM stripe_events WHERE eventid LIKE ?", "evt_"+prefix+"%")
+}
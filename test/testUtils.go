@@ -1,11 +1,13 @@
 package test
 
 import (
+	"bytes"
 	json2 "encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -13,17 +15,66 @@ import (
 
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/partner"
 	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
 	"gorm.io/gorm"
 )
 
+// TestApp wraps fiber.App to override the default Test timeout from 1s to 30s.
+type TestApp struct {
+	*fiber.App
+}
+
+// Test shadows fiber.App.Test with a 30-second default timeout instead of 1s.
+// Fiber's default 1s is too tight for CI environments under load.
+func (a *TestApp) Test(req *http.Request, msTimeout ...int) (*http.Response, error) {
+	if len(msTimeout) == 0 {
+		msTimeout = []int{30000}
+	}
+
+	return a.App.Test(req, msTimeout...)
+}
+
+// withJWT sends a JWT in the Authorization header, which is the only place /apiv2 looks for one.  /api still
+// accepts ?jwt= for older clients, which is how most of the tests send it.
+func withJWT(req *http.Request, token string) *http.Request {
+	req.Header.Set("Authorization", token)
+	return req
+}
+
+var app *TestApp
+
+func getApp() *TestApp {
+	// We use this so that we only initialise fiber once.
+	return app
+}
+
 func rsp(response *http.Response) []byte {
 	buf := new(strings.Builder)
 	io.Copy(buf, response.Body)
 	return []byte(buf.String())
 }
 
+// jsonRequest makes a request with an optional JSON body, and returns the status and decoded response.
+func jsonRequest(method string, url string, body interface{}) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, url, nil)
+
+	if body != nil {
+		b, _ := json2.Marshal(body)
+		req = httptest.NewRequest(method, url, bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, _ := getApp().Test(req)
+
+	var result map[string]interface{}
+	json2.Unmarshal(rsp(resp), &result)
+
+	return resp.StatusCode, result
+}
+
 func GetToken(id uint64, sessionid uint64) string {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"id":        fmt.Sprint(id),
@@ -237,6 +288,34 @@ func CreateTestSession(t *testing.T, userID uint64) (uint64, string) {
 	return sessionID, token
 }
 
+// CreateTestPartnerKey creates a partner with an API key which has the given scopes, and returns (partnerID, key)
+func CreateTestPartnerKey(t *testing.T, prefix string, scopes ...string) (uint64, string) {
+	db := database.DBConn
+
+	name := prefix + "_partner"
+	key := prefix + "_key"
+
+	db.Exec("INSERT INTO partners_keys (partner, `key`) VALUES (?, ?)", name, key)
+
+	var partnerID uint64
+	db.Raw("SELECT id FROM partners_keys WHERE partner = ?", name).Scan(&partnerID)
+
+	if partnerID == 0 {
+		t.Fatalf("ERROR: Partner was created but ID not found for %s", name)
+	}
+
+	db.Exec("INSERT INTO partners_apikeys (partnerid, keyhash, prefix, scopes, created) VALUES (?, ?, ?, ?, NOW())",
+		partnerID, partner.HashKey(key), key[:8], strings.Join(scopes, " "))
+
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM partners_audit WHERE partnerid = ?", partnerID)
+		db.Exec("DELETE FROM partners_apikeys WHERE partnerid = ?", partnerID)
+		db.Exec("DELETE FROM partners_keys WHERE id = ?", partnerID)
+	})
+
+	return partnerID, key
+}
+
 // CreatePersistentToken creates the old-style Authorization2 persistent token format
 func CreatePersistentToken(t *testing.T, userID uint64, sessionID uint64) string {
 	db := database.DBConn
@@ -0,0 +1,158 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func loginForTokens(t *testing.T, prefix string) (uint64, string, string, uint64) {
+	userID, email := createPasswordUser(t, prefix, "User", "mypassword")
+
+	resp, result := postLogin(testLoginIP(), map[string]interface{}{"email": email, "password": "mypassword"})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	jwtString, _ := result["jwt"].(string)
+	refresh, _ := result["refreshtoken"].(string)
+	assert.NotEmpty(t, jwtString)
+	assert.NotEmpty(t, refresh)
+
+	sessionID := uint64(result["persistent"].(map[string]interface{})["id"].(float64))
+
+	return userID, jwtString, refresh, sessionID
+}
+
+func TestLoginReturnsShortLivedJWT(t *testing.T) {
+	_, jwtString, _, _ := loginForTokens(t, uniquePrefix("tokens_login"))
+
+	claims := jwt.MapClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(jwtString, claims)
+	assert.NoError(t, err)
+
+	exp, _ := claims["exp"].(float64)
+	assert.InDelta(t, float64(time.Now().Add(auth.AccessTokenLifetime).Unix()), exp, 10)
+}
+
+func TestRefreshRotates(t *testing.T) {
+	userID, _, refresh, sessionID := loginForTokens(t, uniquePrefix("tokens_rotate"))
+
+	resp, result := postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": refresh})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	newJWT, _ := result["jwt"].(string)
+	newRefresh, _ := result["refreshtoken"].(string)
+	assert.NotEmpty(t, newJWT)
+	assert.NotEqual(t, refresh, newRefresh)
+
+	// The new JWT is for the same session.
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/session?jwt="+newJWT, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	claims := jwt.MapClaims{}
+	new(jwt.Parser).ParseUnverified(newJWT, claims)
+	assert.Equal(t, strconv.FormatUint(userID, 10), claims["id"])
+	assert.Equal(t, strconv.FormatUint(sessionID, 10), claims["sessionid"])
+
+	// And the new refresh token works in turn.
+	resp, _ = postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": newRefresh})
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestRefreshReuseEndsSession(t *testing.T) {
+	_, jwtString, refresh, sessionID := loginForTokens(t, uniquePrefix("tokens_reuse"))
+
+	resp, result := postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": refresh})
+	assert.Equal(t, 200, resp.StatusCode)
+	newRefresh, _ := result["refreshtoken"].(string)
+
+	// Using the old one again, once the grace period has passed, looks like theft, so the whole session goes.
+	database.DBConn.Exec("UPDATE sessions_refresh SET used = DATE_SUB(NOW(), INTERVAL 1 MINUTE) WHERE sessionid = ? AND used IS NOT NULL", sessionID)
+	resp, result = postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": refresh})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "token_reused", result["code"])
+
+	var count int64
+	database.DBConn.Raw("SELECT COUNT(*) FROM sessions WHERE id = ?", sessionID).Scan(&count)
+	assert.Equal(t, int64(0), count)
+
+	resp, result = postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": newRefresh})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "token_invalid", result["code"])
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/session?jwt="+jwtString, nil))
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestRefreshGrace(t *testing.T) {
+	_, _, refresh, sessionID := loginForTokens(t, uniquePrefix("tokens_grace"))
+
+	resp, result := postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": refresh})
+	assert.Equal(t, 200, resp.StatusCode)
+	newRefresh, _ := result["refreshtoken"].(string)
+
+	// Another tab refreshing with the same token at the same time gets the same new one, and stays logged in.
+	resp, result = postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": refresh})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, newRefresh, result["refreshtoken"])
+	assert.NotEmpty(t, result["jwt"])
+
+	var count int64
+	database.DBConn.Raw("SELECT COUNT(*) FROM sessions WHERE id = ?", sessionID).Scan(&count)
+	assert.Equal(t, int64(1), count)
+
+	database.DBConn.Raw("SELECT COUNT(*) FROM sessions_refresh WHERE sessionid = ?", sessionID).Scan(&count)
+	assert.Equal(t, int64(2), count)
+
+	resp, _ = postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": newRefresh})
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestRefreshInvalid(t *testing.T) {
+	resp, _ := postSessionAction("", map[string]interface{}{"action": "Refresh"})
+	assert.Equal(t, 400, resp.StatusCode)
+
+	resp, result := postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": "nonsense"})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "token_invalid", result["code"])
+
+	// Logging out stops refresh tokens working.
+	_, jwtString, refresh, _ := loginForTokens(t, uniquePrefix("tokens_logout"))
+	req := httptest.NewRequest("DELETE", "/api/session?jwt="+jwtString, nil)
+	getApp().Test(req)
+
+	resp, result = postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": refresh})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "token_invalid", result["code"])
+
+	// As do expired ones.
+	_, _, refresh, sessionID := loginForTokens(t, uniquePrefix("tokens_expired"))
+	database.DBConn.Exec("UPDATE sessions_refresh SET expires = DATE_SUB(NOW(), INTERVAL 1 MINUTE) WHERE sessionid = ?", sessionID)
+
+	resp, _ = postSessionAction("", map[string]interface{}{"action": "Refresh", "refreshtoken": refresh})
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestGetSessionDoesNotExtendJWT(t *testing.T) {
+	userID, _, _, sessionID := loginForTokens(t, uniquePrefix("tokens_getsession"))
+
+	expires := time.Now().Add(2 * time.Minute).Unix()
+	jwtString, _ := auth.SignAccessToken(userID, sessionID, expires)
+
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/session?jwt="+jwtString, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	claims := jwt.MapClaims{}
+	new(jwt.Parser).ParseUnverified(result["jwt"].(string), claims)
+	assert.Equal(t, float64(expires), claims["exp"])
+	assert.Equal(t, strconv.FormatUint(sessionID, 10), claims["sessionid"])
+}
@@ -0,0 +1,243 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func postSessionAction(token string, body map[string]interface{}) (*http.Response, map[string]interface{}) {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/api/session?jwt="+token, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := getApp().Test(req, 5000)
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	return resp, result
+}
+
+// enrolTOTP sets up two-factor authentication for a user, returning the secret and recovery codes.  It confirms
+// with the previous code, so that the current one can still be used to log in.
+func enrolTOTP(t *testing.T, token string) (string, []string) {
+	resp, result := postSessionAction(token, map[string]interface{}{"action": "TOTPSetup"})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	secret, _ := result["secret"].(string)
+	assert.NotEmpty(t, secret)
+	assert.Contains(t, result["uri"], "otpauth://totp/")
+
+	code, _ := auth.TOTPCode(secret, time.Now().Add(-30*time.Second))
+	resp, result = postSessionAction(token, map[string]interface{}{"action": "TOTPEnable", "totp": code})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var recovery []string
+	for _, c := range result["recoverycodes"].([]interface{}) {
+		recovery = append(recovery, c.(string))
+	}
+
+	return secret, recovery
+}
+
+func TestTOTPEnrolWrongCode(t *testing.T) {
+	prefix := uniquePrefix("totp_wrong")
+	userID := CreateTestUser(t, prefix, "User")
+	_, token := CreateTestSession(t, userID)
+
+	resp, _ := postSessionAction(token, map[string]interface{}{"action": "TOTPSetup"})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, result := postSessionAction(token, map[string]interface{}{"action": "TOTPEnable", "totp": "000000"})
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Equal(t, "mfa_failed", result["code"])
+
+	// Until it's confirmed, it isn't used.
+	var enabled int
+	database.DBConn.Raw("SELECT enabled FROM users_totp WHERE userid = ?", userID).Scan(&enabled)
+	assert.Equal(t, 0, enabled)
+}
+
+func TestTOTPEnrolNotLoggedIn(t *testing.T) {
+	resp, _ := postSessionAction("", map[string]interface{}{"action": "TOTPSetup"})
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestTOTPLogin(t *testing.T) {
+	prefix := uniquePrefix("totp_login")
+	userID, email := createPasswordUser(t, prefix, "User", "mypassword")
+	_, token := CreateTestSession(t, userID)
+	secret, recovery := enrolTOTP(t, token)
+	assert.Len(t, recovery, 10)
+
+	// Enrolling again isn't allowed.
+	resp, _ := postSessionAction(token, map[string]interface{}{"action": "TOTPSetup"})
+	assert.Equal(t, 409, resp.StatusCode)
+
+	ip := testLoginIP()
+
+	// The password alone isn't enough any more.
+	resp, result := postLogin(ip, map[string]interface{}{"email": email, "password": "mypassword"})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "mfa_required", result["code"])
+
+	resp, result = postLogin(ip, map[string]interface{}{"email": email, "password": "mypassword", "totp": "000000"})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "mfa_failed", result["code"])
+
+	// The wrong password still fails before the code is checked.
+	code, _ := auth.TOTPCode(secret, time.Now())
+	resp, _ = postLogin(ip, map[string]interface{}{"email": email, "password": "wrong", "totp": code})
+	assert.Equal(t, 403, resp.StatusCode)
+
+	database.DBConn.Exec("DELETE FROM login_failures WHERE userid = ?", userID)
+
+	resp, result = postLogin(ip, map[string]interface{}{"email": email, "password": "mypassword", "totp": code})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.NotEmpty(t, result["jwt"])
+
+	var mfa int
+	sessionID := uint64(result["persistent"].(map[string]interface{})["id"].(float64))
+	database.DBConn.Raw("SELECT mfa FROM sessions WHERE id = ?", sessionID).Scan(&mfa)
+	assert.Equal(t, 1, mfa)
+
+	// The same code can't be used again.
+	resp, result = postLogin(ip, map[string]interface{}{"email": email, "password": "mypassword", "totp": code})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "mfa_failed", result["code"])
+
+	// Recovery codes work once each, and for link logins too.
+	var linkKey string
+	postSession(`{"action":"LostPassword","email":"` + email + `"}`)
+	database.DBConn.Raw("SELECT credentials FROM users_logins WHERE userid = ? AND type = 'Link' LIMIT 1", userID).Scan(&linkKey)
+
+	resp, _ = postLogin(ip, map[string]interface{}{"u": userID, "k": linkKey})
+	assert.Equal(t, 401, resp.StatusCode)
+
+	resp, _ = postLogin(ip, map[string]interface{}{"u": userID, "k": linkKey, "recoverycode": recovery[0]})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, _ = postLogin(ip, map[string]interface{}{"email": email, "password": "mypassword", "recoverycode": recovery[0]})
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestTOTPSignupAsLogin(t *testing.T) {
+	prefix := uniquePrefix("totp_signup")
+	userID, email := createPasswordUser(t, prefix, "User", "mypassword")
+	_, token := CreateTestSession(t, userID)
+	secret, _ := enrolTOTP(t, token)
+	ip := testLoginIP()
+
+	// Signing up again with the password isn't a way round the second factor.
+	resp, result := putSignup(ip, map[string]interface{}{"email": email, "password": "mypassword"})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "mfa_required", result["code"])
+	assert.Nil(t, result["jwt"])
+
+	code, _ := auth.TOTPCode(secret, time.Now())
+	resp, result = putSignup(ip, map[string]interface{}{"email": email, "password": "mypassword", "totp": code})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.NotEmpty(t, result["jwt"])
+
+	var mfa int
+	sessionID := uint64(result["persistent"].(map[string]interface{})["id"].(float64))
+	database.DBConn.Raw("SELECT mfa FROM sessions WHERE id = ?", sessionID).Scan(&mfa)
+	assert.Equal(t, 1, mfa)
+}
+
+func TestTOTPDisable(t *testing.T) {
+	prefix := uniquePrefix("totp_disable")
+	userID, email := createPasswordUser(t, prefix, "User", "mypassword")
+	_, token := CreateTestSession(t, userID)
+	_, recovery := enrolTOTP(t, token)
+
+	resp, _ := postSessionAction(token, map[string]interface{}{"action": "TOTPDisable", "totp": "000000"})
+	assert.Equal(t, 403, resp.StatusCode)
+
+	resp, _ = postSessionAction(token, map[string]interface{}{"action": "TOTPDisable", "recoverycode": recovery[1]})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, _ = postLogin(testLoginIP(), map[string]interface{}{"email": email, "password": "mypassword"})
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestTOTPChangeLockout(t *testing.T) {
+	prefix := uniquePrefix("totp_change_lockout")
+	userID, _ := createPasswordUser(t, prefix, "User", "mypassword")
+	_, token := CreateTestSession(t, userID)
+	_, recovery := enrolTOTP(t, token)
+
+	// Wrong codes when asking for new recovery codes count as failed logins.
+	db := database.DBConn
+	resp, result := postSessionAction(token, map[string]interface{}{"action": "TOTPRecoveryCodes", "totp": "000000"})
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Equal(t, "mfa_failed", result["code"])
+
+	var failures int64
+	db.Raw("SELECT COUNT(*) FROM login_failures WHERE userid = ?", userID).Scan(&failures)
+	assert.Equal(t, int64(1), failures)
+
+	// Enough of them lock the account, even for someone who already has a session.
+	for i := 0; i < 8; i++ {
+		db.Exec("INSERT INTO login_failures (userid, ip, timestamp) VALUES (?, ?, DATE_SUB(NOW(), INTERVAL 10 MINUTE))", userID, testLoginIP())
+	}
+
+	db.Exec("UPDATE login_failures SET timestamp = DATE_SUB(NOW(), INTERVAL 10 MINUTE) WHERE userid = ?", userID)
+
+	resp, result = postSessionAction(token, map[string]interface{}{"action": "TOTPDisable", "totp": "000000"})
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Equal(t, "account_locked", result["code"])
+
+	// Once it's locked, even a right code doesn't turn two-factor authentication off.
+	resp, result = postSessionAction(token, map[string]interface{}{"action": "TOTPDisable", "recoverycode": recovery[0]})
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Equal(t, "account_locked", result["code"])
+
+	var enabled int64
+	db.Raw("SELECT COUNT(*) FROM users_totp WHERE userid = ? AND enabled = 1", userID).Scan(&enabled)
+	assert.Equal(t, int64(1), enabled)
+}
+
+func TestTOTPRequiredForSystemLogs(t *testing.T) {
+	prefix := uniquePrefix("totp_syslogs")
+	userID, email := createPasswordUser(t, prefix, "Support", "mypassword")
+	_, token := CreateTestSession(t, userID)
+
+	os.Setenv("TOTP_REQUIRED_ROLES", "Support,Admin")
+	defer os.Unsetenv("TOTP_REQUIRED_ROLES")
+
+	code, ok := testSystemLogsRequest(t, "/api/modtools/systemlogs?jwt="+token)
+	if ok {
+		assert.Equal(t, 403, code)
+	}
+
+	resp, _ := getApp().Test(httptest.NewRequest("GET", "/api/config/admin/spam_keywords?jwt="+token, nil))
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// They can't turn it off while their role needs it.
+	secret, _ := enrolTOTP(t, token)
+	totp, _ := auth.TOTPCode(secret, time.Now())
+	resp, _ = postSessionAction(token, map[string]interface{}{"action": "TOTPDisable", "totp": totp})
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// A session logged in with a code is allowed.
+	resp, result := postLogin(testLoginIP(), map[string]interface{}{"email": email, "password": "mypassword", "totp": totp})
+	assert.Equal(t, 200, resp.StatusCode)
+	mfaToken, _ := result["jwt"].(string)
+
+	resp, _ = getApp().Test(httptest.NewRequest("GET", "/api/config/admin/spam_keywords?jwt="+mfaToken, nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	code, ok = testSystemLogsRequest(t, "/api/modtools/systemlogs?jwt="+mfaToken)
+	if ok {
+		assert.NotEqual(t, 403, code)
+	}
+}
@@ -1945,8 +1945,8 @@ func TestSpammers_FilterByUserid(t *testing.T) {
 	db.Exec("INSERT INTO spam_users (userid, collection, reason, added) VALUES (?, 'Spammer', 'Test reason', NOW())",
 		targetID)
 
-	url := fmt.Sprintf("/apiv2/modtools/spammers?userid=%d&jwt=%s", targetID, token)
-	resp, _ := getApp().Test(httptest.NewRequest("GET", url, nil))
+	url := fmt.Sprintf("/apiv2/modtools/spammers?userid=%d", targetID)
+	resp, _ := getApp().Test(withJWT(httptest.NewRequest("GET", url, nil), token))
 	assert.Equal(t, 200, resp.StatusCode)
 
 	var result map[string]interface{}
@@ -2232,8 +2232,8 @@ func TestSearchUsers_V2Path(t *testing.T) {
 	targetID := CreateTestUser(t, prefix+"_target", "User")
 
 	// Test the v2 API path.
-	url := fmt.Sprintf("/apiv2/user/search?q=%d&jwt=%s", targetID, adminToken)
-	resp, err := getApp().Test(httptest.NewRequest("GET", url, nil))
+	url := fmt.Sprintf("/apiv2/user/search?q=%d", targetID)
+	resp, err := getApp().Test(withJWT(httptest.NewRequest("GET", url, nil), adminToken))
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 }
@@ -3053,7 +3053,7 @@ func TestUserSearch_V2Path(t *testing.T) {
 	userID := CreateTestUser(t, prefix, "User")
 	_, token := CreateTestSession(t, userID)
 
-	resp, _ := getApp().Test(httptest.NewRequest("GET", fmt.Sprintf("/apiv2/user/%d/search?jwt=%s", userID, token), nil))
+	resp, _ := getApp().Test(withJWT(httptest.NewRequest("GET", fmt.Sprintf("/apiv2/user/%d/search", userID), nil), token))
 	assert.Equal(t, 200, resp.StatusCode)
 }
 
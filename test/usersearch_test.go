@@ -4,11 +4,14 @@ import (
 	"bytes"
 	json2 "encoding/json"
 	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func createTestSearch(t *testing.T, userID uint64, term string) uint64 {
@@ -52,7 +55,7 @@ func TestDeleteUserSearchJSONBody(t *testing.T) {
 	searchID := createTestSearch(t, userID, prefix+"_search")
 
 	body := fmt.Sprintf(`{"id":%d}`, searchID)
-	req := httptest.NewRequest("DELETE", fmt.Sprintf("/apiv2/usersearch?jwt=%s", token), bytes.NewBufferString(body))
+	req := withJWT(httptest.NewRequest("DELETE", "/apiv2/usersearch", bytes.NewBufferString(body)), token)
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := getApp().Test(req)
 	assert.NoError(t, err)
@@ -106,7 +109,7 @@ func TestDeleteUserSearchV2Path(t *testing.T) {
 
 	searchID := createTestSearch(t, userID, prefix+"_search")
 
-	req := httptest.NewRequest("DELETE", fmt.Sprintf("/apiv2/usersearch?id=%d&jwt=%s", searchID, token), nil)
+	req := withJWT(httptest.NewRequest("DELETE", fmt.Sprintf("/apiv2/usersearch?id=%d", searchID), nil), token)
 	resp, _ := getApp().Test(req)
 	assert.Equal(t, 200, resp.StatusCode)
 
@@ -114,3 +117,218 @@ func TestDeleteUserSearchV2Path(t *testing.T) {
 	json2.Unmarshal(rsp(resp), &result)
 	assert.Equal(t, float64(0), result["ret"])
 }
+
+func saveTestSearch(t *testing.T, token string, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest("POST", "/api/usersearch?jwt="+token, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := getApp().Test(req)
+	assert.NoError(t, err)
+
+	var result map[string]interface{}
+	json2.Unmarshal(rsp(resp), &result)
+	return resp.StatusCode, result
+}
+
+func setTestUserLocation(userID uint64, lat float64, lng float64) {
+	database.DBConn.Exec("UPDATE users SET settings = JSON_OBJECT('mylocation', JSON_OBJECT('lat', ?, 'lng', ?)) WHERE id = ?", lat, lng, userID)
+}
+
+func TestSaveUserSearchValidation(t *testing.T) {
+	prefix := uniquePrefix("SaveSearchBad")
+	userID, token := CreateFullTestUser(t, prefix)
+	setTestUserLocation(userID, 55.95, -3.19)
+
+	req := httptest.NewRequest("POST", "/api/usersearch", bytes.NewBufferString(`{"term":"sofa"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := getApp().Test(req)
+	assert.Equal(t, 401, resp.StatusCode)
+
+	status, _ := saveTestSearch(t, token, `{}`)
+	assert.Equal(t, 400, status)
+
+	status, _ = saveTestSearch(t, token, `{"term":"sofa","radius":500}`)
+	assert.Equal(t, 400, status)
+
+	status, _ = saveTestSearch(t, token, `{"term":"sofa","messagetype":"Other"}`)
+	assert.Equal(t, 400, status)
+
+	status, _ = saveTestSearch(t, token, `{"term":"sofa","isochroneid":999999999}`)
+	assert.Equal(t, 400, status)
+
+	// Someone else's search.
+	otherID := CreateTestUser(t, prefix+"_other", "User")
+	otherSearch := createTestSearch(t, otherID, "sofa")
+	status, _ = saveTestSearch(t, token, fmt.Sprintf(`{"id":%d}`, otherSearch))
+	assert.Equal(t, 404, status)
+}
+
+func TestSaveUserSearch(t *testing.T) {
+	prefix := uniquePrefix("SaveSearch")
+	userID, token := CreateFullTestUser(t, prefix)
+	setTestUserLocation(userID, 55.95, -3.19)
+
+	// Save one from history.
+	historyID := createTestSearch(t, userID, prefix+"_history")
+	status, result := saveTestSearch(t, token, fmt.Sprintf(`{"id":%d,"messagetype":"Offer","radius":5}`, historyID))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, float64(historyID), result["id"])
+
+	var saved struct {
+		Alert   bool
+		Msgtype *string
+		Radius  *float64
+	}
+	database.DBConn.Raw("SELECT alert, msgtype, radius FROM users_searches WHERE id = ?", historyID).Scan(&saved)
+	assert.True(t, saved.Alert)
+	assert.Equal(t, "Offer", *saved.Msgtype)
+	assert.Equal(t, 5.0, *saved.Radius)
+
+	// Saving the same term again updates it rather than adding another.
+	status, result = saveTestSearch(t, token, fmt.Sprintf(`{"term":"%s_history","radius":8}`, prefix))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, float64(historyID), result["id"])
+
+	// Saved searches are listed first.
+	createTestSearch(t, userID, prefix+"_recent")
+	resp, _ := getApp().Test(httptest.NewRequest("GET", fmt.Sprintf("/api/user/%d/search?jwt=%s", userID, token), nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var searches []map[string]interface{}
+	json2.Unmarshal(rsp(resp), &searches)
+	assert.Equal(t, 2, len(searches))
+	if len(searches) == 2 {
+		assert.Equal(t, prefix+"_history", searches[0]["term"])
+		assert.Equal(t, true, searches[0]["alert"])
+	}
+
+	// Stop alerting.
+	status, _ = saveTestSearch(t, token, fmt.Sprintf(`{"id":%d,"alert":false}`, historyID))
+	assert.Equal(t, 200, status)
+	database.DBConn.Raw("SELECT alert, msgtype, radius FROM users_searches WHERE id = ?", historyID).Scan(&saved)
+	assert.False(t, saved.Alert)
+}
+
+// savedSearchAlerts returns how many saved search alerts have been queued for a user about a message.
+func savedSearchAlerts(userID uint64, msgID uint64) int64 {
+	var count int64
+	database.DBConn.Raw("SELECT COUNT(*) FROM background_tasks WHERE task_type = 'saved_search_alert' "+
+		"AND JSON_EXTRACT(data, '$.userid') = ? AND JSON_EXTRACT(data, '$.msgid') = ?", userID, msgID).Scan(&count)
+	return count
+}
+
+func TestSavedSearchAlertOnApprove(t *testing.T) {
+	prefix := uniquePrefix("SearchAlert")
+	db := database.DBConn
+
+	groupID := CreateTestGroup(t, prefix)
+	posterID := CreateTestUser(t, prefix+"_poster", "User")
+	modID := CreateTestUser(t, prefix+"_mod", "User")
+	CreateTestMembership(t, posterID, groupID, "Member")
+	CreateTestMembership(t, modID, groupID, "Moderator")
+	_, modToken := CreateTestSession(t, modID)
+
+	// A word nobody else will be searching for.
+	word := fmt.Sprintf("zq%d", time.Now().UnixNano())
+
+	nearID, nearToken := CreateFullTestUser(t, prefix+"_near")
+	setTestUserLocation(nearID, 55.95, -3.19)
+	status, _ := saveTestSearch(t, nearToken, fmt.Sprintf(`{"term":"sofa %s","radius":10}`, word))
+	assert.Equal(t, 200, status)
+
+	farID, farToken := CreateFullTestUser(t, prefix+"_far")
+	setTestUserLocation(farID, 51.5, -0.13)
+	status, _ = saveTestSearch(t, farToken, fmt.Sprintf(`{"term":"sofa %s","radius":10}`, word))
+	assert.Equal(t, 200, status)
+
+	wantedID, wantedToken := CreateFullTestUser(t, prefix+"_wanted")
+	setTestUserLocation(wantedID, 55.95, -3.19)
+	status, _ = saveTestSearch(t, wantedToken, fmt.Sprintf(`{"term":"sofa %s","messagetype":"Wanted"}`, word))
+	assert.Equal(t, 200, status)
+
+	msgID := createPendingMessage(t, posterID, groupID, prefix)
+	db.Exec("UPDATE messages SET subject = ?, lat = 55.96, lng = -3.2 WHERE id = ?", fmt.Sprintf("OFFER: Leather settee %s (Edinburgh)", word), msgID)
+
+	body, _ := json2.Marshal(map[string]interface{}{"id": msgID, "action": "Approve"})
+	req := httptest.NewRequest("POST", "/api/message?jwt="+modToken, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := getApp().Test(req)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Only the nearby searcher looking for Offers hears about it, and only once.
+	assert.Equal(t, int64(1), savedSearchAlerts(nearID, msgID))
+	assert.Equal(t, int64(0), savedSearchAlerts(farID, msgID))
+	assert.Equal(t, int64(0), savedSearchAlerts(wantedID, msgID))
+
+	resp, _ = getApp().Test(func() *http.Request {
+		r := httptest.NewRequest("POST", "/api/message?jwt="+modToken, bytes.NewBuffer(body))
+		r.Header.Set("Content-Type", "application/json")
+		return r
+	}())
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, int64(1), savedSearchAlerts(nearID, msgID))
+
+	// Nor when it's approved on another group, after the first alert has been sent.
+	db.Exec("UPDATE background_tasks SET status = 'done', processed_at = NOW() WHERE task_type = 'saved_search_alert' "+
+		"AND JSON_EXTRACT(data, '$.msgid') = ?", msgID)
+
+	otherGroupID := CreateTestGroup(t, prefix+"_other")
+	CreateTestMembership(t, modID, otherGroupID, "Moderator")
+	db.Exec("INSERT INTO messages_groups (msgid, groupid, collection, arrival) VALUES (?, ?, 'Pending', NOW())", msgID, otherGroupID)
+
+	status, _ = jsonRequest("POST", "/api/message?jwt="+modToken, map[string]interface{}{"id": msgID, "groupid": otherGroupID, "action": "Approve"})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, int64(1), savedSearchAlerts(nearID, msgID))
+}
+
+func TestSavedSearchAlertOnAutoApprove(t *testing.T) {
+	prefix := uniquePrefix("SearchAlertAuto")
+	db := database.DBConn
+
+	groupID := CreateTestGroup(t, prefix)
+	userID := CreateTestUser(t, prefix, "User")
+	CreateTestMembership(t, userID, groupID, "Member")
+	_, token := CreateTestSession(t, userID)
+
+	var loc struct {
+		ID  uint64
+		Lat float64
+		Lng float64
+	}
+	db.Raw("SELECT id, lat, lng FROM locations WHERE lat != 0 AND lng != 0 LIMIT 1").Scan(&loc)
+	require.NotZero(t, loc.ID)
+
+	word := fmt.Sprintf("zq%d", time.Now().UnixNano())
+
+	searcherID, searcherToken := CreateFullTestUser(t, prefix+"_searcher")
+	setTestUserLocation(searcherID, loc.Lat, loc.Lng)
+	status, _ := saveTestSearch(t, searcherToken, fmt.Sprintf(`{"term":"sofa %s","radius":10}`, word))
+	assert.Equal(t, 200, status)
+
+	post := func() uint64 {
+		body, _ := json2.Marshal(map[string]interface{}{
+			"groupid":    groupID,
+			"type":       "Offer",
+			"subject":    "Sofa " + word,
+			"textbody":   "A test offer",
+			"item":       "Sofa " + word,
+			"locationid": loc.ID,
+		})
+		req := httptest.NewRequest("PUT", "/api/message?jwt="+token, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := getApp().Test(req)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var result map[string]interface{}
+		json2.Unmarshal(rsp(resp), &result)
+		id, _ := result["id"].(float64)
+		return uint64(id)
+	}
+
+	// A moderated member's post waits for a mod.
+	db.Exec("UPDATE memberships SET ourPostingStatus = 'MODERATED' WHERE userid = ? AND groupid = ?", userID, groupID)
+	assert.Equal(t, int64(0), savedSearchAlerts(searcherID, post()))
+
+	// An unmoderated member's post is approved straight away, so it alerts too.
+	db.Exec("UPDATE memberships SET ourPostingStatus = 'DEFAULT' WHERE userid = ? AND groupid = ?", userID, groupID)
+	assert.Equal(t, int64(1), savedSearchAlerts(searcherID, post()))
+}
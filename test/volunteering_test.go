@@ -72,7 +72,7 @@ func TestVolunteering_V2Path(t *testing.T) {
 	prefix := uniquePrefix("volv2")
 	_, token := CreateFullTestUser(t, prefix)
 
-	resp, _ := getApp().Test(httptest.NewRequest("GET", "/apiv2/volunteering?jwt="+token, nil))
+	resp, _ := getApp().Test(withJWT(httptest.NewRequest("GET", "/apiv2/volunteering", nil), token))
 	assert.Equal(t, 200, resp.StatusCode)
 }
 
@@ -5,7 +5,6 @@ import (
 
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
-	"github.com/freegle/iznik-server-go/utils"
 )
 
 // IsAdminOrSupport checks if the user has Admin or Support system role.
@@ -22,37 +21,26 @@ func IsModOfGroup(myid uint64, groupid uint64) bool {
 // IsModOfUser checks if myid is Admin/Support or a Moderator/Owner of any
 // group that targetid also belongs to (including groups the target is banned from).
 func IsModOfUser(myid, targetid uint64) bool {
-	if auth.IsAdminOrSupport(myid) {
+	p := auth.PolicyForUser(myid)
+	if p.Can(auth.PERM_GROUP_MODERATE) {
 		return true
 	}
-	db := database.DBConn
-	var count int64
 
-	// Check active memberships.
-	result := db.Raw("SELECT COUNT(*) FROM memberships m1 "+
-		"INNER JOIN memberships m2 ON m2.groupid = m1.groupid "+
-		"WHERE m1.userid = ? AND m2.userid = ? "+
-		"AND m1.role IN (?, ?)",
-		myid, targetid, utils.ROLE_MODERATOR, utils.ROLE_OWNER).Scan(&count)
-	if result.Error != nil {
-		log.Printf("Failed to check IsModOfUser for user %d target %d: %v", myid, targetid, result.Error)
+	groupIDs := p.GroupsWith(auth.PERM_GROUP_MODERATE)
+	if len(groupIDs) == 0 {
 		return false
 	}
-	if count > 0 {
-		return true
-	}
 
-	// Also check users_banned — banning deletes the memberships row,
-	// so banned users won't appear in the query above.
-	result = db.Raw("SELECT COUNT(*) FROM memberships m1 "+
-		"INNER JOIN users_banned b ON b.groupid = m1.groupid "+
-		"WHERE m1.userid = ? AND b.userid = ? "+
-		"AND m1.role IN (?, ?)",
-		myid, targetid, utils.ROLE_MODERATOR, utils.ROLE_OWNER).Scan(&count)
+	db := database.DBConn
+	var count int64
+
+	// Banning deletes the memberships row, so we check users_banned too.
+	result := db.Raw("SELECT (SELECT COUNT(*) FROM memberships WHERE userid = ? AND groupid IN ?) + "+
+		"(SELECT COUNT(*) FROM users_banned WHERE userid = ? AND groupid IN ?)",
+		targetid, groupIDs, targetid, groupIDs).Scan(&count)
 	if result.Error != nil {
-		log.Printf("Failed to check IsModOfUser (banned) for user %d target %d: %v", myid, targetid, result.Error)
+		log.Printf("Failed to check IsModOfUser for user %d target %d: %v", myid, targetid, result.Error)
 		return false
 	}
 	return count > 0
 }
-
@@ -0,0 +1,64 @@
+package user
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GroupRole is a group where a user has a role which gives them permissions.
+type GroupRole struct {
+	Groupid     uint64   `json:"groupid"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+// GetUserPermissions returns what a user can do, and why.  Users can see their own; support can see anyone's, e.g.
+// to check what a mod has access to.
+//
+// @Summary Get a user's permissions
+// @Tags user
+// @Router /api/user/{id}/permissions [get]
+func GetUserPermissions(c *fiber.Ctx) error {
+	me := auth.PolicyFor(c)
+	if me.UserID == 0 {
+		return apierror.ErrNotLoggedIn
+	}
+
+	targetid, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil || targetid == 0 {
+		return apierror.ErrInvalidID
+	}
+
+	p := me
+	if targetid != me.UserID {
+		if !me.Can(auth.PERM_SYSTEM_SUPPORT) {
+			return apierror.ErrForbidden
+		}
+
+		p = auth.PolicyForUser(targetid)
+	}
+
+	groups := []GroupRole{}
+	for groupid, role := range p.GroupRoles() {
+		groups = append(groups, GroupRole{
+			Groupid:     groupid,
+			Role:        role,
+			Permissions: auth.GroupRolePermissions[role],
+		})
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Groupid < groups[j].Groupid })
+
+	return c.JSON(fiber.Map{
+		"ret":         0,
+		"status":      "Success",
+		"id":          p.UserID,
+		"systemrole":  p.SystemRole(),
+		"permissions": p.Permissions(),
+		"groups":      groups,
+	})
+}
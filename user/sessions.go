@@ -0,0 +1,81 @@
+package user
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/auth"
+	log2 "github.com/freegle/iznik-server-go/log"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetUserSessions returns where a user is logged in, e.g. to check whether their account has been taken over.
+// Only support and admin see IP addresses.
+//
+// @Summary Get sessions for a user (mod-only)
+// @Tags user
+// @Router /api/user/{id}/sessions [get]
+func GetUserSessions(c *fiber.Ctx) error {
+	myid, targetid, err := requireModOfUser(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(auth.ListSessions(targetid, 0, IsAdminOrSupport(myid)))
+}
+
+// RevokeUserSessions logs a user out of one of their sessions, or all of them if no session ID is given, e.g. if
+// their account has been taken over.  Mods can only do this to users less senior than them, so that a group mod
+// can't log out support or an admin who happens to be a member of their group.  Admins can do it to anyone.
+//
+// @Summary Revoke sessions for a user (mod-only)
+// @Tags user
+// @Router /api/user/{id}/sessions/{sessionid} [delete]
+func RevokeUserSessions(c *fiber.Ctx) error {
+	myid, targetid, err := requireModOfUser(c)
+	if err != nil {
+		return err
+	}
+
+	me := auth.PolicyFor(c)
+	if targetid != myid && !me.Can(auth.PERM_SYSTEM_ADMIN) && !me.Outranks(auth.PolicyForUser(targetid)) {
+		return apierror.ErrForbidden.WithMessage("You can't log out a user as senior as you")
+	}
+
+	var count int64
+
+	if c.Params("sessionid") == "" {
+		count = auth.RevokeOtherSessions(targetid, 0)
+	} else {
+		sessionID, parseErr := strconv.ParseUint(c.Params("sessionid"), 10, 64)
+		if parseErr != nil || sessionID == 0 {
+			return apierror.ErrInvalidID
+		}
+
+		if !auth.RevokeUserSession(targetid, sessionID) {
+			return apierror.ErrNotFound.WithMessage("Session not found")
+		}
+
+		count = 1
+	}
+
+	if targetid == myid {
+		c.Locals("skipPostAuthCheck", true)
+	}
+
+	text := fmt.Sprintf("Logged out of %d session(s) by moderator", count)
+	log2.Log(log2.LogEntry{
+		Type:    log2.LOG_TYPE_USER,
+		Subtype: log2.LOG_SUBTYPE_LOGOUT,
+		User:    &targetid,
+		Byuser:  &myid,
+		Text:    &text,
+	})
+
+	return c.JSON(fiber.Map{
+		"ret":     0,
+		"status":  "Success",
+		"revoked": count,
+	})
+}
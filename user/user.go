@@ -1,8 +1,6 @@
 package user
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +14,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/freegle/iznik-server-go/apierror"
 	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/location"
@@ -23,7 +22,6 @@ import (
 	"github.com/freegle/iznik-server-go/queue"
 	"github.com/freegle/iznik-server-go/utils"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v4"
 	"gorm.io/gorm"
 )
 
@@ -177,12 +175,17 @@ type MembershipHistory struct {
 }
 
 type Search struct {
-	ID         uint64    `json:"id" gorm:"primary_key"`
-	Date       time.Time `json:"date"`
-	Userid     uint64    `json:"userid"`
-	Term       string    `json:"term"`
-	Maxmsg     uint64    `json:"maxmsg"`
-	Locationid uint64    `json:"locationid"`
+	ID          uint64     `json:"id" gorm:"primary_key"`
+	Date        time.Time  `json:"date"`
+	Userid      uint64     `json:"userid"`
+	Term        string     `json:"term"`
+	Maxmsg      uint64     `json:"maxmsg"`
+	Locationid  uint64     `json:"locationid"`
+	Alert       bool       `json:"alert"`
+	Msgtype     *string    `json:"msgtype"`
+	Radius      *float64   `json:"radius"`
+	Isochroneid *uint64    `json:"isochroneid"`
+	Lastalert   *time.Time `json:"lastalert"`
 }
 
 func hideSensitiveFields(user *User, myid uint64) {
@@ -610,13 +613,13 @@ func GetUserById(id uint64, myid uint64) User {
 
 		db.Raw("SELECT (CASE WHEN "+
 			"((users.systemrole != ? OR "+
-			"EXISTS(SELECT id FROM users_donations WHERE userid = ? AND users_donations.timestamp >= ?) OR "+
+			"EXISTS(SELECT id FROM users_donations WHERE userid = ? AND users_donations.timestamp >= ? AND adjusts IS NULL) OR "+
 			"EXISTS(SELECT id FROM microactions WHERE userid = ? AND microactions.timestamp >= ?)) AND "+
 			"(CASE WHEN JSON_EXTRACT(users.settings, '$.hidesupporter') IS NULL THEN 0 ELSE JSON_EXTRACT(users.settings, '$.hidesupporter') END) = 0) "+
 			"THEN 1 ELSE 0 END) "+
 			"AS supporter, "+
-			"(SELECT MAX(timestamp) FROM users_donations WHERE userid = ?) AS donated, "+
-			"(SELECT type FROM users_donations WHERE userid = ? ORDER BY timestamp DESC LIMIT 1) AS donatedtype "+
+			"(SELECT MAX(timestamp) FROM users_donations WHERE userid = ? AND adjusts IS NULL) AS donated, "+
+			"(SELECT type FROM users_donations WHERE userid = ? AND adjusts IS NULL ORDER BY timestamp DESC LIMIT 1) AS donatedtype "+
 			"FROM users "+
 			"WHERE users.id = ?", utils.SYSTEMROLE_USER, id, start, id, start, id, id, id).Scan(&supporter)
 	}()
@@ -841,11 +844,25 @@ func GetSearchesForUser(c *fiber.Ctx) error {
 				"(SELECT * FROM users_searches WHERE userid = ? AND deleted = 0 ORDER BY id desc LIMIT 100) t "+
 				"GROUP BY t.term ORDER BY t.id DESC LIMIT 10;", id).Find(&searches)
 
-			if searches == nil {
-				searches = make([]Search, 0)
+			// Saved searches come first, and always appear even if they weren't searched for recently.
+			var saved []Search
+			db.Raw("SELECT * FROM users_searches WHERE userid = ? AND deleted = 0 AND alert = 1 ORDER BY id DESC", id).Scan(&saved)
+
+			ret := make([]Search, 0, len(saved)+len(searches))
+			savedTerms := map[string]bool{}
+
+			for _, s := range saved {
+				ret = append(ret, s)
+				savedTerms[s.Term] = true
+			}
+
+			for _, s := range searches {
+				if !savedTerms[s.Term] {
+					ret = append(ret, s)
+				}
 			}
 
-			return c.JSON(searches)
+			return c.JSON(ret)
 		}
 	}
 
@@ -865,7 +882,7 @@ func GetSearchesForUser(c *fiber.Ctx) error {
 func DeleteUserSearch(c *fiber.Ctx) error {
 	myid := WhoAmI(c)
 	if myid == 0 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ret": 1, "status": "Not logged in"})
+		return apierror.ErrNotLoggedIn
 	}
 
 	// Try JSON body first (frontend sends DELETE with JSON body), fall back to query param.
@@ -878,7 +895,7 @@ func DeleteUserSearch(c *fiber.Ctx) error {
 	} else {
 		parsed, err := strconv.ParseUint(c.Query("id"), 10, 64)
 		if err != nil || parsed == 0 {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 2, "status": "Invalid id"})
+			return apierror.ErrInvalidID
 		}
 		id = parsed
 	}
@@ -888,13 +905,13 @@ func DeleteUserSearch(c *fiber.Ctx) error {
 	// Check ownership.
 	var search Search
 	if err := db.Raw("SELECT * FROM users_searches WHERE id = ?", id).Scan(&search).Error; err != nil || search.ID == 0 {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": "Permission denied"})
+		return apierror.ErrForbidden
 	}
 
 	if search.Userid != myid {
 		// Check if admin/support.
 		if !auth.IsAdminOrSupport(myid) {
-			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"ret": 2, "status": "Permission denied"})
+			return apierror.ErrForbidden
 		}
 	}
 
@@ -1534,7 +1551,7 @@ func handleAddEmail(c *fiber.Ctx, db *gorm.DB, myid uint64, req UserPostRequest)
 		if existingUID != nil && *existingUID != targetID {
 			// Email is used by a different user.
 			if !auth.IsAdminOrSupport(myid) {
-				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"ret": 3, "status": "Email already used"})
+				return apierror.New(fiber.StatusConflict, apierror.CodeEmailInUse, "Email already used")
 			}
 		}
 
@@ -1554,7 +1571,7 @@ func handleAddEmail(c *fiber.Ctx, db *gorm.DB, myid uint64, req UserPostRequest)
 		targetID, email, primaryVal, canon, reverseString(canon))
 
 	if result.Error != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ret": 4, "status": "Email add failed"})
+		return apierror.New(fiber.StatusInternalServerError, apierror.CodeInternal, "Email add failed").WithRet(4)
 	}
 
 	if isPrimary {
@@ -1589,7 +1606,7 @@ func handleRemoveEmail(c *fiber.Ctx, db *gorm.DB, myid uint64, req UserPostReque
 	db.Raw("SELECT userid FROM users_emails WHERE email = ? AND userid = ?", req.Email, targetID).Scan(&emailUserid)
 
 	if emailUserid == 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ret": 3, "status": "Not on same user"})
+		return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Not on same user").WithRet(3)
 	}
 
 	db.Exec("DELETE FROM users_emails WHERE email = ? AND userid = ?", req.Email, targetID)
@@ -1642,15 +1659,8 @@ type UserDeleteRequest struct {
 	ID uint64 `json:"id"`
 }
 
-// PutUser creates a new user (signup).
-//
-// @Summary Create/signup a new user
-// @Tags user
-// @Accept json
-// @Produce json
-// @Param body body UserPutRequest true "Signup details"
-// @Success 200 {object} map[string]interface{}
-// @Router /user [put]
+// PutUser creates a new user (signup).  It's called by session.Signup, which handles people who sign up again
+// with the right password for an existing account.
 func PutUser(c *fiber.Ctx) error {
 	var req UserPutRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -1669,26 +1679,21 @@ func PutUser(c *fiber.Ctx) error {
 	db.Raw("SELECT userid FROM users_emails WHERE email = ? LIMIT 1", email).Scan(&existingUID)
 
 	if existingUID > 0 {
-		// If they provided a correct password, treat signup as login — avoids
-		// forcing users to switch to the login screen and re-enter credentials.
-		if req.Password != "" && auth.VerifyPassword(existingUID, req.Password) {
-			persistent, jwtString, err := auth.CreateSessionAndJWT(existingUID)
-			if err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, "Failed to create session")
-			}
-			return c.JSON(fiber.Map{
-				"ret":        0,
-				"status":     "Success",
-				"id":         existingUID,
-				"persistent": persistent,
-				"jwt":        jwtString,
-			})
-		}
+		// session.Signup has already logged them in if they gave the right password.
+		return apierror.New(fiber.StatusConflict, apierror.CodeEmailInUse, "That email is already in use").WithRet(2)
+	}
 
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-			"ret":    2,
-			"status": "That email is already in use",
-		})
+	// Generate random password if none provided (for email-only signup).
+	// The client shows this to the user in the welcome modal.
+	password := req.Password
+	if password == "" {
+		password = utils.RandomHex(4) // 8 char random hex password
+	}
+
+	// Hash it before creating anything, so that we don't create a user who can't log in.
+	hashed, err := auth.HashPassword(password)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to hash password")
 	}
 
 	// Build display name from parts.
@@ -1738,23 +1743,9 @@ func PutUser(c *fiber.Ctx) error {
 	db.Exec("INSERT INTO users_emails (userid, email, preferred, validated, canon) VALUES (?, ?, 1, NOW(), ?)",
 		newUserID, email, canon)
 
-	// Generate random password if none provided (for email-only signup).
-	// The client shows this to the user in the welcome modal.
-	password := req.Password
-	if password == "" {
-		password = utils.RandomHex(4) // 8 char random hex password
-	}
-
-	// Hash with sha1+salt and store.
-	salt := os.Getenv("PASSWORD_SALT")
-	if salt == "" {
-		salt = "zzzz"
-	}
-	h := sha1.New()
-	h.Write([]byte(password + salt))
-	hashed := hex.EncodeToString(h.Sum(nil))
-	db.Exec("INSERT INTO users_logins (userid, type, uid, credentials, salt) VALUES (?, ?, ?, ?, ?)",
-		newUserID, utils.LOGIN_TYPE_NATIVE, newUserID, hashed, salt)
+	// Add the Native login.
+	db.Exec("INSERT INTO users_logins (userid, type, uid, credentials, salt) VALUES (?, ?, ?, ?, NULL)",
+		newUserID, utils.LOGIN_TYPE_NATIVE, newUserID, hashed)
 
 	// If groupid provided, add membership.
 	if req.GroupID > 0 {
@@ -1774,18 +1765,13 @@ func PutUser(c *fiber.Ctx) error {
 	var sessionID uint64
 	db.Raw("SELECT id FROM sessions WHERE userid = ? ORDER BY id DESC LIMIT 1", newUserID).Scan(&sessionID)
 
-	// Generate JWT.
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":        fmt.Sprint(newUserID),
-		"sessionid": fmt.Sprint(sessionID),
-		"exp":       time.Now().Unix() + 30*24*60*60, // 30 days
-	})
-
-	jwtString, err := jwtToken.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	tokens, err := auth.IssueTokens(newUserID, sessionID)
 	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to generate JWT")
 	}
 
+	auth.RecordSessionClient(c, sessionID)
+
 	resp := fiber.Map{
 		"ret":    0,
 		"status": "Success",
@@ -1796,7 +1782,8 @@ func PutUser(c *fiber.Ctx) error {
 			"token":  token,
 			"userid": newUserID,
 		},
-		"jwt": jwtString,
+		"jwt":          tokens.JWT,
+		"refreshtoken": tokens.RefreshToken,
 	}
 
 	// Return the generated password so the client can show it in the welcome modal.
@@ -1999,12 +1986,15 @@ func PatchUser(c *fiber.Ctx) error {
 			targetID = req.ID
 		}
 
-		salt := auth.GetPasswordSalt()
-		hashed := auth.HashPassword(*req.Password, salt)
+		hashed, err := auth.HashPassword(*req.Password)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to hash password")
+		}
+
 		uid := strconv.FormatUint(targetID, 10)
-		db.Exec("INSERT INTO users_logins (userid, type, uid, credentials, salt) VALUES (?, ?, ?, ?, ?) "+
-			"ON DUPLICATE KEY UPDATE credentials = ?, salt = ?",
-			targetID, utils.LOGIN_TYPE_NATIVE, uid, hashed, salt, hashed, salt)
+		db.Exec("INSERT INTO users_logins (userid, type, uid, credentials, salt) VALUES (?, ?, ?, ?, NULL) "+
+			"ON DUPLICATE KEY UPDATE credentials = ?, salt = NULL",
+			targetID, utils.LOGIN_TYPE_NATIVE, uid, hashed, hashed)
 	}
 
 	return c.JSON(fiber.Map{"ret": 0, "status": "Success"})
@@ -2063,20 +2053,14 @@ func LimboUser(c *fiber.Ctx) error {
 		db.Raw("SELECT role FROM memberships WHERE userid = ? AND role IN (?, ?) LIMIT 1", myid, utils.ROLE_MODERATOR, utils.ROLE_OWNER).Scan(&modRole)
 
 		if modRole != "" {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"ret":    2,
-				"status": "Please demote yourself to a member first",
-			})
+			return apierror.New(fiber.StatusBadRequest, apierror.CodeBadRequest, "Please demote yourself to a member first")
 		}
 
 		var spammerCount int64
 		db.Raw("SELECT COUNT(*) FROM spam_users WHERE userid = ? AND collection IN (?, ?)", myid, utils.SPAM_COLLECTION_SPAMMER, utils.SPAM_COLLECTION_PENDING_ADD).Scan(&spammerCount)
 
 		if spammerCount > 0 {
-			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-				"ret":    3,
-				"status": "We can't do this.",
-			})
+			return apierror.New(fiber.StatusForbidden, apierror.CodeForbidden, "We can't do this.").WithRet(3)
 		}
 	}
 
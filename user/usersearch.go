@@ -0,0 +1,141 @@
+package user
+
+import (
+	"github.com/freegle/iznik-server-go/database"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/freegle/iznik-server-go/validate"
+	"github.com/gofiber/fiber/v2"
+)
+
+// A saved search is a row in users_searches with alert set.  When a post matching it is approved, we queue an
+// alert to the user (see message.alertSavedSearches).  The alert, msgtype, lat, lng, radius,
+// isochroneid and lastalert columns are added by the iznik-batch migrations.
+
+const (
+	// savedSearchDefaultRadius is the radius in miles we use if the user doesn't give one or an isochrone.
+	savedSearchDefaultRadius = 10.0
+
+	// savedSearchMaxRadius stops people asking to hear about everything in the country.
+	savedSearchMaxRadius = 50.0
+
+	// savedSearchMax is how many saved searches one user can have.
+	savedSearchMax = 20
+)
+
+type SaveSearchRequest struct {
+	ID          uint64   `json:"id"`
+	Term        string   `json:"term"`
+	Messagetype string   `json:"messagetype" validate:"oneof=Offer Wanted All"`
+	Radius      *float64 `json:"radius"`
+	Isochroneid *uint64  `json:"isochroneid"`
+	Alert       *bool    `json:"alert"`
+}
+
+// SaveUserSearch saves a search so that the user is alerted when a matching post is approved, or with alert
+// false stops alerting for it.  The search is either an existing one from the user's history (id) or a new term.
+//
+// @Summary Save a search as an alert
+// @Tags usersearch
+// @Accept json
+// @Produce json
+// @Param body body SaveSearchRequest true "Search to save"
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Router /api/usersearch [post]
+func SaveUserSearch(c *fiber.Ctx) error {
+	myid := WhoAmI(c)
+	if myid == 0 {
+		return fiber.NewError(fiber.StatusUnauthorized, "Not logged in")
+	}
+
+	req, err := validate.Parsed[SaveSearchRequest](c)
+	if err != nil {
+		return err
+	}
+
+	db := database.DBConn
+
+	if req.ID > 0 {
+		var existing Search
+		db.Raw("SELECT * FROM users_searches WHERE id = ? AND userid = ? AND deleted = 0", req.ID, myid).Scan(&existing)
+
+		if existing.ID == 0 {
+			return fiber.NewError(fiber.StatusNotFound, "Search not found")
+		}
+
+		req.Term = existing.Term
+	}
+
+	if req.Term == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "term or id required")
+	}
+
+	if req.Alert != nil && !*req.Alert {
+		db.Exec("UPDATE users_searches SET alert = 0 WHERE userid = ? AND term = ?", myid, req.Term)
+		return c.JSON(fiber.Map{"ret": 0, "status": "Success"})
+	}
+
+	var msgtype *string
+
+	if req.Messagetype == utils.OFFER || req.Messagetype == utils.WANTED {
+		msgtype = &req.Messagetype
+	}
+
+	var radius *float64
+	var lat, lng *float64
+
+	if req.Isochroneid != nil {
+		var owned uint64
+		db.Raw("SELECT id FROM isochrones_users WHERE userid = ? AND isochroneid = ?", myid, *req.Isochroneid).Scan(&owned)
+
+		if owned == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid isochroneid")
+		}
+	} else {
+		r := savedSearchDefaultRadius
+		if req.Radius != nil {
+			r = *req.Radius
+		}
+
+		if r <= 0 || r > savedSearchMaxRadius {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid radius")
+		}
+
+		loc := GetLatLng(myid)
+		if loc.Lat == 0 && loc.Lng == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "We don't know where you are")
+		}
+
+		la, ln := float64(loc.Lat), float64(loc.Lng)
+		radius, lat, lng = &r, &la, &ln
+	}
+
+	// Saving a search for a term we're already alerting on updates it rather than adding another.
+	var id uint64
+	db.Raw("SELECT id FROM users_searches WHERE userid = ? AND term = ? AND alert = 1 AND deleted = 0 ORDER BY id DESC LIMIT 1", myid, req.Term).Scan(&id)
+
+	if id == 0 {
+		var count int64
+		db.Raw("SELECT COUNT(*) FROM users_searches WHERE userid = ? AND alert = 1 AND deleted = 0", myid).Scan(&count)
+
+		if count >= savedSearchMax {
+			return fiber.NewError(fiber.StatusBadRequest, "Too many saved searches")
+		}
+
+		if req.ID > 0 {
+			id = req.ID
+		} else {
+			db.Exec("INSERT INTO users_searches (userid, term) VALUES (?, ?)", myid, req.Term)
+			db.Raw("SELECT id FROM users_searches WHERE userid = ? AND term = ? ORDER BY id DESC LIMIT 1", myid, req.Term).Scan(&id)
+		}
+	}
+
+	result := db.Exec("UPDATE users_searches SET alert = 1, msgtype = ?, lat = ?, lng = ?, radius = ?, isochroneid = ? WHERE id = ?",
+		msgtype, lat, lng, radius, req.Isochroneid, id)
+
+	if result.Error != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to save search")
+	}
+
+	return c.JSON(fiber.Map{"ret": 0, "status": "Success", "id": id})
+}
@@ -0,0 +1,408 @@
+// Package validate checks request structs against rules in their `validate` struct tags, so that handlers don't
+// have to check each field by hand, and reports every problem at once rather than just the first.
+//
+// The tag syntax is the same as go-playground/validator, which swag also reads to document the constraints:
+//
+//	type CreateRequest struct {
+//		Transport string `json:"transport" validate:"required,oneof=Walk Cycle Drive"`
+//		Minutes   int    `json:"minutes" validate:"min=5,max=45"`
+//		Email     string `json:"email" validate:"omitempty,email,max=254"`
+//	}
+//
+// The rules are:
+//
+//	required    must be present: non-empty, non-zero, or non-nil
+//	omitempty   skip the other rules if the field is empty (the default for all rules apart from required)
+//	min=N       numbers must be at least N; strings and lists must have at least N characters or entries
+//	max=N       numbers must be at most N; strings and lists must have at most N characters or entries
+//	oneof=a b   must be one of the space-separated values
+//	email       must look like an email address
+//	idorflag    for fields which clients send as either an id or true/false
+//
+// Nested structs, pointers to them and lists of them are checked too, with field names like "items[2].name".
+//
+// Routes check their body before the handler runs by declaring its type when they're registered:
+//
+//	rg.Put("/address", auth.Require(), validate.Request[address.CreateRequest](), address.Create)
+//
+// and the handler gets it with Parsed.  The tags are checked when a type is first seen, which for those routes is
+// at startup, so an unknown rule or a bad parameter panics then rather than when a request arrives.
+package validate
+
+import (
+	"fmt"
+	"math"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Codes for the individual field errors, which clients can use to show their own messages.
+const (
+	FieldRequired = "required"
+	FieldMin      = "min"
+	FieldMax      = "max"
+	FieldOneOf    = "oneof"
+	FieldEmail    = "email"
+	FieldIDOrFlag = "idorflag"
+)
+
+type rule struct {
+	name  string
+	param string
+
+	// limit is the parsed param for min and max.
+	limit float64
+}
+
+type field struct {
+	index    int
+	name     string
+	rules    []rule
+	required bool
+}
+
+// Parsing the tags is relatively slow, so we do it once per type.
+var fieldCache sync.Map
+
+// fieldsOf returns the fields of a struct type and their rules.  It panics if a tag is wrong, as that's a bug.
+func fieldsOf(t reflect.Type) []field {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]field)
+	}
+
+	var ret []field
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		if !f.IsExported() {
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fd := field{index: i, name: name}
+
+		for _, r := range strings.Split(f.Tag.Get("validate"), ",") {
+			r = strings.TrimSpace(r)
+			if r == "" || r == "omitempty" {
+				continue
+			}
+
+			if r == FieldRequired {
+				fd.required = true
+				continue
+			}
+
+			fd.rules = append(fd.rules, parseRule(t, f, r))
+		}
+
+		ret = append(ret, fd)
+	}
+
+	fieldCache.Store(t, ret)
+
+	return ret
+}
+
+func parseRule(t reflect.Type, f reflect.StructField, r string) rule {
+	name, param, _ := strings.Cut(r, "=")
+	ret := rule{name: name, param: param}
+
+	bad := func(why string) {
+		panic(fmt.Sprintf("validate: %s.%s: %s", t.Name(), f.Name, why))
+	}
+
+	switch name {
+	case FieldMin, FieldMax:
+		limit, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			bad("bad " + name + " parameter " + strconv.Quote(param))
+		}
+
+		ret.limit = limit
+	case FieldOneOf:
+		if len(strings.Fields(param)) == 0 {
+			bad("oneof needs some values")
+		}
+	case FieldEmail, FieldIDOrFlag:
+	default:
+		bad("unknown rule " + strconv.Quote(name))
+	}
+
+	return ret
+}
+
+// prepare parses the tags of a type and any types nested in it, so that mistakes in them show up straight away.
+func prepare(t reflect.Type, seen map[reflect.Type]bool) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct || seen[t] {
+		return
+	}
+
+	seen[t] = true
+
+	for _, f := range fieldsOf(t) {
+		prepare(t.Field(f.index).Type, seen)
+	}
+}
+
+type parsedKey struct{}
+
+// Request is a middleware which parses the request body into a T and checks it, so that handlers only see valid
+// requests.  The handler gets the T with Parsed.  It panics if T's tags are wrong, so register it at startup.
+//
+// Put it after anything which checks the user is logged in, so that they get told that first.
+func Request[T any]() fiber.Handler {
+	prepare(reflect.TypeOf((*T)(nil)).Elem(), map[reflect.Type]bool{})
+
+	return func(c *fiber.Ctx) error {
+		req := new(T)
+		if err := Body(c, req); err != nil {
+			return err
+		}
+
+		c.Locals(parsedKey{}, req)
+
+		return c.Next()
+	}
+}
+
+// Parsed returns the request checked by Request.  If the route doesn't have Request, it parses and checks the body
+// now, so the handler works either way.
+func Parsed[T any](c *fiber.Ctx) (*T, error) {
+	if req, ok := c.Locals(parsedKey{}).(*T); ok {
+		return req, nil
+	}
+
+	req := new(T)
+	if err := Body(c, req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// Struct checks a struct, or a pointer to one.  It returns nil if it's valid, and otherwise an *apierror.Error
+// listing every field which isn't.
+func Struct(v interface{}) error {
+	errs := check(reflect.ValueOf(v), "", nil)
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Message
+	}
+
+	return apierror.New(fiber.StatusBadRequest, apierror.CodeValidationFailed, strings.Join(messages, "; ")).WithFields(errs...)
+}
+
+// Body parses the request body into v and checks it.  Use it instead of c.BodyParser.
+func Body(c *fiber.Ctx, v interface{}) error {
+	if err := c.BodyParser(v); err != nil {
+		return apierror.ErrInvalidBody.WithCause(err)
+	}
+
+	return Struct(v)
+}
+
+func check(v reflect.Value, prefix string, errs []apierror.FieldError) []apierror.FieldError {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return errs
+		}
+
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, f := range fieldsOf(v.Type()) {
+			name := f.name
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+
+			errs = checkField(v.Field(f.index), name, f, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			errs = check(v.Index(i), fmt.Sprintf("%s[%d]", prefix, i), errs)
+		}
+	}
+
+	return errs
+}
+
+func checkField(v reflect.Value, name string, f field, errs []apierror.FieldError) []apierror.FieldError {
+	if isEmpty(v) {
+		if f.required {
+			errs = append(errs, apierror.FieldError{Field: name, Code: FieldRequired, Message: name + " is required"})
+		}
+
+		return errs
+	}
+
+	for _, r := range f.rules {
+		if msg := apply(r, deref(v)); msg != "" {
+			errs = append(errs, apierror.FieldError{Field: name, Code: r.name, Message: name + " " + msg})
+		}
+	}
+
+	// Check inside nested structs and lists of them.  Raw JSON and the like are byte slices, so skip those.
+	if e := deref(v); e.Kind() == reflect.Struct || ((e.Kind() == reflect.Slice || e.Kind() == reflect.Array) && e.Type().Elem().Kind() != reflect.Uint8) {
+		errs = check(e, name, errs)
+	}
+
+	return errs
+}
+
+func deref(v reflect.Value) reflect.Value {
+	for (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	return v
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.String:
+		return strings.TrimSpace(v.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Struct:
+		return false
+	}
+
+	return v.IsZero()
+}
+
+// apply checks one rule, and returns what's wrong, or "" if it passes.  fieldsOf has already checked the rule.
+func apply(r rule, v reflect.Value) string {
+	switch r.name {
+	case FieldMin, FieldMax:
+		n, isLength := measure(v)
+
+		if r.name == FieldMin && n < r.limit {
+			if isLength {
+				return fmt.Sprintf("must have at least %s %s", r.param, unit(v))
+			}
+
+			return "must be at least " + r.param
+		}
+
+		if r.name == FieldMax && n > r.limit {
+			if isLength {
+				return fmt.Sprintf("must have at most %s %s", r.param, unit(v))
+			}
+
+			return "must be at most " + r.param
+		}
+	case FieldOneOf:
+		options := strings.Fields(r.param)
+		s := fmt.Sprint(v.Interface())
+
+		for _, o := range options {
+			if s == o {
+				return ""
+			}
+		}
+
+		return "must be one of " + strings.Join(options, ", ")
+	case FieldEmail:
+		if v.Kind() != reflect.String || !isEmail(v.String()) {
+			return "must be a valid email address"
+		}
+	case FieldIDOrFlag:
+		if !isIDOrFlag(v) {
+			return "must be an id or true/false"
+		}
+	}
+
+	return ""
+}
+
+// measure returns the number to compare against min and max: the value for numbers, and otherwise the length.
+func measure(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), false
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), true
+	}
+
+	return math.NaN(), false
+}
+
+func unit(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return "characters"
+	}
+
+	return "entries"
+}
+
+func isEmail(s string) bool {
+	// ParseAddress also accepts "Name <a@b.com>", which isn't what we want here.
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return false
+	}
+
+	at := strings.LastIndex(s, "@")
+	return at > 0 && strings.Contains(s[at+1:], ".")
+}
+
+// isIDOrFlag checks a value which was decoded into an interface{}, i.e. a bool, float64 or string.
+func isIDOrFlag(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Bool:
+		return true
+	case reflect.Float64:
+		f := v.Float()
+		return f >= 0 && f == math.Trunc(f)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() >= 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.String:
+		s := v.String()
+		if s == "true" || s == "false" {
+			return true
+		}
+
+		_, err := strconv.ParseUint(s, 10, 64)
+		return err == nil
+	}
+
+	return false
+}
@@ -0,0 +1,220 @@
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/freegle/iznik-server-go/apierror"
+	"github.com/freegle/iznik-server-go/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type item struct {
+	Name string `json:"name" validate:"required,max=10"`
+}
+
+type request struct {
+	Transport string           `json:"transport" validate:"required,oneof=Walk Cycle Drive"`
+	Minutes   utils.FlexInt    `json:"minutes" validate:"min=5,max=45"`
+	Email     string           `json:"email" validate:"omitempty,email"`
+	ID        utils.FlexUint64 `json:"id"`
+	Parent    any              `json:"parent" validate:"idorflag"`
+	Rotate    *int             `json:"rotate" validate:"oneof=0 90 180 270"`
+	Items     []item           `json:"items" validate:"max=3"`
+	Raw       json.RawMessage  `json:"raw"`
+	Nested    *item            `json:"nested"`
+}
+
+func fields(err error) map[string]string {
+	ret := map[string]string{}
+
+	var e *apierror.Error
+	if errors.As(err, &e) {
+		for _, f := range e.Fields {
+			ret[f.Field] = f.Code
+		}
+	}
+
+	return ret
+}
+
+func TestValid(t *testing.T) {
+	rotate := 90
+
+	assert.NoError(t, Struct(request{Transport: "Walk"}))
+	assert.NoError(t, Struct(&request{
+		Transport: "Drive",
+		Minutes:   45,
+		Email:     "test@example.com",
+		Parent:    true,
+		Rotate:    &rotate,
+		Items:     []item{{Name: "chair"}},
+		Raw:       json.RawMessage(`{"rotate": 90}`),
+		Nested:    &item{Name: "table"},
+	}))
+
+	for _, parent := range []any{false, float64(123), "123", "true"} {
+		assert.NoError(t, Struct(request{Transport: "Walk", Parent: parent}))
+	}
+}
+
+func TestAllErrorsReported(t *testing.T) {
+	rotate := 45
+
+	err := Struct(request{
+		Minutes: 60,
+		Email:   "Someone <test@example.com>",
+		Parent:  float64(-1),
+		Rotate:  &rotate,
+		Items:   []item{{Name: "chair"}, {Name: ""}, {Name: "a very long name"}, {Name: "x"}},
+		Nested:  &item{},
+	})
+
+	assert.Equal(t, map[string]string{
+		"transport":     FieldRequired,
+		"minutes":       FieldMax,
+		"email":         FieldEmail,
+		"parent":        FieldIDOrFlag,
+		"rotate":        FieldOneOf,
+		"items":         FieldMax,
+		"items[1].name": FieldRequired,
+		"items[2].name": FieldMax,
+		"nested.name":   FieldRequired,
+	}, fields(err))
+
+	var e *apierror.Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, fiber.StatusBadRequest, e.Status)
+	assert.Equal(t, apierror.CodeValidationFailed, e.Code)
+	assert.Contains(t, e.Message, "transport is required")
+	assert.Contains(t, e.Message, "minutes must be at most 45")
+}
+
+func TestMessages(t *testing.T) {
+	err := Struct(request{Transport: "Bus", Minutes: 1})
+	assert.Equal(t, "transport must be one of Walk, Cycle, Drive; minutes must be at least 5", err.Error())
+
+	err = Struct(item{Name: "   "})
+	assert.Equal(t, "name is required", err.Error())
+
+	err = Struct(item{Name: "ünïcödé ok"})
+	assert.NoError(t, err)
+
+	err = Struct(item{Name: "eleven char"})
+	assert.Equal(t, "name must have at most 10 characters", err.Error())
+}
+
+func TestBody(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	app.Post("/api/thing", func(c *fiber.Ctx) error {
+		var req request
+		if err := Body(c, &req); err != nil {
+			return err
+		}
+
+		return c.JSON(fiber.Map{"transport": req.Transport})
+	})
+
+	post := func(body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/api/thing", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := app.Test(req)
+
+		var result map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&result)
+
+		return resp.StatusCode, result
+	}
+
+	status, result := post(`{"transport": "Cycle", "minutes": "30"}`)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Cycle", result["transport"])
+
+	status, result = post(`{"transport": "Cycle"`)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, apierror.CodeInvalidBody, result["code"])
+
+	status, result = post(`{"minutes": 100, "email": "nope"}`)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, apierror.CodeValidationFailed, result["code"])
+	assert.Len(t, result["fields"], 3)
+}
+
+func TestBadTags(t *testing.T) {
+	type unknownRule struct {
+		Name string `json:"name" validate:"required,url"`
+	}
+
+	type badMax struct {
+		Name string `json:"name" validate:"max=ten"`
+	}
+
+	type emptyOneOf struct {
+		Name string `json:"name" validate:"oneof="`
+	}
+
+	type nestedBad struct {
+		Items []badMax `json:"items"`
+	}
+
+	// Mistakes in tags are found when the route is registered, not when a request arrives.
+	assert.PanicsWithValue(t, `validate: unknownRule.Name: unknown rule "url"`, func() { Request[unknownRule]() })
+	assert.PanicsWithValue(t, `validate: badMax.Name: bad max parameter "ten"`, func() { Request[badMax]() })
+	assert.PanicsWithValue(t, `validate: emptyOneOf.Name: oneof needs some values`, func() { Request[emptyOneOf]() })
+	assert.Panics(t, func() { Request[nestedBad]() })
+	assert.NotPanics(t, func() { Request[request]() })
+}
+
+func TestRequest(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+
+	ran := false
+	handler := func(c *fiber.Ctx) error {
+		ran = true
+
+		req, err := Parsed[request](c)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(fiber.Map{"transport": req.Transport})
+	}
+
+	app.Post("/api/checked", Request[request](), handler)
+	app.Post("/api/unchecked", handler)
+
+	post := func(path, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := app.Test(req)
+
+		var result map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&result)
+
+		return resp.StatusCode, result
+	}
+
+	status, result := post("/api/checked", `{"transport": "Walk"}`)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Walk", result["transport"])
+	assert.True(t, ran)
+
+	// Invalid requests don't reach the handler.
+	ran = false
+	status, result = post("/api/checked", `{"transport": "Bus"}`)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, apierror.CodeValidationFailed, result["code"])
+	assert.False(t, ran)
+
+	// Without the middleware, Parsed checks the body itself.
+	status, result = post("/api/unchecked", `{"transport": "Drive"}`)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Drive", result["transport"])
+
+	status, _ = post("/api/unchecked", `{"transport": "Bus"}`)
+	assert.Equal(t, 400, status)
+}
@@ -2,6 +2,7 @@ package volunteering
 
 import (
 	"errors"
+	"github.com/freegle/iznik-server-go/auth"
 	"github.com/freegle/iznik-server-go/database"
 	"github.com/freegle/iznik-server-go/misc"
 	"github.com/freegle/iznik-server-go/newsfeed"
@@ -216,7 +217,7 @@ func Single(c *fiber.Ctx) error {
 
 			myid := user.WhoAmI(c)
 			if myid > 0 {
-				volunteering.Canmodify = canModify(myid, volunteering.ID)
+				volunteering.Canmodify = canModify(auth.PolicyFor(c), volunteering.ID)
 			}
 
 			return c.JSON(volunteering)
@@ -229,34 +230,25 @@ func Single(c *fiber.Ctx) error {
 // canModify checks if a user can modify a volunteering opportunity.
 // They can if they created it, are admin/support, or are a moderator/owner of a group
 // the volunteering is linked to.
-func canModify(myid uint64, volunteeringID uint64) bool {
+func canModify(p *auth.Policy, volunteeringID uint64) bool {
 	db := database.DBConn
 
 	var ownerID uint64
 	db.Raw("SELECT userid FROM volunteering WHERE id = ?", volunteeringID).Scan(&ownerID)
 
-	if ownerID == myid {
+	if ownerID == p.UserID {
 		return true
 	}
 
-	return isModerator(myid, volunteeringID)
+	return isModerator(p, volunteeringID)
 }
 
-// isModerator checks if a user is a moderator who can hold/release volunteering opportunities.
-func isModerator(myid uint64, volunteeringID uint64) bool {
-	if user.IsAdminOrSupport(myid) {
-		return true
-	}
-
-	// Single query to check if user is moderator/owner of any linked group.
-	db := database.DBConn
-	var count int64
-	db.Raw("SELECT COUNT(*) FROM memberships m "+
-		"INNER JOIN volunteering_groups vg ON vg.groupid = m.groupid "+
-		"WHERE vg.volunteeringid = ? AND m.userid = ? AND m.collection = ? AND m.role IN (?, ?)",
-		volunteeringID, myid, utils.COLLECTION_APPROVED, utils.ROLE_MODERATOR, utils.ROLE_OWNER).Scan(&count)
+// isModerator checks if a user can moderate any group the item is linked to, e.g. to hold/release it.
+func isModerator(p *auth.Policy, volunteeringID uint64) bool {
+	var groupIDs []uint64
+	database.DBConn.Raw("SELECT groupid FROM volunteering_groups WHERE volunteeringid = ?", volunteeringID).Scan(&groupIDs)
 
-	return count > 0
+	return p.CanInSomeGroup(auth.PERM_GROUP_MODERATE, groupIDs)
 }
 
 // isMemberOfGroup checks if a user has an approved membership in the given group.
@@ -391,7 +383,7 @@ func Update(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusNotFound, "Volunteering not found")
 	}
 
-	if !canModify(myid, req.ID) {
+	if !canModify(auth.PolicyFor(c), req.ID) {
 		return fiber.NewError(fiber.StatusForbidden, "Not authorized to modify this volunteering")
 	}
 
@@ -448,9 +440,7 @@ func Update(c *fiber.Ctx) error {
 			}
 
 			// 2. Notify group moderators via background task queue.
-			if err := queue.QueueTask(queue.TaskPushNotifyGroupMods, map[string]interface{}{
-				"group_id": req.GroupID,
-			}); err != nil {
+			if err := queue.QueuePushNotifyGroupMods(req.GroupID); err != nil {
 				log.Printf("Failed to queue push notification for group %d: %v", req.GroupID, err)
 			}
 		}
@@ -474,11 +464,11 @@ func Update(c *fiber.Ctx) error {
 	case "Expire":
 		db.Exec("UPDATE volunteering SET expired = 1 WHERE id = ?", req.ID)
 	case "Hold":
-		if isModerator(myid, req.ID) {
+		if isModerator(auth.PolicyFor(c), req.ID) {
 			db.Exec("UPDATE volunteering SET heldby = ? WHERE id = ?", myid, req.ID)
 		}
 	case "Release":
-		if isModerator(myid, req.ID) {
+		if isModerator(auth.PolicyFor(c), req.ID) {
 			db.Exec("UPDATE volunteering SET heldby = NULL WHERE id = ?", req.ID)
 		}
 	}
@@ -512,7 +502,7 @@ func Delete(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusNotFound, "Volunteering not found")
 	}
 
-	if !canModify(myid, id) {
+	if !canModify(auth.PolicyFor(c), id) {
 		return fiber.NewError(fiber.StatusForbidden, "Not authorized to delete this volunteering")
 	}
 